@@ -3,6 +3,7 @@ package accounts
 import (
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/labstack/echo/v4"
 	"github.com/latebit-io/bulwarkauth/api/problem"
@@ -69,6 +70,9 @@ func (ah AccountHandler) Create(c echo.Context) error {
 	ctx := c.Request().Context()
 	err = ah.accounts.Create(ctx, newAccountRequest.Email, newAccountRequest.Password)
 	if err != nil {
+		if httpError, ok := passwordPolicyProblem(err); ok {
+			return echo.NewHTTPError(httpError.Status, httpError)
+		}
 		var accountDuplicateError accounts.AccountDuplicateError
 		duplicate := errors.As(err, &accountDuplicateError)
 		if duplicate {
@@ -192,6 +196,9 @@ func (ah AccountHandler) ForgotPassword(c echo.Context) error {
 
 	err = ah.accounts.ForgotPassword(c.Request().Context(), resetPasswordRequest.Email, resetPasswordRequest.Password, resetPasswordRequest.Token)
 	if err != nil {
+		if httpError, ok := passwordPolicyProblem(err); ok {
+			return echo.NewHTTPError(httpError.Status, httpError)
+		}
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
@@ -229,6 +236,9 @@ func (ah AccountHandler) ChangePassword(c echo.Context) error {
 		changePasswordRequest.AccessToken)
 
 	if err != nil {
+		if httpError, ok := passwordPolicyProblem(err); ok {
+			return echo.NewHTTPError(httpError.Status, httpError)
+		}
 		httpError := problem.NewServerError(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
@@ -251,3 +261,42 @@ func (ah AccountHandler) UpdateEmail(c echo.Context) error {
 	}
 	return c.NoContent(http.StatusNoContent)
 }
+
+// UserInfo returns the OpenID Connect claims for the account the bearer access token was issued to
+func (ah AccountHandler) UserInfo(c echo.Context) error {
+	authorization := c.Request().Header.Get(echo.HeaderAuthorization)
+	accessToken, found := strings.CutPrefix(authorization, "Bearer ")
+	if !found || accessToken == "" {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		httpError := problem.NewProblem(problem.Unauthorized, http.StatusUnauthorized, errors.New("bearer token required"))
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	userInfo, err := ah.accounts.UserInfo(c.Request().Context(), accessToken)
+	if err != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		httpError := problem.NewProblem(problem.Unauthorized, http.StatusUnauthorized, err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	return c.JSON(http.StatusOK, userInfo)
+}
+
+// passwordPolicyProblem lists each rule of the password policy the new password failed
+func passwordPolicyProblem(err error) (problem.Details, bool) {
+	var policyError accounts.PasswordPolicyError
+	if !errors.As(err, &policyError) {
+		return problem.Details{}, false
+	}
+	violations := make([]problem.Violation, len(policyError.Violations))
+	for i, violation := range policyError.Violations {
+		violations[i] = problem.Violation{Rule: violation.Rule, Detail: violation.Detail}
+	}
+	return problem.Details{
+		Type:       "https://latebit.io/bulwark/errors/",
+		Title:      "Password Policy",
+		Status:     http.StatusBadRequest,
+		Detail:     "password does not meet the policy",
+		Violations: violations,
+	}, true
+}
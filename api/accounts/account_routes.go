@@ -11,4 +11,6 @@ func AccountRoutes(e *echo.Echo, handler AccountHandler) {
 	e.PUT("/api/accounts/delete", handler.DeleteAccount)
 	e.PUT("/api/accounts/password", handler.ChangePassword)
 	e.PUT("/api/accounts/email", handler.UpdateEmail)
+	e.GET("/userinfo", handler.UserInfo)
+	e.POST("/userinfo", handler.UserInfo)
 }
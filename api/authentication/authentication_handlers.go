@@ -1,7 +1,10 @@
 package authentication
 
 import (
+	"errors"
+	"math"
 	"net/http"
+	"strconv"
 
 	"github.com/labstack/echo/v4"
 	"github.com/latebit-io/bulwarkauth/api/problem"
@@ -9,30 +12,30 @@ import (
 )
 
 type AuthenticationRequest struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
+	Email    string   `json:"email"`
+	Password string   `json:"password"`
+	ClientId string   `json:"clientId"`
+	Nonce    string   `json:"nonce"`
+	Audience []string `json:"audience"`
 }
 
 type RenewRequest struct {
-	Email        string `json:"email"`
+	ClientId     string `json:"clientId"`
 	RefreshToken string `json:"refreshToken"`
 }
 
 type AcknowledgeRequest struct {
-	Email        string `json:"email"`
 	ClientId     string `json:"clientId"`
 	AccessToken  string `json:"accessToken"`
 	RefreshToken string `json:"refreshToken"`
 }
 
 type RevokeRequest struct {
-	Email       string `json:"email"`
 	ClientId    string `json:"clientId"`
 	AccessToken string `json:"accessToken"`
 }
 
 type ValidateAccessTokenRequest struct {
-	Email    string `json:"email"`
 	ClientId string `json:"clientId"`
 	Token    string `json:"token"`
 }
@@ -54,10 +57,10 @@ func (ah AuthenticationHandler) Authenticate(c echo.Context) error {
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	authenticated, err := ah.authentication.Authenticate(c.Request().Context(), newAuthRequest.Email, newAuthRequest.Password)
+	authenticated, err := ah.authentication.Authenticate(c.Request().Context(), newAuthRequest.Email, newAuthRequest.Password,
+		newAuthRequest.ClientId, newAuthRequest.Nonce, newAuthRequest.Audience)
 	if err != nil {
-		httpError := problem.NewBadRequest(err)
-		return echo.NewHTTPError(httpError.Status, httpError)
+		return authenticationError(c, err)
 	}
 
 	return c.JSON(http.StatusOK, authenticated)
@@ -71,22 +74,27 @@ func (ah AuthenticationHandler) Acknowledge(c echo.Context) error {
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	_, err = ah.authentication.ValidateAccessToken(c.Request().Context(), newAckRequest.AccessToken, newAckRequest.Email)
+	accessClaims, err := ah.authentication.ValidateAccessToken(c.Request().Context(), newAckRequest.AccessToken)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	_, err = ah.authentication.ValidateRefreshToken(c.Request().Context(), newAckRequest.RefreshToken, newAckRequest.Email)
+	refreshClaims, err := ah.authentication.ValidateRefreshToken(c.Request().Context(), newAckRequest.RefreshToken)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
+	if accessClaims.Subject != refreshClaims.Subject {
+		httpError := problem.NewBadRequest(errors.New("tokens were issued to different subjects"))
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
 	err = ah.authentication.Acknowledge(c.Request().Context(), authentication.Authenticated{
 		AccessToken:  newAckRequest.AccessToken,
 		RefreshToken: newAckRequest.RefreshToken,
-	}, newAckRequest.Email, newAckRequest.ClientId)
+	}, accessClaims.Email, newAckRequest.ClientId)
 
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
@@ -104,7 +112,8 @@ func (ah AuthenticationHandler) Renew(c echo.Context) error {
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	authenticated, err := ah.authentication.Renew(c.Request().Context(), newRenewRequest.RefreshToken, newRenewRequest.Email)
+	authenticated, err := ah.authentication.Renew(c.Request().Context(), newRenewRequest.RefreshToken,
+		newRenewRequest.ClientId)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
@@ -120,13 +129,13 @@ func (ah AuthenticationHandler) Revoke(c echo.Context) error {
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	_, err := ah.authentication.ValidateAccessToken(c.Request().Context(), newRevokeRequest.AccessToken, newRevokeRequest.Email)
+	_, err := ah.authentication.ValidateAccessToken(c.Request().Context(), newRevokeRequest.AccessToken)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	err = ah.authentication.Revoke(c.Request().Context(), newRevokeRequest.ClientId, newRevokeRequest.Email, newRevokeRequest.AccessToken)
+	err = ah.authentication.Revoke(c.Request().Context(), newRevokeRequest.ClientId, newRevokeRequest.AccessToken)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
@@ -142,10 +151,34 @@ func (ah AuthenticationHandler) ValidateAccessToken(c echo.Context) error {
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 
-	claims, err := ah.authentication.ValidateAccessToken(c.Request().Context(), validateAccessTokenRequest.Token, validateAccessTokenRequest.Email)
+	claims, err := ah.authentication.ValidateAccessToken(c.Request().Context(), validateAccessTokenRequest.Token)
 	if err != nil {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
 	return c.JSON(http.StatusOK, claims)
 }
+
+// authenticationError a throttled sign in is answered with 429 and Retry-After, a sign in that needs a second factor
+// with 401 and the challenge token. Anything else is a bad request
+func authenticationError(c echo.Context, err error) error {
+	var tooMany authentication.TooManyAttemptsError
+	var mfaRequired authentication.MfaRequiredError
+	var mfaCode authentication.MfaCodeError
+	var mfaChallenge authentication.MfaChallengeError
+	var httpError problem.Details
+	switch {
+	case errors.As(err, &tooMany):
+		seconds := int(math.Ceil(tooMany.RetryAfter.Seconds()))
+		c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+		httpError = problem.NewProblem(problem.TooManyRequests, http.StatusTooManyRequests, err)
+	case errors.As(err, &mfaRequired):
+		httpError = problem.NewProblem(problem.MfaRequired, http.StatusUnauthorized, err)
+		httpError.ChallengeToken = mfaRequired.ChallengeToken
+	case errors.As(err, &mfaCode) || errors.As(err, &mfaChallenge):
+		httpError = problem.NewProblem(problem.Unauthorized, http.StatusUnauthorized, err)
+	default:
+		httpError = problem.NewBadRequest(err)
+	}
+	return echo.NewHTTPError(httpError.Status, httpError)
+}
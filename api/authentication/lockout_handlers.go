@@ -0,0 +1,64 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/api/problem"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+)
+
+type LockoutHandlers struct {
+	lockout authentication.LockoutService
+}
+
+func NewLockoutHandlers(lockout authentication.LockoutService) *LockoutHandlers {
+	return &LockoutHandlers{lockout: lockout}
+}
+
+// ClientIp puts the client IP in the request context so failed sign ins are counted for it, it is read with the
+// IPExtractor of the echo server so forwarding headers are only used when they come from a trusted proxy
+func ClientIp(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		request := c.Request()
+		c.SetRequest(request.WithContext(authentication.WithClientIp(request.Context(), c.RealIP())))
+		return next(c)
+	}
+}
+
+// ReadAccount the failed sign ins of the account, not found when there are none
+func (h *LockoutHandlers) ReadAccount(c echo.Context) error {
+	attempts, err := h.lockout.Read(c.Request().Context(), c.Param("email"))
+	if err != nil {
+		httpError := problem.NewServerError(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+	if attempts == nil {
+		httpError := problem.NewProblem(problem.NotFound, http.StatusNotFound,
+			errors.New("no failed sign ins for account"))
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	return c.JSON(http.StatusOK, attempts)
+}
+
+// ClearAccount unlocks the account
+func (h *LockoutHandlers) ClearAccount(c echo.Context) error {
+	if err := h.lockout.Clear(c.Request().Context(), c.Param("email")); err != nil {
+		httpError := problem.NewServerError(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ClearIp unlocks the client IP
+func (h *LockoutHandlers) ClearIp(c echo.Context) error {
+	if err := h.lockout.ClearIp(c.Request().Context(), c.Param("ip")); err != nil {
+		httpError := problem.NewServerError(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
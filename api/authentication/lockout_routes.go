@@ -0,0 +1,11 @@
+package authentication
+
+import "github.com/labstack/echo/v4"
+
+// LockoutRoutes the admin endpoints are only reachable through the middleware, which authenticates the administrator
+func LockoutRoutes(e *echo.Echo, handler *LockoutHandlers, middleware ...echo.MiddlewareFunc) {
+	admin := e.Group("/admin/lockouts", middleware...)
+	admin.GET("/accounts/:email", handler.ReadAccount)
+	admin.DELETE("/accounts/:email", handler.ClearAccount)
+	admin.DELETE("/ips/:ip", handler.ClearIp)
+}
@@ -9,8 +9,11 @@ import (
 )
 
 type LogonAuthRequest struct {
-	Email string `json:"email"`
-	Code  string `json:"code"`
+	Email    string   `json:"email"`
+	Code     string   `json:"code"`
+	ClientId string   `json:"clientId"`
+	Nonce    string   `json:"nonce"`
+	Audience []string `json:"audience"`
 }
 
 type LogonRequest struct {
@@ -35,10 +38,10 @@ func (h *LogonCodeHandlers) Authenticate(c echo.Context) error {
 		httpError := problem.NewBadRequest(err)
 		return echo.NewHTTPError(httpError.Status, httpError)
 	}
-	authenticated, err := h.logonService.Authenticate(c.Request().Context(), newLogonRequest.Email, newLogonRequest.Code)
+	authenticated, err := h.logonService.Authenticate(c.Request().Context(), newLogonRequest.Email, newLogonRequest.Code,
+		newLogonRequest.ClientId, newLogonRequest.Nonce, newLogonRequest.Audience)
 	if err != nil {
-		httpError := problem.NewBadRequest(err)
-		return echo.NewHTTPError(httpError.Status, httpError)
+		return authenticationError(c, err)
 	}
 
 	return c.JSON(http.StatusOK, authenticated)
@@ -0,0 +1,106 @@
+package authentication
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/api/problem"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+)
+
+type MfaEnrollRequest struct {
+	Email       string `json:"email"`
+	AccessToken string `json:"accessToken"`
+}
+
+type MfaCodeRequest struct {
+	Email       string `json:"email"`
+	Code        string `json:"code"`
+	AccessToken string `json:"accessToken"`
+}
+
+type MfaExchangeRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+type MfaHandlers struct {
+	mfa authentication.MfaService
+}
+
+func NewMfaHandlers(mfa authentication.MfaService) *MfaHandlers {
+	return &MfaHandlers{mfa: mfa}
+}
+
+// Enroll returns the secret of a new factor, it has to be confirmed with a code before it is used
+func (h *MfaHandlers) Enroll(c echo.Context) error {
+	request := new(MfaEnrollRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	enrollment, err := h.mfa.Enroll(c.Request().Context(), request.Email, request.AccessToken)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+func (h *MfaHandlers) Confirm(c echo.Context) error {
+	request := new(MfaCodeRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	err := h.mfa.Confirm(c.Request().Context(), request.Email, request.Code, request.AccessToken)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *MfaHandlers) Disable(c echo.Context) error {
+	request := new(MfaCodeRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	err := h.mfa.Disable(c.Request().Context(), request.Email, request.Code, request.AccessToken)
+	if err != nil {
+		return mfaError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// Exchange issues the tokens of a sign in that was answered with a challenge token
+func (h *MfaHandlers) Exchange(c echo.Context) error {
+	request := new(MfaExchangeRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	authenticated, err := h.mfa.Exchange(c.Request().Context(), request.ChallengeToken, request.Code)
+	if err != nil {
+		return authenticationError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, authenticated)
+}
+
+// mfaError a factor in the wrong state is a conflict
+func mfaError(c echo.Context, err error) error {
+	var enrollment authentication.MfaEnrollmentError
+	if errors.As(err, &enrollment) {
+		httpError := problem.NewProblem(problem.Conflict, http.StatusConflict, err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+	return authenticationError(c, err)
+}
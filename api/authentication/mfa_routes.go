@@ -0,0 +1,10 @@
+package authentication
+
+import "github.com/labstack/echo/v4"
+
+func MfaRoutes(e *echo.Echo, handler *MfaHandlers) {
+	e.POST("/api/accounts/mfa/totp", handler.Enroll)
+	e.POST("/api/accounts/mfa/totp/confirm", handler.Confirm)
+	e.PUT("/api/accounts/mfa/totp/disable", handler.Disable)
+	e.POST("/api/authenticate/mfa", handler.Exchange)
+}
@@ -9,8 +9,11 @@ import (
 )
 
 type SocialAuthRequest struct {
-	ID       string `json:"id" query:"id"`
-	Provider string `json:"provider" query:"provider"`
+	ID       string   `json:"id" query:"id"`
+	Provider string   `json:"provider" query:"provider"`
+	ClientId string   `json:"clientId" query:"clientId"`
+	Nonce    string   `json:"nonce" query:"nonce"`
+	Audience []string `json:"audience" query:"audience"`
 }
 
 type SocialHandlers struct {
@@ -31,10 +34,9 @@ func (handler *SocialHandlers) Authenticate(c echo.Context) error {
 	}
 
 	authenticated, err := handler.socialService.Authenticate(c.Request().Context(), socialRequest.ID,
-		socialRequest.Provider)
+		socialRequest.Provider, socialRequest.ClientId, socialRequest.Nonce, socialRequest.Audience)
 	if err != nil {
-		httpError := problem.NewBadRequest(err)
-		return echo.NewHTTPError(httpError.Status, httpError)
+		return authenticationError(c, err)
 	}
 
 	return c.JSON(http.StatusOK, authenticated)
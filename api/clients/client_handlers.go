@@ -0,0 +1,154 @@
+package clients
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/api/problem"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+)
+
+type ClientRequest struct {
+	ClientId                    string   `json:"clientId"`
+	Name                        string   `json:"name"`
+	Public                      bool     `json:"public"`
+	TokenEndpointAuthMethod     string   `json:"tokenEndpointAuthMethod"`
+	PublicKeys                  []string `json:"publicKeys"`
+	RedirectUrls                []string `json:"redirectUrls"`
+	VerificationUrls            []string `json:"verificationUrls"`
+	AllowedOrigins              []string `json:"allowedOrigins"`
+	GrantTypes                  []string `json:"grantTypes"`
+	Scopes                      []string `json:"scopes"`
+	Roles                       []string `json:"roles"`
+	ExchangeAudiences           []string `json:"exchangeAudiences"`
+	AccessTokenExpireInSeconds  int      `json:"accessTokenExpireInSeconds"`
+	RefreshTokenExpireInSeconds int      `json:"refreshTokenExpireInSeconds"`
+}
+
+// ClientResponse the secret is only included when it has just been generated
+type ClientResponse struct {
+	clients.Client
+	ClientSecret string `json:"clientSecret,omitempty"`
+}
+
+type SecretResponse struct {
+	ClientId     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret"`
+}
+
+type ClientHandlers struct {
+	clients clients.ClientService
+}
+
+func NewClientHandlers(clients clients.ClientService) *ClientHandlers {
+	return &ClientHandlers{clients: clients}
+}
+
+// Create registers a client, the response holds the only copy of the secret
+func (h *ClientHandlers) Create(c echo.Context) error {
+	request := new(ClientRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	client, secret, err := h.clients.Create(c.Request().Context(), request.client())
+	if err != nil {
+		return clientError(err)
+	}
+
+	return c.JSON(http.StatusCreated, ClientResponse{Client: *client, ClientSecret: secret})
+}
+
+func (h *ClientHandlers) List(c echo.Context) error {
+	registered, err := h.clients.List(c.Request().Context())
+	if err != nil {
+		return clientError(err)
+	}
+
+	return c.JSON(http.StatusOK, registered)
+}
+
+func (h *ClientHandlers) Read(c echo.Context) error {
+	client, err := h.clients.Read(c.Request().Context(), c.Param("clientId"))
+	if err != nil {
+		return clientError(err)
+	}
+
+	return c.JSON(http.StatusOK, client)
+}
+
+// Update replaces the settings of the client named in the path, the secret is not changed
+func (h *ClientHandlers) Update(c echo.Context) error {
+	request := new(ClientRequest)
+	if err := c.Bind(request); err != nil {
+		httpError := problem.NewBadRequest(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	update := request.client()
+	update.ClientId = c.Param("clientId")
+	client, err := h.clients.Update(c.Request().Context(), update)
+	if err != nil {
+		return clientError(err)
+	}
+
+	return c.JSON(http.StatusOK, client)
+}
+
+func (h *ClientHandlers) Delete(c echo.Context) error {
+	if err := h.clients.Delete(c.Request().Context(), c.Param("clientId")); err != nil {
+		return clientError(err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RotateSecret generates a new secret, the old secret stops working immediately
+func (h *ClientHandlers) RotateSecret(c echo.Context) error {
+	clientId := c.Param("clientId")
+	secret, err := h.clients.RotateSecret(c.Request().Context(), clientId)
+	if err != nil {
+		return clientError(err)
+	}
+
+	return c.JSON(http.StatusOK, SecretResponse{ClientId: clientId, ClientSecret: secret})
+}
+
+func (r ClientRequest) client() clients.Client {
+	return clients.Client{
+		ClientId:                    r.ClientId,
+		Name:                        r.Name,
+		Public:                      r.Public,
+		TokenEndpointAuthMethod:     r.TokenEndpointAuthMethod,
+		PublicKeys:                  r.PublicKeys,
+		RedirectUrls:                r.RedirectUrls,
+		VerificationUrls:            r.VerificationUrls,
+		AllowedOrigins:              r.AllowedOrigins,
+		GrantTypes:                  r.GrantTypes,
+		Scopes:                      r.Scopes,
+		Roles:                       r.Roles,
+		ExchangeAudiences:           r.ExchangeAudiences,
+		AccessTokenExpireInSeconds:  r.AccessTokenExpireInSeconds,
+		RefreshTokenExpireInSeconds: r.RefreshTokenExpireInSeconds,
+	}
+}
+
+func clientError(err error) error {
+	var notFound clients.ClientNotFoundError
+	var duplicate clients.ClientDuplicateError
+	var invalid clients.ClientValidationError
+	var httpError problem.Details
+	switch {
+	case errors.As(err, &notFound):
+		httpError = problem.NewProblem(problem.NotFound, http.StatusNotFound, err)
+	case errors.As(err, &duplicate):
+		httpError = problem.NewProblem(problem.Conflict, http.StatusConflict, err)
+	case errors.As(err, &invalid):
+		httpError = problem.NewBadRequest(err)
+	default:
+		httpError = problem.NewServerError(err)
+	}
+	return echo.NewHTTPError(httpError.Status, httpError)
+}
@@ -0,0 +1,14 @@
+package clients
+
+import "github.com/labstack/echo/v4"
+
+// ClientRoutes the admin endpoints are only reachable through the middleware, which authenticates the administrator
+func ClientRoutes(e *echo.Echo, handler *ClientHandlers, middleware ...echo.MiddlewareFunc) {
+	admin := e.Group("/admin/clients", middleware...)
+	admin.POST("", handler.Create)
+	admin.GET("", handler.List)
+	admin.GET("/:clientId", handler.Read)
+	admin.PUT("/:clientId", handler.Update)
+	admin.DELETE("/:clientId", handler.Delete)
+	admin.POST("/:clientId/secret", handler.RotateSecret)
+}
@@ -0,0 +1,496 @@
+package oauth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/oauth"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// OAuth error codes, see RFC 6749 section 5.2
+const (
+	ErrorInvalidRequest          = "invalid_request"
+	ErrorInvalidClient           = "invalid_client"
+	ErrorInvalidGrant            = "invalid_grant"
+	ErrorInvalidScope            = "invalid_scope"
+	ErrorUnauthorizedClient      = "unauthorized_client"
+	ErrorUnsupportedGrantType    = "unsupported_grant_type"
+	ErrorUnsupportedResponseType = "unsupported_response_type"
+	ErrorServerError             = "server_error"
+	// ErrorInvalidTarget see RFC 8693 section 2.2.2
+	ErrorInvalidTarget = "invalid_target"
+)
+
+// Device flow error codes, see RFC 8628 section 3.5
+const (
+	ErrorAuthorizationPending = "authorization_pending"
+	ErrorSlowDown             = "slow_down"
+	ErrorAccessDenied         = "access_denied"
+	ErrorExpiredToken         = "expired_token"
+)
+
+// ErrorResponse OAuth endpoints answer with RFC 6749 errors instead of problem details so standard clients and
+// gateways understand them
+type ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+type IntrospectionRequest struct {
+	Token               string `form:"token"`
+	TokenTypeHint       string `form:"token_type_hint"`
+	ClientId            string `form:"client_id"`
+	ClientSecret        string `form:"client_secret"`
+	ClientAssertionType string `form:"client_assertion_type"`
+	ClientAssertion     string `form:"client_assertion"`
+}
+
+type AuthorizeRequest struct {
+	ResponseType        string `query:"response_type" form:"response_type"`
+	ClientId            string `query:"client_id" form:"client_id"`
+	RedirectUri         string `query:"redirect_uri" form:"redirect_uri"`
+	Scope               string `query:"scope" form:"scope"`
+	State               string `query:"state" form:"state"`
+	CodeChallenge       string `query:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `query:"code_challenge_method" form:"code_challenge_method"`
+	Audience            string `query:"audience" form:"audience"`
+	Nonce               string `query:"nonce" form:"nonce"`
+	Email               string `form:"email"`
+	Password            string `form:"password"`
+	MfaCode             string `form:"mfa_code"`
+}
+
+type TokenRequest struct {
+	GrantType           string `form:"grant_type"`
+	ClientId            string `form:"client_id"`
+	ClientSecret        string `form:"client_secret"`
+	ClientAssertionType string `form:"client_assertion_type"`
+	ClientAssertion     string `form:"client_assertion"`
+	Code                string `form:"code"`
+	RedirectUri         string `form:"redirect_uri"`
+	CodeVerifier        string `form:"code_verifier"`
+	RefreshToken        string `form:"refresh_token"`
+	DeviceCode          string `form:"device_code"`
+	SubjectToken        string `form:"subject_token"`
+	SubjectTokenType    string `form:"subject_token_type"`
+	RequestedTokenType  string `form:"requested_token_type"`
+	ActorToken          string `form:"actor_token"`
+	Scope               string `form:"scope"`
+	Audience            string `form:"audience"`
+}
+
+type DeviceAuthorizationRequest struct {
+	ClientId            string `form:"client_id"`
+	ClientSecret        string `form:"client_secret"`
+	ClientAssertionType string `form:"client_assertion_type"`
+	ClientAssertion     string `form:"client_assertion"`
+	Scope               string `form:"scope"`
+	Audience            string `form:"audience"`
+}
+
+// DeviceAuthorizationResponse RFC 8628 section 3.2
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationUri         string `json:"verification_uri"`
+	VerificationUriComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type DeviceVerificationRequest struct {
+	UserCode string `query:"user_code" form:"user_code"`
+	Email    string `form:"email"`
+	Password string `form:"password"`
+	MfaCode  string `form:"mfa_code"`
+	Action   string `form:"action"`
+}
+
+type OAuthHandlers struct {
+	introspection oauth.IntrospectionService
+	authorization oauth.AuthorizationService
+	devices       oauth.DeviceAuthorizationService
+	clients       oauth.ClientAuthenticator
+	issuer        string
+}
+
+// NewOAuthHandlers client assertions are accepted when addressed to the issuer or the url of the endpoint
+func NewOAuthHandlers(introspection oauth.IntrospectionService, authorization oauth.AuthorizationService,
+	devices oauth.DeviceAuthorizationService, clients oauth.ClientAuthenticator, issuer string) *OAuthHandlers {
+	return &OAuthHandlers{
+		introspection: introspection,
+		authorization: authorization,
+		devices:       devices,
+		clients:       clients,
+		issuer:        issuer,
+	}
+}
+
+// Introspect RFC 7662 token introspection, the caller authenticates with client_secret_basic or client_secret_post
+func (h *OAuthHandlers) Introspect(c echo.Context) error {
+	request := new(IntrospectionRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+
+	if err := h.authenticateClient(c, request); err != nil {
+		return err
+	}
+
+	if request.Token == "" {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: "token is required"})
+	}
+
+	introspection, err := h.introspection.Introspect(c.Request().Context(), request.Token, request.TokenTypeHint)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: ErrorServerError, ErrorDescription: err.Error()})
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-store")
+	return c.JSON(http.StatusOK, introspection)
+}
+
+// Authorize shows the sign in form for a valid authorization request, errors about the client or redirect uri are
+// shown to the user and every other error is sent back to the client's redirect uri
+func (h *OAuthHandlers) Authorize(c echo.Context) error {
+	request := new(AuthorizeRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+
+	_, err := h.authorization.ValidateAuthorization(c.Request().Context(), request.authorization())
+	if err != nil {
+		return h.authorizationError(c, request, err)
+	}
+
+	return renderSignIn(c, http.StatusOK, request, "")
+}
+
+// SignIn checks the credentials posted by the sign in form and redirects back to the client with a code
+func (h *OAuthHandlers) SignIn(c echo.Context) error {
+	request := new(AuthorizeRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+
+	code, err := h.authorization.Authorize(c.Request().Context(), request.authorization(), request.Email, request.Password,
+		request.MfaCode)
+	if err != nil {
+		if status, message, ok := signInError(err); ok {
+			return renderSignIn(c, status, request, message)
+		}
+		return h.authorizationError(c, request, err)
+	}
+
+	return c.Redirect(http.StatusFound, redirectUri(request.RedirectUri, url.Values{
+		"code":  {code},
+		"state": {request.State},
+	}))
+}
+
+// Token the token endpoint of RFC 6749 section 3.2, confidential clients authenticate with client_secret_basic,
+// client_secret_post or private_key_jwt
+func (h *OAuthHandlers) Token(c echo.Context) error {
+	request := new(TokenRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		request.ClientId, request.ClientSecret = id, secret
+	}
+
+	response, err := h.authorization.Token(c.Request().Context(), oauth.TokenRequest{
+		GrantType:           request.GrantType,
+		ClientId:            request.ClientId,
+		ClientSecret:        request.ClientSecret,
+		ClientAssertionType: request.ClientAssertionType,
+		ClientAssertion:     request.ClientAssertion,
+		AssertionAudiences:  h.assertionAudiences(),
+		Code:                request.Code,
+		RedirectUri:         request.RedirectUri,
+		CodeVerifier:        request.CodeVerifier,
+		RefreshToken:        request.RefreshToken,
+		DeviceCode:          request.DeviceCode,
+		SubjectToken:        request.SubjectToken,
+		SubjectTokenType:    request.SubjectTokenType,
+		RequestedTokenType:  request.RequestedTokenType,
+		ActorToken:          request.ActorToken,
+		Scope:               request.Scope,
+		Audience:            request.Audience,
+	})
+	c.Response().Header().Set("Cache-Control", "no-store")
+	if err != nil {
+		return tokenError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeviceAuthorization the device authorization endpoint of RFC 8628 section 3.1, clients authenticate as they do at
+// the token endpoint
+func (h *OAuthHandlers) DeviceAuthorization(c echo.Context) error {
+	request := new(DeviceAuthorizationRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		request.ClientId, request.ClientSecret = id, secret
+	}
+	c.Response().Header().Set("Cache-Control", "no-store")
+	// a device can only send the user to the verification page at an absolute url
+	verificationUri, err := oauth.EndpointUrl(h.issuer, "/oauth/device")
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: ErrorServerError, ErrorDescription: err.Error()})
+	}
+
+	device, err := h.devices.AuthorizeDevice(c.Request().Context(), oauth.DeviceAuthorizationRequest{
+		ClientCredentials: oauth.ClientCredentials{
+			ClientId:            request.ClientId,
+			ClientSecret:        request.ClientSecret,
+			ClientAssertionType: request.ClientAssertionType,
+			ClientAssertion:     request.ClientAssertion,
+			AssertionAudiences:  h.assertionAudiences(),
+		},
+		Scope:    request.Scope,
+		Audience: request.Audience,
+	})
+	if err != nil {
+		return tokenError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, DeviceAuthorizationResponse{
+		DeviceCode:              device.DeviceCode,
+		UserCode:                device.UserCode,
+		VerificationUri:         verificationUri,
+		VerificationUriComplete: redirectUri(verificationUri, url.Values{"user_code": {device.UserCode}}),
+		ExpiresIn:               device.ExpiresIn,
+		Interval:                device.Interval,
+	})
+}
+
+// Device the verification page, asks for the user code unless the device linked to the page with it
+func (h *OAuthHandlers) Device(c echo.Context) error {
+	request := new(DeviceVerificationRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+	if request.UserCode == "" {
+		return renderDevice(c, http.StatusOK, devicePage{})
+	}
+
+	verification, err := h.devices.ReadDevice(c.Request().Context(), request.UserCode)
+	if err != nil {
+		return deviceError(c, err)
+	}
+
+	return renderDevice(c, http.StatusOK, devicePage{Verification: verification})
+}
+
+// VerifyDevice the user signs in to approve or deny the device
+func (h *OAuthHandlers) VerifyDevice(c echo.Context) error {
+	request := new(DeviceVerificationRequest)
+	if err := c.Bind(request); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	}
+
+	approve := request.Action == "approve"
+	err := h.devices.VerifyDevice(c.Request().Context(), request.UserCode, request.Email, request.Password,
+		request.MfaCode, approve)
+	if err != nil {
+		if status, message, ok := signInError(err); ok {
+			verification, err := h.devices.ReadDevice(c.Request().Context(), request.UserCode)
+			if err != nil {
+				return deviceError(c, err)
+			}
+			return renderDevice(c, status, devicePage{
+				Verification: verification,
+				Email:        request.Email,
+				Error:        message,
+			})
+		}
+		return deviceError(c, err)
+	}
+
+	return renderDevice(c, http.StatusOK, devicePage{Done: true, Approved: approve})
+}
+
+// deviceError an unknown or expired user code asks for the code again
+func deviceError(c echo.Context, err error) error {
+	var userCode oauth.UserCodeError
+	if errors.As(err, &userCode) {
+		return renderDevice(c, http.StatusBadRequest, devicePage{Error: "The code is invalid or has expired"})
+	}
+	return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: ErrorServerError, ErrorDescription: err.Error()})
+}
+
+// authorizationError redirects errors about the request back to the client, see RFC 6749 section 4.1.2.1. The user
+// is never sent to a redirect uri that has not been checked
+func (h *OAuthHandlers) authorizationError(c echo.Context, request *AuthorizeRequest, err error) error {
+	var redirectErr oauth.InvalidRedirectError
+	var invalidRequest oauth.InvalidRequestError
+	var unauthorized oauth.UnauthorizedClientError
+	var unsupported oauth.UnsupportedResponseTypeError
+	var scope clients.ScopeError
+	var code string
+	switch {
+	case errors.As(err, &redirectErr):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	case errors.As(err, &invalidRequest):
+		code = ErrorInvalidRequest
+	case errors.As(err, &unauthorized):
+		code = ErrorUnauthorizedClient
+	case errors.As(err, &unsupported):
+		code = ErrorUnsupportedResponseType
+	case errors.As(err, &scope):
+		code = ErrorInvalidScope
+	default:
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: ErrorServerError, ErrorDescription: err.Error()})
+	}
+
+	return c.Redirect(http.StatusFound, redirectUri(request.RedirectUri, url.Values{
+		"error":             {code},
+		"error_description": {err.Error()},
+		"state":             {request.State},
+	}))
+}
+
+// tokenError maps the error to the RFC 6749 section 5.2 error response
+func tokenError(c echo.Context, err error) error {
+	var clientErr clients.ClientAuthenticationError
+	var invalidRequest oauth.InvalidRequestError
+	var invalidGrant oauth.InvalidGrantError
+	var unauthorized oauth.UnauthorizedClientError
+	var unsupported oauth.UnsupportedGrantTypeError
+	var audience tokens.AudienceError
+	var scope clients.ScopeError
+	var pending oauth.AuthorizationPendingError
+	var slowDown oauth.SlowDownError
+	var denied oauth.AccessDeniedError
+	var expired oauth.ExpiredTokenError
+	var target oauth.InvalidTargetError
+	switch {
+	case errors.As(err, &clientErr):
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="bulwarkauth"`)
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: ErrorInvalidClient, ErrorDescription: err.Error()})
+	case errors.As(err, &invalidRequest), errors.As(err, &audience):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidRequest, ErrorDescription: err.Error()})
+	case errors.As(err, &invalidGrant):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidGrant, ErrorDescription: err.Error()})
+	case errors.As(err, &unauthorized):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorUnauthorizedClient, ErrorDescription: err.Error()})
+	case errors.As(err, &unsupported):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorUnsupportedGrantType, ErrorDescription: err.Error()})
+	case errors.As(err, &scope):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidScope, ErrorDescription: err.Error()})
+	case errors.As(err, &pending):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorAuthorizationPending, ErrorDescription: err.Error()})
+	case errors.As(err, &slowDown):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorSlowDown, ErrorDescription: err.Error()})
+	case errors.As(err, &denied):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorAccessDenied, ErrorDescription: err.Error()})
+	case errors.As(err, &expired):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorExpiredToken, ErrorDescription: err.Error()})
+	case errors.As(err, &target):
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Error: ErrorInvalidTarget, ErrorDescription: err.Error()})
+	default:
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{Error: ErrorServerError, ErrorDescription: err.Error()})
+	}
+}
+
+// redirectUri adds the parameters to the query of the redirect uri, an empty state is left out
+func redirectUri(uri string, params url.Values) string {
+	if params.Get("state") == "" {
+		params.Del("state")
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return uri
+	}
+	query := parsed.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// signInError the account could not sign in and the form is shown again with the message, why the credentials were
+// refused is not disclosed to the user
+func signInError(err error) (int, string, bool) {
+	var authenticationErr authentication.AuthenticationError
+	var notFound accounts.AccountNotFoundError
+	var notVerified accounts.AccountNotVerifiedError
+	var disabled accounts.AccountDisabledError
+	var deleted accounts.AccountDeletedError
+	var mfaCode authentication.MfaCodeError
+	var tooMany authentication.TooManyAttemptsError
+	switch {
+	case errors.As(err, &authenticationErr) || errors.As(err, &notFound) || errors.As(err, &notVerified) ||
+		errors.As(err, &disabled) || errors.As(err, &deleted):
+		return http.StatusUnauthorized, "The email or password is incorrect", true
+	case errors.As(err, &mfaCode):
+		return http.StatusUnauthorized, "The authentication code is incorrect", true
+	case errors.As(err, &tooMany):
+		return http.StatusTooManyRequests, "Too many failed attempts, try again later", true
+	}
+	return 0, "", false
+}
+
+func (r AuthorizeRequest) authorization() oauth.AuthorizationRequest {
+	return oauth.AuthorizationRequest{
+		ResponseType:        r.ResponseType,
+		ClientId:            r.ClientId,
+		RedirectUri:         r.RedirectUri,
+		Scope:               r.Scope,
+		State:               r.State,
+		CodeChallenge:       r.CodeChallenge,
+		CodeChallengeMethod: r.CodeChallengeMethod,
+		Audience:            r.Audience,
+		Nonce:               r.Nonce,
+	}
+}
+
+// authenticateClient prefers basic authentication over the form, a client assertion is verified instead when one is
+// posted
+func (h *OAuthHandlers) authenticateClient(c echo.Context, request *IntrospectionRequest) error {
+	clientId, clientSecret := request.ClientId, request.ClientSecret
+	if id, secret, ok := c.Request().BasicAuth(); ok {
+		clientId, clientSecret = id, secret
+	}
+
+	var err error
+	switch {
+	case request.ClientAssertionType == "" && request.ClientAssertion == "":
+		err = h.clients.AuthenticateClient(c.Request().Context(), clientId, clientSecret)
+	case request.ClientAssertionType != clients.ClientAssertionType || clientSecret != "":
+		err = clients.ClientAuthenticationError{Value: clientId}
+	default:
+		var client *clients.Client
+		client, err = h.clients.AuthenticateAssertion(c.Request().Context(), request.ClientAssertion, h.assertionAudiences())
+		if err == nil && clientId != "" && clientId != client.ClientId {
+			err = clients.ClientAuthenticationError{Value: clientId}
+		}
+	}
+	if err != nil {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="bulwarkauth"`)
+		return c.JSON(http.StatusUnauthorized, ErrorResponse{Error: ErrorInvalidClient, ErrorDescription: err.Error()})
+	}
+
+	return nil
+}
+
+// assertionAudiences a client assertion is addressed to the issuer or the url of the token endpoint, see RFC 7523
+// section 3. Both come from the configured issuer, never from the request
+func (h *OAuthHandlers) assertionAudiences() []string {
+	tokenEndpoint, err := oauth.EndpointUrl(h.issuer, "/oauth/token")
+	if err != nil {
+		return []string{h.issuer}
+	}
+	return []string{h.issuer, tokenEndpoint}
+}
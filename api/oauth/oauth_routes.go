@@ -0,0 +1,13 @@
+package oauth
+
+import "github.com/labstack/echo/v4"
+
+func OAuthRoutes(e *echo.Echo, handler *OAuthHandlers) {
+	e.GET("/oauth/authorize", handler.Authorize)
+	e.POST("/oauth/authorize", handler.SignIn)
+	e.POST("/oauth/token", handler.Token)
+	e.POST("/oauth/introspect", handler.Introspect)
+	e.POST("/oauth/device_authorization", handler.DeviceAuthorization)
+	e.GET("/oauth/device", handler.Device)
+	e.POST("/oauth/device", handler.VerifyDevice)
+}
@@ -0,0 +1,118 @@
+package oauth
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/internal/oauth"
+)
+
+// signInTemplate a minimal sign in form, the authorization request is posted back with the credentials
+var signInTemplate = template.Must(template.New("signIn").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Sign in</title>
+</head>
+<body>
+<form method="post" action="/oauth/authorize">
+<h1>Sign in</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectUri}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="audience" value="{{.Request.Audience}}">
+<input type="hidden" name="nonce" value="{{.Request.Nonce}}">
+<label for="email">Email</label>
+<input type="email" id="email" name="email" value="{{.Request.Email}}" autocomplete="username" required>
+<label for="password">Password</label>
+<input type="password" id="password" name="password" autocomplete="current-password" required>
+<label for="mfa_code">Authentication code, if you have turned it on</label>
+<input type="text" id="mfa_code" name="mfa_code" inputmode="numeric" autocomplete="one-time-code">
+<button type="submit">Sign in</button>
+</form>
+</body>
+</html>
+`))
+
+type signInPage struct {
+	Request *AuthorizeRequest
+	Error   string
+}
+
+// deviceTemplate the verification page of the device flow, the user enters the code shown on the device and signs in
+// to approve or deny it
+var deviceTemplate = template.Must(template.New("device").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Connect a device</title>
+</head>
+<body>
+{{if .Done}}
+<h1>{{if .Approved}}Device connected{{else}}Device denied{{end}}</h1>
+<p>You can return to your device.</p>
+{{else if .Verification}}
+<form method="post" action="/oauth/device">
+<h1>Connect {{if .Verification.ClientName}}{{.Verification.ClientName}}{{else}}{{.Verification.ClientId}}{{end}}</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<p>Check that the device shows the code {{.Verification.UserCode}}</p>
+{{if .Verification.Scope}}<p>It asks for access to: {{.Verification.Scope}}</p>{{end}}
+<input type="hidden" name="user_code" value="{{.Verification.UserCode}}">
+<label for="email">Email</label>
+<input type="email" id="email" name="email" value="{{.Email}}" autocomplete="username" required>
+<label for="password">Password</label>
+<input type="password" id="password" name="password" autocomplete="current-password" required>
+<label for="mfa_code">Authentication code, if you have turned it on</label>
+<input type="text" id="mfa_code" name="mfa_code" inputmode="numeric" autocomplete="one-time-code">
+<button type="submit" name="action" value="approve">Approve</button>
+<button type="submit" name="action" value="deny">Deny</button>
+</form>
+{{else}}
+<form method="get" action="/oauth/device">
+<h1>Connect a device</h1>
+{{if .Error}}<p role="alert">{{.Error}}</p>{{end}}
+<label for="user_code">Enter the code shown on your device</label>
+<input type="text" id="user_code" name="user_code" autocomplete="off" autocapitalize="characters" required>
+<button type="submit">Continue</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type devicePage struct {
+	Verification *oauth.DeviceVerification
+	Email        string
+	Error        string
+	Done         bool
+	Approved     bool
+}
+
+func renderSignIn(c echo.Context, status int, request *AuthorizeRequest, message string) error {
+	return renderPage(c, status, signInTemplate, signInPage{Request: request, Error: message})
+}
+
+func renderDevice(c echo.Context, status int, page devicePage) error {
+	return renderPage(c, status, deviceTemplate, page)
+}
+
+// renderPage the pages take credentials so they must not be framed by another site or cached
+func renderPage(c echo.Context, status int, tmpl *template.Template, data any) error {
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		return err
+	}
+	header := c.Response().Header()
+	header.Set("Cache-Control", "no-store")
+	header.Set("X-Frame-Options", "DENY")
+	header.Set("Content-Security-Policy", "frame-ancestors 'none'")
+	return c.HTMLBlob(status, page.Bytes())
+}
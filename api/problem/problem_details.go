@@ -10,6 +10,7 @@ const(
 	NotFound = "Not Found"
 	Conflict = "Conflict"
 	TooManyRequests = "Too Many Requests"
+	MfaRequired = "MFA Required"
 )
 
 // Details RFC 7807: Problem Details
@@ -19,6 +20,16 @@ type Details struct {
 	Status   int    `json:"status"`
 	Detail   string `json:"detail,omitempty"`
 	Instance string `json:"instance,omitempty"`
+	// Violations an extension member listing each rule a request failed
+	Violations []Violation `json:"violations,omitempty"`
+	// ChallengeToken an extension member with the token a second factor code is exchanged with
+	ChallengeToken string `json:"challengeToken,omitempty"`
+}
+
+// Violation a rule a request failed
+type Violation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
 }
 
 func NewServerError(err error) Details {
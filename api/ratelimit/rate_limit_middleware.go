@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/api/problem"
+	"github.com/latebit-io/bulwarkauth/internal/ratelimit"
+)
+
+// apiKeyHeader the api key header, see apiKeySetting
+const apiKeyHeader = "X-BULWARK-API-KEY"
+
+// maxEmailBody larger bodies are not read for the email, they are still limited by the other keys
+const maxEmailBody = 64 << 10
+
+// RateLimit limits the routes with a limit, each key of a request takes a token from its own bucket for the route
+// and the request is answered with 429 when any of them is empty. It has to run after routing, with echo Use. The ip
+// key is read with the extractor, pass the IPExtractor of the server so it trusts the same proxies
+func RateLimit(limiter ratelimit.Limiter, limits map[string]ratelimit.Limit, keys []string,
+	ipExtractor echo.IPExtractor) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit, ok := limits[c.Path()]
+			if !ok {
+				return next(c)
+			}
+			for _, key := range keys {
+				value := keyValue(c, key, ipExtractor)
+				if value == "" {
+					continue
+				}
+				result, err := limiter.Take(c.Request().Context(), c.Path()+":"+key+":"+value, limit)
+				if err != nil {
+					httpError := problem.NewServerError(err)
+					return echo.NewHTTPError(httpError.Status, httpError)
+				}
+				if !result.Allowed {
+					seconds := int(math.Ceil(result.RetryAfter.Seconds()))
+					c.Response().Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+					httpError := problem.NewProblem(problem.TooManyRequests, http.StatusTooManyRequests,
+						errors.New("rate limit exceeded for "+key))
+					return echo.NewHTTPError(httpError.Status, httpError)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// keyValue empty when the request has nothing for the key, api keys are hashed so they are not stored
+func keyValue(c echo.Context, key string, ipExtractor echo.IPExtractor) string {
+	switch key {
+	case ratelimit.KeyIp:
+		return ipExtractor(c.Request())
+	case ratelimit.KeyEmail:
+		return strings.ToLower(strings.TrimSpace(requestEmail(c)))
+	case ratelimit.KeyApiKey:
+		apiKey := c.Request().Header.Get(apiKeyHeader)
+		if apiKey == "" {
+			return ""
+		}
+		hash := sha256.Sum256([]byte(apiKey))
+		return hex.EncodeToString(hash[:])
+	}
+	return ""
+}
+
+// requestEmail reads the email of a json or form body and puts the body back for the handler
+func requestEmail(c echo.Context) string {
+	request := c.Request()
+	if request.Body == nil {
+		return ""
+	}
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxEmailBody+1))
+	request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), request.Body))
+	if err != nil || len(body) > maxEmailBody {
+		return ""
+	}
+
+	contentType := request.Header.Get(echo.HeaderContentType)
+	switch {
+	case strings.HasPrefix(contentType, echo.MIMEApplicationJSON):
+		var emailRequest struct {
+			Email string `json:"email"`
+		}
+		if json.Unmarshal(body, &emailRequest) != nil {
+			return ""
+		}
+		return emailRequest.Email
+	case strings.HasPrefix(contentType, echo.MIMEApplicationForm):
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return ""
+		}
+		return values.Get("email")
+	}
+	return ""
+}
@@ -0,0 +1,118 @@
+package wellknown
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/latebit-io/bulwarkauth/api/problem"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/oauth"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// OpenIDConfiguration OpenID Connect discovery document
+type OpenIDConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JwksURI                           string   `json:"jwks_uri"`
+	UserInfoEndpoint                  string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint             string   `json:"introspection_endpoint"`
+	DeviceAuthorizationEndpoint       string   `json:"device_authorization_endpoint"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	TokenEndpointAuthSigningAlgs      []string `json:"token_endpoint_auth_signing_alg_values_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ClaimsSupported                   []string `json:"claims_supported"`
+}
+
+type WellKnownHandlers struct {
+	signingKeyService tokens.SigningKeyService
+	issuer            string
+	cacheMaxAge       int
+}
+
+// NewWellKnownHandlers cacheMaxAge is the number of seconds consumers may cache the key set, keep it short
+// so rotated keys reach them without a restart
+func NewWellKnownHandlers(signingKeyService tokens.SigningKeyService, issuer string, cacheMaxAge int) *WellKnownHandlers {
+	return &WellKnownHandlers{
+		signingKeyService: signingKeyService,
+		issuer:            issuer,
+		cacheMaxAge:       cacheMaxAge,
+	}
+}
+
+// OpenIDConfiguration returns the discovery document so standard OpenID Connect clients can find the
+// keys and endpoints without custom configuration. The endpoints are under the issuer, never the Host header, so a
+// request can not point them elsewhere. There is no document unless the issuer is an https url
+func (h *WellKnownHandlers) OpenIDConfiguration(c echo.Context) error {
+	issuer, err := oauth.EndpointUrl(h.issuer, "")
+	if err != nil {
+		httpError := problem.NewProblem("Discovery is not available", http.StatusNotFound, err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	return c.JSON(http.StatusOK, OpenIDConfiguration{
+		Issuer:                      issuer,
+		AuthorizationEndpoint:       issuer + "/oauth/authorize",
+		TokenEndpoint:               issuer + "/oauth/token",
+		JwksURI:                     issuer + "/.well-known/jwks.json",
+		UserInfoEndpoint:            issuer + "/userinfo",
+		IntrospectionEndpoint:       issuer + "/oauth/introspect",
+		DeviceAuthorizationEndpoint: issuer + "/oauth/device_authorization",
+		ResponseTypesSupported:      []string{oauth.ResponseTypeCode},
+		GrantTypesSupported: []string{clients.GrantTypeAuthorizationCode, clients.GrantTypeRefreshToken,
+			clients.GrantTypeClientCredentials, clients.GrantTypeDeviceCode, clients.GrantTypeTokenExchange},
+		CodeChallengeMethodsSupported: []string{oauth.CodeChallengeMethodS256},
+		TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post",
+			clients.AuthMethodPrivateKeyJwt, clients.AuthMethodNone},
+		TokenEndpointAuthSigningAlgs:     tokens.SigningAlgorithms,
+		SubjectTypesSupported:            []string{"public"},
+		IDTokenSigningAlgValuesSupported: tokens.SigningAlgorithms,
+		ScopesSupported:                  []string{"openid", "email"},
+		ClaimsSupported: []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "amr", "azp", "email",
+			"email_verified", "roles", "client_id", "scope", "act"},
+	})
+}
+
+// JWKS returns the public signing keys as a JSON Web Key Set so tokens can be verified locally
+func (h *WellKnownHandlers) JWKS(c echo.Context) error {
+	keys, err := h.signingKeyService.GetAllKeys(c.Request().Context())
+	if err != nil {
+		httpError := problem.NewServerError(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	jwks, err := tokens.NewJWKS(keys)
+	if err != nil {
+		httpError := problem.NewServerError(err)
+		return echo.NewHTTPError(httpError.Status, httpError)
+	}
+
+	etag := keySetETag(jwks)
+	c.Response().Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", h.cacheMaxAge))
+	c.Response().Header().Set("ETag", etag)
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return c.JSON(http.StatusOK, jwks)
+}
+
+// keySetETag changes whenever a key is added or removed from the set
+func keySetETag(jwks *tokens.JWKS) string {
+	kids := make([]string, 0, len(jwks.Keys))
+	for _, k := range jwks.Keys {
+		kids = append(kids, k.KeyId)
+	}
+	sum := sha256.Sum256([]byte(strings.Join(kids, ",")))
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(sum[:8]))
+}
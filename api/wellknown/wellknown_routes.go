@@ -0,0 +1,8 @@
+package wellknown
+
+import "github.com/labstack/echo/v4"
+
+func WellKnownRoutes(e *echo.Echo, handler *WellKnownHandlers) {
+	e.GET("/.well-known/jwks.json", handler.JWKS)
+	e.GET("/.well-known/openid-configuration", handler.OpenIDConfiguration)
+}
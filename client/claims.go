@@ -0,0 +1,62 @@
+package client
+
+import (
+	"encoding/json"
+	"slices"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenTypeAccess the typ header and claim every bulwarkauth access token carries, see RFC 9068
+const TokenTypeAccess = "at+jwt"
+
+// reservedClaims claims set by bulwarkauth itself, everything else is a custom claim
+var reservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "typ", "roles", "email", "client_id", "act"}
+
+// AccessTokenClaims the claims of a verified access token, Custom holds the claims added by claims providers.
+// ClientId is only set on tokens a client requested for itself with the client credentials grant. Act names the
+// service acting on behalf of the subject of an exchanged token
+type AccessTokenClaims struct {
+	Type     string                 `json:"typ"`
+	Roles    []string               `json:"roles"`
+	Email    string                 `json:"email,omitempty"`
+	ClientId string                 `json:"client_id,omitempty"`
+	Act      *Actor                 `json:"act,omitempty"`
+	Custom   map[string]interface{} `json:"-"`
+	jwt.RegisteredClaims
+}
+
+// Actor the party acting on behalf of the subject, Act is the actor before it, see RFC 8693 section 4.1
+type Actor struct {
+	Subject string `json:"sub"`
+	Act     *Actor `json:"act,omitempty"`
+}
+
+// HasRole reports whether the token was issued with the role
+func (c AccessTokenClaims) HasRole(role string) bool {
+	return slices.Contains(c.Roles, role)
+}
+
+// UnmarshalJSON reads every claim that is not reserved into Custom
+func (c *AccessTokenClaims) UnmarshalJSON(data []byte) error {
+	type plain AccessTokenClaims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+
+	for _, name := range reservedClaims {
+		delete(all, name)
+	}
+
+	c.Custom = nil
+	if len(all) > 0 {
+		c.Custom = all
+	}
+
+	return nil
+}
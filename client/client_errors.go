@@ -0,0 +1,27 @@
+package client
+
+import "fmt"
+
+type KeyNotFoundError struct {
+	Value string `json:"value"`
+}
+
+func (e KeyNotFoundError) Error() string {
+	return fmt.Sprintf("signing key not found: %s", e.Value)
+}
+
+type TokenTypeError struct {
+	Value string `json:"value"`
+}
+
+func (e TokenTypeError) Error() string {
+	return fmt.Sprintf("unexpected token type: %s", e.Value)
+}
+
+type KeySetError struct {
+	Value string `json:"value"`
+}
+
+func (e KeySetError) Error() string {
+	return fmt.Sprintf("fetching key set failed: %s", e.Value)
+}
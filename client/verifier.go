@@ -0,0 +1,243 @@
+// Package client verifies bulwarkauth access tokens inside your own services. The public signing keys are fetched
+// from the bulwarkauth JWKS endpoint and cached, tokens are then checked locally without a round trip to the server.
+// Revocation is only known to the server, use the server side validation when a revoked token must be rejected
+// straight away.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	defaultRefreshInterval = 5 * time.Minute
+	defaultReloadCooldown  = 10 * time.Second
+)
+
+// Options configures a Verifier
+type Options struct {
+	// JWKSURL the bulwarkauth key set, for example https://auth.example.com/.well-known/jwks.json
+	JWKSURL string
+	// Issuer the expected iss claim, required. bulwarkauth issues tokens as bulwark-auth unless configured otherwise
+	Issuer string
+	// Audience the expected aud claim, required. The DOMAIN bulwarkauth is configured with unless TOKEN_AUDIENCES is set
+	Audience string
+	// HTTPClient used to fetch the key set, defaults to a client with a ten second timeout
+	HTTPClient *http.Client
+	// RefreshInterval how often Start fetches the key set, defaults to five minutes
+	RefreshInterval time.Duration
+	// ReloadCooldown the least time between fetches caused by tokens with an unknown kid, defaults to ten seconds
+	ReloadCooldown time.Duration
+	// Logger receives the failures of background refreshes and keys that are skipped, nothing is logged without one
+	Logger *slog.Logger
+}
+
+// Verifier verifies access tokens with the same signature, issuer, audience, expiry and type rules bulwarkauth
+// applies on the server
+type Verifier struct {
+	options Options
+
+	mu        sync.RWMutex
+	keys      map[string]verificationKey
+	etag      string
+	lastFetch time.Time
+	fetchMu   sync.Mutex
+}
+
+// NewVerifier fetches the key set once so the verifier is ready to use, call Start to keep the keys up to date. The
+// issuer and audience are required so a verifier can never accept tokens issued for another service
+func NewVerifier(ctx context.Context, options Options) (*Verifier, error) {
+	if options.JWKSURL == "" {
+		return nil, fmt.Errorf("a JWKS url is required")
+	}
+	if options.Issuer == "" || options.Audience == "" {
+		return nil, fmt.Errorf("an issuer and audience are required")
+	}
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = defaultRefreshInterval
+	}
+	if options.ReloadCooldown <= 0 {
+		options.ReloadCooldown = defaultReloadCooldown
+	}
+	if options.Logger == nil {
+		options.Logger = slog.New(slog.DiscardHandler)
+	}
+
+	verifier := &Verifier{
+		options: options,
+		keys:    make(map[string]verificationKey),
+	}
+	if err := verifier.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return verifier, nil
+}
+
+// Start refreshes the keys every RefreshInterval until the context is cancelled, failures are logged to the Logger
+// and the keys already cached stay in use
+func (v *Verifier) Start(ctx context.Context) {
+	ticker := time.NewTicker(v.options.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := v.Refresh(ctx); err != nil && ctx.Err() == nil {
+				v.options.Logger.Error("refreshing bulwarkauth keys failed", "error", err)
+			}
+		}
+	}
+}
+
+// Refresh fetches the key set, an unchanged key set is detected with its ETag and not parsed again
+func (v *Verifier) Refresh(ctx context.Context) error {
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+	return v.fetch(ctx)
+}
+
+// fetch must be called holding fetchMu so concurrent refreshes do not fetch the key set more than once
+func (v *Verifier) fetch(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, v.options.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	v.mu.RLock()
+	etag := v.etag
+	v.mu.RUnlock()
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := v.options.HTTPClient.Do(request)
+	if err != nil {
+		return KeySetError{Value: err.Error()}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotModified {
+		v.mu.Lock()
+		v.lastFetch = time.Now()
+		v.mu.Unlock()
+		return nil
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return KeySetError{Value: response.Status}
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return KeySetError{Value: err.Error()}
+	}
+
+	keys := make(map[string]verificationKey, len(jwks.Keys))
+	for _, jwk := range jwks.Keys {
+		publicKey, err := jwk.PublicKey()
+		if err != nil {
+			// a key this version does not understand must not stop the others from being used
+			v.options.Logger.Warn("skipping bulwarkauth key", "kid", jwk.KeyId, "error", err)
+			continue
+		}
+		keys[jwk.KeyId] = verificationKey{algorithm: jwk.Algorithm, publicKey: publicKey}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.keys = keys
+	v.etag = response.Header.Get("ETag")
+	v.lastFetch = time.Now()
+	return nil
+}
+
+// VerifyAccessToken verifies the token and returns its claims
+func (v *Verifier) VerifyAccessToken(ctx context.Context, tokenString string) (*AccessTokenClaims, error) {
+	options := []jwt.ParserOption{
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuer(v.options.Issuer),
+		jwt.WithAudience(v.options.Audience),
+	}
+
+	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		typ := fmt.Sprintf("%v", token.Header["typ"])
+		if typ != TokenTypeAccess {
+			return nil, TokenTypeError{Value: typ}
+		}
+
+		kid := fmt.Sprintf("%v", token.Header["kid"])
+		key, err := v.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+
+		if token.Method.Alg() != key.algorithm {
+			return nil, fmt.Errorf("signing method not supported")
+		}
+
+		return key.publicKey, nil
+	}, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(*AccessTokenClaims)
+	if !ok || !token.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	if claims.Type != TokenTypeAccess {
+		return nil, TokenTypeError{Value: claims.Type}
+	}
+
+	return claims, nil
+}
+
+// key returns the key for kid, an unknown kid fetches the key set again in case the key was rotated in since the
+// last refresh, at most once every ReloadCooldown
+func (v *Verifier) key(ctx context.Context, kid string) (verificationKey, error) {
+	key, ok, lastFetch := v.cached(kid)
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(lastFetch) < v.options.ReloadCooldown {
+		return verificationKey{}, KeyNotFoundError{Value: kid}
+	}
+
+	v.fetchMu.Lock()
+	defer v.fetchMu.Unlock()
+	// another request may have fetched the key set while this one waited
+	key, ok, lastFetch = v.cached(kid)
+	if ok {
+		return key, nil
+	}
+	if time.Since(lastFetch) >= v.options.ReloadCooldown {
+		if err := v.fetch(ctx); err != nil {
+			return verificationKey{}, err
+		}
+		key, ok, _ = v.cached(kid)
+		if ok {
+			return key, nil
+		}
+	}
+
+	return verificationKey{}, KeyNotFoundError{Value: kid}
+}
+
+func (v *Verifier) cached(kid string) (verificationKey, bool, time.Time) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	key, ok := v.keys[kid]
+	return key, ok, v.lastFetch
+}
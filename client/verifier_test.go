@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+type keySetServer struct {
+	*httptest.Server
+	keys    atomic.Value
+	fetches atomic.Int32
+}
+
+func newKeySetServer(t *testing.T, keys ...tokens.SigningKey) *keySetServer {
+	s := &keySetServer{}
+	s.keys.Store(keys)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		jwks, err := tokens.NewJWKS(s.keys.Load().([]tokens.SigningKey))
+		if err != nil {
+			t.Error(err)
+		}
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func signToken(t *testing.T, key *tokens.SigningKey, typ string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["typ"] = typ
+	token.Header["kid"] = key.KeyId
+	privateKey, err := tokens.ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := token.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func accessClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"typ":    TokenTypeAccess,
+		"sub":    "test@latebit.io",
+		"iss":    "bulwark-auth",
+		"aud":    []string{"latebit.io"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+		"iat":    time.Now().Unix(),
+		"roles":  []string{"admin"},
+		"tenant": "acme",
+	}
+}
+
+func TestVerifier_VerifyAccessToken(t *testing.T) {
+	for _, algorithm := range tokens.SigningAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			key, err := tokens.NewSigningKey(algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := newKeySetServer(t, *key)
+			verifier, err := NewVerifier(context.TODO(), Options{
+				JWKSURL:  server.URL,
+				Issuer:   "bulwark-auth",
+				Audience: "latebit.io",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := verifier.VerifyAccessToken(context.TODO(), signToken(t, key, TokenTypeAccess, accessClaims()))
+			assert.Nil(t, err)
+			assert.Equal(t, "test@latebit.io", claims.Subject)
+			assert.True(t, claims.HasRole("admin"))
+			assert.Equal(t, map[string]interface{}{"tenant": "acme"}, claims.Custom)
+		})
+	}
+}
+
+func TestVerifier_Rejects(t *testing.T) {
+	key, err := tokens.NewSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newKeySetServer(t, *key)
+	verifier, err := NewVerifier(context.TODO(), Options{
+		JWKSURL:  server.URL,
+		Issuer:   "bulwark-auth",
+		Audience: "latebit.io",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var typeErr TokenTypeError
+	refresh := accessClaims()
+	refresh["typ"] = "rt+jwt"
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, key, "rt+jwt", refresh))
+	assert.ErrorAs(t, err, &typeErr)
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, key, TokenTypeAccess, refresh))
+	assert.ErrorAs(t, err, &typeErr)
+
+	expired := accessClaims()
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, key, TokenTypeAccess, expired))
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	issuer := accessClaims()
+	issuer["iss"] = "someone-else"
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, key, TokenTypeAccess, issuer))
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidIssuer)
+
+	audience := accessClaims()
+	audience["aud"] = []string{"other.io"}
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, key, TokenTypeAccess, audience))
+	assert.ErrorIs(t, err, jwt.ErrTokenInvalidAudience)
+}
+
+func TestNewVerifier_RequiresIssuerAndAudience(t *testing.T) {
+	key, err := tokens.NewSigningKey("ES256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newKeySetServer(t, *key)
+	_, err = NewVerifier(context.TODO(), Options{JWKSURL: server.URL, Issuer: "bulwark-auth"})
+	assert.Error(t, err)
+	_, err = NewVerifier(context.TODO(), Options{JWKSURL: server.URL, Audience: "latebit.io"})
+	assert.Error(t, err)
+	assert.Equal(t, int32(0), server.fetches.Load())
+}
+
+func TestVerifier_UnknownKey(t *testing.T) {
+	first, err := tokens.NewSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newKeySetServer(t, *first)
+	verifier, err := NewVerifier(context.TODO(), Options{
+		JWKSURL:        server.URL,
+		Issuer:         "bulwark-auth",
+		Audience:       "latebit.io",
+		ReloadCooldown: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a key rotated in after the last fetch is picked up on first use
+	second, err := tokens.NewSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.keys.Store([]tokens.SigningKey{*first, *second})
+	time.Sleep(50 * time.Millisecond)
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, second, TokenTypeAccess, accessClaims()))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), server.fetches.Load())
+
+	// unknown keys do not fetch again inside the cooldown
+	unknown, err := tokens.NewSigningKey("EdDSA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = verifier.VerifyAccessToken(context.TODO(), signToken(t, unknown, TokenTypeAccess, accessClaims()))
+	var notFound KeyNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+	assert.Equal(t, int32(2), server.fetches.Load())
+}
@@ -2,43 +2,100 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/encryption"
+	"github.com/latebit-io/bulwarkauth/internal/ratelimit"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
 )
 
 type AppConfig struct {
-	AccessTokenExpireInSeconds  int
-	AllowedOrigins              []string
-	ApiKeyEnabled               bool
-	CompanyID                   string
-	CORSEnabled                 bool
-	DbConnection                string
-	DbNameSeed                  string
-	Domain                      string
-	DomainVerify                bool
-	EmailAuth                   bool
-	EmailFromAddress            string
-	EmailSmtpHost               string
-	EmailSmtpPass               string
-	EmailSmtpPort               string
-	EmailSmtpSecure             bool
-	EmailSmtpUser               string
-	EmailTemplateDir            string
-	EmailTemplatesDir           string
-	EnableSmtp                  bool
-	ForgotPasswordUrl           string
-	GithubAppName               string
-	GoogleClientId              string
-	MagicCodeExpireInMinutes    int
-	MagicUrl                    string
-	MicrosoftClientId           string
-	MicrosoftTenantId           string
-	Port                        int
-	RefreshTokenExpireInSeconds int
-	VerificationUrl             string
-	WebsiteName                 string
-	TestMode                    bool
+	AcceptUntypedTokens              bool
+	AccessTokenExpireInSeconds       int
+	AdminApiKey                      string
+	Argon2Iterations                 int
+	Argon2MemoryKib                  int
+	Argon2Parallelism                int
+	BcryptCost                       int
+	AllowedOrigins                   []string
+	AuthorizationCodeExpireInSeconds int
+	ApiKeyEnabled                    bool
+	ClientIds                        []string
+	CompanyID                        string
+	CORSEnabled                      bool
+	DbConnection                     string
+	DbNameSeed                       string
+	DeviceCodeExpireInSeconds        int
+	DeviceCodeIntervalInSeconds      int
+	Domain                           string
+	DomainVerify                     bool
+	EmailAuth                        bool
+	EmailFromAddress                 string
+	EmailSmtpHost                    string
+	EmailSmtpPass                    string
+	EmailSmtpPort                    string
+	EmailSmtpSecure                  bool
+	EmailSmtpUser                    string
+	EmailTemplateDir                 string
+	EmailTemplatesDir                string
+	EnableSmtp                       bool
+	ForgotPasswordUrl                string
+	GithubAppName                    string
+	GoogleClientId                   string
+	Issuer                           string
+	JwksCacheMaxAgeInSeconds         int
+	KeyRotationInSeconds             int
+	KeyPendingInSeconds              int
+	KeyPollInSeconds                 int
+	LockoutBackoffInSeconds          int
+	LockoutDurationInSeconds         int
+	LockoutFreeAttempts              int
+	LockoutIpMaxFailures             int
+	LockoutMaxFailures               int
+	MagicCodeExpireInMinutes         int
+	MagicUrl                         string
+	MfaChallengeExpireInSeconds      int
+	MfaKek                           string
+	MfaKekFile                       string
+	MicrosoftClientId                string
+	MicrosoftTenantId                string
+	PasswordBannedWords              []string
+	PasswordBreachedFile             string
+	PasswordCharacterClasses         []string
+	PasswordHash                     string
+	PasswordMaxLength                int
+	PasswordMinLength                int
+	PasswordPepper                   string
+	PasswordPepperFile               string
+	PasswordPreviousPepper           string
+	PasswordPreviousPepperFile       string
+	Port                             int
+	RateLimitEnabled                 bool
+	RateLimitKeys                    []string
+	RateLimits                       map[string]ratelimit.Limit
+	RateLimitStore                   string
+	RefreshTokenExpireInSeconds      int
+	RevocationCacheInSeconds         int
+	ScryptCostLog2                   int
+	SeparateSigningKeys              bool
+	SigningAlgorithm                 string
+	SigningKeyKek                    string
+	SigningKeyKekFile                string
+	SigningKeyPreviousKek            string
+	SigningKeyPreviousKekFile        string
+	VerificationUrl                  string
+	WebsiteName                      string
+	TokenAudiences                   []string
+	TokenClaims                      []string
+	TrustedProxies                   []*net.IPNet
+	TestMode                         bool
 }
 
 func NewAppConfig() (*AppConfig, error) {
@@ -95,14 +152,148 @@ func NewAppConfig() (*AppConfig, error) {
 	config.MagicCodeExpireInMinutes = getEnvAsInt("MAGIC_CODE_EXPIRE_IN_MINUTES", 10)
 	config.AccessTokenExpireInSeconds = getEnvAsInt("ACCESS_TOKEN_EXPIRE_IN_SECONDS", 3600)
 	config.RefreshTokenExpireInSeconds = getEnvAsInt("REFRESH_TOKEN_EXPIRE_IN_SECONDS", 86400)
+	config.AuthorizationCodeExpireInSeconds = getEnvAsInt("AUTHORIZATION_CODE_EXPIRE_IN_SECONDS", 60)
+	config.DeviceCodeExpireInSeconds = getEnvAsInt("DEVICE_CODE_EXPIRE_IN_SECONDS", 600)
+	config.DeviceCodeIntervalInSeconds = getEnvAsInt("DEVICE_CODE_INTERVAL_IN_SECONDS", 5)
+	config.JwksCacheMaxAgeInSeconds = getEnvAsInt("JWKS_CACHE_MAX_AGE_IN_SECONDS", 300)
+	config.KeyRotationInSeconds = getEnvAsInt("KEY_ROTATION_IN_SECONDS", 0)
+	config.KeyPendingInSeconds = getEnvAsInt("KEY_PENDING_IN_SECONDS", 3600)
+	// the next key is published KEY_PENDING_IN_SECONDS before the active one is due, so it has to fit in the interval
+	if config.KeyRotationInSeconds > 0 &&
+		(config.KeyPendingInSeconds < 0 || config.KeyPendingInSeconds >= config.KeyRotationInSeconds) {
+		return nil, errors.New("KEY_PENDING_IN_SECONDS must be less than KEY_ROTATION_IN_SECONDS")
+	}
+	config.KeyPollInSeconds = getEnvAsInt("KEY_POLL_IN_SECONDS", 60)
+	config.RevocationCacheInSeconds = getEnvAsInt("REVOCATION_CACHE_IN_SECONDS", 30)
+	config.SigningAlgorithm = getEnv("SIGNING_ALGORITHM", "RS256")
+	if !slices.Contains(tokens.SigningAlgorithms, config.SigningAlgorithm) {
+		return nil, errors.New("SIGNING_ALGORITHM must be one of " + strings.Join(tokens.SigningAlgorithms, ", "))
+	}
+	config.SeparateSigningKeys = getEnv("SEPARATE_SIGNING_KEYS", "false") == "true"
+	config.AcceptUntypedTokens = getEnv("ACCEPT_UNTYPED_TOKENS", "false") == "true"
+	config.SigningKeyKek = getEnv("SIGNING_KEY_KEK", "")
+	config.SigningKeyKekFile = getEnv("SIGNING_KEY_KEK_FILE", "")
+	config.SigningKeyPreviousKek = getEnv("SIGNING_KEY_PREVIOUS_KEK", "")
+	config.SigningKeyPreviousKekFile = getEnv("SIGNING_KEY_PREVIOUS_KEK_FILE", "")
+	config.PasswordMinLength = getEnvAsInt("PASSWORD_MIN_LENGTH", 8)
+	config.PasswordMaxLength = getEnvAsInt("PASSWORD_MAX_LENGTH", 64)
+	config.PasswordCharacterClasses = getEnvAsStringSlice("PASSWORD_CHARACTER_CLASSES", []string{})
+	for i, class := range config.PasswordCharacterClasses {
+		config.PasswordCharacterClasses[i] = strings.TrimSpace(class)
+		if !slices.Contains(accounts.CharacterClasses, config.PasswordCharacterClasses[i]) {
+			return nil, errors.New("PASSWORD_CHARACTER_CLASSES must be a list of " +
+				strings.Join(accounts.CharacterClasses, ", "))
+		}
+	}
+	config.PasswordBannedWords = getEnvAsStringSlice("PASSWORD_BANNED_WORDS", []string{})
+	config.PasswordBreachedFile = getEnv("PASSWORD_BREACHED_FILE", "")
+	config.PasswordHash = getEnv("PASSWORD_HASH", encryption.HashArgon2id)
+	if !slices.Contains(encryption.HashSchemes, config.PasswordHash) {
+		return nil, errors.New("PASSWORD_HASH must be one of " + strings.Join(encryption.HashSchemes, ", "))
+	}
+	config.PasswordPepper = getEnv("PASSWORD_PEPPER", "")
+	config.PasswordPepperFile = getEnv("PASSWORD_PEPPER_FILE", "")
+	config.PasswordPreviousPepper = getEnv("PASSWORD_PREVIOUS_PEPPER", "")
+	config.PasswordPreviousPepperFile = getEnv("PASSWORD_PREVIOUS_PEPPER_FILE", "")
+	config.Argon2MemoryKib = getEnvAsInt("ARGON2_MEMORY_KIB", int(encryption.DefaultArgon2idParams.Memory))
+	config.Argon2Iterations = getEnvAsInt("ARGON2_ITERATIONS", int(encryption.DefaultArgon2idParams.Iterations))
+	config.Argon2Parallelism = getEnvAsInt("ARGON2_PARALLELISM", int(encryption.DefaultArgon2idParams.Parallelism))
+	config.BcryptCost = getEnvAsInt("BCRYPT_COST", encryption.DefaultBcryptCost)
+	config.ScryptCostLog2 = getEnvAsInt("SCRYPT_COST_LOG2", encryption.DefaultScryptParams.CostLog2)
+	config.LockoutFreeAttempts = getEnvAsInt("LOCKOUT_FREE_ATTEMPTS", 3)
+	config.LockoutBackoffInSeconds = getEnvAsInt("LOCKOUT_BACKOFF_IN_SECONDS", 1)
+	config.LockoutMaxFailures = getEnvAsInt("LOCKOUT_MAX_FAILURES", 10)
+	config.LockoutIpMaxFailures = getEnvAsInt("LOCKOUT_IP_MAX_FAILURES", 100)
+	config.LockoutDurationInSeconds = getEnvAsInt("LOCKOUT_DURATION_IN_SECONDS", 900)
+	config.MfaKek = getEnv("MFA_KEK", "")
+	config.MfaKekFile = getEnv("MFA_KEK_FILE", "")
+	config.MfaChallengeExpireInSeconds = getEnvAsInt("MFA_CHALLENGE_EXPIRE_IN_SECONDS", 300)
+	config.Issuer = strings.TrimSuffix(getEnv("ISSUER", "bulwark-auth"), "/")
+	if err := validateIssuer(config.Issuer); err != nil {
+		return nil, err
+	}
+	config.TokenAudiences = getEnvAsStringSlice("TOKEN_AUDIENCES", []string{config.Domain})
+	for i, audience := range config.TokenAudiences {
+		config.TokenAudiences[i] = strings.TrimSpace(audience)
+	}
+	config.TokenClaims = getEnvAsStringSlice("TOKEN_CLAIMS", []string{})
 	config.AllowedOrigins = getEnvAsStringSlice("ALLOWED_WEB_ORIGINS", []string{})
+	config.ClientIds = getEnvAsStringSlice("CLIENT_IDS", []string{})
+	for i, clientId := range config.ClientIds {
+		config.ClientIds[i] = strings.TrimSpace(clientId)
+	}
+	trustedProxies, err := parseTrustedProxies(getEnvAsStringSlice("TRUSTED_PROXIES", []string{}))
+	if err != nil {
+		return nil, err
+	}
+	config.TrustedProxies = trustedProxies
 	config.CompanyID = getEnv("COMPANY_ID", "")
 	config.ApiKeyEnabled = getEnv("API_KEY_ENABLED", "false") == "true"
+	config.AdminApiKey = getEnv("ADMIN_API_KEY", "")
 	config.CORSEnabled = getEnv("CORS_ENABLED", "false") == "true"
+	config.RateLimitEnabled = getEnv("RATE_LIMIT_ENABLED", "true") == "true"
+	config.RateLimitStore = getEnv("RATE_LIMIT_STORE", ratelimit.StoreMemory)
+	if !slices.Contains(ratelimit.Stores, config.RateLimitStore) {
+		return nil, errors.New("RATE_LIMIT_STORE must be one of " + strings.Join(ratelimit.Stores, ", "))
+	}
+	config.RateLimitKeys = getEnvAsStringSlice("RATE_LIMIT_KEYS", slices.Clone(ratelimit.Keys))
+	for i, key := range config.RateLimitKeys {
+		config.RateLimitKeys[i] = strings.TrimSpace(key)
+		if !slices.Contains(ratelimit.Keys, config.RateLimitKeys[i]) {
+			return nil, errors.New("RATE_LIMIT_KEYS must be a list of " + strings.Join(ratelimit.Keys, ", "))
+		}
+	}
+	rateLimits, err := ratelimit.ParseLimits(getEnvAsStringSlice("RATE_LIMITS", []string{}), ratelimit.DefaultLimits)
+	if err != nil {
+		return nil, err
+	}
+	config.RateLimits = rateLimits
 
 	return config, nil
 }
 
+// validateIssuer an issuer given as a URL must be usable as an OpenID Connect issuer, an https URL without a query
+// or fragment. http is accepted for local development
+func validateIssuer(issuer string) error {
+	if !strings.Contains(issuer, "://") {
+		return nil
+	}
+	parsed, err := url.Parse(issuer)
+	if err != nil {
+		return fmt.Errorf("ISSUER is not a valid URL: %w", err)
+	}
+	if (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" || parsed.RawQuery != "" ||
+		parsed.Fragment != "" {
+		return errors.New("ISSUER must be an https URL without a query or fragment")
+	}
+	return nil
+}
+
+// parseTrustedProxies each proxy is an IP or a CIDR range
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if proxy == "" {
+			continue
+		}
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ranges = append(ranges, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipRange, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTED_PROXIES %s is not an IP or CIDR range", proxy)
+		}
+		ranges = append(ranges, ipRange)
+	}
+	return ranges, nil
+}
+
 func getEnv(key, defaultValue string) string {
 	value, exists := os.LookupEnv(key)
 	if !exists {
@@ -2,26 +2,39 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	accountsapi "github.com/latebit-io/bulwarkauth/api/accounts"
 	authenticationapi "github.com/latebit-io/bulwarkauth/api/authentication"
+	clientsapi "github.com/latebit-io/bulwarkauth/api/clients"
 	domainapi "github.com/latebit-io/bulwarkauth/api/domain"
 	"github.com/latebit-io/bulwarkauth/api/health"
+	oauthapi "github.com/latebit-io/bulwarkauth/api/oauth"
+	ratelimitapi "github.com/latebit-io/bulwarkauth/api/ratelimit"
+	"github.com/latebit-io/bulwarkauth/api/wellknown"
 	"github.com/latebit-io/bulwarkauth/internal/accounts"
 	"github.com/latebit-io/bulwarkauth/internal/authentication"
 	"github.com/latebit-io/bulwarkauth/internal/authentication/social"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
 	"github.com/latebit-io/bulwarkauth/internal/domain"
 	"github.com/latebit-io/bulwarkauth/internal/email"
 	"github.com/latebit-io/bulwarkauth/internal/encryption"
+	"github.com/latebit-io/bulwarkauth/internal/oauth"
+	"github.com/latebit-io/bulwarkauth/internal/ratelimit"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
 	"github.com/latebit-io/bulwarkauth/internal/utils"
 	"github.com/latebit-io/bulwarkauth/internal/version"
@@ -31,6 +44,7 @@ import (
 
 func main() {
 	versionFlag := flag.Bool("version", false, "Print version information and exit")
+	rewrapFlag := flag.Bool("rewrap-signing-keys", false, "Re-wrap signing private keys with the current key-encryption key and exit")
 	flag.Parse()
 
 	// If the version flag is passed, print the version and exit
@@ -57,6 +71,8 @@ func main() {
 
 	service := echo.New()
 	service.HideBanner = true
+	service.IPExtractor = ipExtractor(config.TrustedProxies)
+	service.Use(authenticationapi.ClientIp)
 	logger.Info("connecting to mongodb: ", "uri", config.DbConnection, "db", config.DbNameSeed)
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(config.DbConnection))
 	if err != nil {
@@ -71,17 +87,44 @@ func main() {
 
 	mongodb := client.Database("bulwarkauth" + config.DbNameSeed)
 	mongodbTxManager := utils.NewMongoTxManager(client)
-	encrypt := encryption.NewDefaultEncryption()
+	encrypt, err := passwordEncryption(config)
+	if err != nil {
+		panic(err)
+	}
 	accountsRepo := accounts.NewMongodbAccountRepository(mongodb, encrypt)
+	migrateAccountIds(accountsRepo, logger)
 	forgotRepo := accounts.NewMongoDbForgotRepository(mongodb)
-	signingRepo := tokens.NewDefaultSigningKeyRepository(mongodb)
-	signingService := tokens.NewDefaultSigningKeyService(signingRepo)
+	keyEncryption, err := loadKeyEncryption(config.SigningKeyKek, config.SigningKeyKekFile)
+	if err != nil {
+		panic(err)
+	}
+	previousKeyEncryption, err := loadKeyEncryption(config.SigningKeyPreviousKek, config.SigningKeyPreviousKekFile)
+	if err != nil {
+		panic(err)
+	}
+	signingRepo := tokens.NewDefaultSigningKeyRepository(mongodb, keyEncryption, previousKeyEncryption)
+	if *rewrapFlag {
+		rewrapSigningKeys(signingRepo, logger)
+		return
+	}
+	signingService := tokens.NewDefaultSigningKeyService(signingRepo, config.SigningAlgorithm, config.SeparateSigningKeys)
 	err = signingService.Initialize(context.Background())
 	if err != nil {
 		panic(err)
 	}
-	tokenizer := tokens.NewDefaultTokenizer("bulwark-auth", "bulwark-auth", config.Domain,
+	keyRotationSetting(signingRepo, config, logger)
+	tokenizer := tokens.NewDefaultTokenizer("bulwark-auth", config.Issuer, config.TokenAudiences,
 		config.RefreshTokenExpireInSeconds, config.AccessTokenExpireInSeconds, signingService)
+	claimsProvider, err := accounts.NewAccountClaimsProvider(accountsRepo, config.TokenClaims)
+	if err != nil {
+		panic(err)
+	}
+	tokenizer.AddClaimsProvider(claimsProvider)
+	if config.AcceptUntypedTokens {
+		// every token issued before the upgrade has expired after the longest token lifetime
+		tokenizer.AcceptUntypedUntil(time.Now().Add(maxTokenLifetime(config)))
+	}
+	go tokenizer.WatchKeys(context.Background(), signingRepo, time.Duration(config.KeyPollInSeconds)*time.Second)
 	emailRepo := email.NewMongoDbEmailRepository(mongodb)
 	emailService := email.NewDefaultEmailService(config.EmailSmtpUser, config.EmailSmtpPass,
 		config.EmailSmtpHost, config.EmailSmtpPort, config.Domain, config.EmailTemplatesDir, config.Domain, emailRepo, email.EmailOptions{
@@ -96,25 +139,83 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	accountsService := accounts.NewDefaultAccountService(accountsRepo, forgotRepo, tokenizer, emailService, mongodbTxManager)
+	revocationRepo := tokens.NewDefaultRevocationRepository(mongodb)
+	revocationService := tokens.NewDefaultRevocationService(revocationRepo, maxTokenLifetime(config),
+		time.Duration(config.RevocationCacheInSeconds)*time.Second)
+	passwordPolicy, err := newPasswordPolicy(config, logger)
+	if err != nil {
+		panic(err)
+	}
+	tokenRepo := authentication.NewDefaultTokenRepository(mongodb)
+	accountsService := accounts.NewDefaultAccountService(accountsRepo, forgotRepo, tokenizer, emailService, mongodbTxManager,
+		revocationService, tokenRepo, passwordPolicy)
 	accountHandlers := accountsapi.NewAccountHandler(accountsService)
 	accountsapi.AccountRoutes(service, accountHandlers)
-	tokenRepo := authentication.NewDefaultTokenRepository(mongodb)
-	authenticationService := authentication.NewDefaultAuthenticationService(accountsRepo, tokenRepo, tokenizer)
+	clientRepo := clients.NewMongodbClientRepository(mongodb)
+	clientService := clients.NewDefaultClientService(clientRepo, config.AccessTokenExpireInSeconds,
+		config.RefreshTokenExpireInSeconds)
+	seedClients(clientService, config, logger)
+	clientHandlers := clientsapi.NewClientHandlers(clientService)
+	loginAttemptRepo := authentication.NewMongodbLoginAttemptRepository(mongodb)
+	lockoutService := authentication.NewDefaultLockoutService(loginAttemptRepo, accountsRepo, emailService,
+		authentication.LockoutOptions{
+			FreeAttempts:  config.LockoutFreeAttempts,
+			Backoff:       time.Duration(config.LockoutBackoffInSeconds) * time.Second,
+			MaxFailures:   config.LockoutMaxFailures,
+			IpMaxFailures: config.LockoutIpMaxFailures,
+			Duration:      time.Duration(config.LockoutDurationInSeconds) * time.Second,
+		})
+	lockoutHandlers := authenticationapi.NewLockoutHandlers(lockoutService)
+	adminSetting(service, clientHandlers, lockoutHandlers, config, logger)
+	mfaKeyEncryption, err := loadKeyEncryption(config.MfaKek, config.MfaKekFile)
+	if err != nil {
+		panic(err)
+	}
+	mfaChallengeRepo := authentication.NewMongodbMfaChallengeRepository(mongodb)
+	mfaService := authentication.NewDefaultMfaService(accountsRepo, mfaChallengeRepo, tokenizer, revocationService,
+		clientService, lockoutService, mfaKeyEncryption, authentication.MfaOptions{
+			Issuer:             config.WebsiteName,
+			ChallengeExpiresIn: time.Duration(config.MfaChallengeExpireInSeconds) * time.Second,
+		})
+	authenticationapi.MfaRoutes(service, authenticationapi.NewMfaHandlers(mfaService))
+	refreshTokenRepo := authentication.NewDefaultRefreshTokenRepository(mongodb)
+	authenticationService := authentication.NewDefaultAuthenticationService(accountsRepo, tokenRepo, tokenizer,
+		refreshTokenRepo, revocationService, clientService, lockoutService, mfaService)
 	authenticationHandler := authenticationapi.NewAuthenticationHandler(authenticationService)
 	authenticationapi.AuthenticationRoutes(service, authenticationHandler)
 	logonRepo := authentication.NewDefaultLogonCodeRepository(mongodb)
-	logonService := authentication.NewDefaultLogonService(logonRepo, accountsRepo, emailService, tokenizer, encrypt)
+	logonService := authentication.NewDefaultLogonService(logonRepo, accountsRepo, emailService, tokenizer, encrypt,
+		clientService, lockoutService, mfaService)
 	logonCodeHandlers := authenticationapi.NewLogonCodeHandlers(logonService)
 	authenticationapi.LogonRoutes(service, logonCodeHandlers)
 	google, err := social.NewGoogleValidator(config.GoogleClientId)
 	if err != nil {
 		panic(err)
 	}
-	socialService := social.NewDefaultSocialService(accountsRepo, accountsService, encrypt, tokenizer)
+	socialService := social.NewDefaultSocialService(accountsRepo, accountsService, encrypt, tokenizer, clientService,
+		mfaService)
 	socialService.AddValidator(google)
 	socialHandlers := authenticationapi.NewSocialHandlers(socialService)
 	authenticationapi.SocialRoutes(service, socialHandlers)
+	introspectionService := oauth.NewDefaultIntrospectionService(tokenizer, tokenRepo, revocationService,
+		refreshTokenRepo)
+	authorizationCodeRepo := oauth.NewMongodbAuthorizationCodeRepository(mongodb)
+	deviceCodeRepo := oauth.NewMongodbDeviceCodeRepository(mongodb)
+	authorizationService := oauth.NewDefaultAuthorizationService(clientService, authenticationService, tokenizer,
+		authorizationCodeRepo, deviceCodeRepo, oauth.AuthorizationOptions{
+			CodeExpiresIn:       time.Duration(config.AuthorizationCodeExpireInSeconds) * time.Second,
+			DeviceCodeExpiresIn: time.Duration(config.DeviceCodeExpireInSeconds) * time.Second,
+			DevicePollInterval:  time.Duration(config.DeviceCodeIntervalInSeconds) * time.Second,
+			AccessTokenExpInSec: config.AccessTokenExpireInSeconds,
+		})
+	tokenExchangeService := oauth.NewDefaultTokenExchangeService(introspectionService, tokenizer,
+		config.AccessTokenExpireInSeconds)
+	authorizationService.AddGrant(clients.GrantTypeTokenExchange, tokenExchangeService.Exchange)
+	oauthHandlers := oauthapi.NewOAuthHandlers(introspectionService, authorizationService, authorizationService,
+		clientService, tokenizer.Issuer)
+	oauthapi.OAuthRoutes(service, oauthHandlers)
+	wellKnownHandlers := wellknown.NewWellKnownHandlers(signingService, tokenizer.Issuer, config.JwksCacheMaxAgeInSeconds)
+	wellknown.WellKnownRoutes(service, wellKnownHandlers)
 
 	if config.DomainVerify {
 		domainRepo := domain.NewDefaultDomainRepository(mongodb)
@@ -134,8 +235,9 @@ func main() {
 
 		domainapi.DomainRoutes(service, domainHandlers)
 	}
-	corsSetting(service, config, logger)
+	corsSetting(service, config, clientService, logger)
 	apiKeySetting(service, config, logger)
+	rateLimitSetting(service, mongodb, config, logger)
 
 	healthHandler := health.NewHealthHandler()
 	health.HealthRoutes(service, healthHandler)
@@ -151,26 +253,216 @@ func getLogger() *slog.Logger {
 	return logger
 }
 
-func corsSetting(service *echo.Echo, config *AppConfig, logger *slog.Logger) {
+// loadKeyEncryption the key-encryption key can be given directly or as a path to a mounted secret
+func loadKeyEncryption(value, file string) (*encryption.KeyEncryption, error) {
+	if file != "" {
+		return encryption.NewKeyEncryptionFromFile(file)
+	}
+	if value != "" {
+		return encryption.NewKeyEncryptionFromBase64(value)
+	}
+	return nil, nil
+}
+
+// passwordEncryption the peppers can be given directly or as a path to a mounted secret, both base64 encoded
+func passwordEncryption(config *AppConfig) (*encryption.DefaultEncryption, error) {
+	pepper, err := loadPepper(config.PasswordPepper, config.PasswordPepperFile)
+	if err != nil {
+		return nil, err
+	}
+	previousPepper, err := loadPepper(config.PasswordPreviousPepper, config.PasswordPreviousPepperFile)
+	if err != nil {
+		return nil, err
+	}
+	return encryption.NewDefaultEncryptionWithOptions(encryption.HashOptions{
+		Scheme: config.PasswordHash,
+		Argon2id: encryption.Argon2idParams{
+			Memory:      uint32(config.Argon2MemoryKib),
+			Iterations:  uint32(config.Argon2Iterations),
+			Parallelism: uint8(config.Argon2Parallelism),
+		},
+		Scrypt:         encryption.ScryptParams{CostLog2: config.ScryptCostLog2},
+		BcryptCost:     config.BcryptCost,
+		Pepper:         pepper,
+		PreviousPepper: previousPepper,
+	})
+}
+
+// loadPepper the file takes precedence, no pepper is configured when neither is set
+func loadPepper(value, file string) ([]byte, error) {
+	if file != "" {
+		contents, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		value = string(contents)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("password pepper is not valid base64: %w", err)
+	}
+	return decoded, nil
+}
+
+// ipExtractor without trusted proxies the client IP is the connection address and forwarding headers are ignored.
+// Behind proxies it is the first address of X-Forwarded-For, read from the right, that is not a trusted proxy
+func ipExtractor(trustedProxies []*net.IPNet) echo.IPExtractor {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	options := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, ipRange := range trustedProxies {
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+	return echo.ExtractIPFromXFFHeader(options...)
+}
+
+// newPasswordPolicy the breached password file is opened at start up and searched on disk
+func newPasswordPolicy(config *AppConfig, logger *slog.Logger) (*accounts.DefaultPasswordPolicy, error) {
+	var breached *accounts.BreachedPasswords
+	if config.PasswordBreachedFile != "" {
+		var err error
+		breached, err = accounts.LoadBreachedPasswords(config.PasswordBreachedFile)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("breached passwords opened", "bytes", breached.Size())
+	}
+	return accounts.NewDefaultPasswordPolicy(accounts.PasswordPolicyOptions{
+		MinLength:        config.PasswordMinLength,
+		MaxLength:        config.PasswordMaxLength,
+		CharacterClasses: config.PasswordCharacterClasses,
+		BannedWords:      config.PasswordBannedWords,
+		SiteName:         config.WebsiteName,
+		Breached:         breached,
+	}), nil
+}
+
+func rewrapSigningKeys(signingRepo *tokens.DefaultSigningKeyRepository, logger *slog.Logger) {
+	changed, err := signingRepo.Rewrap(context.Background())
+	if err != nil {
+		logger.Error("re-wrapping signing keys failed", "rewrapped", changed, "error", err.Error())
+		return
+	}
+	logger.Info("signing keys re-wrapped", "rewrapped", changed)
+}
+
+// migrateAccountIds accounts created before tokens were issued to account ids get one before the service starts
+func migrateAccountIds(accountsRepo *accounts.MongodbAccountRepository, logger *slog.Logger) {
+	migrated, err := accountsRepo.MigrateAccountIds(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	if migrated > 0 {
+		logger.Info("account ids migrated", "migrated", migrated)
+	}
+}
+
+// seedClients registers the client ids applications sent before clients had to be registered
+func seedClients(clientService *clients.DefaultClientService, config *AppConfig, logger *slog.Logger) {
+	seeded, err := clientService.Seed(context.Background(), config.ClientIds)
+	if err != nil {
+		panic(err)
+	}
+	if seeded > 0 {
+		logger.Info("clients registered", "registered", seeded)
+	}
+}
+
+func keyRotationSetting(signingRepo tokens.SigningKeyRepository, config *AppConfig, logger *slog.Logger) {
+	if config.KeyRotationInSeconds <= 0 {
+		return
+	}
+	rotator := tokens.NewSigningKeyRotator(signingRepo, tokens.RotationPolicy{
+		Interval:         time.Duration(config.KeyRotationInSeconds) * time.Second,
+		PendingPeriod:    time.Duration(config.KeyPendingInSeconds) * time.Second,
+		MaxTokenLifetime: maxTokenLifetime(config),
+		Algorithm:        config.SigningAlgorithm,
+		SeparateKeys:     config.SeparateSigningKeys,
+	})
+	go rotator.Start(context.Background(), time.Minute)
+	logger.Info("signing key rotation enabled", "interval", config.KeyRotationInSeconds)
+}
+
+// maxTokenLifetime the longest any issued token can stay valid
+func maxTokenLifetime(config *AppConfig) time.Duration {
+	return time.Duration(max(config.AccessTokenExpireInSeconds, config.RefreshTokenExpireInSeconds)) * time.Second
+}
+
+// corsSetting origins are allowed when configured or when a registered client allows them
+func corsSetting(service *echo.Echo, config *AppConfig, clientService clients.ClientService, logger *slog.Logger) {
 	if !config.CORSEnabled {
 		return
 	}
 	config.AllowedOrigins = append(config.AllowedOrigins, fmt.Sprintf("https://%s", config.Domain))
 
 	service.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: config.AllowedOrigins,
+		AllowOriginFunc: func(origin string) (bool, error) {
+			if slices.Contains(config.AllowedOrigins, origin) {
+				return true, nil
+			}
+			return clientService.AllowedOrigin(context.Background(), origin)
+		},
 		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
 	}))
 
 	logger.Info("cors enabled")
 }
 
+// adminSetting the admin endpoints are only registered when an admin key is configured
+func adminSetting(service *echo.Echo, clientHandlers *clientsapi.ClientHandlers,
+	lockoutHandlers *authenticationapi.LockoutHandlers, config *AppConfig, logger *slog.Logger) {
+	if config.AdminApiKey == "" {
+		return
+	}
+	adminKey := middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
+		KeyLookup: "header:X-BULWARK-ADMIN-KEY",
+		Validator: func(key string, c echo.Context) (bool, error) {
+			return subtle.ConstantTimeCompare([]byte(key), []byte(config.AdminApiKey)) == 1, nil
+		},
+	})
+	clientsapi.ClientRoutes(service, clientHandlers, adminKey)
+	authenticationapi.LockoutRoutes(service, lockoutHandlers, adminKey)
+	logger.Info("admin api enabled")
+}
+
+// rateLimitSetting the mongodb store shares the limits across replicas, the memory store limits each on its own
+func rateLimitSetting(service *echo.Echo, mongodb *mongo.Database, config *AppConfig, logger *slog.Logger) {
+	if !config.RateLimitEnabled {
+		return
+	}
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter()
+	if config.RateLimitStore == ratelimit.StoreMongodb {
+		limiter = ratelimit.NewMongodbLimiter(mongodb)
+	}
+	service.Use(ratelimitapi.RateLimit(limiter, config.RateLimits, config.RateLimitKeys,
+		service.IPExtractor))
+	logger.Info("rate limiting enabled", "store", config.RateLimitStore, "routes", len(config.RateLimits))
+}
+
+// publicPaths are served without the api key. Browsers are sent to the authorization endpoint and the device
+// verification page and standard OpenID Connect clients and devices can not add the header, the oauth endpoints
+// authenticate the client themselves
+var publicPaths = []string{
+	"/.well-known/openid-configuration",
+	"/.well-known/jwks.json",
+	"/userinfo",
+	"/oauth/authorize",
+	"/oauth/token",
+	"/oauth/introspect",
+	"/oauth/device_authorization",
+	"/oauth/device",
+}
+
 func apiKeySetting(service *echo.Echo, config *AppConfig, logger *slog.Logger) {
 	if !config.ApiKeyEnabled {
 		return
 	}
 	service.Use(middleware.KeyAuthWithConfig(middleware.KeyAuthConfig{
 		KeyLookup: "header:X-BULWARK-API-KEY",
+		Skipper: func(c echo.Context) bool {
+			return slices.Contains(publicPaths, c.Path())
+		},
 		Validator: func(key string, c echo.Context) (bool, error) {
 			return key == os.Getenv("API_KEY"), nil
 		},
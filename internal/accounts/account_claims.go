@@ -0,0 +1,122 @@
+package accounts
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Claim sources an AccountClaimsProvider can read, profile and metadata fields are selected with
+// profile.<field> and metadata.<key>
+const (
+	ClaimSourceAccountId     = "account_id"
+	ClaimSourceEmailVerified = "email_verified"
+	ClaimSourceTenant        = "tenant"
+	claimSourceProfile       = "profile."
+	claimSourceMetadata      = "metadata."
+)
+
+// claimMapping a claim and the account field it is read from
+type claimMapping struct {
+	claim  string
+	source string
+}
+
+// AccountClaimsProvider adds claims from the account record and its metadata to access tokens
+type AccountClaimsProvider struct {
+	accountRepository AccountRepository
+	claims            []claimMapping
+}
+
+// NewAccountClaimsProvider claims are written as source or claim=source, without a claim name the claim is named
+// after the source field, for example profile.name becomes name
+func NewAccountClaimsProvider(accountRepository AccountRepository, claims []string) (*AccountClaimsProvider, error) {
+	provider := &AccountClaimsProvider{accountRepository: accountRepository}
+	for _, entry := range claims {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		claim, source, renamed := strings.Cut(entry, "=")
+		if !renamed {
+			source = claim
+			claim = source[strings.LastIndex(source, ".")+1:]
+		}
+
+		switch {
+		case source == ClaimSourceAccountId, source == ClaimSourceEmailVerified, source == ClaimSourceTenant:
+		case strings.HasPrefix(source, claimSourceProfile) && len(source) > len(claimSourceProfile):
+		case strings.HasPrefix(source, claimSourceMetadata) && len(source) > len(claimSourceMetadata):
+		default:
+			return nil, ClaimSourceError{Value: source}
+		}
+
+		provider.claims = append(provider.claims, claimMapping{claim: claim, source: source})
+	}
+
+	return provider, nil
+}
+
+// Claims reads the configured claims from the account, values the account does not have are left out
+func (p *AccountClaimsProvider) Claims(ctx context.Context, subject string) (map[string]interface{}, error) {
+	account, err := p.accountRepository.ReadById(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{}, len(p.claims))
+	for _, mapping := range p.claims {
+		value, ok := claimValue(account, mapping.source)
+		if ok {
+			claims[mapping.claim] = value
+		}
+	}
+
+	return claims, nil
+}
+
+func claimValue(account *Account, source string) (interface{}, bool) {
+	switch {
+	case source == ClaimSourceAccountId:
+		return account.AccountId, account.AccountId != ""
+	case source == ClaimSourceEmailVerified:
+		return account.IsVerified, true
+	case source == ClaimSourceTenant:
+		return account.Tenant, account.Tenant != ""
+	case strings.HasPrefix(source, claimSourceProfile):
+		value, ok := account.Profile[strings.TrimPrefix(source, claimSourceProfile)]
+		return claimJSON(value), ok
+	default:
+		value, ok := account.Metadata[strings.TrimPrefix(source, claimSourceMetadata)]
+		return claimJSON(value), ok
+	}
+}
+
+// claimJSON nested documents and arrays are decoded from mongodb as bson types, they are converted to maps and
+// slices so they are written to the token as plain JSON
+func claimJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case primitive.D:
+		m := make(map[string]interface{}, len(v))
+		for _, e := range v {
+			m[e.Key] = claimJSON(e.Value)
+		}
+		return m
+	case primitive.M:
+		m := make(map[string]interface{}, len(v))
+		for key, e := range v {
+			m[key] = claimJSON(e)
+		}
+		return m
+	case primitive.A:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = claimJSON(e)
+		}
+		return a
+	default:
+		return value
+	}
+}
@@ -0,0 +1,59 @@
+package accounts
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type claimsAccountRepository struct {
+	AccountRepository
+	account *Account
+}
+
+func (r claimsAccountRepository) ReadById(ctx context.Context, accountId string) (*Account, error) {
+	return r.account, nil
+}
+
+func TestAccountClaimsProvider_Claims(t *testing.T) {
+	account := &Account{
+		AccountId:  "6f1c2a9e-3b7d-4c41-9a57-2f0e8d4b1c73",
+		Email:      "test@latebit.io",
+		IsVerified: true,
+		Tenant:     "acme",
+		Profile:    map[string]interface{}{"name": "Test"},
+		Metadata: map[string]interface{}{
+			"plan":   "pro",
+			"limits": primitive.D{{Key: "seats", Value: int32(5)}},
+		},
+	}
+	provider, err := NewAccountClaimsProvider(claimsAccountRepository{account: account}, []string{
+		"account_id", "email_verified", "tenant", "profile.name", "tier=metadata.plan", "metadata.limits",
+		"metadata.missing",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.Claims(context.TODO(), account.AccountId)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"account_id":     account.AccountId,
+		"email_verified": true,
+		"tenant":         "acme",
+		"name":           "Test",
+		"tier":           "pro",
+		"limits":         map[string]interface{}{"seats": int32(5)},
+	}, claims)
+}
+
+func TestNewAccountClaimsProvider_UnknownSource(t *testing.T) {
+	_, err := NewAccountClaimsProvider(claimsAccountRepository{}, []string{"password"})
+	var sourceErr ClaimSourceError
+	assert.ErrorAs(t, err, &sourceErr)
+
+	_, err = NewAccountClaimsProvider(claimsAccountRepository{}, []string{"profile."})
+	assert.ErrorAs(t, err, &sourceErr)
+}
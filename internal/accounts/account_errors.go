@@ -1,6 +1,9 @@
 package accounts
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type AccountDuplicateError struct {
 	Value string `json:"value"`
@@ -47,3 +50,25 @@ type AccountDisabledError struct {
 func (e AccountDisabledError) Error() string {
 	return fmt.Sprintf("account: '%s' is disabled", e.Value)
 }
+
+type ClaimSourceError struct {
+	Value string `json:"value"`
+}
+
+func (e ClaimSourceError) Error() string {
+	return fmt.Sprintf("unknown claim source: %s", e.Value)
+}
+
+// PasswordPolicyError the password failed one or more rules of the password policy. It does not name the account,
+// the message is logged and returned to callers
+type PasswordPolicyError struct {
+	Violations []PasswordViolation `json:"violations"`
+}
+
+func (e PasswordPolicyError) Error() string {
+	details := make([]string, len(e.Violations))
+	for i, violation := range e.Violations {
+		details[i] = violation.Detail
+	}
+	return "password does not meet the policy: " + strings.Join(details, ", ")
+}
@@ -12,7 +12,6 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // AccountRepository this is not a typical repository pattern, the functions are intentionally more granular
@@ -21,11 +20,14 @@ import (
 type AccountRepository interface {
 	Create(ctx context.Context, email, password string) error
 	Read(ctx context.Context, email string) (*Account, error)
+	ReadById(ctx context.Context, accountId string) (*Account, error)
 	Delete(ctx context.Context, email string) error
 	UpdateEmail(ctx context.Context, email, newEmail string) (*Verification, error)
 	UpdatePassword(ctx context.Context, email, newPassword string) error
 	PasswordMatches(ctx context.Context, email, password string) (bool, error)
 	LinkSocial(ctx context.Context, email string, provider SocialProvider) error
+	UpdateTotp(ctx context.Context, email string, totp *Totp) error
+	UseTotp(ctx context.Context, email string, counter int64, confirm bool) (bool, error)
 	Verify(ctx context.Context, email string) error
 }
 
@@ -42,9 +44,16 @@ type MongodbAccountRepository struct {
 // NewMongodbAccountRepository returns a MongodbAccountRepository
 func NewMongodbAccountRepository(db *mongo.Database, encryption encryption.Encryption) *MongodbAccountRepository {
 	collection := db.Collection(accountCollection)
-	_, err := collection.Indexes().CreateOne(context.Background(), mongo.IndexModel{
-		Keys:    bson.D{{Key: "email", Value: 1}},
-		Options: options.Index().SetUnique(true),
+	// accounts created before account ids were introduced have none until they are migrated
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "accountId", Value: 1}},
+			Options: options.Index().SetUnique(true).SetSparse(true),
+		},
 	})
 	if err != nil {
 		log.Fatal(err)
@@ -71,6 +80,7 @@ func (a MongodbAccountRepository) Create(ctx context.Context, email, password st
 	}
 
 	collection := a.db.Collection(accountCollection)
+	accountId := uuid.New()
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		return err
@@ -82,6 +92,7 @@ func (a MongodbAccountRepository) Create(ctx context.Context, email, password st
 	}
 	_, err = collection.InsertOne(ctx,
 		bson.D{
+			{Key: "accountId", Value: accountId.String()},
 			{Key: "email", Value: email},
 			{Key: "password", Value: hashed},
 			{Key: "isVerified", Value: false},
@@ -119,6 +130,50 @@ func (a MongodbAccountRepository) Read(ctx context.Context, email string) (*Acco
 	return &account, nil
 }
 
+// ReadById will retrieve an account by its account id
+func (a MongodbAccountRepository) ReadById(ctx context.Context, accountId string) (*Account, error) {
+	collection := a.db.Collection(accountCollection)
+	result := collection.FindOne(ctx, bson.D{{Key: "accountId", Value: accountId}})
+	var account Account
+	err := result.Decode(&account)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, AccountNotFoundError{Value: accountId}
+		}
+		return nil, err
+	}
+	return &account, nil
+}
+
+// MigrateAccountIds gives every account created before account ids were introduced an id, it is safe to run
+// repeatedly and on several replicas at once and returns how many accounts were changed
+func (a MongodbAccountRepository) MigrateAccountIds(ctx context.Context) (int, error) {
+	collection := a.db.Collection(accountCollection)
+	missing := bson.D{{Key: "accountId", Value: bson.D{{Key: "$exists", Value: false}}}}
+	cursor, err := collection.Find(ctx, missing, options.Find().SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	var accounts []bson.M
+	if err = cursor.All(ctx, &accounts); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, account := range accounts {
+		filter := append(bson.D{{Key: "_id", Value: account["_id"]}}, missing...)
+		result, err := collection.UpdateOne(ctx, filter, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "accountId", Value: uuid.New().String()},
+		}}})
+		if err != nil {
+			return migrated, err
+		}
+		migrated += int(result.ModifiedCount)
+	}
+
+	return migrated, nil
+}
+
 // Delete will soft delete the account by marking it as deleted
 func (a MongodbAccountRepository) Delete(ctx context.Context, email string) error {
 	collection := a.db.Collection(accountCollection)
@@ -186,7 +241,8 @@ func (a MongodbAccountRepository) Verify(ctx context.Context, email string) erro
 	return nil
 }
 
-// PasswordMatches check if the password is correct
+// PasswordMatches check if the password is correct, the hash is upgraded when it no longer matches the configured
+// hashing
 func (a MongodbAccountRepository) PasswordMatches(ctx context.Context, email, password string) (bool, error) {
 	collection := a.db.Collection(accountCollection)
 	result := collection.FindOne(ctx, bson.D{{Key: "email", Value: email}})
@@ -200,14 +256,35 @@ func (a MongodbAccountRepository) PasswordMatches(ctx context.Context, email, pa
 		return false, err
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(r["password"].(string)), []byte(password))
-	if err != nil {
+	hash, ok := r["password"].(string)
+	if !ok {
+		return false, nil
+	}
+	matches, err := a.encryption.Verify(hash, password)
+	if err != nil || !matches {
 		return false, err
 	}
 
+	if a.encryption.NeedsRehash(hash) {
+		a.rehashPassword(ctx, email, hash, password)
+	}
 	return true, nil
 }
 
+// rehashPassword replaces a hash made with an older scheme or weaker parameters, it only succeeds when the password
+// was not changed since it was verified. A failure is logged, the old hash still works
+func (a MongodbAccountRepository) rehashPassword(ctx context.Context, email, hash, password string) {
+	rehashed, err := a.encryption.Encrypt(password)
+	if err == nil {
+		collection := a.db.Collection(accountCollection)
+		_, err = collection.UpdateOne(ctx, bson.D{{Key: "email", Value: email}, {Key: "password", Value: hash}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "password", Value: rehashed}}}})
+	}
+	if err != nil {
+		log.Println("rehashing password failed:", err)
+	}
+}
+
 func (a MongodbAccountRepository) LinkSocial(ctx context.Context, email string, provider SocialProvider) error {
 	collection := a.db.Collection(accountCollection)
 	result, err := collection.UpdateOne(ctx, bson.D{{Key: "email", Value: email}}, bson.D{{Key: "$push", Value: bson.D{{Key: "socialProviders", Value: provider}}}})
@@ -219,3 +296,41 @@ func (a MongodbAccountRepository) LinkSocial(ctx context.Context, email string,
 	}
 	return nil
 }
+
+// UpdateTotp replaces the second factor of the account, nil removes it
+func (a MongodbAccountRepository) UpdateTotp(ctx context.Context, email string, totp *Totp) error {
+	collection := a.db.Collection(accountCollection)
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "totp", Value: totp}, {Key: "modified", Value: time.Now()}}}}
+	if totp == nil {
+		update = bson.D{
+			{Key: "$unset", Value: bson.D{{Key: "totp", Value: ""}}},
+			{Key: "$set", Value: bson.D{{Key: "modified", Value: time.Now()}}},
+		}
+	}
+	result, err := collection.UpdateOne(ctx, bson.D{{Key: "email", Value: email}}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return AccountNotFoundError{Value: email}
+	}
+	return nil
+}
+
+// UseTotp records the time step of an accepted code, false when a code of the same or a later time step was already
+// used. Confirm marks the second factor as confirmed
+func (a MongodbAccountRepository) UseTotp(ctx context.Context, email string, counter int64, confirm bool) (bool, error) {
+	collection := a.db.Collection(accountCollection)
+	set := bson.D{{Key: "totp.counter", Value: counter}}
+	if confirm {
+		set = append(set, bson.E{Key: "totp.confirmed", Value: true}, bson.E{Key: "modified", Value: time.Now()})
+	}
+	result, err := collection.UpdateOne(ctx, bson.D{
+		{Key: "email", Value: email},
+		{Key: "totp.counter", Value: bson.D{{Key: "$lt", Value: counter}}},
+	}, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		return false, err
+	}
+	return result.MatchedCount == 1, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -12,6 +13,7 @@ import (
 // AccountService contract for all account related actions
 type AccountService interface {
 	Create(ctx context.Context, email string, password string) error
+	CreateSocial(ctx context.Context, email string) error
 	Verify(ctx context.Context, email string, verificationCode string) error
 	Resend(ctx context.Context, email string) error
 	UpdateEmail(ctx context.Context, email string, accessToken string) error
@@ -19,6 +21,7 @@ type AccountService interface {
 	UpdatePassword(ctx context.Context, email, newPassword, accessToken string) error
 	Forgot(ctx context.Context, email string) error
 	ForgotPassword(ctx context.Context, email, newPassword, forgotToken string) error
+	UserInfo(ctx context.Context, accessToken string) (*UserInfo, error)
 }
 
 type EmailService interface {
@@ -31,20 +34,55 @@ type TxManager interface {
 	WithTransaction(ctx context.Context, fn func(ctx mongo.SessionContext) error) error
 }
 
+// SessionRepository moves the sessions acknowledged for an account when its email changes
+type SessionRepository interface {
+	UpdateEmail(ctx context.Context, email, newEmail string) error
+}
+
 type Tokenizer interface {
-	ValidateAccessToken(ctx context.Context, email, tokenString string) (*tokens.AccessTokenClaims, error)
+	ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error)
 }
 
 type Account struct {
-	Email             string           `bson:"email"`
-	IsVerified        bool             `bson:"isVerified"`
-	VerificationToken string           `bson:"verificationToken"`
-	IsEnabled         bool             `bson:"isEnabled"`
-	IsDeleted         bool             `bson:"isDeleted"`
-	SocialProviders   []SocialProvider `bson:"socialProviders"`
-	Roles             []string         `bson:"roles"`
-	Created           time.Time        `bson:"created"`
-	Modified          time.Time        `bson:"modified"`
+	AccountId         string                 `bson:"accountId"`
+	Email             string                 `bson:"email"`
+	IsVerified        bool                   `bson:"isVerified"`
+	VerificationToken string                 `bson:"verificationToken"`
+	IsEnabled         bool                   `bson:"isEnabled"`
+	IsDeleted         bool                   `bson:"isDeleted"`
+	SocialProviders   []SocialProvider       `bson:"socialProviders"`
+	Roles             []string               `bson:"roles"`
+	Tenant            string                 `bson:"tenant,omitempty"`
+	Profile           map[string]interface{} `bson:"profile,omitempty"`
+	Metadata          map[string]interface{} `bson:"metadata,omitempty"`
+	Totp              *Totp                  `bson:"totp,omitempty"`
+	Created           time.Time              `bson:"created"`
+	Modified          time.Time              `bson:"modified"`
+}
+
+// MfaEnabled the account has confirmed a second factor, signing in with a password then needs a code as well
+func (a Account) MfaEnabled() bool {
+	return a.Totp != nil && a.Totp.Confirmed
+}
+
+// Totp a TOTP second factor, the secret is sealed with its own data key which is wrapped by the mfa key-encryption
+// key. Counter is the time step of the last code accepted so every code can only be used once
+type Totp struct {
+	Secret     string    `bson:"secret"`
+	WrappedKey string    `bson:"wrappedKey"`
+	KekId      string    `bson:"kekId"`
+	Confirmed  bool      `bson:"confirmed"`
+	Counter    int64     `bson:"counter"`
+	Created    time.Time `bson:"created"`
+}
+
+// UserInfo OpenID Connect userinfo claims for the account an access token was issued to
+type UserInfo struct {
+	Subject       string   `json:"sub"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Roles         []string `json:"roles,omitempty"`
+	UpdatedAt     int64    `json:"updated_at"`
 }
 
 type SocialProvider struct {
@@ -58,16 +96,25 @@ type DefaultAccountService struct {
 	tokenizer         Tokenizer
 	emailService      EmailService
 	txManager         TxManager
+	revocations       tokens.RevocationService
+	sessions          SessionRepository
+	passwordPolicy    PasswordPolicy
 }
 
+// NewDefaultAccountService new passwords are checked against the password policy when an account is created, the
+// password is changed or reset
 func NewDefaultAccountService(accountRepository AccountRepository, forgotRepository ForgotRepository,
-	tokenizer Tokenizer, emailService EmailService, txManager TxManager) AccountService {
+	tokenizer Tokenizer, emailService EmailService, txManager TxManager, revocations tokens.RevocationService,
+	sessions SessionRepository, passwordPolicy PasswordPolicy) AccountService {
 	return DefaultAccountService{
 		accountRepository: accountRepository,
 		tokenizer:         tokenizer,
 		forgotRepository:  forgotRepository,
 		emailService:      emailService,
 		txManager:         txManager,
+		revocations:       revocations,
+		sessions:          sessions,
+		passwordPolicy:    passwordPolicy,
 	}
 }
 
@@ -96,6 +143,14 @@ func (a DefaultAccountService) ForgotPassword(ctx context.Context, email, newPas
 		return errors.New("cannot change password")
 	}
 
+	account, err := a.accountRepository.Read(ctx, email)
+	if err != nil {
+		return err
+	}
+	if err = a.passwordPolicy.Check(ctx, email, newPassword); err != nil {
+		return err
+	}
+
 	return a.txManager.WithTransaction(ctx, func(txCtx mongo.SessionContext) error {
 		err = a.accountRepository.UpdatePassword(ctx, email, newPassword)
 		if err != nil {
@@ -105,7 +160,7 @@ func (a DefaultAccountService) ForgotPassword(ctx context.Context, email, newPas
 		if err != nil {
 			return err
 		}
-		return nil
+		return a.revocations.RevokeSubject(ctx, account.AccountId)
 	})
 }
 
@@ -132,6 +187,21 @@ func (a DefaultAccountService) Forgot(ctx context.Context, email string) error {
 
 // Create will create a new user if the email is available
 func (a DefaultAccountService) Create(ctx context.Context, email string, password string) error {
+	if email != "" && password != "" {
+		if err := a.passwordPolicy.Check(ctx, email, password); err != nil {
+			return err
+		}
+	}
+	return a.create(ctx, email, password)
+}
+
+// CreateSocial creates an account for a user signing in with a social provider, its password is random and never
+// shown to anyone so the password policy does not apply
+func (a DefaultAccountService) CreateSocial(ctx context.Context, email string) error {
+	return a.create(ctx, email, uuid.New().String())
+}
+
+func (a DefaultAccountService) create(ctx context.Context, email string, password string) error {
 	err := a.accountRepository.Create(ctx, email, password)
 	if err != nil {
 		return err
@@ -159,13 +229,21 @@ func (a DefaultAccountService) Verify(ctx context.Context, email string, verific
 	return a.accountRepository.Verify(ctx, email)
 }
 
-// UpdateEmail updates an accounts email must supply a valid accessToken
+// UpdateEmail changes the email of the account the accessToken was issued to, tokens stay valid because they are
+// issued to the account id and the account's sessions move to the new email so they can still be revoked
 func (a DefaultAccountService) UpdateEmail(ctx context.Context, email string, accessToken string) error {
-	token, err := a.tokenizer.ValidateAccessToken(ctx, email, accessToken)
+	account, err := a.tokenAccount(ctx, accessToken)
 	if err != nil {
 		return err
 	}
-	newVerification, err := a.accountRepository.UpdateEmail(ctx, token.Subject, email)
+	var newVerification *Verification
+	err = a.txManager.WithTransaction(ctx, func(txCtx mongo.SessionContext) error {
+		newVerification, err = a.accountRepository.UpdateEmail(txCtx, account.Email, email)
+		if err != nil {
+			return err
+		}
+		return a.sessions.UpdateEmail(txCtx, account.Email, email)
+	})
 	if err != nil {
 		return err
 	}
@@ -178,21 +256,26 @@ func (a DefaultAccountService) UpdateEmail(ctx context.Context, email string, ac
 	return nil
 }
 
+// UpdatePassword changes the password and revokes every token issued before the change
 func (a DefaultAccountService) UpdatePassword(ctx context.Context, email, newPassword, accessToken string) error {
-	_, err := a.tokenizer.ValidateAccessToken(ctx, email, accessToken)
+	account, err := a.emailAccount(ctx, email, accessToken)
 	if err != nil {
 		return err
 	}
+	if err = a.passwordPolicy.Check(ctx, email, newPassword); err != nil {
+		return err
+	}
 
 	if err = a.accountRepository.UpdatePassword(ctx, email, newPassword); err != nil {
 		return err
 	}
 
-	return nil
+	return a.revocations.RevokeSubject(ctx, account.AccountId)
 }
 
+// Delete soft deletes the account and revokes every token issued to it
 func (a DefaultAccountService) Delete(ctx context.Context, email string, accessToken string) error {
-	_, err := a.tokenizer.ValidateAccessToken(ctx, email, accessToken)
+	account, err := a.emailAccount(ctx, email, accessToken)
 	if err != nil {
 		return err
 	}
@@ -202,5 +285,71 @@ func (a DefaultAccountService) Delete(ctx context.Context, email string, accessT
 		return err
 	}
 
+	return a.revocations.RevokeSubject(ctx, account.AccountId)
+}
+
+// UserInfo returns the claims for the account the bearer access token belongs to
+func (a DefaultAccountService) UserInfo(ctx context.Context, accessToken string) (*UserInfo, error) {
+	account, err := a.tokenAccount(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.IsDeleted {
+		return nil, AccountDeletedError{Value: account.Email}
+	}
+
+	return &UserInfo{
+		Subject:       account.AccountId,
+		Email:         account.Email,
+		EmailVerified: account.IsVerified,
+		Roles:         account.Roles,
+		UpdatedAt:     account.Modified.Unix(),
+	}, nil
+}
+
+// tokenAccount validates the token, rejects it if it has been revoked and reads the account it was issued to. Tokens
+// a client requested for itself have no account, and exchanged tokens are only for the services they were exchanged for
+func (a DefaultAccountService) tokenAccount(ctx context.Context, accessToken string) (*Account, error) {
+	token, err := a.tokenizer.ValidateAccessToken(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.ClientId != "" || token.Act != nil {
+		return nil, errors.New("invalid token")
+	}
+
+	err = a.checkRevoked(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.accountRepository.ReadById(ctx, token.Subject)
+}
+
+// emailAccount reads the account the token was issued to and makes sure it is the account of the email
+func (a DefaultAccountService) emailAccount(ctx context.Context, email, accessToken string) (*Account, error) {
+	account, err := a.tokenAccount(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.Email != email {
+		return nil, errors.New("invalid token")
+	}
+
+	return account, nil
+}
+
+func (a DefaultAccountService) checkRevoked(ctx context.Context, token *tokens.AccessTokenClaims) error {
+	revoked, err := a.revocations.IsRevoked(ctx, token.RegisteredClaims)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return tokens.TokenRevokedError{Value: token.ID}
+	}
+
 	return nil
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"testing"
+	"time"
 
 	"github.com/latebit-io/bulwarkauth/internal/encryption"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
@@ -51,13 +52,15 @@ func TestDefaultAccountService_Create(t *testing.T) {
 	mongodbTxManager := utils.NewMongoTxManager(client)
 	accountRepo := NewMongodbAccountRepository(db, encryption.NewDefaultEncryption())
 	forgotRepo := NewMongoDbForgotRepository(db)
-	signingRepo := tokens.NewDefaultSigningKeyRepository(db)
-	signingService := tokens.NewDefaultSigningKeyService(signingRepo)
-	tokenizer := tokens.NewDefaultTokenizer("test", "test", "test", 3600,
+	signingRepo := tokens.NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := tokens.NewDefaultSigningKeyService(signingRepo, "RS256", false)
+	tokenizer := tokens.NewDefaultTokenizer("test", "test", []string{"test"}, 3600,
 		9600, signingService)
 	mockEmailService := &MockEmailService{}
 	mockEmailService.On("SendVerificationEmail", mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	accountService := NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager)
+	revocations := tokens.NewDefaultRevocationService(tokens.NewDefaultRevocationRepository(db), time.Hour, time.Minute)
+	accountService := NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager, revocations, nil,
+		NewDefaultPasswordPolicy(PasswordPolicyOptions{}))
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -102,13 +105,15 @@ func TestDefaultAccountService_Verification(t *testing.T) {
 	mongodbTxManager := utils.NewMongoTxManager(client)
 	accountRepo := NewMongodbAccountRepository(db, encryption.NewDefaultEncryption())
 	forgotRepo := NewMongoDbForgotRepository(db)
-	signingRepo := tokens.NewDefaultSigningKeyRepository(db)
-	signingService := tokens.NewDefaultSigningKeyService(signingRepo)
-	tokenizer := tokens.NewDefaultTokenizer("test", "test", "test", 3600,
+	signingRepo := tokens.NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := tokens.NewDefaultSigningKeyService(signingRepo, "RS256", false)
+	tokenizer := tokens.NewDefaultTokenizer("test", "test", []string{"test"}, 3600,
 		9600, signingService)
 	mockEmailService := &MockEmailService{}
 	mockEmailService.On("SendVerificationEmail", mock.Anything, mock.Anything, mock.Anything).Return(nil)
-	accountService := NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager)
+	revocations := tokens.NewDefaultRevocationService(tokens.NewDefaultRevocationRepository(db), time.Hour, time.Minute)
+	accountService := NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager, revocations, nil,
+		NewDefaultPasswordPolicy(PasswordPolicyOptions{}))
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
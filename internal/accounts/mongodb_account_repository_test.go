@@ -8,6 +8,7 @@ import (
 	"github.com/latebit-io/bulwarkauth/internal/encryption"
 	"github.com/latebit-io/bulwarkauth/internal/utils"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -99,11 +100,53 @@ func TestUserRepository_ReadAccount(t *testing.T) {
 			assert.Equal(t, tt.expectedErr, err)
 			if err == nil {
 				assert.Equal(t, tt.expectedEmail, account.Email)
+				byId, err := accountsRepo.ReadById(context.TODO(), account.AccountId)
+				assert.Nil(t, err)
+				assert.Equal(t, account.Email, byId.Email)
 			}
 		})
 	}
 }
 
+func TestUserRepository_MigrateAccountIds(t *testing.T) {
+	mongodb := utils.NewMongoTestUtil()
+	mongoServer, err := mongodb.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mongoServer.Stop()
+
+	clientOptions := options.Client().ApplyURI(mongoServer.URI())
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := client.Disconnect(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	db := client.Database("bulwark")
+	accountsRepo := NewMongodbAccountRepository(db, encryption.NewDefaultEncryption())
+	err = accountsRepo.Create(context.TODO(), "test@latebit.io", "password")
+	assert.Nil(t, err)
+	_, err = db.Collection(accountCollection).InsertOne(context.TODO(), bson.D{{Key: "email", Value: "old@latebit.io"}})
+	assert.Nil(t, err)
+
+	migrated, err := accountsRepo.MigrateAccountIds(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, migrated)
+	account, err := accountsRepo.Read(context.TODO(), "old@latebit.io")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, account.AccountId)
+
+	migrated, err = accountsRepo.MigrateAccountIds(context.TODO())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, migrated)
+}
+
 func TestUserRepository_Delete(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -254,3 +297,54 @@ func TestUserRepository_UpdatePassword(t *testing.T) {
 		})
 	}
 }
+
+func TestUserRepository_PasswordMatchesRehash(t *testing.T) {
+	mongodb := utils.NewMongoTestUtil()
+	mongoServer, err := mongodb.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mongoServer.Stop()
+
+	clientOptions := options.Client().ApplyURI(mongoServer.URI())
+	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		err := client.Disconnect(context.TODO())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}()
+
+	db := client.Database("bulwark")
+	bcryptEncryption, err := encryption.NewDefaultEncryptionWithOptions(encryption.HashOptions{
+		Scheme:     encryption.HashBcrypt,
+		BcryptCost: 4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = NewMongodbAccountRepository(db, bcryptEncryption).Create(context.TODO(), "test@latebit.io", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bcrypt hash is replaced by an argon2id hash at the next successful check
+	accountsRepo := NewMongodbAccountRepository(db, encryption.NewDefaultEncryption())
+	match, err := accountsRepo.PasswordMatches(context.TODO(), "test@latebit.io", "wrong")
+	assert.Nil(t, err)
+	assert.False(t, match)
+	match, err = accountsRepo.PasswordMatches(context.TODO(), "test@latebit.io", "password")
+	assert.Nil(t, err)
+	assert.True(t, match)
+
+	var stored bson.M
+	err = db.Collection(accountCollection).FindOne(context.TODO(), bson.D{{Key: "email", Value: "test@latebit.io"}}).Decode(&stored)
+	assert.Nil(t, err)
+	assert.Contains(t, stored["password"], "$argon2id$")
+	match, err = accountsRepo.PasswordMatches(context.TODO(), "test@latebit.io", "password")
+	assert.Nil(t, err)
+	assert.True(t, match)
+}
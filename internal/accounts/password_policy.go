@@ -0,0 +1,291 @@
+package accounts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Password rules, each names the violations it reports
+const (
+	PasswordRuleMinLength        = "min_length"
+	PasswordRuleMaxLength        = "max_length"
+	PasswordRuleCharacterClasses = "character_classes"
+	PasswordRuleBannedWord       = "banned_word"
+	PasswordRuleBreached         = "breached"
+)
+
+// Character classes a policy can require
+const (
+	CharacterClassLower  = "lower"
+	CharacterClassUpper  = "upper"
+	CharacterClassDigit  = "digit"
+	CharacterClassSymbol = "symbol"
+)
+
+// CharacterClasses the character classes a policy can require
+var CharacterClasses = []string{CharacterClassLower, CharacterClassUpper, CharacterClassDigit, CharacterClassSymbol}
+
+// minBannedWordLength shorter words, such as a two letter email local part, would reject too many passwords
+const minBannedWordLength = 3
+
+// PasswordPolicy checks a new password for the account with the email before it is stored
+type PasswordPolicy interface {
+	Check(ctx context.Context, email, password string) error
+}
+
+// PasswordViolation a rule the password failed
+type PasswordViolation struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail"`
+}
+
+// PasswordRule an additional rule, it returns nil when the password passes
+type PasswordRule func(ctx context.Context, email, password string) *PasswordViolation
+
+// PasswordPolicyOptions zero values turn a rule off
+type PasswordPolicyOptions struct {
+	MinLength        int
+	MaxLength        int
+	CharacterClasses []string
+	// BannedWords can not appear anywhere in a password regardless of case, the site name and the local part of the
+	// email are always banned
+	BannedWords []string
+	SiteName    string
+	Breached    *BreachedPasswords
+}
+
+// DefaultPasswordPolicy checks every rule and reports all the violations at once
+type DefaultPasswordPolicy struct {
+	options     PasswordPolicyOptions
+	bannedWords []string
+	rules       []PasswordRule
+}
+
+// NewDefaultPasswordPolicy lengths are counted in characters, not bytes
+func NewDefaultPasswordPolicy(options PasswordPolicyOptions) *DefaultPasswordPolicy {
+	policy := &DefaultPasswordPolicy{options: options}
+	for _, word := range append(slices.Clone(options.BannedWords), strings.Fields(options.SiteName)...) {
+		policy.bannedWords = appendBannedWord(policy.bannedWords, word)
+	}
+	return policy
+}
+
+// AddRule adds a rule that is checked after the configured ones
+func (p *DefaultPasswordPolicy) AddRule(rule PasswordRule) {
+	p.rules = append(p.rules, rule)
+}
+
+// Check returns a PasswordPolicyError listing every violation
+func (p *DefaultPasswordPolicy) Check(ctx context.Context, email, password string) error {
+	var violations []PasswordViolation
+	length := utf8.RuneCountInString(password)
+	if p.options.MinLength > 0 && length < p.options.MinLength {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleMinLength,
+			Detail: fmt.Sprintf("must be at least %d characters", p.options.MinLength)})
+	}
+	if p.options.MaxLength > 0 && length > p.options.MaxLength {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleMaxLength,
+			Detail: fmt.Sprintf("must be at most %d characters", p.options.MaxLength)})
+	}
+
+	if missing := missingCharacterClasses(password, p.options.CharacterClasses); len(missing) > 0 {
+		violations = append(violations, PasswordViolation{Rule: PasswordRuleCharacterClasses,
+			Detail: "must contain a " + strings.Join(missing, ", a ") + " character"})
+	}
+
+	lower := strings.ToLower(password)
+	for _, word := range p.accountBannedWords(email) {
+		if strings.Contains(lower, word) {
+			violations = append(violations, PasswordViolation{Rule: PasswordRuleBannedWord,
+				Detail: fmt.Sprintf("must not contain %q", word)})
+		}
+	}
+
+	if p.options.Breached != nil {
+		breached, err := p.options.Breached.Contains(password)
+		if err != nil {
+			return err
+		}
+		if breached {
+			violations = append(violations, PasswordViolation{Rule: PasswordRuleBreached,
+				Detail: "has appeared in a data breach"})
+		}
+	}
+
+	for _, rule := range p.rules {
+		if violation := rule(ctx, email, password); violation != nil {
+			violations = append(violations, *violation)
+		}
+	}
+
+	if len(violations) > 0 {
+		return PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// accountBannedWords the configured words with the local part of the email, whole and split at punctuation so
+// john.smith bans john and smith as well
+func (p *DefaultPasswordPolicy) accountBannedWords(email string) []string {
+	words := p.bannedWords
+	local, _, _ := strings.Cut(email, "@")
+	words = appendBannedWord(words, local)
+	for _, part := range strings.FieldsFunc(local, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		words = appendBannedWord(words, part)
+	}
+	return words
+}
+
+func appendBannedWord(words []string, word string) []string {
+	word = strings.ToLower(strings.TrimSpace(word))
+	if utf8.RuneCountInString(word) < minBannedWordLength || slices.Contains(words, word) {
+		return words
+	}
+	return append(slices.Clip(words), word)
+}
+
+func missingCharacterClasses(password string, classes []string) []string {
+	var missing []string
+	for _, class := range classes {
+		var matches func(rune) bool
+		switch class {
+		case CharacterClassLower:
+			matches = unicode.IsLower
+		case CharacterClassUpper:
+			matches = unicode.IsUpper
+		case CharacterClassDigit:
+			matches = unicode.IsDigit
+		case CharacterClassSymbol:
+			matches = func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+			}
+		default:
+			continue
+		}
+		if !strings.ContainsFunc(password, matches) {
+			missing = append(missing, class)
+		}
+	}
+	return missing
+}
+
+// BreachedPasswords a file of SHA-1 password hashes sorted by hash, such as the Pwned Passwords list ordered by hash.
+// It is searched on disk, so lists of any size can be used without holding them in memory
+type BreachedPasswords struct {
+	reader io.ReaderAt
+	size   int64
+	closer io.Closer
+}
+
+// LoadBreachedPasswords opens a breached password file, it stays open until Close
+func LoadBreachedPasswords(path string) (*BreachedPasswords, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	breached, err := NewBreachedPasswords(file, info.Size())
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	breached.closer = file
+	return breached, nil
+}
+
+// NewBreachedPasswords reads one hex SHA-1 hash per line in any case, sorted in ascending order. Anything after a
+// colon, such as the count of the Pwned Passwords format, is ignored. Only the first line is checked up front, an
+// unsorted list is not detected and passwords on it may be missed
+func NewBreachedPasswords(reader io.ReaderAt, size int64) (*BreachedPasswords, error) {
+	breached := &BreachedPasswords{reader: reader, size: size}
+	if _, _, _, err := breached.lineAt(0); err != nil {
+		return nil, err
+	}
+	return breached, nil
+}
+
+// Contains the password is on the list, found by a binary search over the byte offsets of the file
+func (b *BreachedPasswords) Contains(password string) (bool, error) {
+	hash := sha1.Sum([]byte(password))
+	low, high := int64(0), b.size
+	for low < high {
+		middle := low + (high-low)/2
+		start, end, lineHash, err := b.lineAt(middle)
+		if err != nil {
+			return false, err
+		}
+		if start >= high || lineHash == nil {
+			high = middle
+			continue
+		}
+		switch bytes.Compare(lineHash, hash[:]) {
+		case 0:
+			return true, nil
+		case -1:
+			low = end
+		default:
+			high = middle
+		}
+	}
+	return false, nil
+}
+
+// Size the size of the list in bytes
+func (b *BreachedPasswords) Size() int64 {
+	return b.size
+}
+
+// Close closes the file of a loaded list
+func (b *BreachedPasswords) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
+
+// lineAt the first line starting at or after the offset, its hash is nil when the list ends before one. A line
+// starts at the beginning of the file or after a newline, so the byte before the offset is read as well
+func (b *BreachedPasswords) lineAt(offset int64) (start, end int64, hash []byte, err error) {
+	start = max(offset-1, 0)
+	reader := bufio.NewReader(io.NewSectionReader(b.reader, start, b.size-start))
+	if offset > 0 {
+		skipped, err := reader.ReadSlice('\n')
+		if err == io.EOF {
+			return b.size, b.size, nil, nil
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		start += int64(len(skipped))
+	}
+	line, err := reader.ReadSlice('\n')
+	if err != nil && err != io.EOF {
+		return 0, 0, nil, err
+	}
+	end = start + int64(len(line))
+	hexHash, _, _ := strings.Cut(strings.TrimSpace(string(line)), ":")
+	if hexHash == "" && end == b.size {
+		return start, end, nil, nil
+	}
+	hash, decodeErr := hex.DecodeString(hexHash)
+	if decodeErr != nil || len(hash) != sha1.Size {
+		return 0, 0, nil, fmt.Errorf("breached passwords line at byte %d is not a SHA-1 hash", start)
+	}
+	return start, end, hash, nil
+}
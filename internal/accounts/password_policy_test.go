@@ -0,0 +1,119 @@
+package accounts
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func violatedRules(t *testing.T, policy PasswordPolicy, email, password string) []string {
+	err := policy.Check(context.TODO(), email, password)
+	if err == nil {
+		return nil
+	}
+	var policyError PasswordPolicyError
+	if !assert.ErrorAs(t, err, &policyError) {
+		return nil
+	}
+	var rules []string
+	for _, violation := range policyError.Violations {
+		rules = append(rules, violation.Rule)
+	}
+	return rules
+}
+
+func TestDefaultPasswordPolicy_Check(t *testing.T) {
+	policy := NewDefaultPasswordPolicy(PasswordPolicyOptions{
+		MinLength:        10,
+		MaxLength:        20,
+		CharacterClasses: []string{CharacterClassUpper, CharacterClassDigit, CharacterClassSymbol},
+		BannedWords:      []string{"bulwark"},
+		SiteName:         "Latebit",
+	})
+
+	tests := []struct {
+		name     string
+		email    string
+		password string
+		rules    []string
+	}{
+		{"Valid", "john.smith@latebit.io", "Correct-Horse-9", nil},
+		{"Too short", "john.smith@latebit.io", "Hors3-9!", []string{PasswordRuleMinLength}},
+		{"Too long", "john.smith@latebit.io", strings.Repeat("Horse-9", 3), []string{PasswordRuleMaxLength}},
+		{"Multi byte characters count once", "john.smith@latebit.io", "Pferdé-Äpfel9", nil},
+		{"Missing classes", "john.smith@latebit.io", "correcthorsebattery", []string{PasswordRuleCharacterClasses}},
+		{"Site name", "john.smith@latebit.io", "My-LATEBIT-99", []string{PasswordRuleBannedWord}},
+		{"Banned word", "john.smith@latebit.io", "Bulwark-2024!", []string{PasswordRuleBannedWord}},
+		{"Email local part", "john.smith@latebit.io", "Smith-Family-7", []string{PasswordRuleBannedWord}},
+		{"Short local part is not banned", "jo@latebit.io", "Jo-Correct-Horse-9", nil},
+		{"Every violation", "john.smith@latebit.io", "john", []string{PasswordRuleMinLength,
+			PasswordRuleCharacterClasses, PasswordRuleBannedWord}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.rules, violatedRules(t, policy, tt.email, tt.password))
+		})
+	}
+}
+
+func TestDefaultPasswordPolicy_Breached(t *testing.T) {
+	list := "# not a hash\n"
+	breached, err := NewBreachedPasswords(strings.NewReader(list), int64(len(list)))
+	assert.Error(t, err)
+	assert.Nil(t, breached)
+
+	passwords := []string{"Password1!", "123456", "qwerty", "letmein", "dragon"}
+	var hashes []string
+	for _, password := range passwords {
+		sum := sha1.Sum([]byte(password))
+		hashes = append(hashes, strings.ToUpper(hex.EncodeToString(sum[:]))+":52256179\r\n")
+	}
+	slices.Sort(hashes)
+	list = strings.Join(hashes, "") + "\n"
+	breached, err = NewBreachedPasswords(strings.NewReader(list), int64(len(list)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, password := range passwords {
+		found, err := breached.Contains(password)
+		assert.Nil(t, err)
+		assert.True(t, found, password)
+	}
+	for _, password := range []string{"Password2!", "", "zzzzzz"} {
+		found, err := breached.Contains(password)
+		assert.Nil(t, err)
+		assert.False(t, found, password)
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(list), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := loaded.Contains("dragon")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Nil(t, loaded.Close())
+
+	policy := NewDefaultPasswordPolicy(PasswordPolicyOptions{Breached: breached})
+	assert.Equal(t, []string{PasswordRuleBreached}, violatedRules(t, policy, "user@latebit.io", "Password1!"))
+	assert.Nil(t, violatedRules(t, policy, "user@latebit.io", "Password2!"))
+
+	policy.AddRule(func(ctx context.Context, email, password string) *PasswordViolation {
+		if strings.HasSuffix(password, "!") {
+			return &PasswordViolation{Rule: "no_bang", Detail: "must not end with !"}
+		}
+		return nil
+	})
+	assert.Equal(t, []string{"no_bang"}, violatedRules(t, policy, "user@latebit.io", "Password2!"))
+}
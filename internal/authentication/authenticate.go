@@ -1,39 +1,55 @@
 package authentication
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"strings"
 	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
 )
 
 // AuthenticationService defines the interface for authentication services.
 type AuthenticationService interface {
-	Authenticate(ctx context.Context, email string, password string) (*Authenticated, error)
+	Authenticate(ctx context.Context, email, password, clientId, nonce string, audience []string) (*Authenticated, error)
+	CheckCredentials(ctx context.Context, email, password string) (*accounts.Account, error)
+	CheckSecondFactor(ctx context.Context, account *accounts.Account, code string) error
 	Acknowledge(ctx context.Context, Authenticate Authenticated, email, clientId string) error
-	ValidateAccessToken(ctx context.Context, accessToken, email string) (*AccessTokenClaims, error)
-	ValidateRefreshToken(ctx context.Context, refreshToken, email string) (*RefreshTokenClaims, error)
+	ValidateAccessToken(ctx context.Context, accessToken string) (*AccessTokenClaims, error)
+	ValidateRefreshToken(ctx context.Context, refreshToken string) (*RefreshTokenClaims, error)
 	Renew(ctx context.Context, refreshToken, clientId string) (*Authenticated, error)
-	Revoke(ctx context.Context, clientId, email string, accessToken string) error
+	Revoke(ctx context.Context, clientId string, accessToken string) error
 }
 
 type AccountRepository interface {
 	Read(ctx context.Context, email string) (*accounts.Account, error)
+	ReadById(ctx context.Context, accountId string) (*accounts.Account, error)
 	PasswordMatches(ctx context.Context, email, password string) (bool, error)
 }
 
 type Tokenizer interface {
-	CreateAccessToken(ctx context.Context, email string, rbac []string) (string, error)
-	CreateRefreshToken(ctx context.Context, email string) (string, error)
-	ValidateRefreshToken(ctx context.Context, email, tokenString string) (*tokens.RefreshTokenClaims, error)
-	ValidateAccessToken(ctx context.Context, email, tokenString string) (*tokens.AccessTokenClaims, error)
+	CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options tokens.TokenOptions) (string, error)
+	CreateRefreshToken(ctx context.Context, subject string, options tokens.TokenOptions) (string, error)
+	CreateRefreshTokenInFamily(ctx context.Context, subject, family string, options tokens.TokenOptions) (string, error)
+	CreateIdToken(ctx context.Context, subject string, options tokens.IdTokenOptions) (string, error)
+	ValidateRefreshToken(ctx context.Context, tokenString string) (*tokens.RefreshTokenClaims, error)
+	ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error)
 }
 
-// Authenticated represents the authenticated user's tokens.
+// ClientRepository finds the registered client an authentication flow names
+type ClientRepository interface {
+	Read(ctx context.Context, clientId string) (*clients.Client, error)
+}
+
+// Authenticated represents the authenticated user's tokens, there is an ID token when the user signed in to a client.
 type Authenticated struct {
 	AccessToken  string `json:"accessToken"`
 	RefreshToken string `json:"refreshToken"`
+	IdToken      string `json:"idToken,omitempty"`
 }
 
 // AccessTokenClaims represents the claims in an access token.
@@ -41,6 +57,8 @@ type AccessTokenClaims struct {
 	Roles     []string  `json:"roles"`
 	Issuer    string    `json:"issuer"`
 	Subject   string    `json:"subject"`
+	Email     string    `json:"email,omitempty"`
+	Scope     string    `json:"scope,omitempty"`
 	Audience  string    `json:"audience"`
 	ExpiresAt time.Time `json:"expiresAT"`
 	NotBefore time.Time `json:"notBefore"`
@@ -64,25 +82,99 @@ type DefaultAuthenticationService struct {
 	accounts        AccountRepository
 	tokens          Tokenizer
 	tokenRepository TokenRepository
+	refreshTokens   RefreshTokenRepository
+	revocations     tokens.RevocationService
+	clients         ClientRepository
+	lockout         LockoutService
+	mfa             MfaService
 }
 
 // NewDefaultAuthenticationService creates a new DefaultAuthenticationService.
-func NewDefaultAuthenticationService(accounts AccountRepository, tokens TokenRepository, tokenizer Tokenizer) *DefaultAuthenticationService {
+func NewDefaultAuthenticationService(accounts AccountRepository, tokens TokenRepository, tokenizer Tokenizer,
+	refreshTokens RefreshTokenRepository, revocations tokens.RevocationService, clients ClientRepository,
+	lockout LockoutService, mfa MfaService) *DefaultAuthenticationService {
 	return &DefaultAuthenticationService{
 		accounts:        accounts,
 		tokens:          tokenizer,
 		tokenRepository: tokens,
+		refreshTokens:   refreshTokens,
+		revocations:     revocations,
+		clients:         clients,
+		lockout:         lockout,
+		mfa:             mfa,
 	}
 }
 
-// Authenticate authenticates a user by their email and password.
-func (a *DefaultAuthenticationService) Authenticate(ctx context.Context, email string, password string) (*Authenticated, error) {
+// Authenticate authenticates a user by their email and password, the tokens are issued to the requested audiences
+// or the default audience when none are requested. When a client is named the tokens get the client's lifetimes
+// and an ID token is issued to the client with the nonce. Accounts with a second factor get a MfaRequiredError
+// with a challenge token instead of the tokens, see MfaService.Exchange.
+func (a *DefaultAuthenticationService) Authenticate(ctx context.Context, email, password, clientId, nonce string, audience []string) (*Authenticated, error) {
+	options := tokens.TokenOptions{Audience: audience}
+	var client *clients.Client
+	if clientId != "" {
+		var err error
+		client, err = a.client(ctx, clientId, clients.GrantTypePassword)
+		if err != nil {
+			return nil, err
+		}
+		options = client.TokenOptions(audience)
+	}
+
+	account, err := a.CheckCredentials(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if account.MfaEnabled() {
+		challengeToken, err := a.mfa.Challenge(ctx, account, tokens.AmrPassword, clientId, nonce, audience)
+		if err != nil {
+			return nil, err
+		}
+		return nil, MfaRequiredError{Value: account.Email, ChallengeToken: challengeToken}
+	}
+
+	accessToken, err := a.tokens.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := a.tokens.CreateRefreshToken(ctx, account.AccountId, options)
+	if err != nil {
+		return nil, err
+	}
+	idToken := ""
+	if client != nil {
+		idToken, err = CreateIdToken(ctx, a.tokens, client, account, nonce, tokens.AmrPassword)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Authenticated{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		IdToken:      idToken,
+	}, nil
+}
+
+// CheckCredentials verifies the password of an account that is able to sign in without issuing tokens, for flows
+// that issue them later such as the authorization code grant. Failed attempts are counted by the lockout service.
+func (a *DefaultAuthenticationService) CheckCredentials(ctx context.Context, email, password string) (*accounts.Account, error) {
+	if err := a.lockout.Check(ctx, email); err != nil {
+		return nil, err
+	}
+
 	account, err := a.accounts.Read(ctx, email)
 	if err != nil {
+		var notFound accounts.AccountNotFoundError
+		if errors.As(err, &notFound) {
+			if err := a.lockout.Failed(ctx, email); err != nil {
+				return nil, err
+			}
+		}
 		return nil, err
 	}
 
-	err = a.accountHealth(account)
+	err = accountHealth(account)
 	if err != nil {
 		return nil, err
 	}
@@ -93,28 +185,34 @@ func (a *DefaultAuthenticationService) Authenticate(ctx context.Context, email s
 	}
 
 	if !authenticated {
+		if err = a.lockout.Failed(ctx, email); err != nil {
+			return nil, err
+		}
 		return nil, AuthenticationError{
 			Value: email,
 		}
 	}
 
-	accessToken, err := a.tokens.CreateAccessToken(ctx, email, nil)
-	if err != nil {
+	if err = a.lockout.Succeeded(ctx, email); err != nil {
 		return nil, err
 	}
-	refreshToken, err := a.tokens.CreateRefreshToken(ctx, email)
-	if err != nil {
-		return nil, err
-	}
-	return &Authenticated{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-	}, nil
+	return account, nil
+}
+
+// CheckSecondFactor verifies the code of an account with a second factor after CheckCredentials, for flows that ask
+// for both at once. Accounts without a second factor pass
+func (a *DefaultAuthenticationService) CheckSecondFactor(ctx context.Context, account *accounts.Account, code string) error {
+	return a.mfa.Verify(ctx, account, code)
 }
 
-// Acknowledge acknowledges the authentication by storing the tokens.
+// Acknowledge acknowledges the authentication by storing the tokens for a registered client.
 func (a *DefaultAuthenticationService) Acknowledge(ctx context.Context, authenticated Authenticated, email, clientId string) error {
-	err := a.tokenRepository.Create(ctx, email, clientId, authenticated.AccessToken, authenticated.RefreshToken)
+	_, err := a.client(ctx, clientId, "")
+	if err != nil {
+		return err
+	}
+
+	err = a.tokenRepository.Create(ctx, email, clientId, authenticated.AccessToken, authenticated.RefreshToken)
 	//TODO: on ack have the option to set cookie for SPA
 	if err != nil {
 		return err
@@ -122,9 +220,14 @@ func (a *DefaultAuthenticationService) Acknowledge(ctx context.Context, authenti
 	return nil
 }
 
-// ValidateAccessToken validates an access token.
-func (a *DefaultAuthenticationService) ValidateAccessToken(ctx context.Context, accessToken string, email string) (*AccessTokenClaims, error) {
-	token, err := a.tokens.ValidateAccessToken(ctx, email, accessToken)
+// ValidateAccessToken validates an access token, including whether it has been revoked.
+func (a *DefaultAuthenticationService) ValidateAccessToken(ctx context.Context, accessToken string) (*AccessTokenClaims, error) {
+	token, err := a.tokens.ValidateAccessToken(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.checkRevoked(ctx, token.RegisteredClaims)
 	if err != nil {
 		return nil, err
 	}
@@ -132,6 +235,8 @@ func (a *DefaultAuthenticationService) ValidateAccessToken(ctx context.Context,
 		Roles:     token.Roles,
 		Issuer:    token.Issuer,
 		Subject:   token.Subject,
+		Email:     token.Email,
+		Scope:     token.Scope,
 		ExpiresAt: token.ExpiresAt.Time,
 		NotBefore: token.NotBefore.Time,
 		IssuedAt:  token.IssuedAt.Time,
@@ -139,9 +244,14 @@ func (a *DefaultAuthenticationService) ValidateAccessToken(ctx context.Context,
 	}, nil
 }
 
-// ValidateRefreshToken validates a refresh token.
-func (a *DefaultAuthenticationService) ValidateRefreshToken(ctx context.Context, refreshToken string, email string) (*RefreshTokenClaims, error) {
-	token, err := a.tokens.ValidateRefreshToken(ctx, email, refreshToken)
+// ValidateRefreshToken validates a refresh token, including whether it has been revoked.
+func (a *DefaultAuthenticationService) ValidateRefreshToken(ctx context.Context, refreshToken string) (*RefreshTokenClaims, error) {
+	token, err := a.tokens.ValidateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.checkRefreshRevoked(ctx, token)
 	if err != nil {
 		return nil, err
 	}
@@ -155,24 +265,72 @@ func (a *DefaultAuthenticationService) ValidateRefreshToken(ctx context.Context,
 	}, nil
 }
 
-// Renew renews the authentication by generating new tokens.
-func (a *DefaultAuthenticationService) Renew(ctx context.Context, refreshToken, email string) (*Authenticated, error) {
-	token, err := a.tokens.ValidateRefreshToken(ctx, email, refreshToken)
+// Renew renews the authentication by generating new tokens for the audience of the refresh token. Only the client the refresh token was issued to can
+// renew it, tokens issued before they recorded their client can be renewed by any client. The refresh token is replaced by a new token of the
+// same family and can only be used once, presenting it again revokes the family and the acknowledged session of the family's client. The refresh token
+// is only marked used once the new tokens are issued, so a failure to issue them does not burn the family.
+func (a *DefaultAuthenticationService) Renew(ctx context.Context, refreshToken, clientId string) (*Authenticated, error) {
+	client, err := a.client(ctx, clientId, clients.GrantTypeRefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := a.tokens.ValidateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.checkRefreshRevoked(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	if token.ClientId != "" && token.ClientId != client.ClientId {
+		return nil, RefreshTokenClientError{Value: clientId}
+	}
+
+	account, err := a.subjectAccount(ctx, token.Subject)
 	if err != nil {
 		return nil, err
 	}
+	if account.AccountId != token.Subject {
+		// the account revokes its tokens by account id, which also covers the ones issued to its email
+		accountClaims := token.RegisteredClaims
+		accountClaims.Subject = account.AccountId
+		if err = a.checkRevoked(ctx, accountClaims); err != nil {
+			return nil, err
+		}
+	}
 
-	account, err := a.accounts.Read(ctx, token.Subject)
+	family := token.TokenFamily()
+	options := client.TokenOptions(token.Audience)
+	options.Scope = token.Scope
+	accessToken, err := a.tokens.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
 	if err != nil {
 		return nil, err
 	}
 
-	accessToken, err := a.tokens.CreateAccessToken(ctx, token.Subject, account.Roles)
+	refreshToken, err = a.tokens.CreateRefreshTokenInFamily(ctx, account.AccountId, family, options)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken, err = a.tokens.CreateRefreshToken(ctx, token.Subject)
+	err = a.refreshTokens.MarkUsed(ctx, UsedRefreshToken{
+		TokenId: token.ID,
+		Family:  family,
+		Email:   account.Email,
+		Used:    time.Now(),
+		Expires: token.ExpiresAt.Time,
+	})
+	var reuse RefreshTokenReuseError
+	if errors.As(err, &reuse) {
+		// refresh tokens issued before they recorded their client belong to the client renewing them
+		familyClientId := cmp.Or(token.ClientId, clientId)
+		if revokeErr := a.revokeFamily(ctx, family, account.Email, familyClientId); revokeErr != nil {
+			return nil, revokeErr
+		}
+		return nil, err
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -183,16 +341,125 @@ func (a *DefaultAuthenticationService) Renew(ctx context.Context, refreshToken,
 	}, nil
 }
 
-// Revoke revokes the authentication by deleting the tokens.
-func (a *DefaultAuthenticationService) Revoke(ctx context.Context, clientId, email string, accessToken string) error {
-	err := a.tokenRepository.Delete(ctx, email, clientId)
+// Revoke revokes the authentication by deleting the tokens and revoking the access token so it
+// fails validation for the rest of its lifetime. The tokens of the session are revoked as well, so the session can
+// not be renewed after logout.
+func (a *DefaultAuthenticationService) Revoke(ctx context.Context, clientId string, accessToken string) error {
+	_, err := a.client(ctx, clientId, "")
 	if err != nil {
 		return err
 	}
+
+	token, err := a.tokens.ValidateAccessToken(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+
+	err = a.deleteSession(ctx, token.Email, clientId, "")
+	if err != nil {
+		return err
+	}
+
+	return a.revocations.RevokeToken(ctx, token.RegisteredClaims)
+}
+
+func (a *DefaultAuthenticationService) client(ctx context.Context, clientId, grantType string) (*clients.Client, error) {
+	return ReadClient(ctx, a.clients, clientId, grantType)
+}
+
+// ReadClient reads the registered client, unknown clients are rejected as are clients not allowed the grant type.
+// Every sign in of the api, with a password, a logon code or a social provider, needs the password grant
+func ReadClient(ctx context.Context, registry ClientRepository, clientId, grantType string) (*clients.Client, error) {
+	client, err := registry.Read(ctx, clientId)
+	if err != nil {
+		return nil, err
+	}
+
+	if grantType != "" && !client.AllowsGrant(grantType) {
+		return nil, clients.GrantTypeError{Value: grantType}
+	}
+
+	return client, nil
+}
+
+// subjectAccount reads the account a token was issued to, refresh tokens issued before subjects were account ids
+// carry the email instead
+func (a *DefaultAuthenticationService) subjectAccount(ctx context.Context, subject string) (*accounts.Account, error) {
+	account, err := a.accounts.ReadById(ctx, subject)
+	var notFound accounts.AccountNotFoundError
+	if errors.As(err, &notFound) && strings.Contains(subject, "@") {
+		return a.accounts.Read(ctx, subject)
+	}
+	return account, err
+}
+
+// revokeFamily revokes every refresh token of the family and removes the client's acknowledged session
+func (a *DefaultAuthenticationService) revokeFamily(ctx context.Context, family, email, clientId string) error {
+	err := a.revocations.RevokeFamily(ctx, family)
+	if err != nil {
+		return err
+	}
+
+	return a.deleteSession(ctx, email, clientId, family)
+}
+
+// deleteSession removes the client's acknowledged session and revokes the tokens it holds, so they fail validation
+// and introspection once the session is gone. The family the caller has already revoked is not revoked again
+func (a *DefaultAuthenticationService) deleteSession(ctx context.Context, email, clientId, revokedFamily string) error {
+	session, err := a.tokenRepository.Read(ctx, email, clientId)
+	if err != nil {
+		return err
+	}
+	if session != nil {
+		// expired or already revoked tokens fail validation and need no revocation
+		if access, err := a.tokens.ValidateAccessToken(ctx, session.AccessToken); err == nil {
+			if err = a.revocations.RevokeToken(ctx, access.RegisteredClaims); err != nil {
+				return err
+			}
+		}
+		refresh, err := a.tokens.ValidateRefreshToken(ctx, session.RefreshToken)
+		if err == nil && refresh.TokenFamily() != revokedFamily {
+			if err = a.revocations.RevokeFamily(ctx, refresh.TokenFamily()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return a.tokenRepository.Delete(ctx, email, clientId)
+}
+
+func (a *DefaultAuthenticationService) checkRefreshRevoked(ctx context.Context, token *tokens.RefreshTokenClaims) error {
+	err := a.checkRevoked(ctx, token.RegisteredClaims)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := a.revocations.IsFamilyRevoked(ctx, token.TokenFamily())
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return tokens.TokenRevokedError{Value: token.ID}
+	}
+
+	return nil
+}
+
+func (a *DefaultAuthenticationService) checkRevoked(ctx context.Context, claims jwt.RegisteredClaims) error {
+	revoked, err := a.revocations.IsRevoked(ctx, claims)
+	if err != nil {
+		return err
+	}
+
+	if revoked {
+		return tokens.TokenRevokedError{Value: claims.ID}
+	}
+
 	return nil
 }
 
-func (a *DefaultAuthenticationService) accountHealth(account *accounts.Account) error {
+func accountHealth(account *accounts.Account) error {
 	if account.IsDeleted {
 		return accounts.AccountDeletedError{
 			Value: account.Email,
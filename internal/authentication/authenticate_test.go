@@ -0,0 +1,216 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+type renewTokenizer struct {
+	Tokenizer
+	refresh  *tokens.RefreshTokenClaims
+	failSign bool
+	subject  string
+	scopes   []string
+}
+
+func (t *renewTokenizer) ValidateRefreshToken(ctx context.Context, tokenString string) (*tokens.RefreshTokenClaims, error) {
+	return t.refresh, nil
+}
+
+func (t *renewTokenizer) ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error) {
+	return &tokens.AccessTokenClaims{Email: "owner@latebit.io", RegisteredClaims: jwt.RegisteredClaims{ID: tokenString}},
+		nil
+}
+
+func (t *renewTokenizer) CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options tokens.TokenOptions) (string, error) {
+	if t.failSign {
+		return "", errors.New("signing failed")
+	}
+	t.scopes = append(t.scopes, options.Scope)
+	return "access-token", nil
+}
+
+func (t *renewTokenizer) CreateRefreshTokenInFamily(ctx context.Context, subject, family string, options tokens.TokenOptions) (string, error) {
+	t.subject = subject
+	t.scopes = append(t.scopes, options.Scope)
+	return "refresh-token", nil
+}
+
+type renewAccounts struct {
+	AccountRepository
+}
+
+func (a renewAccounts) ReadById(ctx context.Context, accountId string) (*accounts.Account, error) {
+	if accountId == "owner@latebit.io" {
+		return nil, accounts.AccountNotFoundError{Value: accountId}
+	}
+	return &accounts.Account{AccountId: accountId, Email: "owner@latebit.io"}, nil
+}
+
+func (a renewAccounts) Read(ctx context.Context, email string) (*accounts.Account, error) {
+	return &accounts.Account{AccountId: "account-id", Email: email}, nil
+}
+
+type renewRefreshTokens struct {
+	used map[string]bool
+}
+
+func (r *renewRefreshTokens) MarkUsed(ctx context.Context, token UsedRefreshToken) error {
+	if r.used[token.TokenId] {
+		return RefreshTokenReuseError{Value: token.Family}
+	}
+	r.used[token.TokenId] = true
+	return nil
+}
+
+type renewSessions struct {
+	TokenRepository
+	deleted []string
+}
+
+func (s *renewSessions) Read(ctx context.Context, email, clientId string) (*Token, error) {
+	return &Token{Email: email, ClientId: clientId, AccessToken: "session-access", RefreshToken: "refresh"},
+		nil
+}
+
+func (s *renewSessions) Delete(ctx context.Context, email, clientId string) error {
+	s.deleted = append(s.deleted, clientId)
+	return nil
+}
+
+type renewRevocations struct {
+	tokens.RevocationService
+	families []string
+	tokens   []string
+}
+
+func (r *renewRevocations) RevokeToken(ctx context.Context, claims jwt.RegisteredClaims) error {
+	r.tokens = append(r.tokens, claims.ID)
+	return nil
+}
+
+func (r *renewRevocations) RevokeFamily(ctx context.Context, family string) error {
+	r.families = append(r.families, family)
+	return nil
+}
+
+func (r *renewRevocations) IsRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error) {
+	return false, nil
+}
+
+func (r *renewRevocations) IsFamilyRevoked(ctx context.Context, family string) (bool, error) {
+	return false, nil
+}
+
+type renewClients struct{}
+
+func (c renewClients) Read(ctx context.Context, clientId string) (*clients.Client, error) {
+	return &clients.Client{ClientId: clientId, GrantTypes: []string{clients.GrantTypeRefreshToken}}, nil
+}
+
+func newTestRenewService(refresh *tokens.RefreshTokenClaims) (*DefaultAuthenticationService, *renewTokenizer,
+	*renewRefreshTokens, *renewSessions, *renewRevocations) {
+	tokenizer := &renewTokenizer{refresh: refresh}
+	refreshTokens := &renewRefreshTokens{used: map[string]bool{}}
+	sessions := &renewSessions{}
+	revocations := &renewRevocations{}
+	service := NewDefaultAuthenticationService(renewAccounts{}, sessions, tokenizer, refreshTokens, revocations,
+		renewClients{}, nil, nil)
+	return service, tokenizer, refreshTokens, sessions, revocations
+}
+
+func testRefreshClaims(clientId string) *tokens.RefreshTokenClaims {
+	return &tokens.RefreshTokenClaims{
+		Type:     tokens.TokenTypeRefresh,
+		Family:   "family",
+		ClientId: clientId,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        "token-id",
+			Subject:   "account-id",
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+func TestDefaultAuthenticationService_RenewSigningFailureKeepsToken(t *testing.T) {
+	ctx := context.Background()
+	service, tokenizer, refreshTokens, _, revocations := newTestRenewService(testRefreshClaims("web"))
+
+	tokenizer.failSign = true
+	_, err := service.Renew(ctx, "refresh", "web")
+	assert.Error(t, err)
+	assert.Empty(t, refreshTokens.used)
+
+	tokenizer.failSign = false
+	authenticated, err := service.Renew(ctx, "refresh", "web")
+	assert.NoError(t, err)
+	assert.Equal(t, "refresh-token", authenticated.RefreshToken)
+	assert.Empty(t, revocations.families)
+}
+
+func TestDefaultAuthenticationService_RenewReuseRevokesFamilyClient(t *testing.T) {
+	ctx := context.Background()
+	service, _, _, sessions, revocations := newTestRenewService(testRefreshClaims("web"))
+
+	_, err := service.Renew(ctx, "refresh", "web")
+	assert.NoError(t, err)
+	_, err = service.Renew(ctx, "refresh", "web")
+	var reuse RefreshTokenReuseError
+	assert.ErrorAs(t, err, &reuse)
+	assert.Equal(t, []string{"family"}, revocations.families)
+	assert.Equal(t, []string{"web"}, sessions.deleted)
+}
+
+func TestDefaultAuthenticationService_RenewOtherClient(t *testing.T) {
+	ctx := context.Background()
+	service, _, refreshTokens, _, revocations := newTestRenewService(testRefreshClaims("web"))
+
+	_, err := service.Renew(ctx, "refresh", "mobile")
+	var clientErr RefreshTokenClientError
+	assert.ErrorAs(t, err, &clientErr)
+	assert.Empty(t, refreshTokens.used)
+	assert.Empty(t, revocations.families)
+
+	// refresh tokens issued before they recorded their client are renewed by any client
+	service, _, _, _, _ = newTestRenewService(testRefreshClaims(""))
+	_, err = service.Renew(ctx, "refresh", "mobile")
+	assert.NoError(t, err)
+}
+
+func TestDefaultAuthenticationService_RenewEmailSubject(t *testing.T) {
+	ctx := context.Background()
+	claims := testRefreshClaims("web")
+	claims.Subject = "owner@latebit.io"
+	service, tokenizer, _, _, _ := newTestRenewService(claims)
+
+	_, err := service.Renew(ctx, "refresh", "web")
+	assert.NoError(t, err)
+	assert.Equal(t, "account-id", tokenizer.subject)
+}
+
+func TestDefaultAuthenticationService_RenewKeepsScope(t *testing.T) {
+	claims := testRefreshClaims("web")
+	claims.Scope = "openid email"
+	service, tokenizer, _, _, _ := newTestRenewService(claims)
+
+	_, err := service.Renew(context.Background(), "refresh", "web")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"openid email", "openid email"}, tokenizer.scopes)
+}
+
+func TestDefaultAuthenticationService_RevokeFamily(t *testing.T) {
+	service, _, _, sessions, revocations := newTestRenewService(testRefreshClaims("web"))
+
+	assert.NoError(t, service.Revoke(context.Background(), "web", "access"))
+	assert.Equal(t, []string{"family"}, revocations.families)
+	assert.Equal(t, []string{"session-access", "access"}, revocations.tokens)
+	assert.Equal(t, []string{"web"}, sessions.deleted)
+}
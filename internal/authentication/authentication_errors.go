@@ -1,6 +1,9 @@
 package authentication
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 type AuthenticationError struct {
 	Value string `json:"value"`
@@ -9,3 +12,67 @@ type AuthenticationError struct {
 func (e AuthenticationError) Error() string {
 	return fmt.Sprintf("cannot authenticate account: %s", e.Value)
 }
+
+// RefreshTokenClientError the refresh token was issued to another client than the one renewing it
+type RefreshTokenClientError struct {
+	Value string `json:"value"`
+}
+
+func (e RefreshTokenClientError) Error() string {
+	return fmt.Sprintf("refresh token was issued to another client: %s", e.Value)
+}
+
+type RefreshTokenReuseError struct {
+	Value string `json:"value"`
+}
+
+func (e RefreshTokenReuseError) Error() string {
+	return fmt.Sprintf("refresh token reused, token family revoked: %s", e.Value)
+}
+
+// TooManyAttemptsError signing in is throttled or locked for the account or the client IP, RetryAfter is how long
+// to wait
+type TooManyAttemptsError struct {
+	Value      string        `json:"value"`
+	RetryAfter time.Duration `json:"retryAfter"`
+}
+
+func (e TooManyAttemptsError) Error() string {
+	return fmt.Sprintf("too many failed sign in attempts: %s, retry in %s", e.Value,
+		e.RetryAfter.Round(time.Second))
+}
+
+// MfaRequiredError the password was right but the account needs a second factor, the challenge token is exchanged
+// for the tokens together with a code
+type MfaRequiredError struct {
+	Value          string `json:"value"`
+	ChallengeToken string `json:"challengeToken"`
+}
+
+func (e MfaRequiredError) Error() string {
+	return fmt.Sprintf("second factor required: %s", e.Value)
+}
+
+type MfaCodeError struct {
+	Value string `json:"value"`
+}
+
+func (e MfaCodeError) Error() string {
+	return fmt.Sprintf("invalid second factor code: %s", e.Value)
+}
+
+// MfaChallengeError the challenge token is unknown, expired or was already exchanged
+type MfaChallengeError struct{}
+
+func (e MfaChallengeError) Error() string {
+	return "mfa challenge is invalid or has expired"
+}
+
+// MfaEnrollmentError the second factor is not in a state the request can be made in
+type MfaEnrollmentError struct {
+	Value string `json:"value"`
+}
+
+func (e MfaEnrollmentError) Error() string {
+	return fmt.Sprintf("mfa enrollment: %s", e.Value)
+}
@@ -0,0 +1,30 @@
+package authentication
+
+import (
+	"context"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// IdTokenizer signs the ID tokens of sign ins, see tokens.DefaultTokenizer
+type IdTokenizer interface {
+	CreateIdToken(ctx context.Context, subject string, options tokens.IdTokenOptions) (string, error)
+}
+
+// CreateIdToken issues the ID token of a sign in that just happened to the client, methods are the amr values of
+// how the account authenticated. The token lives as long as the client's access tokens
+func CreateIdToken(ctx context.Context, tokenizer IdTokenizer, client *clients.Client, account *accounts.Account,
+	nonce string, methods ...string) (string, error) {
+	return tokenizer.CreateIdToken(ctx, account.AccountId, tokens.IdTokenOptions{
+		ClientId:      client.ClientId,
+		Nonce:         nonce,
+		AuthTime:      time.Now(),
+		Methods:       methods,
+		Email:         account.Email,
+		EmailVerified: account.IsVerified,
+		ExpInSec:      client.AccessTokenExpireInSeconds,
+	})
+}
@@ -0,0 +1,176 @@
+package authentication
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	lockoutAccountKey = "account:"
+	lockoutIpKey      = "ip:"
+)
+
+// LockoutService throttles sign in guesses, failures are counted for each account and each client IP. The client IP
+// is read from the context, see WithClientIp
+type LockoutService interface {
+	Check(ctx context.Context, email string) error
+	Failed(ctx context.Context, email string) error
+	Succeeded(ctx context.Context, email string) error
+	Read(ctx context.Context, email string) (*LoginAttempts, error)
+	Clear(ctx context.Context, email string) error
+	ClearIp(ctx context.Context, ip string) error
+}
+
+// LockoutNotifier tells the account owner their account was locked
+type LockoutNotifier interface {
+	SendLockoutEmail(ctx context.Context, email string, until time.Time) error
+}
+
+// LockoutOptions a zero value turns its rule off
+type LockoutOptions struct {
+	// FreeAttempts failures of an account before each further attempt has to wait, the wait starts at Backoff and
+	// doubles with every failure
+	FreeAttempts int
+	Backoff      time.Duration
+	// MaxFailures failures of an account before it is locked
+	MaxFailures int
+	// IpMaxFailures failures from a client IP, across all accounts, before it is locked
+	IpMaxFailures int
+	// Duration how long a lock lasts and how long failures are remembered after the last one
+	Duration time.Duration
+}
+
+type DefaultLockoutService struct {
+	repository LoginAttemptRepository
+	accounts   AccountRepository
+	notifier   LockoutNotifier
+	options    LockoutOptions
+}
+
+func NewDefaultLockoutService(repository LoginAttemptRepository, accounts AccountRepository, notifier LockoutNotifier,
+	options LockoutOptions) *DefaultLockoutService {
+	return &DefaultLockoutService{
+		repository: repository,
+		accounts:   accounts,
+		notifier:   notifier,
+		options:    options,
+	}
+}
+
+type clientIpKey struct{}
+
+// WithClientIp the client IP failed sign ins are counted for
+func WithClientIp(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIpKey{}, ip)
+}
+
+// ClientIp empty when the context has none
+func ClientIp(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIpKey{}).(string)
+	return ip
+}
+
+// Check returns a TooManyAttemptsError while the account or the client IP is locked, or the account has to wait
+// before it can be tried again
+func (s *DefaultLockoutService) Check(ctx context.Context, email string) error {
+	now := time.Now()
+	for _, key := range s.keys(ctx, email) {
+		attempts, err := s.repository.Read(ctx, key)
+		if err != nil {
+			return err
+		}
+		if attempts == nil {
+			continue
+		}
+		if retryAfter := s.retryAfter(key, attempts, now); retryAfter > 0 {
+			return TooManyAttemptsError{Value: email, RetryAfter: retryAfter}
+		}
+	}
+	return nil
+}
+
+// Failed counts a failed sign in, the account owner is notified when it locks the account
+func (s *DefaultLockoutService) Failed(ctx context.Context, email string) error {
+	now := time.Now()
+	for _, key := range s.keys(ctx, email) {
+		attempts, err := s.repository.Fail(ctx, key, now, now.Add(s.options.Duration))
+		if err != nil {
+			return err
+		}
+		account := strings.HasPrefix(key, lockoutAccountKey)
+		maxFailures := s.options.MaxFailures
+		if !account {
+			maxFailures = s.options.IpMaxFailures
+		}
+		if maxFailures == 0 || attempts.Failures < maxFailures {
+			continue
+		}
+		until := now.Add(s.options.Duration)
+		locked, err := s.repository.Lock(ctx, key, until)
+		if err != nil {
+			return err
+		}
+		if locked && account {
+			s.notify(ctx, email, until)
+		}
+	}
+	return nil
+}
+
+// Succeeded forgets the failures of the account, the failures of the client IP are kept so signing in to one
+// account can not be used to guess the passwords of others
+func (s *DefaultLockoutService) Succeeded(ctx context.Context, email string) error {
+	return s.repository.Clear(ctx, lockoutAccountKey+email)
+}
+
+// Read returns nil when the account has no failures
+func (s *DefaultLockoutService) Read(ctx context.Context, email string) (*LoginAttempts, error) {
+	return s.repository.Read(ctx, lockoutAccountKey+email)
+}
+
+// Clear unlocks the account and forgets its failures
+func (s *DefaultLockoutService) Clear(ctx context.Context, email string) error {
+	return s.repository.Clear(ctx, lockoutAccountKey+email)
+}
+
+// ClearIp unlocks the client IP and forgets its failures
+func (s *DefaultLockoutService) ClearIp(ctx context.Context, ip string) error {
+	return s.repository.Clear(ctx, lockoutIpKey+ip)
+}
+
+func (s *DefaultLockoutService) keys(ctx context.Context, email string) []string {
+	keys := []string{lockoutAccountKey + email}
+	if ip := ClientIp(ctx); ip != "" {
+		keys = append(keys, lockoutIpKey+ip)
+	}
+	return keys
+}
+
+// retryAfter how long until the key can be tried again, the backoff only applies to accounts
+func (s *DefaultLockoutService) retryAfter(key string, attempts *LoginAttempts, now time.Time) time.Duration {
+	if attempts.LockedUntil.After(now) {
+		return attempts.LockedUntil.Sub(now)
+	}
+	if !strings.HasPrefix(key, lockoutAccountKey) || s.options.FreeAttempts == 0 ||
+		attempts.Failures < s.options.FreeAttempts {
+		return 0
+	}
+	wait := s.options.Backoff
+	for i := s.options.FreeAttempts; i < attempts.Failures && wait < s.options.Duration; i++ {
+		wait *= 2
+	}
+	wait = min(wait, s.options.Duration)
+	return attempts.LastFailure.Add(wait).Sub(now)
+}
+
+// notify only accounts that exist are told, a failure to send is logged
+func (s *DefaultLockoutService) notify(ctx context.Context, email string, until time.Time) {
+	if _, err := s.accounts.Read(ctx, email); err != nil {
+		return
+	}
+	if err := s.notifier.SendLockoutEmail(ctx, email, until); err != nil {
+		log.Println("sending lockout email failed:", err)
+	}
+}
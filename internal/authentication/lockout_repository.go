@@ -0,0 +1,127 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionLoginAttempts = "loginAttempts"
+)
+
+// LoginAttempts the failed sign ins of an account or a client IP, the key is account:<email> or ip:<address>.
+// The record is forgotten once it expires
+type LoginAttempts struct {
+	Key         string    `bson:"key" json:"key"`
+	Failures    int       `bson:"failures" json:"failures"`
+	LastFailure time.Time `bson:"lastFailure" json:"lastFailure"`
+	LockedUntil time.Time `bson:"lockedUntil,omitempty" json:"lockedUntil,omitempty"`
+	Expires     time.Time `bson:"expires" json:"expires"`
+}
+
+type LoginAttemptRepository interface {
+	Read(ctx context.Context, key string) (*LoginAttempts, error)
+	Fail(ctx context.Context, key string, failed, expires time.Time) (*LoginAttempts, error)
+	Lock(ctx context.Context, key string, until time.Time) (bool, error)
+	Clear(ctx context.Context, key string) error
+}
+
+type MongodbLoginAttemptRepository struct {
+	db *mongo.Database
+}
+
+func NewMongodbLoginAttemptRepository(db *mongo.Database) *MongodbLoginAttemptRepository {
+	// mongodb removes the attempts once they expire, which also unlocks a locked account
+	_, err := db.Collection(collectionLoginAttempts).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbLoginAttemptRepository{db: db}
+}
+
+// Read returns nil when there are no unexpired attempts
+func (r *MongodbLoginAttemptRepository) Read(ctx context.Context, key string) (*LoginAttempts, error) {
+	var attempts LoginAttempts
+	err := r.db.Collection(collectionLoginAttempts).FindOne(ctx, bson.D{
+		{Key: "key", Value: key},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&attempts)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &attempts, nil
+}
+
+// Fail counts a failure and returns the attempts after it. Attempts that expired but were not yet removed by
+// mongodb are started over
+func (r *MongodbLoginAttemptRepository) Fail(ctx context.Context, key string, failed, expires time.Time) (*LoginAttempts, error) {
+	collection := r.db.Collection(collectionLoginAttempts)
+	_, err := collection.DeleteOne(ctx, bson.D{
+		{Key: "key", Value: key},
+		{Key: "expires", Value: bson.D{{Key: "$lte", Value: failed}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func() (*LoginAttempts, error) {
+		var attempts LoginAttempts
+		err := collection.FindOneAndUpdate(ctx, bson.D{{Key: "key", Value: key}},
+			bson.D{
+				{Key: "$inc", Value: bson.D{{Key: "failures", Value: 1}}},
+				{Key: "$set", Value: bson.D{{Key: "lastFailure", Value: failed}, {Key: "expires", Value: expires}}},
+			},
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&attempts)
+		return &attempts, err
+	}
+	attempts, err := fail()
+	// two failures at once can both try to insert the first record, the one that lost increments it instead
+	if mongo.IsDuplicateKeyError(err) {
+		attempts, err = fail()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return attempts, nil
+}
+
+// Lock locks until the time given and keeps the attempts until then, false when it was already locked
+func (r *MongodbLoginAttemptRepository) Lock(ctx context.Context, key string, until time.Time) (bool, error) {
+	result, err := r.db.Collection(collectionLoginAttempts).UpdateOne(ctx,
+		bson.D{
+			{Key: "key", Value: key},
+			{Key: "$or", Value: bson.A{
+				bson.D{{Key: "lockedUntil", Value: bson.D{{Key: "$exists", Value: false}}}},
+				bson.D{{Key: "lockedUntil", Value: bson.D{{Key: "$lte", Value: time.Now()}}}},
+			}},
+		},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "lockedUntil", Value: until}, {Key: "expires", Value: until}}}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Clear forgets the attempts, unlocking the key
+func (r *MongodbLoginAttemptRepository) Clear(ctx context.Context, key string) error {
+	_, err := r.db.Collection(collectionLoginAttempts).DeleteOne(ctx, bson.D{{Key: "key", Value: key}})
+	return err
+}
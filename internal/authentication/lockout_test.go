@@ -0,0 +1,166 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryLoginAttemptRepository struct {
+	attempts map[string]*LoginAttempts
+}
+
+func newMemoryLoginAttemptRepository() *memoryLoginAttemptRepository {
+	return &memoryLoginAttemptRepository{attempts: map[string]*LoginAttempts{}}
+}
+
+func (r *memoryLoginAttemptRepository) Read(ctx context.Context, key string) (*LoginAttempts, error) {
+	attempts, ok := r.attempts[key]
+	if !ok || !attempts.Expires.After(time.Now()) {
+		return nil, nil
+	}
+	copied := *attempts
+	return &copied, nil
+}
+
+func (r *memoryLoginAttemptRepository) Fail(ctx context.Context, key string, failed, expires time.Time) (*LoginAttempts, error) {
+	attempts, ok := r.attempts[key]
+	if !ok || !attempts.Expires.After(failed) {
+		attempts = &LoginAttempts{Key: key}
+		r.attempts[key] = attempts
+	}
+	attempts.Failures++
+	attempts.LastFailure = failed
+	attempts.Expires = expires
+	copied := *attempts
+	return &copied, nil
+}
+
+func (r *memoryLoginAttemptRepository) Lock(ctx context.Context, key string, until time.Time) (bool, error) {
+	attempts, ok := r.attempts[key]
+	if !ok || attempts.LockedUntil.After(time.Now()) {
+		return false, nil
+	}
+	attempts.LockedUntil = until
+	attempts.Expires = until
+	return true, nil
+}
+
+func (r *memoryLoginAttemptRepository) Clear(ctx context.Context, key string) error {
+	delete(r.attempts, key)
+	return nil
+}
+
+type lockoutAccounts struct {
+	emails []string
+}
+
+func (a lockoutAccounts) Read(ctx context.Context, email string) (*accounts.Account, error) {
+	for _, e := range a.emails {
+		if e == email {
+			return &accounts.Account{Email: email}, nil
+		}
+	}
+	return nil, accounts.AccountNotFoundError{Value: email}
+}
+
+func (a lockoutAccounts) ReadById(ctx context.Context, accountId string) (*accounts.Account, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (a lockoutAccounts) PasswordMatches(ctx context.Context, email, password string) (bool, error) {
+	return false, nil
+}
+
+type lockoutNotifier struct {
+	sent []string
+}
+
+func (n *lockoutNotifier) SendLockoutEmail(ctx context.Context, email string, until time.Time) error {
+	n.sent = append(n.sent, email)
+	return nil
+}
+
+func newTestLockoutService(options LockoutOptions) (*DefaultLockoutService, *memoryLoginAttemptRepository, *lockoutNotifier) {
+	repository := newMemoryLoginAttemptRepository()
+	notifier := &lockoutNotifier{}
+	service := NewDefaultLockoutService(repository, lockoutAccounts{emails: []string{"owner@latebit.io"}}, notifier,
+		options)
+	return service, repository, notifier
+}
+
+func TestDefaultLockoutService_Backoff(t *testing.T) {
+	ctx := context.Background()
+	service, _, _ := newTestLockoutService(LockoutOptions{FreeAttempts: 2, Backoff: time.Minute, Duration: time.Hour})
+
+	for range 2 {
+		assert.NoError(t, service.Check(ctx, "owner@latebit.io"))
+		assert.NoError(t, service.Failed(ctx, "owner@latebit.io"))
+	}
+	var tooMany TooManyAttemptsError
+	assert.ErrorAs(t, service.Check(ctx, "owner@latebit.io"), &tooMany)
+	assert.InDelta(t, time.Minute.Seconds(), tooMany.RetryAfter.Seconds(), 1)
+
+	assert.NoError(t, service.Failed(ctx, "owner@latebit.io"))
+	assert.ErrorAs(t, service.Check(ctx, "owner@latebit.io"), &tooMany)
+	assert.InDelta(t, (2 * time.Minute).Seconds(), tooMany.RetryAfter.Seconds(), 1)
+
+	assert.NoError(t, service.Check(ctx, "other@latebit.io"))
+}
+
+func TestDefaultLockoutService_LockNotifies(t *testing.T) {
+	ctx := context.Background()
+	service, _, notifier := newTestLockoutService(LockoutOptions{MaxFailures: 3, Duration: time.Hour})
+
+	for _, email := range []string{"owner@latebit.io", "unknown@latebit.io"} {
+		for range 4 {
+			assert.NoError(t, service.Failed(ctx, email))
+		}
+		var tooMany TooManyAttemptsError
+		assert.ErrorAs(t, service.Check(ctx, email), &tooMany)
+		assert.InDelta(t, time.Hour.Seconds(), tooMany.RetryAfter.Seconds(), 1)
+	}
+	assert.Equal(t, []string{"owner@latebit.io"}, notifier.sent)
+
+	assert.NoError(t, service.Clear(ctx, "owner@latebit.io"))
+	assert.NoError(t, service.Check(ctx, "owner@latebit.io"))
+	attempts, err := service.Read(ctx, "owner@latebit.io")
+	assert.NoError(t, err)
+	assert.Nil(t, attempts)
+}
+
+func TestDefaultLockoutService_ClientIp(t *testing.T) {
+	ctx := WithClientIp(context.Background(), "203.0.113.7")
+	service, _, notifier := newTestLockoutService(LockoutOptions{MaxFailures: 10, IpMaxFailures: 3,
+		Duration: time.Hour})
+
+	for _, email := range []string{"a@latebit.io", "b@latebit.io", "c@latebit.io"} {
+		assert.NoError(t, service.Failed(ctx, email))
+	}
+	var tooMany TooManyAttemptsError
+	assert.ErrorAs(t, service.Check(ctx, "owner@latebit.io"), &tooMany)
+	assert.NoError(t, service.Check(WithClientIp(context.Background(), "198.51.100.1"), "owner@latebit.io"))
+	assert.Empty(t, notifier.sent)
+
+	assert.NoError(t, service.Succeeded(ctx, "a@latebit.io"))
+	assert.ErrorAs(t, service.Check(ctx, "a@latebit.io"), &tooMany)
+
+	assert.NoError(t, service.ClearIp(ctx, "203.0.113.7"))
+	assert.NoError(t, service.Check(ctx, "owner@latebit.io"))
+}
+
+func TestDefaultLockoutService_SucceededForgetsAccount(t *testing.T) {
+	ctx := context.Background()
+	service, repository, _ := newTestLockoutService(LockoutOptions{FreeAttempts: 1, Backoff: time.Minute,
+		Duration: time.Hour})
+
+	assert.NoError(t, service.Failed(ctx, "owner@latebit.io"))
+	assert.Error(t, service.Check(ctx, "owner@latebit.io"))
+	assert.NoError(t, service.Succeeded(ctx, "owner@latebit.io"))
+	assert.NoError(t, service.Check(ctx, "owner@latebit.io"))
+	assert.Empty(t, repository.attempts)
+}
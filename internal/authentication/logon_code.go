@@ -7,9 +7,9 @@ import (
 	"math/big"
 	"time"
 
+	"github.com/latebit-io/bulwarkauth/internal/clients"
 	"github.com/latebit-io/bulwarkauth/internal/email"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
-	"golang.org/x/crypto/bcrypt"
 )
 
 const (
@@ -19,7 +19,7 @@ const (
 )
 
 type LogonCodeService interface {
-	Authenticate(ctx context.Context, email, code string) (*Authenticated, error)
+	Authenticate(ctx context.Context, email, code, clientId, nonce string, audience []string) (*Authenticated, error)
 	Request(ctx context.Context, email string) error
 }
 
@@ -39,20 +39,45 @@ type DefaultLogonCodeService struct {
 	encrypt             Encryption
 	emailService        email.EmailService
 	tokens              tokens.Tokenizer
+	clients             ClientRepository
+	lockout             LockoutService
+	mfa                 MfaService
 }
 
 func NewDefaultLogonService(logonRepo LogonCodeRepository, accountsRepository AccountRepository,
-	emailService email.EmailService, tokens tokens.Tokenizer, encrypt Encryption) *DefaultLogonCodeService {
+	emailService email.EmailService, tokens tokens.Tokenizer, encrypt Encryption, clients ClientRepository,
+	lockout LockoutService, mfa MfaService) *DefaultLogonCodeService {
 	return &DefaultLogonCodeService{
 		logonCodeRepository: logonRepo,
 		accountsRepository:  accountsRepository,
 		encrypt:             encrypt,
 		emailService:        emailService,
 		tokens:              tokens,
+		clients:             clients,
+		lockout:             lockout,
+		mfa:                 mfa,
 	}
 }
 
-func (s *DefaultLogonCodeService) Authenticate(ctx context.Context, email, code string) (*Authenticated, error) {
+// Authenticate when a client is named the tokens get the client's lifetimes and an ID token is issued to it with the
+// nonce, wrong codes are counted by the lockout service like wrong passwords. Accounts with a second factor get a
+// MfaRequiredError with a challenge token instead of the tokens, see MfaService.Exchange
+func (s *DefaultLogonCodeService) Authenticate(ctx context.Context, email, code, clientId, nonce string, audience []string) (*Authenticated, error) {
+	options := tokens.TokenOptions{Audience: audience}
+	var client *clients.Client
+	if clientId != "" {
+		var err error
+		client, err = ReadClient(ctx, s.clients, clientId, clients.GrantTypePassword)
+		if err != nil {
+			return nil, err
+		}
+		options = client.TokenOptions(audience)
+	}
+
+	if err := s.lockout.Check(ctx, email); err != nil {
+		return nil, err
+	}
+
 	compareCode, err := s.logonCodeRepository.Read(ctx, email)
 	if err != nil {
 		return nil, err
@@ -64,19 +89,40 @@ func (s *DefaultLogonCodeService) Authenticate(ctx context.Context, email, code
 	}
 
 	if verified {
+		if err := s.lockout.Succeeded(ctx, email); err != nil {
+			return nil, err
+		}
 		account, err := s.accountsRepository.Read(ctx, email)
 		if err != nil {
 			return nil, err
 		}
 
-		accessToken, err := s.tokens.CreateAccessToken(ctx, email, account.Roles)
+		if account.MfaEnabled() {
+			challengeToken, err := s.mfa.Challenge(ctx, account, tokens.AmrOneTimePassword, clientId, nonce, audience)
+			if err != nil {
+				return nil, err
+			}
+			if err := s.logonCodeRepository.Delete(ctx, email, compareCode.Code); err != nil {
+				log.Println(err)
+			}
+			return nil, MfaRequiredError{Value: account.Email, ChallengeToken: challengeToken}
+		}
+
+		accessToken, err := s.tokens.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
 		if err != nil {
 			return nil, err
 		}
-		refreshToken, err := s.tokens.CreateRefreshToken(ctx, email)
+		refreshToken, err := s.tokens.CreateRefreshToken(ctx, account.AccountId, options)
 		if err != nil {
 			return nil, err
 		}
+		idToken := ""
+		if client != nil {
+			idToken, err = CreateIdToken(ctx, s.tokens, client, account, nonce, tokens.AmrOneTimePassword)
+			if err != nil {
+				return nil, err
+			}
+		}
 		err = s.logonCodeRepository.Delete(ctx, email, compareCode.Code)
 		if err != nil {
 			log.Println(err)
@@ -84,9 +130,13 @@ func (s *DefaultLogonCodeService) Authenticate(ctx context.Context, email, code
 		return &Authenticated{
 			AccessToken:  accessToken,
 			RefreshToken: refreshToken,
+			IdToken:      idToken,
 		}, nil
 	}
 
+	if err = s.lockout.Failed(ctx, email); err != nil {
+		return nil, err
+	}
 	return nil, AuthenticationError{
 		Value: email,
 	}
@@ -103,12 +153,12 @@ func (s *DefaultLogonCodeService) Request(ctx context.Context, email string) err
 		return err
 	}
 
-	hashedCode, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	hashedCode, err := s.encrypt.Encrypt(code)
 	if err != nil {
 		return err
 	}
 
-	err = s.logonCodeRepository.Create(ctx, email, string(hashedCode), time.Now().Add(expires))
+	err = s.logonCodeRepository.Create(ctx, email, hashedCode, time.Now().Add(expires))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,87 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryLogonCodes map[string]string
+
+func (m memoryLogonCodes) Create(ctx context.Context, email, code string, expires time.Time) error {
+	m[email] = code
+	return nil
+}
+
+func (m memoryLogonCodes) Delete(ctx context.Context, email, code string) error {
+	delete(m, email)
+	return nil
+}
+
+func (m memoryLogonCodes) Read(ctx context.Context, email string) (*LogonCode, error) {
+	code, ok := m[email]
+	if !ok {
+		return nil, errors.New("no logon code")
+	}
+	return &LogonCode{Email: email, Code: code}, nil
+}
+
+// logonAccounts every account has a confirmed second factor
+type logonAccounts struct {
+	lockoutAccounts
+}
+
+func (a logonAccounts) Read(ctx context.Context, email string) (*accounts.Account, error) {
+	return &accounts.Account{AccountId: "account", Email: email, Totp: &accounts.Totp{Confirmed: true}}, nil
+}
+
+type plainEncryption struct{}
+
+func (plainEncryption) Encrypt(password string) (string, error) {
+	return password, nil
+}
+
+func (plainEncryption) Verify(password, verifyPassword string) (bool, error) {
+	return password == verifyPassword, nil
+}
+
+type challengeMfa struct {
+	MfaService
+	method string
+}
+
+func (m *challengeMfa) Challenge(ctx context.Context, account *accounts.Account, method, clientId, nonce string,
+	audience []string) (string, error) {
+	m.method = method
+	return "challenge", nil
+}
+
+func TestDefaultLogonCodeService_AuthenticateMfa(t *testing.T) {
+	lockout, _, _ := newTestLockoutService(LockoutOptions{FreeAttempts: 3, Backoff: time.Minute, Duration: time.Hour})
+	codes := memoryLogonCodes{"owner@latebit.io": "123456"}
+	mfa := &challengeMfa{}
+	service := NewDefaultLogonService(codes, logonAccounts{}, nil, nil, plainEncryption{}, nil, lockout, mfa)
+
+	authenticated, err := service.Authenticate(context.TODO(), "owner@latebit.io", "123456", "", "", nil)
+	assert.Nil(t, authenticated)
+	var mfaRequired MfaRequiredError
+	assert.ErrorAs(t, err, &mfaRequired)
+	assert.Equal(t, "challenge", mfaRequired.ChallengeToken)
+	assert.Equal(t, tokens.AmrOneTimePassword, mfa.method)
+	// the logon code can not be used again
+	assert.Empty(t, codes)
+}
+
+func TestChallengeMethods(t *testing.T) {
+	assert.Equal(t, []string{tokens.AmrPassword, tokens.AmrOneTimePassword, tokens.AmrMultiFactor},
+		challengeMethods(&MfaChallenge{}))
+	assert.Equal(t, []string{tokens.AmrOneTimePassword, tokens.AmrMultiFactor},
+		challengeMethods(&MfaChallenge{Method: tokens.AmrOneTimePassword}))
+	assert.Equal(t, []string{tokens.AmrFederated, tokens.AmrOneTimePassword, tokens.AmrMultiFactor},
+		challengeMethods(&MfaChallenge{Method: tokens.AmrFederated}))
+}
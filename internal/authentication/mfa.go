@@ -0,0 +1,347 @@
+package authentication
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/encryption"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+const (
+	challengeTokenSize = 32
+	// maxChallengeAttempts wrong codes a challenge takes before it has to be started over with the password
+	maxChallengeAttempts = 5
+)
+
+var errMfaNotConfigured = errors.New("no mfa key-encryption key is configured")
+
+// MfaService TOTP second factors, see RFC 6238. An account enrolls and confirms a factor with an access token, after
+// that a password sign in returns a challenge that is exchanged for the tokens together with a code
+type MfaService interface {
+	Enroll(ctx context.Context, email, accessToken string) (*TotpEnrollment, error)
+	Confirm(ctx context.Context, email, code, accessToken string) error
+	Disable(ctx context.Context, email, code, accessToken string) error
+	Verify(ctx context.Context, account *accounts.Account, code string) error
+	Challenge(ctx context.Context, account *accounts.Account, method, clientId, nonce string, audience []string) (string, error)
+	Exchange(ctx context.Context, challengeToken, code string) (*Authenticated, error)
+}
+
+type MfaAccountRepository interface {
+	Read(ctx context.Context, email string) (*accounts.Account, error)
+	ReadById(ctx context.Context, accountId string) (*accounts.Account, error)
+	UpdateTotp(ctx context.Context, email string, totp *accounts.Totp) error
+	UseTotp(ctx context.Context, email string, counter int64, confirm bool) (bool, error)
+}
+
+// TotpEnrollment the secret for authenticator apps that can not read the URI
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+// MfaOptions Issuer names the service in authenticator apps
+type MfaOptions struct {
+	Issuer             string
+	ChallengeExpiresIn time.Duration
+}
+
+type DefaultMfaService struct {
+	accounts      MfaAccountRepository
+	challenges    MfaChallengeRepository
+	tokens        Tokenizer
+	revocations   tokens.RevocationService
+	clients       ClientRepository
+	lockout       LockoutService
+	keyEncryption *encryption.KeyEncryption
+	options       MfaOptions
+}
+
+// NewDefaultMfaService the secrets are sealed with the key encryption, without one accounts can not enroll
+func NewDefaultMfaService(accounts MfaAccountRepository, challenges MfaChallengeRepository, tokenizer Tokenizer,
+	revocations tokens.RevocationService, clients ClientRepository, lockout LockoutService,
+	keyEncryption *encryption.KeyEncryption, options MfaOptions) *DefaultMfaService {
+	return &DefaultMfaService{
+		accounts:      accounts,
+		challenges:    challenges,
+		tokens:        tokenizer,
+		revocations:   revocations,
+		clients:       clients,
+		lockout:       lockout,
+		keyEncryption: keyEncryption,
+		options:       options,
+	}
+}
+
+// Enroll starts a new factor for the account, it is only used once confirmed. A confirmed factor has to be disabled
+// before another can be enrolled
+func (s *DefaultMfaService) Enroll(ctx context.Context, email, accessToken string) (*TotpEnrollment, error) {
+	if s.keyEncryption == nil {
+		return nil, errMfaNotConfigured
+	}
+	account, err := s.tokenAccount(ctx, email, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if account.MfaEnabled() {
+		return nil, MfaEnrollmentError{Value: "a confirmed factor is already enrolled"}
+	}
+
+	secret, err := newTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+	envelope, err := s.keyEncryption.Seal(secret)
+	if err != nil {
+		return nil, err
+	}
+	err = s.accounts.UpdateTotp(ctx, account.Email, &accounts.Totp{
+		Secret:     envelope.Ciphertext,
+		WrappedKey: envelope.WrappedKey,
+		KekId:      envelope.KekId,
+		Counter:    0,
+		Created:    time.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &TotpEnrollment{
+		Secret: totpEncoding.EncodeToString(secret),
+		Uri:    totpUri(s.options.Issuer, account.Email, secret),
+	}, nil
+}
+
+// Confirm turns the enrolled factor on with a first code, proving the authenticator app has the secret
+func (s *DefaultMfaService) Confirm(ctx context.Context, email, code, accessToken string) error {
+	account, err := s.tokenAccount(ctx, email, accessToken)
+	if err != nil {
+		return err
+	}
+	if account.Totp == nil || account.Totp.Confirmed {
+		return MfaEnrollmentError{Value: "there is no factor waiting to be confirmed"}
+	}
+
+	return s.verifyCode(ctx, account, code, true)
+}
+
+// Disable removes the factor, a current code is needed so a stolen access token alone can not turn it off
+func (s *DefaultMfaService) Disable(ctx context.Context, email, code, accessToken string) error {
+	account, err := s.tokenAccount(ctx, email, accessToken)
+	if err != nil {
+		return err
+	}
+	if account.Totp == nil {
+		return MfaEnrollmentError{Value: "no factor is enrolled"}
+	}
+	if account.Totp.Confirmed {
+		if err = s.Verify(ctx, account, code); err != nil {
+			return err
+		}
+	}
+
+	return s.accounts.UpdateTotp(ctx, account.Email, nil)
+}
+
+// Verify checks the code of an account with a confirmed factor, accounts without one pass. Wrong codes are counted
+// by the lockout service like wrong passwords
+func (s *DefaultMfaService) Verify(ctx context.Context, account *accounts.Account, code string) error {
+	if !account.MfaEnabled() {
+		return nil
+	}
+	if err := s.lockout.Check(ctx, account.Email); err != nil {
+		return err
+	}
+
+	err := s.verifyCode(ctx, account, code, false)
+	var codeErr MfaCodeError
+	if errors.As(err, &codeErr) {
+		if err := s.lockout.Failed(ctx, account.Email); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Challenge starts the second step of a sign in, the token is returned once and only its hash is stored. The method
+// is the amr value of the first step, a password, logon code or social sign in
+func (s *DefaultMfaService) Challenge(ctx context.Context, account *accounts.Account, method, clientId, nonce string,
+	audience []string) (string, error) {
+	tokenBytes := make([]byte, challengeTokenSize)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+
+	now := time.Now()
+	err := s.challenges.Create(ctx, MfaChallenge{
+		TokenHash: hashChallengeToken(token),
+		Email:     account.Email,
+		Method:    method,
+		ClientId:  clientId,
+		Nonce:     nonce,
+		Audience:  audience,
+		Created:   now,
+		Expires:   now.Add(s.options.ChallengeExpiresIn),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Exchange issues the tokens of the sign in the challenge was made for, a challenge can only be exchanged once and
+// is removed after too many wrong codes
+func (s *DefaultMfaService) Exchange(ctx context.Context, challengeToken, code string) (*Authenticated, error) {
+	tokenHash := hashChallengeToken(challengeToken)
+	challenge, err := s.challenges.Read(ctx, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil {
+		return nil, MfaChallengeError{}
+	}
+
+	account, err := s.accounts.Read(ctx, challenge.Email)
+	if err != nil {
+		return nil, err
+	}
+	if err = accountHealth(account); err != nil {
+		return nil, err
+	}
+
+	err = s.Verify(ctx, account, code)
+	var codeErr MfaCodeError
+	if errors.As(err, &codeErr) {
+		if err := s.challenges.Fail(ctx, tokenHash, maxChallengeAttempts); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	consumed, err := s.challenges.Consume(ctx, tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		return nil, MfaChallengeError{}
+	}
+
+	return s.issue(ctx, account, challenge)
+}
+
+// issue the tokens Authenticate would have issued without a second factor
+func (s *DefaultMfaService) issue(ctx context.Context, account *accounts.Account, challenge *MfaChallenge) (*Authenticated, error) {
+	options := tokens.TokenOptions{Audience: challenge.Audience}
+	var client *clients.Client
+	if challenge.ClientId != "" {
+		var err error
+		client, err = s.clients.Read(ctx, challenge.ClientId)
+		if err != nil {
+			return nil, err
+		}
+		options = client.TokenOptions(challenge.Audience)
+	}
+
+	accessToken, err := s.tokens.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := s.tokens.CreateRefreshToken(ctx, account.AccountId, options)
+	if err != nil {
+		return nil, err
+	}
+	idToken := ""
+	if client != nil {
+		idToken, err = CreateIdToken(ctx, s.tokens, client, account, challenge.Nonce, challengeMethods(challenge)...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Authenticated{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		IdToken:      idToken,
+	}, nil
+}
+
+// challengeMethods the amr values of a sign in completed with a second factor, challenges made before the method was
+// recorded were password sign ins
+func challengeMethods(challenge *MfaChallenge) []string {
+	first := cmp.Or(challenge.Method, tokens.AmrPassword)
+	if first == tokens.AmrOneTimePassword {
+		return []string{first, tokens.AmrMultiFactor}
+	}
+	return []string{first, tokens.AmrOneTimePassword, tokens.AmrMultiFactor}
+}
+
+// verifyCode opens the secret and records the time step of the code, so it can not be used again
+func (s *DefaultMfaService) verifyCode(ctx context.Context, account *accounts.Account, code string, confirm bool) error {
+	if s.keyEncryption == nil {
+		return errMfaNotConfigured
+	}
+	secret, err := s.keyEncryption.Open(encryption.Envelope{
+		Ciphertext: account.Totp.Secret,
+		WrappedKey: account.Totp.WrappedKey,
+		KekId:      account.Totp.KekId,
+	})
+	if err != nil {
+		return err
+	}
+
+	counter, ok := totpValidate(secret, code, time.Now())
+	if !ok {
+		return MfaCodeError{Value: account.Email}
+	}
+	used, err := s.accounts.UseTotp(ctx, account.Email, counter, confirm)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return MfaCodeError{Value: account.Email}
+	}
+	return nil
+}
+
+// tokenAccount the account the access token was issued to, which must be the account of the email. Tokens a client
+// requested for itself and exchanged tokens are rejected
+func (s *DefaultMfaService) tokenAccount(ctx context.Context, email, accessToken string) (*accounts.Account, error) {
+	token, err := s.tokens.ValidateAccessToken(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.ClientId != "" || token.Act != nil {
+		return nil, errors.New("invalid token")
+	}
+	revoked, err := s.revocations.IsRevoked(ctx, token.RegisteredClaims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, tokens.TokenRevokedError{Value: token.ID}
+	}
+
+	account, err := s.accounts.ReadById(ctx, token.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if account.Email != email {
+		return nil, errors.New("invalid token")
+	}
+	return account, nil
+}
+
+func hashChallengeToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
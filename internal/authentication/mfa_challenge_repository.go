@@ -0,0 +1,105 @@
+package authentication
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionMfaChallenges = "mfaChallenges"
+)
+
+// MfaChallenge a password sign in waiting for its second factor, it holds what the tokens are issued for once the
+// code is given. Only the hash of the challenge token is stored
+type MfaChallenge struct {
+	TokenHash string    `bson:"tokenHash"`
+	Email     string    `bson:"email"`
+	Method    string    `bson:"method,omitempty"`
+	ClientId  string    `bson:"clientId,omitempty"`
+	Nonce     string    `bson:"nonce,omitempty"`
+	Audience  []string  `bson:"audience,omitempty"`
+	Attempts  int       `bson:"attempts"`
+	Created   time.Time `bson:"created"`
+	Expires   time.Time `bson:"expires"`
+}
+
+type MfaChallengeRepository interface {
+	Create(ctx context.Context, challenge MfaChallenge) error
+	Read(ctx context.Context, tokenHash string) (*MfaChallenge, error)
+	Fail(ctx context.Context, tokenHash string, maxAttempts int) error
+	Consume(ctx context.Context, tokenHash string) (bool, error)
+}
+
+type MongodbMfaChallengeRepository struct {
+	db *mongo.Database
+}
+
+func NewMongodbMfaChallengeRepository(db *mongo.Database) *MongodbMfaChallengeRepository {
+	// mongodb removes expired challenges that were never answered
+	_, err := db.Collection(collectionMfaChallenges).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbMfaChallengeRepository{db: db}
+}
+
+func (r *MongodbMfaChallengeRepository) Create(ctx context.Context, challenge MfaChallenge) error {
+	_, err := r.db.Collection(collectionMfaChallenges).InsertOne(ctx, challenge)
+	return err
+}
+
+// Read returns nil when there is no unexpired challenge
+func (r *MongodbMfaChallengeRepository) Read(ctx context.Context, tokenHash string) (*MfaChallenge, error) {
+	var challenge MfaChallenge
+	err := r.db.Collection(collectionMfaChallenges).FindOne(ctx, bson.D{
+		{Key: "tokenHash", Value: tokenHash},
+		{Key: "expires", Value: bson.D{{Key: "$gt", Value: time.Now()}}},
+	}).Decode(&challenge)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// Fail counts a wrong code, the challenge is removed once it has had maxAttempts
+func (r *MongodbMfaChallengeRepository) Fail(ctx context.Context, tokenHash string, maxAttempts int) error {
+	collection := r.db.Collection(collectionMfaChallenges)
+	_, err := collection.UpdateOne(ctx, bson.D{{Key: "tokenHash", Value: tokenHash}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "attempts", Value: 1}}}})
+	if err != nil {
+		return err
+	}
+	_, err = collection.DeleteOne(ctx, bson.D{
+		{Key: "tokenHash", Value: tokenHash},
+		{Key: "attempts", Value: bson.D{{Key: "$gte", Value: maxAttempts}}},
+	})
+	return err
+}
+
+// Consume removes the challenge so it can only be answered once, even across replicas. False when it was already
+// removed
+func (r *MongodbMfaChallengeRepository) Consume(ctx context.Context, tokenHash string) (bool, error) {
+	result, err := r.db.Collection(collectionMfaChallenges).DeleteOne(ctx, bson.D{{Key: "tokenHash", Value: tokenHash}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
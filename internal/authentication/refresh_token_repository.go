@@ -0,0 +1,73 @@
+package authentication
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionRefreshTokens = "refreshTokens"
+)
+
+// UsedRefreshToken a refresh token that has already been exchanged for a new token pair
+type UsedRefreshToken struct {
+	TokenId string    `bson:"tokenId"`
+	Family  string    `bson:"family"`
+	Email   string    `bson:"email"`
+	Used    time.Time `bson:"used"`
+	Expires time.Time `bson:"expires"`
+}
+
+type RefreshTokenRepository interface {
+	MarkUsed(ctx context.Context, token UsedRefreshToken) error
+}
+
+type DefaultRefreshTokenRepository struct {
+	db *mongo.Database
+}
+
+func NewDefaultRefreshTokenRepository(db *mongo.Database) *DefaultRefreshTokenRepository {
+	collection := db.Collection(collectionRefreshTokens)
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &DefaultRefreshTokenRepository{db}
+}
+
+// IsUsed the refresh token has already been exchanged for a new token pair
+func (r *DefaultRefreshTokenRepository) IsUsed(ctx context.Context, tokenId string) (bool, error) {
+	collection := r.db.Collection(collectionRefreshTokens)
+	count, err := collection.CountDocuments(ctx, bson.M{"tokenId": tokenId}, options.Count().SetLimit(1))
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// MarkUsed records the refresh token as used, it returns RefreshTokenReuseError when the token was already used
+func (r *DefaultRefreshTokenRepository) MarkUsed(ctx context.Context, token UsedRefreshToken) error {
+	collection := r.db.Collection(collectionRefreshTokens)
+	_, err := collection.InsertOne(ctx, token)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return RefreshTokenReuseError{Value: token.Family}
+		}
+		return err
+	}
+	return nil
+}
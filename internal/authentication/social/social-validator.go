@@ -6,9 +6,9 @@ import (
 	"fmt"
 
 	"github.com/coreos/go-oidc/v3/oidc"
-	"github.com/google/uuid"
 	"github.com/latebit-io/bulwarkauth/internal/accounts"
 	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
 	"github.com/latebit-io/bulwarkauth/internal/encryption"
 	"github.com/latebit-io/bulwarkauth/internal/tokens"
 )
@@ -72,7 +72,7 @@ func (gv *GoogleValidator) ValidateToken(ctx context.Context, ID string) (*Socia
 
 type SocialService interface {
 	AddValidator(validator Validator)
-	Authenticate(context context.Context, idToken, provider string) (*authentication.Authenticated, error)
+	Authenticate(context context.Context, idToken, provider, clientId, nonce string, audience []string) (*authentication.Authenticated, error)
 }
 
 type DefaultSocialService struct {
@@ -81,16 +81,21 @@ type DefaultSocialService struct {
 	accountService accounts.AccountService
 	encrypt        encryption.Encryption
 	token          tokens.Tokenizer
+	clients        authentication.ClientRepository
+	mfa            authentication.MfaService
 }
 
 func NewDefaultSocialService(accountRepo accounts.AccountRepository,
-	accountService accounts.AccountService, encryption encryption.Encryption, token tokens.Tokenizer) *DefaultSocialService {
+	accountService accounts.AccountService, encryption encryption.Encryption, token tokens.Tokenizer,
+	clients authentication.ClientRepository, mfa authentication.MfaService) *DefaultSocialService {
 	return &DefaultSocialService{
 		validators:     make(map[string]Validator),
 		accountRepo:    accountRepo,
 		accountService: accountService,
 		encrypt:        encryption,
 		token:          token,
+		clients:        clients,
+		mfa:            mfa,
 	}
 }
 
@@ -98,11 +103,24 @@ func (s *DefaultSocialService) AddValidator(validator Validator) {
 	s.validators[validator.Name()] = validator
 }
 
-func (s *DefaultSocialService) Authenticate(ctx context.Context, idToken, provider string) (*authentication.Authenticated, error) {
+// Authenticate when a client is named the tokens get the client's lifetimes and an ID token of our own is issued to
+// it with the nonce. Accounts with a second factor get a MfaRequiredError with a challenge token instead of the
+// tokens, see MfaService.Exchange
+func (s *DefaultSocialService) Authenticate(ctx context.Context, idToken, provider, clientId, nonce string, audience []string) (*authentication.Authenticated, error) {
 	validator, ok := s.validators[provider]
 	if !ok {
 		return nil, fmt.Errorf("no validator found for provider %s", provider)
 	}
+	options := tokens.TokenOptions{Audience: audience}
+	var client *clients.Client
+	if clientId != "" {
+		var err error
+		client, err = authentication.ReadClient(ctx, s.clients, clientId, clients.GrantTypePassword)
+		if err != nil {
+			return nil, err
+		}
+		options = client.TokenOptions(audience)
+	}
 	social, err := validator.ValidateToken(ctx, idToken)
 	if err != nil {
 		return nil, err
@@ -115,8 +133,7 @@ func (s *DefaultSocialService) Authenticate(ctx context.Context, idToken, provid
 	account, err := s.accountRepo.Read(ctx, social.Email)
 	var notFound accounts.AccountNotFoundError
 	if errors.As(err, &notFound) {
-		randomPassword := uuid.New().String()
-		err = s.accountService.Create(ctx, social.Email, randomPassword)
+		err = s.accountService.CreateSocial(ctx, social.Email)
 		if err != nil {
 			return nil, err
 		}
@@ -134,17 +151,33 @@ func (s *DefaultSocialService) Authenticate(ctx context.Context, idToken, provid
 		return nil, err
 	}
 
-	accessToken, err := s.token.CreateAccessToken(ctx, account.Email, account.Roles)
+	if account.MfaEnabled() {
+		challengeToken, err := s.mfa.Challenge(ctx, account, tokens.AmrFederated, clientId, nonce, audience)
+		if err != nil {
+			return nil, err
+		}
+		return nil, authentication.MfaRequiredError{Value: account.Email, ChallengeToken: challengeToken}
+	}
+
+	accessToken, err := s.token.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
 	if err != nil {
 		return nil, err
 	}
-	refreshToken, err := s.token.CreateRefreshToken(ctx, account.Email)
+	refreshToken, err := s.token.CreateRefreshToken(ctx, account.AccountId, options)
 	if err != nil {
 		return nil, err
 	}
+	signedIn := ""
+	if client != nil {
+		signedIn, err = authentication.CreateIdToken(ctx, s.token, client, account, nonce, tokens.AmrFederated)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &authentication.Authenticated{
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		IdToken:      signedIn,
 	}, nil
 }
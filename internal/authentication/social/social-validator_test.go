@@ -4,6 +4,7 @@ import (
 	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/latebit-io/bulwarkauth/internal/accounts"
 	"github.com/latebit-io/bulwarkauth/internal/encryption"
@@ -95,18 +96,20 @@ func TestGoogleValidator_WithRealToken_FullFlow(t *testing.T) {
 	encrypt := encryption.NewDefaultEncryption()
 	accountRepo := accounts.NewMongodbAccountRepository(db, encrypt)
 	forgotRepo := accounts.NewMongoDbForgotRepository(db)
-	signingRepo := tokens.NewDefaultSigningKeyRepository(db)
-	signingService := tokens.NewDefaultSigningKeyService(signingRepo)
+	signingRepo := tokens.NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := tokens.NewDefaultSigningKeyService(signingRepo, "RS256", false)
 	err = signingService.Initialize(context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
-	tokenizer := tokens.NewDefaultTokenizer("test", "test", "test", 3600, 9600, signingService)
+	tokenizer := tokens.NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
 
 	mockEmailService := &accounts.MockEmailService{}
 	mockEmailService.On("SendVerificationEmail", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 
-	accountService := accounts.NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager)
+	revocations := tokens.NewDefaultRevocationService(tokens.NewDefaultRevocationRepository(db), time.Hour, time.Minute)
+	accountService := accounts.NewDefaultAccountService(accountRepo, forgotRepo, tokenizer, mockEmailService, mongodbTxManager, revocations, nil,
+		accounts.NewDefaultPasswordPolicy(accounts.PasswordPolicyOptions{}))
 
 	// Create real Google validator
 	googleValidator, err := NewGoogleValidator(clientID)
@@ -139,11 +142,11 @@ func TestGoogleValidator_WithRealToken_FullFlow(t *testing.T) {
 	}
 
 	// Setup social service with real Google validator
-	socialService := NewDefaultSocialService(accountRepo, accountService, encrypt, tokenizer)
+	socialService := NewDefaultSocialService(accountRepo, accountService, encrypt, tokenizer, nil, nil)
 	socialService.AddValidator(googleValidator)
 
 	// Authenticate with the real Google ID token
-	authenticated, err := socialService.Authenticate(context.Background(), idToken, "google")
+	authenticated, err := socialService.Authenticate(context.Background(), idToken, "google", "", "", nil)
 
 	// Assertions
 	assert.NoError(t, err, "Authentication should succeed")
@@ -2,7 +2,9 @@ package authentication
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
@@ -15,20 +17,22 @@ const (
 )
 
 type Token struct {
-	Id           string    `json:"id"`
-	Email        string    `json:"email"`
-	ClientId     string    `json:"clientId"`
-	AccessToken  string    `json:"accessToken"`
-	RefreshToken string    `json:"refreshToken"`
-	CreatedAt    time.Time `json:"createdAt"`
-	ModifiedAt   time.Time `json:"modifiedAt"`
+	Id           string    `json:"id" bson:"-"`
+	Email        string    `json:"email" bson:"email"`
+	ClientId     string    `json:"clientId" bson:"clientId"`
+	AccessToken  string    `json:"accessToken" bson:"accessToken"`
+	RefreshToken string    `json:"refreshToken" bson:"refreshToken"`
+	CreatedAt    time.Time `json:"createdAt" bson:"createdAt"`
+	ModifiedAt   time.Time `json:"modifiedAt" bson:"modifiedAt"`
 }
 
 type TokenRepository interface {
 	Create(ctx context.Context, email, clientId, accessToken, refreshToken string) error
 	Delete(ctx context.Context, email, clientId string) error
 	DeleteByEmail(ctx context.Context, email string) error
+	UpdateEmail(ctx context.Context, email, newEmail string) error
 	Read(ctx context.Context, email, clientId string) (*Token, error)
+	ReadByToken(ctx context.Context, token string) (*Token, error)
 }
 
 type DefaultTokenRepository struct {
@@ -36,6 +40,14 @@ type DefaultTokenRepository struct {
 }
 
 func NewDefaultTokenRepository(db *mongo.Database) *DefaultTokenRepository {
+	// sessions are looked up by token for introspection
+	_, err := db.Collection(collectionTokens).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{Keys: bson.D{{Key: "accessToken", Value: 1}}},
+		{Keys: bson.D{{Key: "refreshToken", Value: 1}}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
 	return &DefaultTokenRepository{db}
 }
 
@@ -71,7 +83,18 @@ func (t *DefaultTokenRepository) Create(ctx context.Context, email, clientId, ac
 
 func (t *DefaultTokenRepository) DeleteByEmail(ctx context.Context, email string) error {
 	collection := t.db.Collection(collectionTokens)
-	_, err := collection.DeleteOne(ctx, bson.M{"email": email})
+	_, err := collection.DeleteMany(ctx, bson.M{"email": email})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// UpdateEmail moves the sessions of an account to its new email
+func (t *DefaultTokenRepository) UpdateEmail(ctx context.Context, email, newEmail string) error {
+	collection := t.db.Collection(collectionTokens)
+	_, err := collection.UpdateMany(ctx, bson.M{"email": email}, bson.M{"$set": bson.M{"email": newEmail,
+		"modifiedAt": time.Now()}})
 	if err != nil {
 		return err
 	}
@@ -87,12 +110,31 @@ func (t *DefaultTokenRepository) Delete(ctx context.Context, email, clientId str
 	return nil
 }
 
+// Read the acknowledged session of the client, nil when there is none
 func (t *DefaultTokenRepository) Read(ctx context.Context, email, clientId string) (*Token, error) {
 	collection := t.db.Collection(collectionTokens)
 	var token Token
-	err := collection.FindOne(ctx, bson.M{"email": email}).Decode(&token)
+	err := collection.FindOne(ctx, bson.M{"email": email, "clientId": clientId}).Decode(&token)
 	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	return &token, nil
 }
+
+// ReadByToken finds the acknowledged session holding the access or refresh token, nil when there is none
+func (t *DefaultTokenRepository) ReadByToken(ctx context.Context, token string) (*Token, error) {
+	collection := t.db.Collection(collectionTokens)
+	var session Token
+	filter := bson.M{"$or": bson.A{bson.M{"accessToken": token}, bson.M{"refreshToken": token}}}
+	err := collection.FindOne(ctx, filter).Decode(&session)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
@@ -0,0 +1,83 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters of RFC 6238, the defaults every authenticator app supports
+const (
+	totpDigits     = 6
+	totpModulo     = 1_000_000
+	totpPeriod     = 30 * time.Second
+	totpSecretSize = 20
+	// totpSkew time steps either side of now that are accepted, for clocks that drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newTotpSecret() ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// totpCounter the time step of t
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod/time.Second)
+}
+
+// totpCode the HOTP value of RFC 4226 for the counter
+func totpCode(secret []byte, counter int64) string {
+	mac := hmac.New(sha1.New, secret)
+	_ = binary.Write(mac, binary.BigEndian, counter)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulo)
+}
+
+// totpValidate returns the time step the code is for, codes of the steps next to now are accepted too
+func totpValidate(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := totpCounter(now)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// totpUri the otpauth:// URI authenticator apps read from a QR code, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+func totpUri(issuer, email string, secret []byte) string {
+	label := url.PathEscape(email)
+	if issuer != "" {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+	query := url.Values{
+		"secret":    {totpEncoding.EncodeToString(secret)},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	if issuer != "" {
+		query.Set("issuer", issuer)
+	}
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
@@ -0,0 +1,111 @@
+package authentication
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc6238Secret the SHA1 seed of the RFC 6238 test vectors
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTotpCode(t *testing.T) {
+	// the last six digits of the RFC 6238 appendix B vectors
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, code := range vectors {
+		assert.Equal(t, code, totpCode(rfc6238Secret, totpCounter(time.Unix(unix, 0))), unix)
+	}
+}
+
+func TestTotpValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	counter, ok := totpValidate(rfc6238Secret, "081 804", now)
+	assert.True(t, ok)
+	assert.Equal(t, totpCounter(now), counter)
+
+	counter, ok = totpValidate(rfc6238Secret, "081804", now.Add(totpPeriod))
+	assert.True(t, ok)
+	assert.Equal(t, totpCounter(now), counter)
+
+	_, ok = totpValidate(rfc6238Secret, "081804", now.Add(2*totpPeriod))
+	assert.False(t, ok)
+	_, ok = totpValidate(rfc6238Secret, "81804", now)
+	assert.False(t, ok)
+}
+
+func TestTotpUri(t *testing.T) {
+	uri, err := url.Parse(totpUri("Bulwark", "owner@latebit.io", rfc6238Secret))
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", uri.Scheme)
+	assert.Equal(t, "totp", uri.Host)
+	assert.Equal(t, "/Bulwark:owner@latebit.io", uri.Path)
+	assert.Equal(t, "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", uri.Query().Get("secret"))
+	assert.Equal(t, "Bulwark", uri.Query().Get("issuer"))
+	assert.Equal(t, "6", uri.Query().Get("digits"))
+}
+
+type mfaAccounts struct {
+	account *accounts.Account
+}
+
+func (a *mfaAccounts) Read(ctx context.Context, email string) (*accounts.Account, error) {
+	return a.account, nil
+}
+
+func (a *mfaAccounts) ReadById(ctx context.Context, accountId string) (*accounts.Account, error) {
+	return a.account, nil
+}
+
+func (a *mfaAccounts) UpdateTotp(ctx context.Context, email string, totp *accounts.Totp) error {
+	a.account.Totp = totp
+	return nil
+}
+
+func (a *mfaAccounts) UseTotp(ctx context.Context, email string, counter int64, confirm bool) (bool, error) {
+	if a.account.Totp.Counter >= counter {
+		return false, nil
+	}
+	a.account.Totp.Counter = counter
+	if confirm {
+		a.account.Totp.Confirmed = true
+	}
+	return true, nil
+}
+
+func TestDefaultMfaService_VerifyRejectsReplay(t *testing.T) {
+	ctx := context.Background()
+	keyEncryption, err := encryption.NewKeyEncryption(make([]byte, 32))
+	assert.NoError(t, err)
+	envelope, err := keyEncryption.Seal(rfc6238Secret)
+	assert.NoError(t, err)
+	account := &accounts.Account{Email: "owner@latebit.io", Totp: &accounts.Totp{
+		Secret:     envelope.Ciphertext,
+		WrappedKey: envelope.WrappedKey,
+		KekId:      envelope.KekId,
+		Confirmed:  true,
+	}}
+	lockout, _, _ := newTestLockoutService(LockoutOptions{MaxFailures: 10, Duration: time.Hour})
+	service := NewDefaultMfaService(&mfaAccounts{account: account}, nil, nil, nil, nil, lockout, keyEncryption,
+		MfaOptions{})
+
+	code := totpCode(rfc6238Secret, totpCounter(time.Now()))
+	assert.NoError(t, service.Verify(ctx, account, code))
+	var codeErr MfaCodeError
+	assert.ErrorAs(t, service.Verify(ctx, account, code), &codeErr)
+
+	attempts, err := lockout.Read(ctx, "owner@latebit.io")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, attempts.Failures)
+	assert.NoError(t, service.Verify(ctx, &accounts.Account{Email: "other@latebit.io"}, ""))
+}
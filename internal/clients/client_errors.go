@@ -0,0 +1,51 @@
+package clients
+
+import "fmt"
+
+type ClientNotFoundError struct {
+	Value string `json:"value"`
+}
+
+func (e ClientNotFoundError) Error() string {
+	return fmt.Sprintf("client not found: %s", e.Value)
+}
+
+type ClientDuplicateError struct {
+	Value string `json:"value"`
+}
+
+func (e ClientDuplicateError) Error() string {
+	return fmt.Sprintf("duplicate client: '%s' already exists", e.Value)
+}
+
+type ClientValidationError struct {
+	Value string `json:"value"`
+}
+
+func (e ClientValidationError) Error() string {
+	return fmt.Sprintf("invalid client: %s", e.Value)
+}
+
+type ClientAuthenticationError struct {
+	Value string `json:"value"`
+}
+
+func (e ClientAuthenticationError) Error() string {
+	return fmt.Sprintf("client authentication failed: %s", e.Value)
+}
+
+type GrantTypeError struct {
+	Value string `json:"value"`
+}
+
+func (e GrantTypeError) Error() string {
+	return fmt.Sprintf("grant type not allowed for client: %s", e.Value)
+}
+
+type ScopeError struct {
+	Value string `json:"value"`
+}
+
+func (e ScopeError) Error() string {
+	return fmt.Sprintf("scope not allowed for client: %s", e.Value)
+}
@@ -0,0 +1,185 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	clientCollection          = "clients"
+	clientAssertionCollection = "clientAssertions"
+)
+
+type ClientRepository interface {
+	Create(ctx context.Context, client Client) error
+	Read(ctx context.Context, clientId string) (*Client, error)
+	ReadAll(ctx context.Context) ([]Client, error)
+	Update(ctx context.Context, client Client) error
+	UpdateSecret(ctx context.Context, clientId, secretHash string) error
+	Delete(ctx context.Context, clientId string) error
+	ReadAllowedOrigins(ctx context.Context) ([]string, error)
+	UseAssertion(ctx context.Context, clientId, jwtId string, expires time.Time) (bool, error)
+}
+
+// usedAssertion the jti of a client assertion that was accepted, kept until the assertion expires
+type usedAssertion struct {
+	ClientId string    `bson:"clientId"`
+	JwtId    string    `bson:"jti"`
+	Expires  time.Time `bson:"expires"`
+}
+
+type MongodbClientRepository struct {
+	db *mongo.Database
+}
+
+func NewMongodbClientRepository(db *mongo.Database) *MongodbClientRepository {
+	// CORS preflights look clients up by origin
+	_, err := db.Collection(clientCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "clientId", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{{Key: "allowedOrigins", Value: 1}}},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// an assertion can only be used once, mongodb removes them once they have expired
+	_, err = db.Collection(clientAssertionCollection).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "clientId", Value: 1}, {Key: "jti", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbClientRepository{db: db}
+}
+
+func (r *MongodbClientRepository) Create(ctx context.Context, client Client) error {
+	_, err := r.db.Collection(clientCollection).InsertOne(ctx, client)
+	if mongo.IsDuplicateKeyError(err) {
+		return ClientDuplicateError{Value: client.ClientId}
+	}
+	return err
+}
+
+func (r *MongodbClientRepository) Read(ctx context.Context, clientId string) (*Client, error) {
+	var client Client
+	err := r.db.Collection(clientCollection).FindOne(ctx, bson.D{{Key: "clientId", Value: clientId}}).Decode(&client)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, ClientNotFoundError{Value: clientId}
+		}
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *MongodbClientRepository) ReadAll(ctx context.Context) ([]Client, error) {
+	cursor, err := r.db.Collection(clientCollection).Find(ctx, bson.D{},
+		options.Find().SetSort(bson.D{{Key: "clientId", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	clients := []Client{}
+	if err = cursor.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+// Update replaces the client document, the secret hash is written by UpdateSecret only
+func (r *MongodbClientRepository) Update(ctx context.Context, client Client) error {
+	result, err := r.db.Collection(clientCollection).UpdateOne(ctx, bson.D{{Key: "clientId", Value: client.ClientId}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "name", Value: client.Name},
+			{Key: "redirectUrls", Value: client.RedirectUrls},
+			{Key: "verificationUrls", Value: client.VerificationUrls},
+			{Key: "allowedOrigins", Value: client.AllowedOrigins},
+			{Key: "grantTypes", Value: client.GrantTypes},
+			{Key: "tokenEndpointAuthMethod", Value: client.TokenEndpointAuthMethod},
+			{Key: "publicKeys", Value: client.PublicKeys},
+			{Key: "scopes", Value: client.Scopes},
+			{Key: "roles", Value: client.Roles},
+			{Key: "exchangeAudiences", Value: client.ExchangeAudiences},
+			{Key: "accessTokenExpireInSeconds", Value: client.AccessTokenExpireInSeconds},
+			{Key: "refreshTokenExpireInSeconds", Value: client.RefreshTokenExpireInSeconds},
+			{Key: "modified", Value: client.Modified},
+		}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ClientNotFoundError{Value: client.ClientId}
+	}
+	return nil
+}
+
+func (r *MongodbClientRepository) UpdateSecret(ctx context.Context, clientId, secretHash string) error {
+	result, err := r.db.Collection(clientCollection).UpdateOne(ctx, bson.D{{Key: "clientId", Value: clientId}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "secretHash", Value: secretHash},
+			{Key: "modified", Value: time.Now()},
+		}}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ClientNotFoundError{Value: clientId}
+	}
+	return nil
+}
+
+func (r *MongodbClientRepository) Delete(ctx context.Context, clientId string) error {
+	result, err := r.db.Collection(clientCollection).DeleteOne(ctx, bson.D{{Key: "clientId", Value: clientId}})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ClientNotFoundError{Value: clientId}
+	}
+	return nil
+}
+
+// ReadAllowedOrigins the allowed origins of every client
+func (r *MongodbClientRepository) ReadAllowedOrigins(ctx context.Context) ([]string, error) {
+	values, err := r.db.Collection(clientCollection).Distinct(ctx, "allowedOrigins", bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	origins := make([]string, 0, len(values))
+	for _, value := range values {
+		if origin, ok := value.(string); ok {
+			origins = append(origins, origin)
+		}
+	}
+	return origins, nil
+}
+
+// UseAssertion records the jti of a client assertion, false when the client already used it
+func (r *MongodbClientRepository) UseAssertion(ctx context.Context, clientId, jwtId string, expires time.Time) (bool, error) {
+	_, err := r.db.Collection(clientAssertionCollection).InsertOne(ctx, usedAssertion{
+		ClientId: clientId,
+		JwtId:    jwtId,
+		Expires:  expires,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,498 @@
+package clients
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// Grant types a client can be allowed to use, see RFC 6749, RFC 8628 for the device code and RFC 8693 for token
+// exchange
+const (
+	GrantTypePassword          = "password"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTypeTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// GrantTypes every grant type a client can be registered with
+var GrantTypes = []string{GrantTypePassword, GrantTypeRefreshToken, GrantTypeAuthorizationCode,
+	GrantTypeClientCredentials, GrantTypeDeviceCode, GrantTypeTokenExchange}
+
+// defaultGrantTypes grants of a client registered without any, the sign in and renew flows of the api
+var defaultGrantTypes = []string{GrantTypePassword, GrantTypeRefreshToken}
+
+// Token endpoint authentication methods, see RFC 7591 section 2. Confidential clients authenticate with a secret
+// unless they are registered for private_key_jwt, see RFC 7523
+const (
+	AuthMethodClientSecret  = "client_secret"
+	AuthMethodPrivateKeyJwt = "private_key_jwt"
+	AuthMethodNone          = "none"
+)
+
+// ClientAssertionType the client_assertion_type of a private_key_jwt client assertion
+const ClientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+const (
+	secretSize = 32
+	// maxAssertionLifetime assertions must expire soon, their jti is kept until then to stop them being replayed
+	maxAssertionLifetime = 5 * time.Minute
+	// originsCacheTtl how long the allowed origins are cached, origins changed on another replica apply after it
+	originsCacheTtl = 30 * time.Second
+)
+
+// ClientService contract for registering client applications and checking them on every flow that names a client
+type ClientService interface {
+	Create(ctx context.Context, client Client) (*Client, string, error)
+	Read(ctx context.Context, clientId string) (*Client, error)
+	List(ctx context.Context) ([]Client, error)
+	Update(ctx context.Context, client Client) (*Client, error)
+	Delete(ctx context.Context, clientId string) error
+	RotateSecret(ctx context.Context, clientId string) (string, error)
+	AuthenticateClient(ctx context.Context, clientId, clientSecret string) error
+	AuthenticateAssertion(ctx context.Context, assertion string, audiences []string) (*Client, error)
+	AllowedOrigin(ctx context.Context, origin string) (bool, error)
+}
+
+// Client a registered client application. Public clients, such as single page apps, have no secret. PublicKeys are
+// PEM encoded keys that verify the assertions of private_key_jwt clients. Scopes and Roles are what a client can be
+// issued with the client credentials grant. ExchangeAudiences are the audiences the client can exchange access tokens
+// for with token exchange. Token lifetimes of zero use the global lifetimes
+type Client struct {
+	ClientId                    string    `json:"clientId" bson:"clientId"`
+	Name                        string    `json:"name" bson:"name"`
+	SecretHash                  string    `json:"-" bson:"secretHash,omitempty"`
+	Public                      bool      `json:"public" bson:"public"`
+	TokenEndpointAuthMethod     string    `json:"tokenEndpointAuthMethod" bson:"tokenEndpointAuthMethod,omitempty"`
+	PublicKeys                  []string  `json:"publicKeys" bson:"publicKeys,omitempty"`
+	RedirectUrls                []string  `json:"redirectUrls" bson:"redirectUrls"`
+	VerificationUrls            []string  `json:"verificationUrls" bson:"verificationUrls"`
+	AllowedOrigins              []string  `json:"allowedOrigins" bson:"allowedOrigins"`
+	GrantTypes                  []string  `json:"grantTypes" bson:"grantTypes"`
+	Scopes                      []string  `json:"scopes" bson:"scopes,omitempty"`
+	Roles                       []string  `json:"roles" bson:"roles,omitempty"`
+	ExchangeAudiences           []string  `json:"exchangeAudiences" bson:"exchangeAudiences,omitempty"`
+	AccessTokenExpireInSeconds  int       `json:"accessTokenExpireInSeconds" bson:"accessTokenExpireInSeconds"`
+	RefreshTokenExpireInSeconds int       `json:"refreshTokenExpireInSeconds" bson:"refreshTokenExpireInSeconds"`
+	Created                     time.Time `json:"created" bson:"created"`
+	Modified                    time.Time `json:"modified" bson:"modified"`
+}
+
+// AllowsGrant reports whether the client is registered for the grant type
+func (c Client) AllowsGrant(grantType string) bool {
+	return slices.Contains(c.GrantTypes, grantType)
+}
+
+// AllowsRedirect redirect urls are compared exactly, see RFC 6749 section 3.1.2.3
+func (c Client) AllowsRedirect(redirectUrl string) bool {
+	return slices.Contains(c.RedirectUrls, redirectUrl)
+}
+
+// AllowsExchange reports whether the client can exchange tokens for every one of the audiences
+func (c Client) AllowsExchange(audience []string) bool {
+	if len(audience) == 0 {
+		return false
+	}
+	for _, exchangeAudience := range audience {
+		if !slices.Contains(c.ExchangeAudiences, exchangeAudience) {
+			return false
+		}
+	}
+	return true
+}
+
+// AuthMethod the token endpoint authentication method, clients registered before methods were introduced use a
+// secret unless they are public
+func (c Client) AuthMethod() string {
+	switch {
+	case c.Public:
+		return AuthMethodNone
+	case c.TokenEndpointAuthMethod == "":
+		return AuthMethodClientSecret
+	default:
+		return c.TokenEndpointAuthMethod
+	}
+}
+
+// GrantScope the scope granted for the requested scopes, every requested scope must be registered for the client.
+// Without requested scopes every registered scope is granted
+func (c Client) GrantScope(requested []string) (string, error) {
+	if len(requested) == 0 {
+		return strings.Join(c.Scopes, " "), nil
+	}
+	for _, scope := range requested {
+		if !slices.Contains(c.Scopes, scope) {
+			return "", ScopeError{Value: scope}
+		}
+	}
+	return strings.Join(requested, " "), nil
+}
+
+// TokenOptions issues tokens to the audience with the lifetimes of the client
+func (c Client) TokenOptions(audience []string) tokens.TokenOptions {
+	return tokens.TokenOptions{
+		Audience:             audience,
+		AccessTokenExpInSec:  c.AccessTokenExpireInSeconds,
+		RefreshTokenExpInSec: c.RefreshTokenExpireInSeconds,
+		ClientId:             c.ClientId,
+	}
+}
+
+type DefaultClientService struct {
+	repository                  ClientRepository
+	maxAccessTokenExpInSeconds  int
+	maxRefreshTokenExpInSeconds int
+
+	mu            sync.RWMutex
+	origins       map[string]bool
+	originsCached time.Time
+}
+
+// NewDefaultClientService the global token lifetimes are the longest a client can be configured with, signing keys
+// and revocations are only kept for that long
+func NewDefaultClientService(repository ClientRepository, maxAccessTokenExpInSeconds,
+	maxRefreshTokenExpInSeconds int) *DefaultClientService {
+	return &DefaultClientService{
+		repository:                  repository,
+		maxAccessTokenExpInSeconds:  maxAccessTokenExpInSeconds,
+		maxRefreshTokenExpInSeconds: maxRefreshTokenExpInSeconds,
+	}
+}
+
+// Create registers the client and returns the generated secret, it is only ever returned here and by RotateSecret.
+// A client id is generated when none is given
+func (s *DefaultClientService) Create(ctx context.Context, client Client) (*Client, string, error) {
+	if client.ClientId == "" {
+		client.ClientId = uuid.New().String()
+	}
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = defaultGrantTypes
+	}
+	if client.TokenEndpointAuthMethod == "" {
+		client.TokenEndpointAuthMethod = client.AuthMethod()
+	}
+	if err := s.validate(client); err != nil {
+		return nil, "", err
+	}
+
+	secret := ""
+	if client.AuthMethod() == AuthMethodClientSecret {
+		var err error
+		secret, client.SecretHash, err = newSecret()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	client.Created = time.Now()
+	client.Modified = client.Created
+	if err := s.repository.Create(ctx, client); err != nil {
+		return nil, "", err
+	}
+	s.clearOrigins()
+	return &client, secret, nil
+}
+
+// Seed registers every client id that is not registered yet as a public client with the default grant types, so
+// applications that sent a client id before clients had to be registered keep working. It returns how many clients
+// were registered
+func (s *DefaultClientService) Seed(ctx context.Context, clientIds []string) (int, error) {
+	seeded := 0
+	for _, clientId := range clientIds {
+		_, _, err := s.Create(ctx, Client{ClientId: clientId, Name: clientId, Public: true})
+		var duplicate ClientDuplicateError
+		if errors.As(err, &duplicate) {
+			continue
+		}
+		if err != nil {
+			return seeded, err
+		}
+		seeded++
+	}
+	return seeded, nil
+}
+
+func (s *DefaultClientService) Read(ctx context.Context, clientId string) (*Client, error) {
+	return s.repository.Read(ctx, clientId)
+}
+
+func (s *DefaultClientService) List(ctx context.Context) ([]Client, error) {
+	return s.repository.ReadAll(ctx)
+}
+
+// Update replaces the settings of the client, the secret is left as it is. A client that stops authenticating with
+// its secret has it removed, switching back to a secret requires RotateSecret
+func (s *DefaultClientService) Update(ctx context.Context, client Client) (*Client, error) {
+	existing, err := s.repository.Read(ctx, client.ClientId)
+	if err != nil {
+		return nil, err
+	}
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = existing.GrantTypes
+	}
+	if client.TokenEndpointAuthMethod == "" {
+		client.TokenEndpointAuthMethod = existing.AuthMethod()
+	}
+	if err = s.validate(client); err != nil {
+		return nil, err
+	}
+	if client.Public != existing.Public {
+		return nil, ClientValidationError{Value: "a client can not change between public and confidential"}
+	}
+
+	client.SecretHash = existing.SecretHash
+	client.Created = existing.Created
+	client.Modified = time.Now()
+	if err = s.repository.Update(ctx, client); err != nil {
+		return nil, err
+	}
+	s.clearOrigins()
+	if client.AuthMethod() != AuthMethodClientSecret && client.SecretHash != "" {
+		client.SecretHash = ""
+		if err = s.repository.UpdateSecret(ctx, client.ClientId, ""); err != nil {
+			return nil, err
+		}
+	}
+	return &client, nil
+}
+
+func (s *DefaultClientService) Delete(ctx context.Context, clientId string) error {
+	if err := s.repository.Delete(ctx, clientId); err != nil {
+		return err
+	}
+	s.clearOrigins()
+	return nil
+}
+
+// RotateSecret replaces the secret of a confidential client, the old secret stops working immediately
+func (s *DefaultClientService) RotateSecret(ctx context.Context, clientId string) (string, error) {
+	client, err := s.repository.Read(ctx, clientId)
+	if err != nil {
+		return "", err
+	}
+	if client.AuthMethod() != AuthMethodClientSecret {
+		return "", ClientValidationError{Value: "only clients that authenticate with a secret have one"}
+	}
+
+	secret, hash, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	if err = s.repository.UpdateSecret(ctx, clientId, hash); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// AuthenticateClient checks the secret of a confidential client, unknown and public clients never authenticate. The
+// hashes are compared in constant time
+func (s *DefaultClientService) AuthenticateClient(ctx context.Context, clientId, clientSecret string) error {
+	client, err := s.repository.Read(ctx, clientId)
+	var notFound ClientNotFoundError
+	if errors.As(err, &notFound) {
+		return ClientAuthenticationError{Value: clientId}
+	}
+	if err != nil {
+		return err
+	}
+	if client.AuthMethod() != AuthMethodClientSecret || client.SecretHash == "" || clientSecret == "" {
+		return ClientAuthenticationError{Value: clientId}
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashSecret(clientSecret)), []byte(client.SecretHash)) != 1 {
+		return ClientAuthenticationError{Value: clientId}
+	}
+	return nil
+}
+
+// AuthenticateAssertion verifies a private_key_jwt client assertion, see RFC 7523 section 3. The assertion is
+// issued by and about the client, addressed to one of the audiences, signed by one of the client's keys and can only
+// be used once
+func (s *DefaultClientService) AuthenticateAssertion(ctx context.Context, assertion string, audiences []string) (*Client, error) {
+	var client *Client
+	var readErr error
+	claims := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(assertion, &claims, func(token *jwt.Token) (interface{}, error) {
+		issuer, err := token.Claims.GetIssuer()
+		if err != nil {
+			return nil, err
+		}
+		client, err = s.repository.Read(ctx, issuer)
+		var notFound ClientNotFoundError
+		if err != nil && !errors.As(err, &notFound) {
+			readErr = err
+		}
+		if err != nil {
+			return nil, err
+		}
+		if client.AuthMethod() != AuthMethodPrivateKeyJwt {
+			return nil, ClientAuthenticationError{Value: client.ClientId}
+		}
+		keys := jwt.VerificationKeySet{}
+		for _, publicKey := range client.PublicKeys {
+			key, err := tokens.ParsePublicKey(publicKey)
+			if err != nil {
+				return nil, err
+			}
+			keys.Keys = append(keys.Keys, key)
+		}
+		return keys, nil
+	}, jwt.WithValidMethods(tokens.SigningAlgorithms), jwt.WithExpirationRequired())
+	if readErr != nil {
+		return nil, readErr
+	}
+	if err != nil {
+		return nil, ClientAuthenticationError{Value: claims.Issuer}
+	}
+
+	if claims.Subject != client.ClientId || claims.ID == "" ||
+		claims.ExpiresAt.After(time.Now().Add(maxAssertionLifetime)) {
+		return nil, ClientAuthenticationError{Value: client.ClientId}
+	}
+	addressed := false
+	for _, audience := range audiences {
+		addressed = addressed || slices.Contains(claims.Audience, audience)
+	}
+	if !addressed {
+		return nil, ClientAuthenticationError{Value: client.ClientId}
+	}
+
+	unused, err := s.repository.UseAssertion(ctx, client.ClientId, claims.ID, claims.ExpiresAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if !unused {
+		return nil, ClientAuthenticationError{Value: client.ClientId}
+	}
+	return client, nil
+}
+
+// AllowedOrigin reports whether any client allows CORS requests from the origin. It is asked on every request so
+// the origins of all clients are cached, changes made on this replica apply immediately
+func (s *DefaultClientService) AllowedOrigin(ctx context.Context, origin string) (bool, error) {
+	s.mu.RLock()
+	origins, cached := s.origins, s.originsCached
+	s.mu.RUnlock()
+	if origins != nil && time.Since(cached) < originsCacheTtl {
+		return origins[origin], nil
+	}
+
+	allowedOrigins, err := s.repository.ReadAllowedOrigins(ctx)
+	if err != nil {
+		return false, err
+	}
+	origins = make(map[string]bool, len(allowedOrigins))
+	for _, allowedOrigin := range allowedOrigins {
+		origins[allowedOrigin] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.origins = origins
+	s.originsCached = time.Now()
+	return origins[origin], nil
+}
+
+// clearOrigins the allowed origins are read again on the next request
+func (s *DefaultClientService) clearOrigins() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.origins = nil
+}
+
+func (s *DefaultClientService) validate(client Client) error {
+	for _, grantType := range client.GrantTypes {
+		if !slices.Contains(GrantTypes, grantType) {
+			return ClientValidationError{Value: fmt.Sprintf("unknown grant type %s", grantType)}
+		}
+	}
+	if client.Public && client.AllowsGrant(GrantTypeClientCredentials) {
+		return ClientValidationError{Value: "public clients can not use client credentials"}
+	}
+	if client.Public && client.AllowsGrant(GrantTypeTokenExchange) {
+		return ClientValidationError{Value: "public clients can not exchange tokens"}
+	}
+
+	switch client.TokenEndpointAuthMethod {
+	case AuthMethodClientSecret, AuthMethodPrivateKeyJwt, AuthMethodNone:
+	default:
+		return ClientValidationError{Value: fmt.Sprintf("unknown token endpoint auth method %s", client.TokenEndpointAuthMethod)}
+	}
+	if client.Public != (client.TokenEndpointAuthMethod == AuthMethodNone) {
+		return ClientValidationError{Value: "only public clients use the token endpoint auth method none"}
+	}
+	if client.TokenEndpointAuthMethod == AuthMethodPrivateKeyJwt && len(client.PublicKeys) == 0 {
+		return ClientValidationError{Value: "private_key_jwt clients need at least one public key"}
+	}
+	for _, publicKey := range client.PublicKeys {
+		if _, err := tokens.ParsePublicKey(publicKey); err != nil {
+			return ClientValidationError{Value: fmt.Sprintf("public key is not a PEM encoded public key: %s", err)}
+		}
+	}
+	for _, scope := range client.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \"") {
+			return ClientValidationError{Value: fmt.Sprintf("invalid scope %q", scope)}
+		}
+	}
+	for _, audience := range client.ExchangeAudiences {
+		if audience == "" || strings.Contains(audience, " ") {
+			return ClientValidationError{Value: fmt.Sprintf("invalid exchange audience %q", audience)}
+		}
+	}
+
+	for _, redirectUrl := range slices.Concat(client.RedirectUrls, client.VerificationUrls) {
+		parsed, err := url.Parse(redirectUrl)
+		if err != nil || !parsed.IsAbs() || parsed.Fragment != "" {
+			return ClientValidationError{Value: fmt.Sprintf("%s must be an absolute url without a fragment", redirectUrl)}
+		}
+	}
+	for _, origin := range client.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Path != "" {
+			return ClientValidationError{Value: fmt.Sprintf("%s must be an origin such as https://app.example.com", origin)}
+		}
+	}
+
+	if client.AccessTokenExpireInSeconds < 0 || client.AccessTokenExpireInSeconds > s.maxAccessTokenExpInSeconds {
+		return ClientValidationError{
+			Value: fmt.Sprintf("access token lifetime must be between 0 and %d seconds", s.maxAccessTokenExpInSeconds)}
+	}
+	if client.RefreshTokenExpireInSeconds < 0 || client.RefreshTokenExpireInSeconds > s.maxRefreshTokenExpInSeconds {
+		return ClientValidationError{
+			Value: fmt.Sprintf("refresh token lifetime must be between 0 and %d seconds", s.maxRefreshTokenExpInSeconds)}
+	}
+	return nil
+}
+
+// newSecret generates a random secret and the hash kept in the database
+func newSecret() (string, string, error) {
+	secretBytes := make([]byte, secretSize)
+	if _, err := rand.Read(secretBytes); err != nil {
+		return "", "", err
+	}
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+	return secret, hashSecret(secret), nil
+}
+
+// hashSecret a SHA-256 of the secret. Secrets are random and as long as the hash, so unlike passwords they need no
+// slow hashing that would be paid on every token and introspection request
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,360 @@
+package clients
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryClientRepository keeps clients in memory so the service can be tested without mongodb
+type memoryClientRepository struct {
+	clients    map[string]Client
+	assertions map[string]bool
+}
+
+func newMemoryClientRepository() *memoryClientRepository {
+	return &memoryClientRepository{clients: map[string]Client{}, assertions: map[string]bool{}}
+}
+
+func (m *memoryClientRepository) Create(ctx context.Context, client Client) error {
+	if _, ok := m.clients[client.ClientId]; ok {
+		return ClientDuplicateError{Value: client.ClientId}
+	}
+	m.clients[client.ClientId] = client
+	return nil
+}
+
+func (m *memoryClientRepository) Read(ctx context.Context, clientId string) (*Client, error) {
+	client, ok := m.clients[clientId]
+	if !ok {
+		return nil, ClientNotFoundError{Value: clientId}
+	}
+	return &client, nil
+}
+
+func (m *memoryClientRepository) ReadAll(ctx context.Context) ([]Client, error) {
+	clients := []Client{}
+	for _, client := range m.clients {
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+func (m *memoryClientRepository) Update(ctx context.Context, client Client) error {
+	existing, ok := m.clients[client.ClientId]
+	if !ok {
+		return ClientNotFoundError{Value: client.ClientId}
+	}
+	client.SecretHash = existing.SecretHash
+	m.clients[client.ClientId] = client
+	return nil
+}
+
+func (m *memoryClientRepository) UpdateSecret(ctx context.Context, clientId, secretHash string) error {
+	client, ok := m.clients[clientId]
+	if !ok {
+		return ClientNotFoundError{Value: clientId}
+	}
+	client.SecretHash = secretHash
+	m.clients[clientId] = client
+	return nil
+}
+
+func (m *memoryClientRepository) Delete(ctx context.Context, clientId string) error {
+	if _, ok := m.clients[clientId]; !ok {
+		return ClientNotFoundError{Value: clientId}
+	}
+	delete(m.clients, clientId)
+	return nil
+}
+
+func (m *memoryClientRepository) ReadAllowedOrigins(ctx context.Context) ([]string, error) {
+	origins := []string{}
+	for _, client := range m.clients {
+		origins = append(origins, client.AllowedOrigins...)
+	}
+	return origins, nil
+}
+
+func (m *memoryClientRepository) UseAssertion(ctx context.Context, clientId, jwtId string, expires time.Time) (bool, error) {
+	key := clientId + "/" + jwtId
+	if m.assertions[key] {
+		return false, nil
+	}
+	m.assertions[key] = true
+	return true, nil
+}
+
+func TestDefaultClientService_Create(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+
+	client, secret, err := service.Create(context.TODO(), Client{
+		ClientId:       "web",
+		RedirectUrls:   []string{"https://app.latebit.io/callback"},
+		AllowedOrigins: []string{"https://app.latebit.io"},
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, secret)
+	assert.NotEqual(t, secret, client.SecretHash)
+	assert.Equal(t, defaultGrantTypes, client.GrantTypes)
+	assert.True(t, client.AllowsRedirect("https://app.latebit.io/callback"))
+	assert.False(t, client.AllowsRedirect("https://app.latebit.io/other"))
+
+	_, _, err = service.Create(context.TODO(), Client{ClientId: "web"})
+	var duplicate ClientDuplicateError
+	assert.ErrorAs(t, err, &duplicate)
+
+	public, secret, err := service.Create(context.TODO(), Client{Public: true})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, public.ClientId)
+	assert.Empty(t, secret)
+
+	allowed, err := service.AllowedOrigin(context.TODO(), "https://app.latebit.io")
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+
+	// the cached origins are dropped when a client changes
+	err = service.Delete(context.TODO(), "web")
+	assert.Nil(t, err)
+	allowed, err = service.AllowedOrigin(context.TODO(), "https://app.latebit.io")
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+}
+
+func TestDefaultClientService_Seed(t *testing.T) {
+	repository := newMemoryClientRepository()
+	service := NewDefaultClientService(repository, 3600, 86400)
+	_, _, err := service.Create(context.TODO(), Client{ClientId: "web", Scopes: []string{"read"}})
+	assert.Nil(t, err)
+
+	seeded, err := service.Seed(context.TODO(), []string{"web", "mobile"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, seeded)
+	assert.Equal(t, []string{"read"}, repository.clients["web"].Scopes)
+	mobile := repository.clients["mobile"]
+	assert.True(t, mobile.Public)
+	assert.Equal(t, defaultGrantTypes, mobile.GrantTypes)
+}
+
+func TestDefaultClientService_Validation(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+
+	invalid := []Client{
+		{GrantTypes: []string{"implicit"}},
+		{Public: true, GrantTypes: []string{GrantTypeClientCredentials}},
+		{RedirectUrls: []string{"/callback"}},
+		{VerificationUrls: []string{"https://app.latebit.io/verify#token"}},
+		{AllowedOrigins: []string{"https://app.latebit.io/path"}},
+		{AccessTokenExpireInSeconds: 7200},
+		{RefreshTokenExpireInSeconds: -1},
+	}
+	for _, client := range invalid {
+		_, _, err := service.Create(context.TODO(), client)
+		var validation ClientValidationError
+		assert.ErrorAs(t, err, &validation)
+	}
+}
+
+func TestDefaultClientService_AuthenticateClient(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+	_, secret, err := service.Create(context.TODO(), Client{ClientId: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = service.Create(context.TODO(), Client{ClientId: "spa", Public: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Nil(t, service.AuthenticateClient(context.TODO(), "gateway", secret))
+
+	var failed ClientAuthenticationError
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "gateway", "wrong"), &failed)
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "spa", ""), &failed)
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "unknown", secret), &failed)
+
+	rotated, err := service.RotateSecret(context.TODO(), "gateway")
+	assert.Nil(t, err)
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "gateway", secret), &failed)
+	assert.Nil(t, service.AuthenticateClient(context.TODO(), "gateway", rotated))
+
+	_, err = service.RotateSecret(context.TODO(), "spa")
+	var validation ClientValidationError
+	assert.ErrorAs(t, err, &validation)
+}
+
+func TestDefaultClientService_Update(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+	created, secret, err := service.Create(context.TODO(), Client{ClientId: "web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := service.Update(context.TODO(), Client{ClientId: "web", Name: "Web", AccessTokenExpireInSeconds: 600})
+	assert.Nil(t, err)
+	assert.Equal(t, "Web", updated.Name)
+	assert.Equal(t, created.GrantTypes, updated.GrantTypes)
+	assert.Equal(t, created.Created, updated.Created)
+	assert.Equal(t, 600, updated.TokenOptions(nil).AccessTokenExpInSec)
+	assert.Nil(t, service.AuthenticateClient(context.TODO(), "web", secret))
+
+	_, err = service.Update(context.TODO(), Client{ClientId: "web", Public: true})
+	var validation ClientValidationError
+	assert.ErrorAs(t, err, &validation)
+
+	_, err = service.Update(context.TODO(), Client{ClientId: "unknown"})
+	var notFound ClientNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+}
+
+func testKeyPair(t *testing.T) (string, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), privateKey
+}
+
+func testAssertion(t *testing.T, privateKey ed25519.PrivateKey, claims jwt.RegisteredClaims) string {
+	assertion, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims).SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestDefaultClientService_AuthenticateAssertion(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+	publicKey, privateKey := testKeyPair(t)
+	client, secret, err := service.Create(context.TODO(), Client{
+		ClientId:                "reports-job",
+		TokenEndpointAuthMethod: AuthMethodPrivateKeyJwt,
+		PublicKeys:              []string{publicKey},
+		GrantTypes:              []string{GrantTypeClientCredentials},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, secret)
+	assert.Empty(t, client.SecretHash)
+
+	audiences := []string{"https://auth.latebit.io", "https://auth.latebit.io/oauth/token"}
+	claims := jwt.RegisteredClaims{
+		ID:        "1",
+		Issuer:    "reports-job",
+		Subject:   "reports-job",
+		Audience:  jwt.ClaimStrings{"https://auth.latebit.io/oauth/token"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+	authenticated, err := service.AuthenticateAssertion(context.TODO(), testAssertion(t, privateKey, claims), audiences)
+	assert.Nil(t, err)
+	assert.Equal(t, "reports-job", authenticated.ClientId)
+
+	var failed ClientAuthenticationError
+	// an assertion can only be used once
+	_, err = service.AuthenticateAssertion(context.TODO(), testAssertion(t, privateKey, claims), audiences)
+	assert.ErrorAs(t, err, &failed)
+
+	_, otherKey := testKeyPair(t)
+	claims.ID = "2"
+	_, err = service.AuthenticateAssertion(context.TODO(), testAssertion(t, otherKey, claims), audiences)
+	assert.ErrorAs(t, err, &failed)
+
+	invalid := []func(claims *jwt.RegisteredClaims){
+		func(claims *jwt.RegisteredClaims) { claims.Audience = jwt.ClaimStrings{"https://other.latebit.io"} },
+		func(claims *jwt.RegisteredClaims) { claims.Subject = "other" },
+		func(claims *jwt.RegisteredClaims) { claims.ExpiresAt = nil },
+		func(claims *jwt.RegisteredClaims) { claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour)) },
+		func(claims *jwt.RegisteredClaims) { claims.ID = "" },
+		func(claims *jwt.RegisteredClaims) { claims.Issuer, claims.Subject = "unknown", "unknown" },
+	}
+	for i, modify := range invalid {
+		modified := claims
+		modified.ID = fmt.Sprintf("invalid-%d", i)
+		modify(&modified)
+		_, err = service.AuthenticateAssertion(context.TODO(), testAssertion(t, privateKey, modified), audiences)
+		assert.ErrorAs(t, err, &failed)
+	}
+
+	// clients that authenticate with a secret can not use an assertion and the other way around
+	_, gatewaySecret, err := service.Create(context.TODO(), Client{ClientId: "gateway", PublicKeys: []string{publicKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.ID, claims.Issuer, claims.Subject = "3", "gateway", "gateway"
+	_, err = service.AuthenticateAssertion(context.TODO(), testAssertion(t, privateKey, claims), audiences)
+	assert.ErrorAs(t, err, &failed)
+	assert.Nil(t, service.AuthenticateClient(context.TODO(), "gateway", gatewaySecret))
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "reports-job", gatewaySecret), &failed)
+	_, err = service.RotateSecret(context.TODO(), "reports-job")
+	var validation ClientValidationError
+	assert.ErrorAs(t, err, &validation)
+
+	// switching to private_key_jwt removes the secret
+	_, err = service.Update(context.TODO(), Client{ClientId: "gateway", TokenEndpointAuthMethod: AuthMethodPrivateKeyJwt,
+		PublicKeys: []string{publicKey}})
+	assert.Nil(t, err)
+	assert.ErrorAs(t, service.AuthenticateClient(context.TODO(), "gateway", gatewaySecret), &failed)
+}
+
+func TestDefaultClientService_AuthMethodValidation(t *testing.T) {
+	service := NewDefaultClientService(newMemoryClientRepository(), 3600, 86400)
+	publicKey, _ := testKeyPair(t)
+
+	invalid := []Client{
+		{TokenEndpointAuthMethod: AuthMethodPrivateKeyJwt},
+		{TokenEndpointAuthMethod: AuthMethodPrivateKeyJwt, PublicKeys: []string{"not a key"}},
+		{TokenEndpointAuthMethod: AuthMethodNone},
+		{TokenEndpointAuthMethod: "tls_client_auth"},
+		{Public: true, TokenEndpointAuthMethod: AuthMethodPrivateKeyJwt, PublicKeys: []string{publicKey}},
+		{Scopes: []string{"reports read"}},
+		{ExchangeAudiences: []string{"billing api"}},
+		{Public: true, GrantTypes: []string{GrantTypeTokenExchange}},
+	}
+	for _, client := range invalid {
+		_, _, err := service.Create(context.TODO(), client)
+		var validation ClientValidationError
+		assert.ErrorAs(t, err, &validation)
+	}
+
+	public, _, err := service.Create(context.TODO(), Client{Public: true})
+	assert.Nil(t, err)
+	assert.Equal(t, AuthMethodNone, public.TokenEndpointAuthMethod)
+}
+
+func TestClient_GrantScope(t *testing.T) {
+	client := Client{Scopes: []string{"reports:read", "reports:write"}}
+
+	scope, err := client.GrantScope(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "reports:read reports:write", scope)
+
+	scope, err = client.GrantScope([]string{"reports:read"})
+	assert.Nil(t, err)
+	assert.Equal(t, "reports:read", scope)
+
+	_, err = client.GrantScope([]string{"accounts:read"})
+	var scopeErr ScopeError
+	assert.ErrorAs(t, err, &scopeErr)
+}
+
+func TestClient_AllowsExchange(t *testing.T) {
+	client := Client{ExchangeAudiences: []string{"billing", "ledger"}}
+
+	assert.True(t, client.AllowsExchange([]string{"billing"}))
+	assert.True(t, client.AllowsExchange([]string{"billing", "ledger"}))
+	assert.False(t, client.AllowsExchange([]string{"billing", "accounts"}))
+	assert.False(t, client.AllowsExchange(nil))
+}
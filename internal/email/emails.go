@@ -8,6 +8,7 @@ import (
 	"html/template"
 	"net/smtp"
 	"os"
+	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 )
@@ -16,6 +17,7 @@ const (
 	verificationTemplate = "verification.html"
 	forgotTemplate       = "forgot.html"
 	magicTemplate        = "magic.html"
+	lockoutTemplate      = "lockout.html"
 )
 
 // Verification data for verification emails
@@ -40,6 +42,13 @@ type Magic struct {
 	Domain string
 }
 
+// Lockout data for lockout emails, Until is when the account unlocks
+type Lockout struct {
+	Email  string
+	Until  string
+	Domain string
+}
+
 // EmailOptions for email server connections
 type EmailOptions struct {
 	VerificationUrl string
@@ -55,6 +64,7 @@ type EmailService interface {
 	SendVerificationEmail(ctx context.Context, email, verificationToken string) error
 	SendForgotPasswordEmail(ctx context.Context, email, forgotToken string) error
 	SendMagicLinkEmail(ctx context.Context, email, code string) error
+	SendLockoutEmail(ctx context.Context, email string, until time.Time) error
 }
 
 type EmailTemplateProvider interface {
@@ -102,6 +112,10 @@ func (s *DefaultEmailService) Initialize(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
+	err = s.lockout(ctx)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -175,6 +189,29 @@ func (s *DefaultEmailService) magic(ctx context.Context) error {
 	return nil
 }
 
+func (s *DefaultEmailService) lockout(ctx context.Context) error {
+	templateFile, err := os.ReadFile(fmt.Sprintf("%s%s", s.templatesDir, lockoutTemplate))
+	if err != nil {
+		return err
+	}
+
+	t, err := s.emailRepository.Read(ctx, "lockout")
+	if err != nil {
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+	}
+
+	if t == "" {
+		err := s.emailRepository.Create(ctx, "lockout", string(templateFile))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // SendVerificationEmail will send out the verification email when a user signs up to activate their account
 func (s *DefaultEmailService) SendVerificationEmail(ctx context.Context, email, verificationToken string) error {
 	subject := "Please verify account"
@@ -268,3 +305,32 @@ func (s *DefaultEmailService) SendMagicLinkEmail(ctx context.Context, email, cod
 
 	return nil
 }
+
+// SendLockoutEmail tells the account owner that signing in is locked after too many failed attempts
+func (s *DefaultEmailService) SendLockoutEmail(ctx context.Context, email string, until time.Time) error {
+	subject := "Account locked after failed sign in attempts"
+	t, err := s.emailRepository.Read(ctx, "lockout")
+
+	if err != nil {
+		return err
+	}
+
+	tmpl := template.Must(template.New("lockout").Parse(t))
+
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, Lockout{Email: email, Until: until.UTC().Format(time.RFC1123), Domain: s.baseUrl}); err != nil {
+		return err
+	}
+
+	msg := []byte("From: " + s.fromAddress + "\r\n" +
+		"To: " + email + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"MIME-version: 1.0;\nContent-Type: text/html; charset=\"UTF-8\";\r\n\r\n" +
+		buf.String())
+
+	if err = smtp.SendMail(s.serverAddress+":"+s.port, s.auth, s.fromAddress, []string{email}, msg); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -1,33 +1,204 @@
 package encryption
 
 import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	HashArgon2id = "argon2id"
+	HashBcrypt   = "bcrypt"
+	HashScrypt   = "scrypt"
+	// minPepperSize a pepper must be at least 16 bytes
+	minPepperSize = 16
+)
+
+// HashSchemes the schemes new passwords can be hashed with
+var HashSchemes = []string{HashArgon2id, HashBcrypt, HashScrypt}
+
 type Encryption interface {
 	Encrypt(password string) (string, error)
 	Verify(password, verifyPassword string) (bool, error)
+	NeedsRehash(password string) bool
 }
 
+// PasswordHasher one hashing scheme, hashes are PHC strings. The pepper is applied before the password reaches
+// the hasher, keyId identifies it and is empty when there is none
+type PasswordHasher interface {
+	Hash(password []byte, keyId string) (string, error)
+	Verify(hash string, password []byte) (bool, error)
+	// Outdated the hash was made with weaker parameters than the hasher uses now
+	Outdated(hash string) bool
+}
+
+// HashOptions zero values use the defaults of each scheme and parameter
+type HashOptions struct {
+	// Scheme new passwords are hashed with, argon2id when empty
+	Scheme     string
+	Argon2id   Argon2idParams
+	Scrypt     ScryptParams
+	BcryptCost int
+	// Pepper a server side secret mixed into argon2id and scrypt hashes, it is never stored with them
+	Pepper []byte
+	// PreviousPepper the pepper being replaced, its hashes are verified and rehashed with Pepper
+	PreviousPepper []byte
+}
+
+// DefaultEncryption a registry of password hashers, new passwords are hashed with one scheme while hashes of every
+// registered scheme can be verified
 type DefaultEncryption struct {
+	hashers map[string]PasswordHasher
+	scheme  string
+	// peppers by the keyid that names them in hashes
+	peppers map[string][]byte
+	keyId   string
 }
 
+// NewDefaultEncryption hashes with argon2id and verifies argon2id, bcrypt and scrypt hashes
 func NewDefaultEncryption() *DefaultEncryption {
-	return &DefaultEncryption{}
+	return &DefaultEncryption{
+		hashers: map[string]PasswordHasher{
+			HashArgon2id: NewArgon2idHasher(DefaultArgon2idParams),
+			HashBcrypt:   NewBcryptHasher(DefaultBcryptCost),
+			HashScrypt:   NewScryptHasher(DefaultScryptParams),
+		},
+		scheme:  HashArgon2id,
+		peppers: map[string][]byte{},
+	}
 }
 
-func (d DefaultEncryption) Encrypt(password string) (string, error) {
-	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
-	if err != nil {
-		return "", err
+// NewDefaultEncryptionWithOptions a pepper can not be used when new passwords are hashed with bcrypt, the bcrypt
+// format has no place to identify it. A previous pepper is only used to verify hashes made with it
+func NewDefaultEncryptionWithOptions(options HashOptions) (*DefaultEncryption, error) {
+	encryption := NewDefaultEncryption()
+	if options.Argon2id != (Argon2idParams{}) {
+		params := options.Argon2id
+		params.Memory = cmp.Or(params.Memory, DefaultArgon2idParams.Memory)
+		params.Iterations = cmp.Or(params.Iterations, DefaultArgon2idParams.Iterations)
+		params.Parallelism = cmp.Or(params.Parallelism, DefaultArgon2idParams.Parallelism)
+		encryption.AddHasher(HashArgon2id, NewArgon2idHasher(params))
+	}
+	if options.Scrypt != (ScryptParams{}) {
+		params := options.Scrypt
+		params.CostLog2 = cmp.Or(params.CostLog2, DefaultScryptParams.CostLog2)
+		params.BlockSize = cmp.Or(params.BlockSize, DefaultScryptParams.BlockSize)
+		params.Parallelism = cmp.Or(params.Parallelism, DefaultScryptParams.Parallelism)
+		encryption.AddHasher(HashScrypt, NewScryptHasher(params))
+	}
+	if options.BcryptCost != 0 {
+		if options.BcryptCost < bcrypt.MinCost || options.BcryptCost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		encryption.AddHasher(HashBcrypt, NewBcryptHasher(options.BcryptCost))
+	}
+	if options.Scheme != "" {
+		if _, ok := encryption.hashers[options.Scheme]; !ok {
+			return nil, fmt.Errorf("unknown password hash scheme %s", options.Scheme)
+		}
+		encryption.scheme = options.Scheme
+	}
+	if len(options.PreviousPepper) > 0 {
+		if _, err := encryption.addPepper(options.PreviousPepper); err != nil {
+			return nil, err
+		}
+	}
+	if len(options.Pepper) > 0 {
+		if encryption.scheme == HashBcrypt {
+			return nil, errors.New("a pepper can not be used with bcrypt")
+		}
+		keyId, err := encryption.addPepper(options.Pepper)
+		if err != nil {
+			return nil, err
+		}
+		encryption.keyId = keyId
+	}
+	return encryption, nil
+}
+
+// addPepper registers a pepper for verification and returns the keyid that names it
+func (d *DefaultEncryption) addPepper(pepper []byte) (string, error) {
+	if len(pepper) < minPepperSize {
+		return "", fmt.Errorf("pepper must be at least %d bytes", minPepperSize)
 	}
-	return string(hashed), nil
+	sum := sha256.Sum256(pepper)
+	keyId := base64.RawStdEncoding.EncodeToString(sum[:6])
+	d.peppers[keyId] = pepper
+	return keyId, nil
 }
 
-func (d DefaultEncryption) Verify(password, verifyPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(password), []byte(verifyPassword))
+// AddHasher registers a hasher for the PHC id of its hashes, replacing the hasher registered for it
+func (d *DefaultEncryption) AddHasher(id string, hasher PasswordHasher) {
+	d.hashers[id] = hasher
+}
+
+// Encrypt hashes the password with the configured scheme
+func (d *DefaultEncryption) Encrypt(password string) (string, error) {
+	return d.hashers[d.scheme].Hash(peppered([]byte(password), d.peppers[d.keyId]), d.keyId)
+}
+
+// Verify password is the stored hash, a mismatch is not an error. Hashes made with the current or the previous
+// pepper can be verified
+func (d *DefaultEncryption) Verify(password, verifyPassword string) (bool, error) {
+	hasher, ok := d.hashers[hashId(password)]
+	if !ok {
+		return false, errors.New("password hash scheme is not supported")
+	}
+	secret := []byte(verifyPassword)
+	if keyId := hashKeyId(password); keyId != "" {
+		pepper, ok := d.peppers[keyId]
+		if !ok {
+			return false, fmt.Errorf("password hash was made with pepper %s", keyId)
+		}
+		secret = peppered(secret, pepper)
+	}
+	return hasher.Verify(password, secret)
+}
+
+// NeedsRehash the hash was made with another scheme, weaker parameters or without the current pepper, hashes of the
+// previous pepper included. It should be replaced once the password has been verified
+func (d *DefaultEncryption) NeedsRehash(password string) bool {
+	id := hashId(password)
+	if id != d.scheme || hashKeyId(password) != d.keyId {
+		return true
+	}
+	return d.hashers[id].Outdated(password)
+}
+
+// peppered the password is replaced by its HMAC keyed with the pepper
+func peppered(password, pepper []byte) []byte {
+	if len(pepper) == 0 {
+		return password
+	}
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write(password)
+	return mac.Sum(nil)
+}
+
+// hashId the scheme of a hash, bcrypt hashes use their own $2a$, $2b$ and $2y$ identifiers
+func hashId(hash string) string {
+	id, _, _ := strings.Cut(strings.TrimPrefix(hash, "$"), "$")
+	switch id {
+	case "2a", "2b", "2y":
+		return HashBcrypt
+	}
+	return id
+}
+
+// hashKeyId the pepper a PHC hash was made with, bcrypt hashes never have one
+func hashKeyId(hash string) string {
+	if hashId(hash) == HashBcrypt {
+		return ""
+	}
+	parsed, err := parsePHC(hash)
 	if err != nil {
-		return false, err
+		return ""
 	}
-	return true, nil
+	return parsed.keyId
 }
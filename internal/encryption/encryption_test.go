@@ -0,0 +1,153 @@
+package encryption
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testHashOptions cheap parameters so the tests run quickly
+var testHashOptions = HashOptions{
+	Argon2id:   Argon2idParams{Memory: 1024, Iterations: 1, Parallelism: 1},
+	Scrypt:     ScryptParams{CostLog2: 10, BlockSize: 8, Parallelism: 1},
+	BcryptCost: bcrypt.MinCost,
+}
+
+func newTestEncryption(t *testing.T, scheme string, pepper []byte) *DefaultEncryption {
+	options := testHashOptions
+	options.Scheme = scheme
+	options.Pepper = pepper
+	encryption, err := NewDefaultEncryptionWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption
+}
+
+func TestDefaultEncryption_Schemes(t *testing.T) {
+	prefixes := map[string]string{
+		HashArgon2id: "$argon2id$v=19$m=1024,t=1,p=1$",
+		HashBcrypt:   "$2a$04$",
+		HashScrypt:   "$scrypt$ln=10,r=8,p=1$",
+	}
+	for _, scheme := range HashSchemes {
+		t.Run(scheme, func(t *testing.T) {
+			encryption := newTestEncryption(t, scheme, nil)
+			hash, err := encryption.Encrypt("password")
+			assert.Nil(t, err)
+			assert.True(t, strings.HasPrefix(hash, prefixes[scheme]), hash)
+			assert.False(t, encryption.NeedsRehash(hash))
+
+			matches, err := encryption.Verify(hash, "password")
+			assert.Nil(t, err)
+			assert.True(t, matches)
+			matches, err = encryption.Verify(hash, "wrong")
+			assert.Nil(t, err)
+			assert.False(t, matches)
+		})
+	}
+}
+
+func TestDefaultEncryption_NeedsRehash(t *testing.T) {
+	legacy, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption := newTestEncryption(t, HashArgon2id, nil)
+
+	// hashes of other schemes are verified and then replaced
+	matches, err := encryption.Verify(string(legacy), "password")
+	assert.Nil(t, err)
+	assert.True(t, matches)
+	assert.True(t, encryption.NeedsRehash(string(legacy)))
+
+	// and so are hashes made with weaker parameters
+	hash, err := encryption.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := testHashOptions
+	options.Argon2id.Memory = 2048
+	stronger, err := NewDefaultEncryptionWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, stronger.NeedsRehash(hash))
+	assert.False(t, encryption.NeedsRehash(hash))
+
+	_, err = encryption.Verify("plain text", "password")
+	assert.Error(t, err)
+}
+
+func TestDefaultEncryption_Pepper(t *testing.T) {
+	pepper := []byte("0123456789abcdef")
+	peppered := newTestEncryption(t, HashArgon2id, pepper)
+	plain := newTestEncryption(t, HashArgon2id, nil)
+
+	hash, err := peppered.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, hash, ",keyid="+peppered.keyId+"$")
+	matches, err := peppered.Verify(hash, "password")
+	assert.Nil(t, err)
+	assert.True(t, matches)
+	assert.False(t, peppered.NeedsRehash(hash))
+
+	// without the pepper the hash can not be checked
+	_, err = plain.Verify(hash, "password")
+	assert.Error(t, err)
+	_, err = newTestEncryption(t, HashArgon2id, []byte("fedcba9876543210")).Verify(hash, "password")
+	assert.Error(t, err)
+
+	// hashes made before the pepper was set still work until they are replaced
+	unpeppered, err := plain.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err = peppered.Verify(unpeppered, "password")
+	assert.Nil(t, err)
+	assert.True(t, matches)
+	assert.True(t, peppered.NeedsRehash(unpeppered))
+
+	_, err = NewDefaultEncryptionWithOptions(HashOptions{Scheme: HashBcrypt, Pepper: pepper})
+	assert.Error(t, err)
+	_, err = NewDefaultEncryptionWithOptions(HashOptions{Pepper: []byte("short")})
+	assert.Error(t, err)
+	_, err = NewDefaultEncryptionWithOptions(HashOptions{Pepper: pepper, PreviousPepper: []byte("short")})
+	assert.Error(t, err)
+}
+
+func TestDefaultEncryption_PreviousPepper(t *testing.T) {
+	previous := newTestEncryption(t, HashArgon2id, []byte("0123456789abcdef"))
+	hash, err := previous.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// hashes of the previous pepper are verified and moved to the new one
+	options := testHashOptions
+	options.Pepper = []byte("fedcba9876543210")
+	options.PreviousPepper = []byte("0123456789abcdef")
+	rotated, err := NewDefaultEncryptionWithOptions(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, err := rotated.Verify(hash, "password")
+	assert.Nil(t, err)
+	assert.True(t, matches)
+	matches, err = rotated.Verify(hash, "wrong")
+	assert.Nil(t, err)
+	assert.False(t, matches)
+	assert.True(t, rotated.NeedsRehash(hash))
+
+	rehashed, err := rotated.Encrypt("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, rehashed, ",keyid="+rotated.keyId+"$")
+	assert.NotEqual(t, previous.keyId, rotated.keyId)
+	assert.False(t, rotated.NeedsRehash(rehashed))
+}
@@ -0,0 +1,167 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Envelope data encrypted with its own data key, the data key is stored wrapped by the key-encryption key
+type Envelope struct {
+	Ciphertext string
+	WrappedKey string
+	KekId      string
+}
+
+// KeyEncryption envelope encryption using AES-256-GCM, each value is sealed with a fresh data key which is
+// then wrapped with the key-encryption key (KEK). Rotating the KEK only needs the data keys to be re-wrapped
+type KeyEncryption struct {
+	kek   []byte
+	kekId string
+}
+
+// NewKeyEncryption kek must be 32 bytes
+func NewKeyEncryption(kek []byte) (*KeyEncryption, error) {
+	if len(kek) != 32 {
+		return nil, errors.New("key-encryption key must be 32 bytes")
+	}
+	sum := sha256.Sum256(kek)
+	return &KeyEncryption{
+		kek:   kek,
+		kekId: hex.EncodeToString(sum[:8]),
+	}, nil
+}
+
+// NewKeyEncryptionFromBase64 decodes a base64 encoded 32 byte key-encryption key
+func NewKeyEncryptionFromBase64(encoded string) (*KeyEncryption, error) {
+	kek, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key-encryption key is not valid base64: %w", err)
+	}
+	return NewKeyEncryption(kek)
+}
+
+// NewKeyEncryptionFromFile reads a base64 encoded key-encryption key from a file, such as a mounted secret
+func NewKeyEncryptionFromFile(path string) (*KeyEncryption, error) {
+	encoded, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeyEncryptionFromBase64(string(encoded))
+}
+
+// KekId identifies the key-encryption key without revealing it
+func (k *KeyEncryption) KekId() string {
+	return k.kekId
+}
+
+// Seal encrypts plaintext with a new data key and wraps the data key
+func (k *KeyEncryption) Seal(plaintext []byte) (*Envelope, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := seal(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := seal(k.kek, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Ciphertext: ciphertext,
+		WrappedKey: wrappedKey,
+		KekId:      k.kekId,
+	}, nil
+}
+
+// Open unwraps the data key and decrypts the envelope
+func (k *KeyEncryption) Open(envelope Envelope) ([]byte, error) {
+	if envelope.KekId != k.kekId {
+		return nil, fmt.Errorf("envelope was sealed with key-encryption key %s", envelope.KekId)
+	}
+
+	dataKey, err := open(k.kek, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(dataKey, envelope.Ciphertext)
+}
+
+// Rewrap re-wraps the data key of an envelope sealed by previous with this key-encryption key,
+// the ciphertext itself is left untouched
+func (k *KeyEncryption) Rewrap(envelope Envelope, previous *KeyEncryption) (*Envelope, error) {
+	if envelope.KekId != previous.kekId {
+		return nil, fmt.Errorf("envelope was sealed with key-encryption key %s", envelope.KekId)
+	}
+
+	dataKey, err := open(previous.kek, envelope.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := seal(k.kek, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		Ciphertext: envelope.Ciphertext,
+		WrappedKey: wrappedKey,
+		KekId:      k.kekId,
+	}, nil
+}
+
+// seal AES-GCM encrypts plaintext, the nonce is prepended to the ciphertext
+func seal(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func open(key []byte, encoded string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
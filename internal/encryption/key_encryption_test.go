@@ -0,0 +1,60 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestKeyEncryption(t *testing.T) *KeyEncryption {
+	kek := make([]byte, 32)
+	if _, err := rand.Read(kek); err != nil {
+		t.Fatal(err)
+	}
+	keyEncryption, err := NewKeyEncryption(kek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyEncryption
+}
+
+func TestKeyEncryption_SealOpen(t *testing.T) {
+	keyEncryption := newTestKeyEncryption(t)
+	envelope, err := keyEncryption.Seal([]byte("private key"))
+	assert.Nil(t, err)
+	assert.NotContains(t, envelope.Ciphertext, "private key")
+	assert.Equal(t, keyEncryption.KekId(), envelope.KekId)
+
+	plaintext, err := keyEncryption.Open(*envelope)
+	assert.Nil(t, err)
+	assert.Equal(t, "private key", string(plaintext))
+
+	_, err = newTestKeyEncryption(t).Open(*envelope)
+	assert.Error(t, err)
+}
+
+func TestKeyEncryption_Rewrap(t *testing.T) {
+	previous := newTestKeyEncryption(t)
+	current := newTestKeyEncryption(t)
+	envelope, err := previous.Seal([]byte("private key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rewrapped, err := current.Rewrap(*envelope, previous)
+	assert.Nil(t, err)
+	assert.Equal(t, envelope.Ciphertext, rewrapped.Ciphertext)
+	assert.Equal(t, current.KekId(), rewrapped.KekId)
+
+	plaintext, err := current.Open(*rewrapped)
+	assert.Nil(t, err)
+	assert.Equal(t, "private key", string(plaintext))
+}
+
+func TestNewKeyEncryption_InvalidKey(t *testing.T) {
+	_, err := NewKeyEncryption([]byte("too short"))
+	assert.Error(t, err)
+	_, err = NewKeyEncryptionFromBase64("not base64!")
+	assert.Error(t, err)
+}
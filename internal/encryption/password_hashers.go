@@ -0,0 +1,321 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltSize = 16
+	keySize  = 32
+	// DefaultBcryptCost new bcrypt hashes use 2^12 rounds
+	DefaultBcryptCost = 12
+)
+
+// Argon2idParams Memory is in KiB
+type Argon2idParams struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+// DefaultArgon2idParams the OWASP recommendation of 19 MiB and 2 iterations
+var DefaultArgon2idParams = Argon2idParams{Memory: 19456, Iterations: 2, Parallelism: 1}
+
+// ScryptParams CostLog2 is the log2 of the CPU/memory cost N
+type ScryptParams struct {
+	CostLog2    int
+	BlockSize   int
+	Parallelism int
+}
+
+// DefaultScryptParams the OWASP recommendation of N=2^17, r=8 and p=1
+var DefaultScryptParams = ScryptParams{CostLog2: 17, BlockSize: 8, Parallelism: 1}
+
+// Argon2idHasher hashes as $argon2id$v=19$m=19456,t=2,p=1$salt$hash
+type Argon2idHasher struct {
+	params Argon2idParams
+}
+
+func NewArgon2idHasher(params Argon2idParams) *Argon2idHasher {
+	return &Argon2idHasher{params: params}
+}
+
+func (h *Argon2idHasher) Hash(password []byte, keyId string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(password, salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, keySize)
+	return phc{
+		id:      HashArgon2id,
+		version: strconv.Itoa(argon2.Version),
+		params: [][2]string{
+			{"m", strconv.FormatUint(uint64(h.params.Memory), 10)},
+			{"t", strconv.FormatUint(uint64(h.params.Iterations), 10)},
+			{"p", strconv.FormatUint(uint64(h.params.Parallelism), 10)},
+		},
+		keyId: keyId,
+		salt:  salt,
+		hash:  key,
+	}.String(), nil
+}
+
+func (h *Argon2idHasher) Verify(hash string, password []byte) (bool, error) {
+	parsed, params, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	key := argon2.IDKey(password, parsed.salt, params.Iterations, params.Memory, params.Parallelism,
+		uint32(len(parsed.hash)))
+	return subtle.ConstantTimeCompare(key, parsed.hash) == 1, nil
+}
+
+func (h *Argon2idHasher) Outdated(hash string) bool {
+	_, params, err := h.parse(hash)
+	return err != nil || params.Memory < h.params.Memory || params.Iterations < h.params.Iterations ||
+		params.Parallelism < h.params.Parallelism
+}
+
+func (h *Argon2idHasher) parse(hash string) (*phc, Argon2idParams, error) {
+	parsed, err := parsePHC(hash)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	if parsed.id != HashArgon2id || parsed.version != strconv.Itoa(argon2.Version) {
+		return nil, Argon2idParams{}, errors.New("not an argon2id hash of a supported version")
+	}
+	memory, err := parsed.uint("m", 32)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	iterations, err := parsed.uint("t", 32)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	parallelism, err := parsed.uint("p", 8)
+	if err != nil {
+		return nil, Argon2idParams{}, err
+	}
+	if iterations == 0 || parallelism == 0 {
+		return nil, Argon2idParams{}, errors.New("argon2id iterations and parallelism must be at least 1")
+	}
+	return parsed, Argon2idParams{
+		Memory:      uint32(memory),
+		Iterations:  uint32(iterations),
+		Parallelism: uint8(parallelism),
+	}, nil
+}
+
+// ScryptHasher hashes as $scrypt$ln=17,r=8,p=1$salt$hash
+type ScryptHasher struct {
+	params ScryptParams
+}
+
+func NewScryptHasher(params ScryptParams) *ScryptHasher {
+	return &ScryptHasher{params: params}
+}
+
+func (h *ScryptHasher) Hash(password []byte, keyId string) (string, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key(password, salt, 1<<h.params.CostLog2, h.params.BlockSize, h.params.Parallelism, keySize)
+	if err != nil {
+		return "", err
+	}
+	return phc{
+		id: HashScrypt,
+		params: [][2]string{
+			{"ln", strconv.Itoa(h.params.CostLog2)},
+			{"r", strconv.Itoa(h.params.BlockSize)},
+			{"p", strconv.Itoa(h.params.Parallelism)},
+		},
+		keyId: keyId,
+		salt:  salt,
+		hash:  key,
+	}.String(), nil
+}
+
+func (h *ScryptHasher) Verify(hash string, password []byte) (bool, error) {
+	parsed, params, err := h.parse(hash)
+	if err != nil {
+		return false, err
+	}
+	key, err := scrypt.Key(password, parsed.salt, 1<<params.CostLog2, params.BlockSize, params.Parallelism,
+		len(parsed.hash))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(key, parsed.hash) == 1, nil
+}
+
+func (h *ScryptHasher) Outdated(hash string) bool {
+	_, params, err := h.parse(hash)
+	return err != nil || params.CostLog2 < h.params.CostLog2 || params.BlockSize < h.params.BlockSize ||
+		params.Parallelism < h.params.Parallelism
+}
+
+func (h *ScryptHasher) parse(hash string) (*phc, ScryptParams, error) {
+	parsed, err := parsePHC(hash)
+	if err != nil {
+		return nil, ScryptParams{}, err
+	}
+	if parsed.id != HashScrypt {
+		return nil, ScryptParams{}, errors.New("not a scrypt hash")
+	}
+	costLog2, err := parsed.uint("ln", 6)
+	if err != nil {
+		return nil, ScryptParams{}, err
+	}
+	blockSize, err := parsed.uint("r", 32)
+	if err != nil {
+		return nil, ScryptParams{}, err
+	}
+	parallelism, err := parsed.uint("p", 32)
+	if err != nil {
+		return nil, ScryptParams{}, err
+	}
+	return parsed, ScryptParams{
+		CostLog2:    int(costLog2),
+		BlockSize:   int(blockSize),
+		Parallelism: int(parallelism),
+	}, nil
+}
+
+// BcryptHasher hashes in the bcrypt format $2a$12$..., which has no place for a pepper. Only the first 72 bytes of
+// a password are used by bcrypt, longer passwords are rejected
+type BcryptHasher struct {
+	cost int
+}
+
+func NewBcryptHasher(cost int) *BcryptHasher {
+	return &BcryptHasher{cost: cost}
+}
+
+func (h *BcryptHasher) Hash(password []byte, keyId string) (string, error) {
+	if keyId != "" {
+		return "", errors.New("a pepper can not be used with bcrypt")
+	}
+	hashed, err := bcrypt.GenerateFromPassword(password, h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+func (h *BcryptHasher) Verify(hash string, password []byte) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (h *BcryptHasher) Outdated(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < h.cost
+}
+
+// phc a hash in the PHC string format $id[$v=version][$param=value(,param=value)*]$salt$hash, see
+// https://github.com/P-H-C/phc-string-format. The pepper is named by the keyid parameter
+type phc struct {
+	id      string
+	version string
+	params  [][2]string
+	keyId   string
+	salt    []byte
+	hash    []byte
+}
+
+func parsePHC(hash string) (*phc, error) {
+	fields := strings.Split(hash, "$")
+	if len(fields) < 2 || fields[0] != "" {
+		return nil, errors.New("not a PHC string")
+	}
+	parsed := &phc{id: fields[1]}
+	fields = fields[2:]
+	if len(fields) > 0 && strings.HasPrefix(fields[0], "v=") {
+		parsed.version = strings.TrimPrefix(fields[0], "v=")
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && strings.Contains(fields[0], "=") {
+		for _, param := range strings.Split(fields[0], ",") {
+			name, value, ok := strings.Cut(param, "=")
+			if !ok {
+				return nil, fmt.Errorf("invalid PHC parameter %s", param)
+			}
+			if name == "keyid" {
+				parsed.keyId = value
+				continue
+			}
+			parsed.params = append(parsed.params, [2]string{name, value})
+		}
+		fields = fields[1:]
+	}
+	if len(fields) != 2 {
+		return nil, errors.New("PHC string must have a salt and a hash")
+	}
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(fields[0]); err != nil {
+		return nil, err
+	}
+	if parsed.hash, err = base64.RawStdEncoding.DecodeString(fields[1]); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+func (p phc) String() string {
+	var builder strings.Builder
+	builder.WriteString("$" + p.id)
+	if p.version != "" {
+		builder.WriteString("$v=" + p.version)
+	}
+	params := p.params
+	if p.keyId != "" {
+		params = append(params[:len(params):len(params)], [2]string{"keyid", p.keyId})
+	}
+	for i, param := range params {
+		if i == 0 {
+			builder.WriteString("$")
+		} else {
+			builder.WriteString(",")
+		}
+		builder.WriteString(param[0] + "=" + param[1])
+	}
+	builder.WriteString("$" + base64.RawStdEncoding.EncodeToString(p.salt))
+	builder.WriteString("$" + base64.RawStdEncoding.EncodeToString(p.hash))
+	return builder.String()
+}
+
+// uint reads a numeric parameter that must fit in bitSize bits
+func (p phc) uint(name string, bitSize int) (uint64, error) {
+	for _, param := range p.params {
+		if param[0] == name {
+			return strconv.ParseUint(param[1], 10, bitSize)
+		}
+	}
+	return 0, fmt.Errorf("PHC string has no %s parameter", name)
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
@@ -0,0 +1,512 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+const (
+	ResponseTypeCode        = "code"
+	CodeChallengeMethodS256 = "S256"
+	TokenTypeBearer         = "Bearer"
+	ScopeOpenId             = "openid"
+	codeSize                = 32
+	codeChallengeLength     = 43
+	minCodeVerifierLength   = 43
+	maxCodeVerifierLength   = 128
+)
+
+// AuthorizationService the authorization code grant with PKCE, see RFC 6749 section 4.1 and RFC 7636, and the
+// client credentials grant for clients acting on their own behalf, see RFC 6749 section 4.4
+type AuthorizationService interface {
+	ValidateAuthorization(ctx context.Context, request AuthorizationRequest) (*clients.Client, error)
+	Authorize(ctx context.Context, request AuthorizationRequest, email, password, mfaCode string) (string, error)
+	Token(ctx context.Context, request TokenRequest) (*TokenResponse, error)
+}
+
+// ClientRegistry finds and authenticates the registered clients
+type ClientRegistry interface {
+	Read(ctx context.Context, clientId string) (*clients.Client, error)
+	AuthenticateClient(ctx context.Context, clientId, clientSecret string) error
+	AuthenticateAssertion(ctx context.Context, assertion string, audiences []string) (*clients.Client, error)
+}
+
+// Authenticator checks credentials and keeps the sessions of the tokens it issues
+type Authenticator interface {
+	CheckCredentials(ctx context.Context, email, password string) (*accounts.Account, error)
+	CheckSecondFactor(ctx context.Context, account *accounts.Account, code string) error
+	Acknowledge(ctx context.Context, authenticated authentication.Authenticated, email, clientId string) error
+	Renew(ctx context.Context, refreshToken, clientId string) (*authentication.Authenticated, error)
+	ValidateAccessToken(ctx context.Context, accessToken string) (*authentication.AccessTokenClaims, error)
+}
+
+type TokenIssuer interface {
+	CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options tokens.TokenOptions) (string, error)
+	CreateClientAccessToken(ctx context.Context, clientId string, rbac []string, scope string, options tokens.TokenOptions) (string, error)
+	CreateRefreshToken(ctx context.Context, subject string, options tokens.TokenOptions) (string, error)
+	CreateIdToken(ctx context.Context, subject string, options tokens.IdTokenOptions) (string, error)
+}
+
+// AuthorizationRequest the parameters of an authorization request, Audience is a space separated list of the
+// audiences the tokens are requested for. Nonce is returned in the ID token
+type AuthorizationRequest struct {
+	ResponseType        string
+	ClientId            string
+	RedirectUri         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	Audience            string
+	Nonce               string
+}
+
+// ClientCredentials how the client authenticates, taken from basic authentication or the form. A client assertion
+// must be addressed to one of AssertionAudiences, the identifiers of this server
+type ClientCredentials struct {
+	ClientId            string
+	ClientSecret        string
+	ClientAssertionType string
+	ClientAssertion     string
+	AssertionAudiences  []string
+}
+
+// TokenRequest the parameters of a token request, Scope and Audience are space separated lists
+type TokenRequest struct {
+	GrantType           string
+	ClientId            string
+	ClientSecret        string
+	ClientAssertionType string
+	ClientAssertion     string
+	AssertionAudiences  []string
+	Code                string
+	RedirectUri         string
+	CodeVerifier        string
+	RefreshToken        string
+	DeviceCode          string
+	SubjectToken        string
+	SubjectTokenType    string
+	RequestedTokenType  string
+	ActorToken          string
+	Scope               string
+	Audience            string
+}
+
+func (r TokenRequest) credentials() ClientCredentials {
+	return ClientCredentials{
+		ClientId:            r.ClientId,
+		ClientSecret:        r.ClientSecret,
+		ClientAssertionType: r.ClientAssertionType,
+		ClientAssertion:     r.ClientAssertion,
+		AssertionAudiences:  r.AssertionAudiences,
+	}
+}
+
+// TokenResponse RFC 6749 section 5.1, with the ID token of OpenID Connect Core section 3.1.3.3
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IdToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+	// IssuedTokenType is only set by token exchange, see RFC 8693 section 2.2.1
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+}
+
+// Grant issues tokens to a client that has authenticated and is allowed the grant type
+type Grant func(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error)
+
+// AuthorizationOptions CodeExpiresIn is how long an authorization code can be exchanged, keep it short.
+// DeviceCodeExpiresIn is how long the user has to approve a device and DevicePollInterval how long a device waits
+// between polls. The access token lifetime is reported for clients without one of their own
+type AuthorizationOptions struct {
+	CodeExpiresIn       time.Duration
+	DeviceCodeExpiresIn time.Duration
+	DevicePollInterval  time.Duration
+	AccessTokenExpInSec int
+}
+
+type DefaultAuthorizationService struct {
+	clients       ClientRegistry
+	authenticator Authenticator
+	tokens        TokenIssuer
+	codes         AuthorizationCodeRepository
+	devices       DeviceCodeRepository
+	options       AuthorizationOptions
+	grants        map[string]Grant
+}
+
+func NewDefaultAuthorizationService(registry ClientRegistry, authenticator Authenticator, tokens TokenIssuer,
+	codes AuthorizationCodeRepository, devices DeviceCodeRepository, options AuthorizationOptions) *DefaultAuthorizationService {
+	service := &DefaultAuthorizationService{
+		clients:       registry,
+		authenticator: authenticator,
+		tokens:        tokens,
+		codes:         codes,
+		devices:       devices,
+		options:       options,
+	}
+	service.grants = map[string]Grant{
+		clients.GrantTypeAuthorizationCode: service.authorizationCode,
+		clients.GrantTypeRefreshToken:      service.refreshToken,
+		clients.GrantTypeClientCredentials: service.clientCredentials,
+		clients.GrantTypeDeviceCode:        service.deviceCode,
+	}
+	return service
+}
+
+// AddGrant registers a grant the token endpoint accepts, such as token exchange, replacing a grant of the same type
+func (s *DefaultAuthorizationService) AddGrant(grantType string, grant Grant) {
+	s.grants[grantType] = grant
+}
+
+// ValidateAuthorization checks the request before credentials are asked for. An InvalidRedirectError means the
+// client or redirect uri is unknown and the user must not be redirected, any other error can be sent to the
+// redirect uri
+func (s *DefaultAuthorizationService) ValidateAuthorization(ctx context.Context, request AuthorizationRequest) (*clients.Client, error) {
+	client, err := s.clients.Read(ctx, request.ClientId)
+	var notFound clients.ClientNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, InvalidRedirectError{Value: request.ClientId}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if request.RedirectUri == "" || !client.AllowsRedirect(request.RedirectUri) {
+		return nil, InvalidRedirectError{Value: request.RedirectUri}
+	}
+
+	if request.ResponseType != ResponseTypeCode {
+		return client, UnsupportedResponseTypeError{Value: request.ResponseType}
+	}
+	if !client.AllowsGrant(clients.GrantTypeAuthorizationCode) {
+		return client, UnauthorizedClientError{Value: client.ClientId}
+	}
+	if request.CodeChallengeMethod != CodeChallengeMethodS256 {
+		return client, InvalidRequestError{Value: "code_challenge_method must be S256"}
+	}
+	if len(request.CodeChallenge) != codeChallengeLength {
+		return client, InvalidRequestError{Value: "code_challenge must be the S256 challenge of a code verifier"}
+	}
+	if _, err = accountScope(client, request.Scope); err != nil {
+		return client, err
+	}
+
+	return client, nil
+}
+
+// Authorize checks the credentials and issues a code the client exchanges at the token endpoint, accounts with a
+// second factor need its code as well
+func (s *DefaultAuthorizationService) Authorize(ctx context.Context, request AuthorizationRequest, email, password, mfaCode string) (string, error) {
+	client, err := s.ValidateAuthorization(ctx, request)
+	if err != nil {
+		return "", err
+	}
+
+	scope, err := accountScope(client, request.Scope)
+	if err != nil {
+		return "", err
+	}
+
+	account, err := s.signIn(ctx, email, password, mfaCode)
+	if err != nil {
+		return "", err
+	}
+
+	codeBytes := make([]byte, codeSize)
+	if _, err = rand.Read(codeBytes); err != nil {
+		return "", err
+	}
+	code := base64.RawURLEncoding.EncodeToString(codeBytes)
+
+	now := time.Now()
+	err = s.codes.Create(ctx, AuthorizationCode{
+		CodeHash:      hashCode(code),
+		ClientId:      client.ClientId,
+		RedirectUri:   request.RedirectUri,
+		Scope:         scope,
+		Audience:      strings.Fields(request.Audience),
+		CodeChallenge: request.CodeChallenge,
+		Nonce:         request.Nonce,
+		AccountId:     account.AccountId,
+		Email:         account.Email,
+		EmailVerified: account.IsVerified,
+		Roles:         account.Roles,
+		Methods:       signInMethods(account),
+		Created:       now,
+		Expires:       now.Add(s.options.CodeExpiresIn),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// Token authenticates the client and issues tokens for the grant, the tokens are acknowledged for the client
+func (s *DefaultAuthorizationService) Token(ctx context.Context, request TokenRequest) (*TokenResponse, error) {
+	grant, ok := s.grants[request.GrantType]
+	if !ok {
+		return nil, UnsupportedGrantTypeError{Value: request.GrantType}
+	}
+
+	client, err := s.authenticateClient(ctx, request.credentials())
+	if err != nil {
+		return nil, err
+	}
+	if !client.AllowsGrant(request.GrantType) {
+		return nil, UnauthorizedClientError{Value: client.ClientId}
+	}
+
+	return grant(ctx, client, request)
+}
+
+// authorizationCode the code is consumed before it is checked, so a code presented with the wrong verifier can not
+// be tried again
+func (s *DefaultAuthorizationService) authorizationCode(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error) {
+	code, err := s.codes.Consume(ctx, hashCode(request.Code))
+	if err != nil {
+		return nil, err
+	}
+	if code == nil || time.Now().After(code.Expires) {
+		return nil, InvalidGrantError{Value: "code is invalid, expired or has been used"}
+	}
+	if code.ClientId != client.ClientId || code.RedirectUri != request.RedirectUri {
+		return nil, InvalidGrantError{Value: "code was issued to another client or redirect uri"}
+	}
+	if !verifyCodeChallenge(request.CodeVerifier, code.CodeChallenge) {
+		return nil, InvalidGrantError{Value: "code_verifier does not match the code_challenge"}
+	}
+
+	// the code is created the moment the user signs in
+	account := &accounts.Account{AccountId: code.AccountId, Email: code.Email, IsVerified: code.EmailVerified,
+		Roles: code.Roles}
+	return s.issueTokens(ctx, client, account, code.Audience, code.Scope, code.Nonce, code.Created, code.Methods)
+}
+
+// issueTokens issues tokens for the account to the client and acknowledges them, there is only a refresh token when
+// the client is allowed to renew and only an ID token when the openid scope was requested
+func (s *DefaultAuthorizationService) issueTokens(ctx context.Context, client *clients.Client, account *accounts.Account,
+	audience []string, scope, nonce string, authTime time.Time, methods []string) (*TokenResponse, error) {
+	options := client.TokenOptions(audience)
+	options.Scope = scope
+	accessToken, err := s.tokens.CreateAccessToken(ctx, account.AccountId, account.Email, account.Roles, options)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken := ""
+	if client.AllowsGrant(clients.GrantTypeRefreshToken) {
+		refreshToken, err = s.tokens.CreateRefreshToken(ctx, account.AccountId, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	idToken := ""
+	if slices.Contains(strings.Fields(scope), ScopeOpenId) {
+		// codes issued before the methods were recorded were all password sign ins
+		if len(methods) == 0 {
+			methods = []string{tokens.AmrPassword}
+		}
+		idToken, err = s.tokens.CreateIdToken(ctx, account.AccountId, tokens.IdTokenOptions{
+			ClientId:      client.ClientId,
+			Nonce:         nonce,
+			AuthTime:      authTime,
+			Methods:       methods,
+			Email:         account.Email,
+			EmailVerified: account.IsVerified,
+			ExpInSec:      client.AccessTokenExpireInSeconds,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	authenticated := authentication.Authenticated{AccessToken: accessToken, RefreshToken: refreshToken, IdToken: idToken}
+	if err = s.authenticator.Acknowledge(ctx, authenticated, account.Email, client.ClientId); err != nil {
+		return nil, err
+	}
+
+	return s.tokenResponse(client, authenticated, scope), nil
+}
+
+// refreshToken renews through the authentication service so refresh token rotation and reuse detection apply
+func (s *DefaultAuthorizationService) refreshToken(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error) {
+	if request.RefreshToken == "" {
+		return nil, InvalidRequestError{Value: "refresh_token is required"}
+	}
+
+	authenticated, err := s.authenticator.Renew(ctx, request.RefreshToken, client.ClientId)
+	if err != nil {
+		return nil, InvalidGrantError{Value: err.Error()}
+	}
+
+	claims, err := s.authenticator.ValidateAccessToken(ctx, authenticated.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.authenticator.Acknowledge(ctx, *authenticated, claims.Email, client.ClientId); err != nil {
+		return nil, err
+	}
+
+	// the renewed tokens keep the scope granted with the refresh token
+	return s.tokenResponse(client, *authenticated, claims.Scope), nil
+}
+
+// clientCredentials issues an access token to the client itself, with the client's roles and the requested scopes.
+// There is no refresh token, the client authenticates again instead
+func (s *DefaultAuthorizationService) clientCredentials(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error) {
+	scope, err := client.GrantScope(strings.Fields(request.Scope))
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := s.tokens.CreateClientAccessToken(ctx, client.ClientId, client.Roles, scope,
+		client.TokenOptions(strings.Fields(request.Audience)))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.tokenResponse(client, authentication.Authenticated{AccessToken: accessToken}, scope), nil
+}
+
+// accountScope the scope a user grants the client, every requested scope must be registered for the client except
+// openid, which only asks for an ID token. Unlike client credentials nothing is granted that was not requested
+func accountScope(client *clients.Client, requested string) (string, error) {
+	scopes := strings.Fields(requested)
+	registered := slices.DeleteFunc(slices.Clone(scopes), func(scope string) bool { return scope == ScopeOpenId })
+	if len(registered) > 0 {
+		if _, err := client.GrantScope(registered); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+// authenticateClient confidential clients authenticate with their secret or a private_key_jwt assertion, public
+// clients only name themselves and rely on PKCE
+func (s *DefaultAuthorizationService) authenticateClient(ctx context.Context, request ClientCredentials) (*clients.Client, error) {
+	if request.ClientAssertionType != "" || request.ClientAssertion != "" {
+		return s.authenticateAssertion(ctx, request)
+	}
+
+	client, err := s.clients.Read(ctx, request.ClientId)
+	var notFound clients.ClientNotFoundError
+	if errors.As(err, &notFound) {
+		return nil, clients.ClientAuthenticationError{Value: request.ClientId}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if client.Public {
+		if request.ClientSecret != "" {
+			return nil, clients.ClientAuthenticationError{Value: request.ClientId}
+		}
+		return client, nil
+	}
+
+	if err = s.clients.AuthenticateClient(ctx, request.ClientId, request.ClientSecret); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// authenticateAssertion a client uses only one authentication method, the client_id is optional but must name the
+// client the assertion was issued by
+func (s *DefaultAuthorizationService) authenticateAssertion(ctx context.Context, request ClientCredentials) (*clients.Client, error) {
+	if request.ClientAssertionType != clients.ClientAssertionType {
+		return nil, InvalidRequestError{Value: "client_assertion_type must be " + clients.ClientAssertionType}
+	}
+	if request.ClientSecret != "" {
+		return nil, InvalidRequestError{Value: "only one client authentication method can be used"}
+	}
+
+	client, err := s.clients.AuthenticateAssertion(ctx, request.ClientAssertion, request.AssertionAudiences)
+	if err != nil {
+		return nil, err
+	}
+	if request.ClientId != "" && request.ClientId != client.ClientId {
+		return nil, clients.ClientAuthenticationError{Value: request.ClientId}
+	}
+	return client, nil
+}
+
+func (s *DefaultAuthorizationService) tokenResponse(client *clients.Client, authenticated authentication.Authenticated, scope string) *TokenResponse {
+	return &TokenResponse{
+		AccessToken:  authenticated.AccessToken,
+		TokenType:    TokenTypeBearer,
+		ExpiresIn:    expiresIn(client.AccessTokenExpireInSeconds, s.options.AccessTokenExpInSec),
+		RefreshToken: authenticated.RefreshToken,
+		IdToken:      authenticated.IdToken,
+		Scope:        scope,
+	}
+}
+
+// expiresIn a client without a lifetime of its own uses the default lifetime
+func expiresIn(seconds, defaultSeconds int) int {
+	if seconds <= 0 {
+		return defaultSeconds
+	}
+	return seconds
+}
+
+// signIn checks the password and, when the account has one, the code of the second factor
+func (s *DefaultAuthorizationService) signIn(ctx context.Context, email, password, mfaCode string) (*accounts.Account, error) {
+	account, err := s.authenticator.CheckCredentials(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if err = s.authenticator.CheckSecondFactor(ctx, account, mfaCode); err != nil {
+		return nil, err
+	}
+	return account, nil
+}
+
+// signInMethods the amr values of a sign in through signIn
+func signInMethods(account *accounts.Account) []string {
+	if account.MfaEnabled() {
+		return []string{tokens.AmrPassword, tokens.AmrOneTimePassword, tokens.AmrMultiFactor}
+	}
+	return []string{tokens.AmrPassword}
+}
+
+// EndpointUrl the url of an endpoint under the issuer. Only an https issuer locates the service, any other issuer is
+// an IssuerUrlError
+func EndpointUrl(issuer, path string) (string, error) {
+	parsed, err := url.Parse(issuer)
+	if err != nil || parsed.Scheme != "https" || parsed.Host == "" {
+		return "", IssuerUrlError{Value: issuer}
+	}
+	return issuer + path, nil
+}
+
+func hashCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// verifyCodeChallenge the challenge is the unpadded base64url SHA-256 of the verifier, see RFC 7636 section 4.2
+func verifyCodeChallenge(verifier, challenge string) bool {
+	if len(verifier) < minCodeVerifierLength || len(verifier) > maxCodeVerifierLength {
+		return false
+	}
+	hash := sha256.Sum256([]byte(verifier))
+	computed := base64.RawURLEncoding.EncodeToString(hash[:])
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(challenge)) == 1
+}
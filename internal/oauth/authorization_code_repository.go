@@ -0,0 +1,81 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionAuthorizationCodes = "authorizationCodes"
+)
+
+// AuthorizationCode an issued code, only the hash of the code is stored
+type AuthorizationCode struct {
+	CodeHash      string    `bson:"codeHash"`
+	ClientId      string    `bson:"clientId"`
+	RedirectUri   string    `bson:"redirectUri"`
+	Scope         string    `bson:"scope,omitempty"`
+	Audience      []string  `bson:"audience,omitempty"`
+	CodeChallenge string    `bson:"codeChallenge"`
+	Nonce         string    `bson:"nonce,omitempty"`
+	AccountId     string    `bson:"accountId"`
+	Email         string    `bson:"email"`
+	EmailVerified bool      `bson:"emailVerified"`
+	Roles         []string  `bson:"roles,omitempty"`
+	Methods       []string  `bson:"methods,omitempty"`
+	Created       time.Time `bson:"created"`
+	Expires       time.Time `bson:"expires"`
+}
+
+type AuthorizationCodeRepository interface {
+	Create(ctx context.Context, code AuthorizationCode) error
+	Consume(ctx context.Context, codeHash string) (*AuthorizationCode, error)
+}
+
+type MongodbAuthorizationCodeRepository struct {
+	db *mongo.Database
+}
+
+func NewMongodbAuthorizationCodeRepository(db *mongo.Database) *MongodbAuthorizationCodeRepository {
+	// mongodb removes expired codes that were never exchanged
+	_, err := db.Collection(collectionAuthorizationCodes).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "codeHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbAuthorizationCodeRepository{db: db}
+}
+
+func (r *MongodbAuthorizationCodeRepository) Create(ctx context.Context, code AuthorizationCode) error {
+	_, err := r.db.Collection(collectionAuthorizationCodes).InsertOne(ctx, code)
+	return err
+}
+
+// Consume removes the code as it is read so a code can only be exchanged once, even across replicas. Returns nil
+// when there is no such code
+func (r *MongodbAuthorizationCodeRepository) Consume(ctx context.Context, codeHash string) (*AuthorizationCode, error) {
+	var code AuthorizationCode
+	err := r.db.Collection(collectionAuthorizationCodes).
+		FindOneAndDelete(ctx, bson.D{{Key: "codeHash", Value: codeHash}}).Decode(&code)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &code, nil
+}
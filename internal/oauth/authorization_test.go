@@ -0,0 +1,543 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeClients map[string]clients.Client
+
+func (f fakeClients) Read(ctx context.Context, clientId string) (*clients.Client, error) {
+	client, ok := f[clientId]
+	if !ok {
+		return nil, clients.ClientNotFoundError{Value: clientId}
+	}
+	return &client, nil
+}
+
+func (f fakeClients) AuthenticateClient(ctx context.Context, clientId, clientSecret string) error {
+	if clientSecret != "secret" {
+		return clients.ClientAuthenticationError{Value: clientId}
+	}
+	return nil
+}
+
+// AuthenticateAssertion accepts assertions of the form assertion:<client id>
+func (f fakeClients) AuthenticateAssertion(ctx context.Context, assertion string, audiences []string) (*clients.Client, error) {
+	clientId, ok := strings.CutPrefix(assertion, "assertion:")
+	client, found := f[clientId]
+	if !ok || !found || client.AuthMethod() != clients.AuthMethodPrivateKeyJwt {
+		return nil, clients.ClientAuthenticationError{Value: clientId}
+	}
+	return &client, nil
+}
+
+type fakeAuthenticator struct {
+	account       accounts.Account
+	acknowledged  map[string]string
+	refreshScopes map[string]string
+	renewedScope  string
+}
+
+func (f *fakeAuthenticator) CheckCredentials(ctx context.Context, email, password string) (*accounts.Account, error) {
+	if email != f.account.Email || password != "password" {
+		return nil, authentication.AuthenticationError{Value: email}
+	}
+	return &f.account, nil
+}
+
+func (f *fakeAuthenticator) CheckSecondFactor(ctx context.Context, account *accounts.Account, code string) error {
+	if account.MfaEnabled() && code != "123456" {
+		return authentication.MfaCodeError{Value: account.Email}
+	}
+	return nil
+}
+
+func (f *fakeAuthenticator) Acknowledge(ctx context.Context, authenticated authentication.Authenticated, email, clientId string) error {
+	f.acknowledged[authenticated.AccessToken] = clientId
+	return nil
+}
+
+// Renew renews the refresh tokens issued by fakeIssuer with the scope they were issued with
+func (f *fakeAuthenticator) Renew(ctx context.Context, refreshToken, clientId string) (*authentication.Authenticated, error) {
+	scope, ok := f.refreshScopes[refreshToken]
+	if !ok {
+		return nil, authentication.AuthenticationError{Value: clientId}
+	}
+	f.renewedScope = scope
+	return &authentication.Authenticated{AccessToken: "renewed-access", RefreshToken: refreshToken}, nil
+}
+
+func (f *fakeAuthenticator) ValidateAccessToken(ctx context.Context, accessToken string) (*authentication.AccessTokenClaims, error) {
+	return &authentication.AccessTokenClaims{Email: f.account.Email, Scope: f.renewedScope}, nil
+}
+
+type fakeIssuer struct {
+	issued        int
+	scope         string
+	emailVerified bool
+	refreshScopes map[string]string
+}
+
+func (f *fakeIssuer) CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options tokens.TokenOptions) (string, error) {
+	f.issued++
+	f.scope = options.Scope
+	return fmt.Sprintf("access-%s-%d", subject, f.issued), nil
+}
+
+func (f *fakeIssuer) CreateClientAccessToken(ctx context.Context, clientId string, rbac []string, scope string, options tokens.TokenOptions) (string, error) {
+	return fmt.Sprintf("client-%s-%s", clientId, scope), nil
+}
+
+func (f *fakeIssuer) CreateIdToken(ctx context.Context, subject string, options tokens.IdTokenOptions) (string, error) {
+	f.emailVerified = options.EmailVerified
+	return fmt.Sprintf("id-%s-%s-%s", subject, options.ClientId, options.Nonce), nil
+}
+
+func (f *fakeIssuer) CreateRefreshToken(ctx context.Context, subject string, options tokens.TokenOptions) (string, error) {
+	f.refreshScopes["refresh-"+subject] = options.Scope
+	return "refresh-" + subject, nil
+}
+
+type memoryCodeRepository map[string]AuthorizationCode
+
+func (m memoryCodeRepository) Create(ctx context.Context, code AuthorizationCode) error {
+	m[code.CodeHash] = code
+	return nil
+}
+
+func (m memoryCodeRepository) Consume(ctx context.Context, codeHash string) (*AuthorizationCode, error) {
+	code, ok := m[codeHash]
+	if !ok {
+		return nil, nil
+	}
+	delete(m, codeHash)
+	return &code, nil
+}
+
+type memoryDeviceRepository map[string]*DeviceCode
+
+func (m memoryDeviceRepository) Create(ctx context.Context, code DeviceCode) error {
+	m[code.DeviceCodeHash] = &code
+	return nil
+}
+
+func (m memoryDeviceRepository) ReadByUserCode(ctx context.Context, userCode string) (*DeviceCode, error) {
+	for _, code := range m {
+		if code.UserCode == userCode {
+			found := *code
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m memoryDeviceRepository) Verify(ctx context.Context, userCode, status, accountId, email string, emailVerified bool, roles []string,
+	authTime time.Time, methods []string) (bool, error) {
+	for _, code := range m {
+		if code.UserCode == userCode && code.Status == DeviceCodePending {
+			code.Status, code.AccountId, code.Email, code.Roles, code.AuthTime = status, accountId, email, roles, authTime
+			code.EmailVerified, code.Methods = emailVerified, methods
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m memoryDeviceRepository) Poll(ctx context.Context, deviceCodeHash string, polled time.Time) (*DeviceCode, error) {
+	code, ok := m[deviceCodeHash]
+	if !ok {
+		return nil, nil
+	}
+	before := *code
+	code.LastPolled = polled
+	return &before, nil
+}
+
+func (m memoryDeviceRepository) SlowDown(ctx context.Context, deviceCodeHash string, seconds int) error {
+	m[deviceCodeHash].Interval += seconds
+	return nil
+}
+
+func (m memoryDeviceRepository) Consume(ctx context.Context, deviceCodeHash, status string) (bool, error) {
+	code, ok := m[deviceCodeHash]
+	if !ok || code.Status != status {
+		return false, nil
+	}
+	delete(m, deviceCodeHash)
+	return true, nil
+}
+
+const (
+	testRedirect = "https://app.latebit.io/callback"
+	testVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+func testChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+func newTestAuthorizationService() (*DefaultAuthorizationService, *fakeAuthenticator) {
+	registry := fakeClients{
+		"spa": {
+			ClientId:     "spa",
+			Public:       true,
+			RedirectUrls: []string{testRedirect},
+			GrantTypes:   []string{clients.GrantTypeAuthorizationCode, clients.GrantTypeRefreshToken},
+			Scopes:       []string{"email"},
+		},
+		"web": {
+			ClientId:     "web",
+			RedirectUrls: []string{testRedirect},
+			GrantTypes:   []string{clients.GrantTypeAuthorizationCode},
+		},
+		"gateway": {
+			ClientId:     "gateway",
+			RedirectUrls: []string{testRedirect},
+			GrantTypes:   []string{clients.GrantTypePassword},
+		},
+		"reports-job": {
+			ClientId:                "reports-job",
+			TokenEndpointAuthMethod: clients.AuthMethodPrivateKeyJwt,
+			GrantTypes:              []string{clients.GrantTypeClientCredentials},
+			Scopes:                  []string{"reports:read", "reports:write"},
+			Roles:                   []string{"reports"},
+		},
+		"tv": {
+			ClientId:   "tv",
+			Name:       "Living room TV",
+			Public:     true,
+			GrantTypes: []string{clients.GrantTypeDeviceCode, clients.GrantTypeRefreshToken},
+		},
+		"backup-job": {
+			ClientId:   "backup-job",
+			GrantTypes: []string{clients.GrantTypeClientCredentials},
+			Scopes:     []string{"backups"},
+		},
+	}
+	authenticator := &fakeAuthenticator{
+		account: accounts.Account{
+			AccountId: "3f1c9a52-6a43-4c1e-9d7e-2b8f0c6d5e14",
+			Email:     "user@latebit.io",
+		},
+		acknowledged:  map[string]string{},
+		refreshScopes: map[string]string{},
+	}
+	issuer := &fakeIssuer{refreshScopes: authenticator.refreshScopes}
+	service := NewDefaultAuthorizationService(registry, authenticator, issuer, memoryCodeRepository{},
+		memoryDeviceRepository{}, AuthorizationOptions{
+			CodeExpiresIn:       time.Minute,
+			DeviceCodeExpiresIn: 10 * time.Minute,
+			DevicePollInterval:  5 * time.Second,
+			AccessTokenExpInSec: 3600,
+		})
+	return service, authenticator
+}
+
+func testAuthorizationRequest(clientId string) AuthorizationRequest {
+	return AuthorizationRequest{
+		ResponseType:        ResponseTypeCode,
+		ClientId:            clientId,
+		RedirectUri:         testRedirect,
+		State:               "state",
+		CodeChallenge:       testChallenge(testVerifier),
+		CodeChallengeMethod: CodeChallengeMethodS256,
+	}
+}
+
+func TestDefaultAuthorizationService_ValidateAuthorization(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+
+	_, err := service.ValidateAuthorization(context.TODO(), testAuthorizationRequest("spa"))
+	assert.Nil(t, err)
+
+	var redirect InvalidRedirectError
+	_, err = service.ValidateAuthorization(context.TODO(), testAuthorizationRequest("unknown"))
+	assert.ErrorAs(t, err, &redirect)
+	request := testAuthorizationRequest("spa")
+	request.RedirectUri = "https://evil.example/callback"
+	_, err = service.ValidateAuthorization(context.TODO(), request)
+	assert.ErrorAs(t, err, &redirect)
+
+	var unauthorized UnauthorizedClientError
+	_, err = service.ValidateAuthorization(context.TODO(), testAuthorizationRequest("gateway"))
+	assert.ErrorAs(t, err, &unauthorized)
+
+	var invalid InvalidRequestError
+	request = testAuthorizationRequest("spa")
+	request.CodeChallengeMethod = "plain"
+	_, err = service.ValidateAuthorization(context.TODO(), request)
+	assert.ErrorAs(t, err, &invalid)
+
+	var unsupported UnsupportedResponseTypeError
+	request = testAuthorizationRequest("spa")
+	request.ResponseType = "token"
+	_, err = service.ValidateAuthorization(context.TODO(), request)
+	assert.ErrorAs(t, err, &unsupported)
+}
+
+func TestDefaultAuthorizationService_Token(t *testing.T) {
+	service, authenticator := newTestAuthorizationService()
+
+	_, err := service.Authorize(context.TODO(), testAuthorizationRequest("spa"), "user@latebit.io", "wrong", "")
+	var authenticationErr authentication.AuthenticationError
+	assert.ErrorAs(t, err, &authenticationErr)
+
+	code, err := service.Authorize(context.TODO(), testAuthorizationRequest("spa"), "user@latebit.io", "password", "")
+	assert.Nil(t, err)
+
+	response, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "spa",
+		Code:         code,
+		RedirectUri:  testRedirect,
+		CodeVerifier: testVerifier,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TokenTypeBearer, response.TokenType)
+	assert.Equal(t, 3600, response.ExpiresIn)
+	assert.NotEmpty(t, response.RefreshToken)
+	assert.Equal(t, "spa", authenticator.acknowledged[response.AccessToken])
+
+	// a code can only be exchanged once
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "spa",
+		Code:         code,
+		RedirectUri:  testRedirect,
+		CodeVerifier: testVerifier,
+	})
+	var invalidGrant InvalidGrantError
+	assert.ErrorAs(t, err, &invalidGrant)
+}
+
+func TestDefaultAuthorizationService_RefreshKeepsScope(t *testing.T) {
+	service, authenticator := newTestAuthorizationService()
+
+	request := testAuthorizationRequest("spa")
+	request.Scope = "email"
+	code, err := service.Authorize(context.TODO(), request, "user@latebit.io", "password", "")
+	assert.Nil(t, err)
+	response, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "spa",
+		Code:         code,
+		RedirectUri:  testRedirect,
+		CodeVerifier: testVerifier,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "email", response.Scope)
+
+	response, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeRefreshToken,
+		ClientId:     "spa",
+		RefreshToken: response.RefreshToken,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "renewed-access", response.AccessToken)
+	assert.Equal(t, "email", response.Scope)
+	assert.Equal(t, "spa", authenticator.acknowledged[response.AccessToken])
+}
+
+func TestDefaultAuthorizationService_TokenRejected(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+	authorize := func(clientId string) string {
+		code, err := service.Authorize(context.TODO(), testAuthorizationRequest(clientId), "user@latebit.io", "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	var invalidGrant InvalidGrantError
+	_, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "spa",
+		Code:         authorize("spa"),
+		RedirectUri:  testRedirect,
+		CodeVerifier: "wrong-verifier-wrong-verifier-wrong-verifier",
+	})
+	assert.ErrorAs(t, err, &invalidGrant)
+
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "spa",
+		Code:         authorize("spa"),
+		RedirectUri:  "https://app.latebit.io/other",
+		CodeVerifier: testVerifier,
+	})
+	assert.ErrorAs(t, err, &invalidGrant)
+
+	var clientErr clients.ClientAuthenticationError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "web",
+		Code:         authorize("web"),
+		RedirectUri:  testRedirect,
+		CodeVerifier: testVerifier,
+	})
+	assert.ErrorAs(t, err, &clientErr)
+
+	response, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeAuthorizationCode,
+		ClientId:     "web",
+		ClientSecret: "secret",
+		Code:         authorize("web"),
+		RedirectUri:  testRedirect,
+		CodeVerifier: testVerifier,
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, response.RefreshToken)
+
+	var unsupported UnsupportedGrantTypeError
+	_, err = service.Token(context.TODO(), TokenRequest{GrantType: "implicit", ClientId: "spa"})
+	assert.ErrorAs(t, err, &unsupported)
+
+	var unauthorized UnauthorizedClientError
+	_, err = service.Token(context.TODO(), TokenRequest{GrantType: clients.GrantTypeRefreshToken, ClientId: "web",
+		ClientSecret: "secret", RefreshToken: "refresh"})
+	assert.ErrorAs(t, err, &unauthorized)
+}
+
+func TestDefaultAuthorizationService_ClientCredentials(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+
+	response, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:           clients.GrantTypeClientCredentials,
+		ClientAssertionType: clients.ClientAssertionType,
+		ClientAssertion:     "assertion:reports-job",
+		Scope:               "reports:read",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "client-reports-job-reports:read", response.AccessToken)
+	assert.Equal(t, "reports:read", response.Scope)
+	assert.Empty(t, response.RefreshToken)
+
+	response, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeClientCredentials,
+		ClientId:     "backup-job",
+		ClientSecret: "secret",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "backups", response.Scope)
+
+	var scopeErr clients.ScopeError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:           clients.GrantTypeClientCredentials,
+		ClientAssertionType: clients.ClientAssertionType,
+		ClientAssertion:     "assertion:reports-job",
+		Scope:               "accounts:read",
+	})
+	assert.ErrorAs(t, err, &scopeErr)
+
+	var clientErr clients.ClientAuthenticationError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:           clients.GrantTypeClientCredentials,
+		ClientId:            "backup-job",
+		ClientAssertionType: clients.ClientAssertionType,
+		ClientAssertion:     "assertion:reports-job",
+	})
+	assert.ErrorAs(t, err, &clientErr)
+
+	var invalidRequest InvalidRequestError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:           clients.GrantTypeClientCredentials,
+		ClientAssertionType: "urn:example:other",
+		ClientAssertion:     "assertion:reports-job",
+	})
+	assert.ErrorAs(t, err, &invalidRequest)
+
+	var unauthorized UnauthorizedClientError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:    clients.GrantTypeClientCredentials,
+		ClientId:     "web",
+		ClientSecret: "secret",
+	})
+	assert.ErrorAs(t, err, &unauthorized)
+}
+
+func TestDefaultAuthorizationService_IdToken(t *testing.T) {
+	service, authenticator := newTestAuthorizationService()
+	exchange := func(request AuthorizationRequest) *TokenResponse {
+		code, err := service.Authorize(context.TODO(), request, "user@latebit.io", "password", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := service.Token(context.TODO(), TokenRequest{
+			GrantType:    clients.GrantTypeAuthorizationCode,
+			ClientId:     request.ClientId,
+			Code:         code,
+			RedirectUri:  testRedirect,
+			CodeVerifier: testVerifier,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	request := testAuthorizationRequest("spa")
+	request.Scope = "openid email"
+	request.Nonce = "n-0S6_WzA2Mj"
+	authenticator.account.IsVerified = true
+	response := exchange(request)
+	assert.Equal(t, "id-"+authenticator.account.AccountId+"-spa-n-0S6_WzA2Mj", response.IdToken)
+	assert.Equal(t, "openid email", response.Scope)
+	assert.Equal(t, "openid email", service.tokens.(*fakeIssuer).scope)
+	assert.True(t, service.tokens.(*fakeIssuer).emailVerified)
+
+	authenticator.account.IsVerified = false
+	exchange(request)
+	assert.False(t, service.tokens.(*fakeIssuer).emailVerified)
+
+	// without the openid scope there is no ID token
+	response = exchange(testAuthorizationRequest("spa"))
+	assert.Empty(t, response.IdToken)
+
+	// scopes the client is not registered for are refused before the user signs in
+	request.Scope = "openid admin"
+	_, err := service.ValidateAuthorization(context.TODO(), request)
+	var scopeErr clients.ScopeError
+	assert.ErrorAs(t, err, &scopeErr)
+	_, err = service.Authorize(context.TODO(), request, "user@latebit.io", "password", "")
+	assert.ErrorAs(t, err, &scopeErr)
+}
+
+func TestDefaultAuthorizationService_AuthorizeSecondFactor(t *testing.T) {
+	service, authenticator := newTestAuthorizationService()
+	authenticator.account.Totp = &accounts.Totp{Confirmed: true}
+
+	var codeErr authentication.MfaCodeError
+	_, err := service.Authorize(context.TODO(), testAuthorizationRequest("spa"), "user@latebit.io", "password", "")
+	assert.ErrorAs(t, err, &codeErr)
+
+	code, err := service.Authorize(context.TODO(), testAuthorizationRequest("spa"), "user@latebit.io", "password",
+		"123456")
+	assert.Nil(t, err)
+	assert.NotEmpty(t, code)
+}
+
+func TestEndpointUrl(t *testing.T) {
+	endpoint, err := EndpointUrl("https://auth.latebit.io", "/oauth/device")
+	assert.Nil(t, err)
+	assert.Equal(t, "https://auth.latebit.io/oauth/device", endpoint)
+
+	// without an https issuer there is no url, never the bare path
+	var issuerErr IssuerUrlError
+	for _, issuer := range []string{"bulwark-auth", "http://localhost:8080", "https://"} {
+		_, err = EndpointUrl(issuer, "/oauth/device")
+		assert.ErrorAs(t, err, &issuerErr)
+	}
+}
@@ -0,0 +1,14 @@
+package oauth
+
+import (
+	"context"
+
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+)
+
+// ClientAuthenticator authenticates the client calling an OAuth endpoint against the registered clients, with a
+// secret or a private_key_jwt assertion
+type ClientAuthenticator interface {
+	AuthenticateClient(ctx context.Context, clientId, clientSecret string) error
+	AuthenticateAssertion(ctx context.Context, assertion string, audiences []string) (*clients.Client, error)
+}
@@ -0,0 +1,239 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/accounts"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+)
+
+const (
+	// userCodeCharset consonants only so user codes can not spell words and are easy to type, see RFC 8628
+	// section 6.1
+	userCodeCharset = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength  = 8
+	// slowDownSeconds added to the interval of a device that polls too fast, see RFC 8628 section 3.5
+	slowDownSeconds = 5
+)
+
+// DeviceAuthorizationService the device authorization grant for devices that can not show a sign in form, see
+// RFC 8628. The device shows the user code and polls the token endpoint while the user approves it elsewhere
+type DeviceAuthorizationService interface {
+	AuthorizeDevice(ctx context.Context, request DeviceAuthorizationRequest) (*DeviceAuthorization, error)
+	ReadDevice(ctx context.Context, userCode string) (*DeviceVerification, error)
+	VerifyDevice(ctx context.Context, userCode, email, password, mfaCode string, approve bool) error
+}
+
+// DeviceAuthorizationRequest Scope and Audience are space separated lists
+type DeviceAuthorizationRequest struct {
+	ClientCredentials
+	Scope    string
+	Audience string
+}
+
+// DeviceAuthorization the codes issued to a device, ExpiresIn and Interval are in seconds
+type DeviceAuthorization struct {
+	DeviceCode string
+	UserCode   string
+	ExpiresIn  int
+	Interval   int
+}
+
+// DeviceVerification what the user is asked to approve on the verification page
+type DeviceVerification struct {
+	UserCode   string
+	ClientId   string
+	ClientName string
+	Scope      string
+}
+
+// AuthorizeDevice issues a device code the device polls with and a user code the user enters on the verification
+// page
+func (s *DefaultAuthorizationService) AuthorizeDevice(ctx context.Context, request DeviceAuthorizationRequest) (*DeviceAuthorization, error) {
+	client, err := s.authenticateClient(ctx, request.ClientCredentials)
+	if err != nil {
+		return nil, err
+	}
+	if !client.AllowsGrant(clients.GrantTypeDeviceCode) {
+		return nil, UnauthorizedClientError{Value: client.ClientId}
+	}
+	scope, err := accountScope(client, request.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceCodeBytes := make([]byte, codeSize)
+	if _, err = rand.Read(deviceCodeBytes); err != nil {
+		return nil, err
+	}
+	deviceCode := base64.RawURLEncoding.EncodeToString(deviceCodeBytes)
+	userCode, err := newUserCode()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	err = s.devices.Create(ctx, DeviceCode{
+		DeviceCodeHash: hashCode(deviceCode),
+		UserCode:       userCode,
+		ClientId:       client.ClientId,
+		Scope:          scope,
+		Audience:       strings.Fields(request.Audience),
+		Status:         DeviceCodePending,
+		Interval:       int(s.options.DevicePollInterval.Seconds()),
+		Created:        now,
+		Expires:        now.Add(s.options.DeviceCodeExpiresIn),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceAuthorization{
+		DeviceCode: deviceCode,
+		UserCode:   formatUserCode(userCode),
+		ExpiresIn:  int(s.options.DeviceCodeExpiresIn.Seconds()),
+		Interval:   int(s.options.DevicePollInterval.Seconds()),
+	}, nil
+}
+
+// ReadDevice finds the pending device of a user code so the user can see which client they are approving
+func (s *DefaultAuthorizationService) ReadDevice(ctx context.Context, userCode string) (*DeviceVerification, error) {
+	code, err := s.pendingDevice(ctx, userCode)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.clients.Read(ctx, code.ClientId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeviceVerification{
+		UserCode:   formatUserCode(code.UserCode),
+		ClientId:   client.ClientId,
+		ClientName: client.Name,
+		Scope:      code.Scope,
+	}, nil
+}
+
+// VerifyDevice the user signs in to approve or deny the device, either decision can only be made once. Accounts with
+// a second factor need its code as well
+func (s *DefaultAuthorizationService) VerifyDevice(ctx context.Context, userCode, email, password, mfaCode string, approve bool) error {
+	code, err := s.pendingDevice(ctx, userCode)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.signIn(ctx, email, password, mfaCode)
+	if err != nil {
+		return err
+	}
+
+	status := DeviceCodeDenied
+	if approve {
+		status = DeviceCodeApproved
+	}
+	verified, err := s.devices.Verify(ctx, code.UserCode, status, account.AccountId, account.Email, account.IsVerified,
+		account.Roles, time.Now(), signInMethods(account))
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return UserCodeError{Value: userCode}
+	}
+	return nil
+}
+
+// deviceCode the device polls until the user has decided, a device polling faster than its interval is slowed
+// down. An approved code is consumed so tokens are only issued once
+func (s *DefaultAuthorizationService) deviceCode(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error) {
+	if request.DeviceCode == "" {
+		return nil, InvalidRequestError{Value: "device_code is required"}
+	}
+
+	hash := hashCode(request.DeviceCode)
+	now := time.Now()
+	code, err := s.devices.Poll(ctx, hash, now)
+	if err != nil {
+		return nil, err
+	}
+	if code == nil || code.ClientId != client.ClientId {
+		return nil, InvalidGrantError{Value: "device code is invalid or has been used"}
+	}
+	if now.After(code.Expires) {
+		return nil, ExpiredTokenError{Value: client.ClientId}
+	}
+	if !code.LastPolled.IsZero() && now.Sub(code.LastPolled) < time.Duration(code.Interval)*time.Second {
+		if err = s.devices.SlowDown(ctx, hash, slowDownSeconds); err != nil {
+			return nil, err
+		}
+		return nil, SlowDownError{Value: client.ClientId}
+	}
+
+	switch code.Status {
+	case DeviceCodeApproved:
+		consumed, err := s.devices.Consume(ctx, hash, DeviceCodeApproved)
+		if err != nil {
+			return nil, err
+		}
+		if !consumed {
+			return nil, InvalidGrantError{Value: "device code is invalid or has been used"}
+		}
+		account := &accounts.Account{AccountId: code.AccountId, Email: code.Email, IsVerified: code.EmailVerified,
+			Roles: code.Roles}
+		return s.issueTokens(ctx, client, account, code.Audience, code.Scope, "", code.AuthTime, code.Methods)
+	case DeviceCodeDenied:
+		if _, err = s.devices.Consume(ctx, hash, DeviceCodeDenied); err != nil {
+			return nil, err
+		}
+		return nil, AccessDeniedError{Value: client.ClientId}
+	default:
+		return nil, AuthorizationPendingError{Value: client.ClientId}
+	}
+}
+
+// pendingDevice a user code is accepted without its dash and in any case
+func (s *DefaultAuthorizationService) pendingDevice(ctx context.Context, userCode string) (*DeviceCode, error) {
+	code, err := s.devices.ReadByUserCode(ctx, normalizeUserCode(userCode))
+	if err != nil {
+		return nil, err
+	}
+	if code == nil || code.Status != DeviceCodePending || time.Now().After(code.Expires) {
+		return nil, UserCodeError{Value: userCode}
+	}
+	return code, nil
+}
+
+func newUserCode() (string, error) {
+	code := make([]byte, userCodeLength)
+	size := big.NewInt(int64(len(userCodeCharset)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			return "", err
+		}
+		code[i] = userCodeCharset[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// formatUserCode splits the code in two halves so it is easier to read, such as BDFH-JKLM
+func formatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:userCodeLength/2] + "-" + code[userCodeLength/2:]
+}
+
+func normalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(code))
+}
@@ -0,0 +1,153 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionDeviceCodes = "deviceCodes"
+)
+
+// Device code states, a pending code is approved or denied by the user on the verification page
+const (
+	DeviceCodePending  = "pending"
+	DeviceCodeApproved = "approved"
+	DeviceCodeDenied   = "denied"
+)
+
+// DeviceCode an issued device and user code pair, only the hash of the device code is stored. The account and the
+// time the user signed in are set once the user approves the code
+type DeviceCode struct {
+	DeviceCodeHash string    `bson:"deviceCodeHash"`
+	UserCode       string    `bson:"userCode"`
+	ClientId       string    `bson:"clientId"`
+	Scope          string    `bson:"scope,omitempty"`
+	Audience       []string  `bson:"audience,omitempty"`
+	Status         string    `bson:"status"`
+	AccountId      string    `bson:"accountId,omitempty"`
+	Email          string    `bson:"email,omitempty"`
+	EmailVerified  bool      `bson:"emailVerified,omitempty"`
+	Roles          []string  `bson:"roles,omitempty"`
+	AuthTime       time.Time `bson:"authTime,omitempty"`
+	Methods        []string  `bson:"methods,omitempty"`
+	Interval       int       `bson:"interval"`
+	LastPolled     time.Time `bson:"lastPolled,omitempty"`
+	Created        time.Time `bson:"created"`
+	Expires        time.Time `bson:"expires"`
+}
+
+type DeviceCodeRepository interface {
+	Create(ctx context.Context, code DeviceCode) error
+	ReadByUserCode(ctx context.Context, userCode string) (*DeviceCode, error)
+	Verify(ctx context.Context, userCode, status, accountId, email string, emailVerified bool, roles []string,
+		authTime time.Time, methods []string) (bool, error)
+	Poll(ctx context.Context, deviceCodeHash string, polled time.Time) (*DeviceCode, error)
+	SlowDown(ctx context.Context, deviceCodeHash string, seconds int) error
+	Consume(ctx context.Context, deviceCodeHash, status string) (bool, error)
+}
+
+type MongodbDeviceCodeRepository struct {
+	db *mongo.Database
+}
+
+func NewMongodbDeviceCodeRepository(db *mongo.Database) *MongodbDeviceCodeRepository {
+	// mongodb removes expired codes, like the logon codes they are only valid for minutes
+	_, err := db.Collection(collectionDeviceCodes).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "deviceCodeHash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "userCode", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbDeviceCodeRepository{db: db}
+}
+
+func (r *MongodbDeviceCodeRepository) Create(ctx context.Context, code DeviceCode) error {
+	_, err := r.db.Collection(collectionDeviceCodes).InsertOne(ctx, code)
+	return err
+}
+
+// ReadByUserCode returns nil when there is no such code
+func (r *MongodbDeviceCodeRepository) ReadByUserCode(ctx context.Context, userCode string) (*DeviceCode, error) {
+	var code DeviceCode
+	err := r.db.Collection(collectionDeviceCodes).FindOne(ctx, bson.D{{Key: "userCode", Value: userCode}}).Decode(&code)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &code, nil
+}
+
+// Verify records the decision of the user, false when the code is no longer pending
+func (r *MongodbDeviceCodeRepository) Verify(ctx context.Context, userCode, status, accountId, email string, emailVerified bool, roles []string,
+	authTime time.Time, methods []string) (bool, error) {
+	result, err := r.db.Collection(collectionDeviceCodes).UpdateOne(ctx,
+		bson.D{{Key: "userCode", Value: userCode}, {Key: "status", Value: DeviceCodePending}},
+		bson.D{{Key: "$set", Value: bson.D{
+			{Key: "status", Value: status},
+			{Key: "accountId", Value: accountId},
+			{Key: "email", Value: email},
+			{Key: "emailVerified", Value: emailVerified},
+			{Key: "roles", Value: roles},
+			{Key: "authTime", Value: authTime},
+			{Key: "methods", Value: methods},
+		}}})
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount == 1, nil
+}
+
+// Poll records the time the device polled and returns the code as it was before, so the previous poll can be
+// compared. Returns nil when there is no such code
+func (r *MongodbDeviceCodeRepository) Poll(ctx context.Context, deviceCodeHash string, polled time.Time) (*DeviceCode, error) {
+	var code DeviceCode
+	err := r.db.Collection(collectionDeviceCodes).FindOneAndUpdate(ctx,
+		bson.D{{Key: "deviceCodeHash", Value: deviceCodeHash}},
+		bson.D{{Key: "$set", Value: bson.D{{Key: "lastPolled", Value: polled}}}},
+		options.FindOneAndUpdate().SetReturnDocument(options.Before)).Decode(&code)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &code, nil
+}
+
+// SlowDown increases the interval the device has to wait between polls
+func (r *MongodbDeviceCodeRepository) SlowDown(ctx context.Context, deviceCodeHash string, seconds int) error {
+	_, err := r.db.Collection(collectionDeviceCodes).UpdateOne(ctx,
+		bson.D{{Key: "deviceCodeHash", Value: deviceCodeHash}},
+		bson.D{{Key: "$inc", Value: bson.D{{Key: "interval", Value: seconds}}}})
+	return err
+}
+
+// Consume removes a code in the status, false when another poll already removed it
+func (r *MongodbDeviceCodeRepository) Consume(ctx context.Context, deviceCodeHash, status string) (bool, error) {
+	result, err := r.db.Collection(collectionDeviceCodes).DeleteOne(ctx,
+		bson.D{{Key: "deviceCodeHash", Value: deviceCodeHash}, {Key: "status", Value: status}})
+	if err != nil {
+		return false, err
+	}
+	return result.DeletedCount == 1, nil
+}
@@ -0,0 +1,137 @@
+package oauth
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAuthorizationService_DeviceCode(t *testing.T) {
+	service, authenticator := newTestAuthorizationService()
+	devices := service.devices.(memoryDeviceRepository)
+
+	// the tv is not registered for any scope but openid
+	var scopeErr clients.ScopeError
+	_, err := service.AuthorizeDevice(context.TODO(), DeviceAuthorizationRequest{
+		ClientCredentials: ClientCredentials{ClientId: "tv"},
+		Scope:             "openid email",
+	})
+	assert.ErrorAs(t, err, &scopeErr)
+
+	device, err := service.AuthorizeDevice(context.TODO(), DeviceAuthorizationRequest{
+		ClientCredentials: ClientCredentials{ClientId: "tv"},
+		Scope:             "openid",
+	})
+	assert.Nil(t, err)
+	assert.Len(t, device.UserCode, userCodeLength+1)
+	assert.Equal(t, 600, device.ExpiresIn)
+	assert.Equal(t, 5, device.Interval)
+
+	poll := func() (*TokenResponse, error) {
+		return service.Token(context.TODO(), TokenRequest{
+			GrantType:  clients.GrantTypeDeviceCode,
+			ClientId:   "tv",
+			DeviceCode: device.DeviceCode,
+		})
+	}
+	// the device is allowed to poll once the interval has passed
+	waited := func() {
+		for _, code := range devices {
+			code.LastPolled = code.LastPolled.Add(-time.Duration(code.Interval) * time.Second)
+		}
+	}
+
+	var pending AuthorizationPendingError
+	_, err = poll()
+	assert.ErrorAs(t, err, &pending)
+
+	var slowDown SlowDownError
+	_, err = poll()
+	assert.ErrorAs(t, err, &slowDown)
+	for _, code := range devices {
+		assert.Equal(t, 10, code.Interval)
+	}
+
+	// user codes are accepted in any case and without the dash
+	userCode := strings.ToLower(strings.ReplaceAll(device.UserCode, "-", ""))
+	verification, err := service.ReadDevice(context.TODO(), userCode)
+	assert.Nil(t, err)
+	assert.Equal(t, "Living room TV", verification.ClientName)
+
+	var authenticationErr authentication.AuthenticationError
+	err = service.VerifyDevice(context.TODO(), userCode, "user@latebit.io", "wrong", "", true)
+	assert.ErrorAs(t, err, &authenticationErr)
+
+	assert.Nil(t, service.VerifyDevice(context.TODO(), userCode, "user@latebit.io", "password", "", true))
+	var userCodeErr UserCodeError
+	assert.ErrorAs(t, service.VerifyDevice(context.TODO(), userCode, "user@latebit.io", "password", "", false), &userCodeErr)
+
+	waited()
+	response, err := poll()
+	assert.Nil(t, err)
+	assert.NotEmpty(t, response.RefreshToken)
+	assert.Equal(t, "tv", authenticator.acknowledged[response.AccessToken])
+
+	var invalidGrant InvalidGrantError
+	waited()
+	_, err = poll()
+	assert.ErrorAs(t, err, &invalidGrant)
+}
+
+func TestDefaultAuthorizationService_DeviceCodeDenied(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+
+	device, err := service.AuthorizeDevice(context.TODO(), DeviceAuthorizationRequest{
+		ClientCredentials: ClientCredentials{ClientId: "tv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, service.VerifyDevice(context.TODO(), device.UserCode, "user@latebit.io", "password", "", false))
+
+	var denied AccessDeniedError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:  clients.GrantTypeDeviceCode,
+		ClientId:   "tv",
+		DeviceCode: device.DeviceCode,
+	})
+	assert.ErrorAs(t, err, &denied)
+
+	var unauthorized UnauthorizedClientError
+	_, err = service.AuthorizeDevice(context.TODO(), DeviceAuthorizationRequest{
+		ClientCredentials: ClientCredentials{ClientId: "spa"},
+	})
+	assert.ErrorAs(t, err, &unauthorized)
+}
+
+func TestDefaultAuthorizationService_DeviceCodeExpired(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+	devices := service.devices.(memoryDeviceRepository)
+
+	device, err := service.AuthorizeDevice(context.TODO(), DeviceAuthorizationRequest{
+		ClientCredentials: ClientCredentials{ClientId: "tv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range devices {
+		code.Expires = time.Now().Add(-time.Second)
+	}
+
+	var userCodeErr UserCodeError
+	_, err = service.ReadDevice(context.TODO(), device.UserCode)
+	assert.ErrorAs(t, err, &userCodeErr)
+
+	var expired ExpiredTokenError
+	_, err = service.Token(context.TODO(), TokenRequest{
+		GrantType:  clients.GrantTypeDeviceCode,
+		ClientId:   "tv",
+		DeviceCode: device.DeviceCode,
+	})
+	assert.ErrorAs(t, err, &expired)
+}
@@ -0,0 +1,186 @@
+package oauth
+
+import (
+	"cmp"
+	"context"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// Token type hints accepted by introspection, see RFC 7662 section 2.1
+const (
+	TokenTypeHintAccessToken  = "access_token"
+	TokenTypeHintRefreshToken = "refresh_token"
+)
+
+// IntrospectionService answers RFC 7662 introspection requests for authenticated clients
+type IntrospectionService interface {
+	Introspect(ctx context.Context, token, tokenTypeHint string) (*Introspection, error)
+}
+
+type Tokenizer interface {
+	ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error)
+	ValidateRefreshToken(ctx context.Context, tokenString string) (*tokens.RefreshTokenClaims, error)
+}
+
+// SessionRepository finds the acknowledged session a token belongs to
+type SessionRepository interface {
+	ReadByToken(ctx context.Context, token string) (*authentication.Token, error)
+}
+
+// UsedRefreshTokenRepository knows the refresh tokens that have been rotated
+type UsedRefreshTokenRepository interface {
+	IsUsed(ctx context.Context, tokenId string) (bool, error)
+}
+
+// Introspection RFC 7662 introspection response, everything but Active is left out for an inactive token
+type Introspection struct {
+	Active    bool          `json:"active"`
+	Scope     string        `json:"scope,omitempty"`
+	ClientId  string        `json:"client_id,omitempty"`
+	Username  string        `json:"username,omitempty"`
+	TokenType string        `json:"token_type,omitempty"`
+	Expires   int64         `json:"exp,omitempty"`
+	IssuedAt  int64         `json:"iat,omitempty"`
+	NotBefore int64         `json:"nbf,omitempty"`
+	Subject   string        `json:"sub,omitempty"`
+	Audience  []string      `json:"aud,omitempty"`
+	Issuer    string        `json:"iss,omitempty"`
+	JwtId     string        `json:"jti,omitempty"`
+	Roles     []string      `json:"roles,omitempty"`
+	Act       *tokens.Actor `json:"act,omitempty"`
+}
+
+type DefaultIntrospectionService struct {
+	tokenizer     Tokenizer
+	sessions      SessionRepository
+	revocations   tokens.RevocationService
+	refreshTokens UsedRefreshTokenRepository
+}
+
+func NewDefaultIntrospectionService(tokenizer Tokenizer, sessions SessionRepository,
+	revocations tokens.RevocationService, refreshTokens UsedRefreshTokenRepository) *DefaultIntrospectionService {
+	return &DefaultIntrospectionService{
+		tokenizer:     tokenizer,
+		sessions:      sessions,
+		revocations:   revocations,
+		refreshTokens: refreshTokens,
+	}
+}
+
+// Introspect reports whether the token is active. A token is active when it validates, which checks its signature
+// and expiry, and has not been revoked. Refresh tokens that have been rotated are inactive, as are the tokens of a
+// session removed by logout or refresh token reuse, which are revoked with it. The hint only decides which type is tried first, an acknowledged session
+// only adds the client and username a token does not carry itself
+func (s *DefaultIntrospectionService) Introspect(ctx context.Context, token, tokenTypeHint string) (*Introspection, error) {
+	introspectors := []func(context.Context, string) (*Introspection, error){s.accessToken, s.refreshToken}
+	if tokenTypeHint == TokenTypeHintRefreshToken {
+		introspectors = []func(context.Context, string) (*Introspection, error){s.refreshToken, s.accessToken}
+	}
+
+	for _, introspect := range introspectors {
+		introspection, err := introspect(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+		if introspection.Active {
+			return introspection, s.addSession(ctx, token, introspection)
+		}
+	}
+
+	return &Introspection{Active: false}, nil
+}
+
+// addSession tokens of an account sign in do not name the client they were issued to, the session acknowledged for
+// the client does
+func (s *DefaultIntrospectionService) addSession(ctx context.Context, token string, introspection *Introspection) error {
+	if introspection.ClientId != "" && introspection.Username != "" {
+		return nil
+	}
+	session, err := s.sessions.ReadByToken(ctx, token)
+	if err != nil || session == nil {
+		return err
+	}
+	introspection.ClientId = cmp.Or(introspection.ClientId, session.ClientId)
+	introspection.Username = cmp.Or(introspection.Username, session.Email)
+	return nil
+}
+
+// accessToken an invalid token is reported as inactive, only lookup failures are returned as errors
+func (s *DefaultIntrospectionService) accessToken(ctx context.Context, token string) (*Introspection, error) {
+	claims, err := s.tokenizer.ValidateAccessToken(ctx, token)
+	if err != nil {
+		return &Introspection{Active: false}, nil
+	}
+
+	revoked, err := s.revocations.IsRevoked(ctx, claims.RegisteredClaims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return &Introspection{Active: false}, nil
+	}
+
+	introspection := newIntrospection(claims.RegisteredClaims, TokenTypeHintAccessToken)
+	introspection.Roles = claims.Roles
+	introspection.Username = claims.Email
+	introspection.ClientId = claims.ClientId
+	introspection.Scope = claims.Scope
+	introspection.Act = claims.Act
+	return introspection, nil
+}
+
+// refreshToken an invalid token is reported as inactive, only lookup failures are returned as errors
+func (s *DefaultIntrospectionService) refreshToken(ctx context.Context, token string) (*Introspection, error) {
+	claims, err := s.tokenizer.ValidateRefreshToken(ctx, token)
+	if err != nil {
+		return &Introspection{Active: false}, nil
+	}
+
+	revoked, err := s.revocations.IsRevoked(ctx, claims.RegisteredClaims)
+	if err != nil {
+		return nil, err
+	}
+	familyRevoked, err := s.revocations.IsFamilyRevoked(ctx, claims.TokenFamily())
+	if err != nil {
+		return nil, err
+	}
+	if revoked || familyRevoked {
+		return &Introspection{Active: false}, nil
+	}
+	used, err := s.refreshTokens.IsUsed(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return &Introspection{Active: false}, nil
+	}
+
+	introspection := newIntrospection(claims.RegisteredClaims, TokenTypeHintRefreshToken)
+	introspection.ClientId = claims.ClientId
+	introspection.Scope = claims.Scope
+	return introspection, nil
+}
+
+func newIntrospection(claims jwt.RegisteredClaims, tokenType string) *Introspection {
+	introspection := &Introspection{
+		Active:    true,
+		TokenType: tokenType,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		JwtId:     claims.ID,
+	}
+	if claims.ExpiresAt != nil {
+		introspection.Expires = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		introspection.IssuedAt = claims.IssuedAt.Unix()
+	}
+	if claims.NotBefore != nil {
+		introspection.NotBefore = claims.NotBefore.Unix()
+	}
+	return introspection
+}
@@ -0,0 +1,181 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/latebit-io/bulwarkauth/internal/authentication"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeTokenizer struct {
+	access  map[string]*tokens.AccessTokenClaims
+	refresh map[string]*tokens.RefreshTokenClaims
+}
+
+func (f fakeTokenizer) ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error) {
+	claims, ok := f.access[tokenString]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func (f fakeTokenizer) ValidateRefreshToken(ctx context.Context, tokenString string) (*tokens.RefreshTokenClaims, error) {
+	claims, ok := f.refresh[tokenString]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+type fakeSessions map[string]*authentication.Token
+
+func (f fakeSessions) ReadByToken(ctx context.Context, token string) (*authentication.Token, error) {
+	return f[token], nil
+}
+
+type fakeRevocations struct {
+	tokens.RevocationService
+	revoked map[string]bool
+}
+
+func (f fakeRevocations) IsRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error) {
+	return f.revoked[claims.ID], nil
+}
+
+func (f fakeRevocations) IsFamilyRevoked(ctx context.Context, family string) (bool, error) {
+	return f.revoked[family], nil
+}
+
+type fakeUsedRefreshTokens map[string]bool
+
+func (f fakeUsedRefreshTokens) IsUsed(ctx context.Context, tokenId string) (bool, error) {
+	return f[tokenId], nil
+}
+
+func testToken(t *testing.T, claims jwt.RegisteredClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestDefaultIntrospectionService_Introspect(t *testing.T) {
+	registered := jwt.RegisteredClaims{
+		ID:        "access",
+		Subject:   "3f1c9a52-6a43-4c1e-9d7e-2b8f0c6d5e14",
+		Issuer:    "bulwark-auth",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	access := testToken(t, registered)
+	refreshClaims := registered
+	refreshClaims.ID = "refresh"
+	refresh := testToken(t, refreshClaims)
+	unacknowledged := testToken(t, jwt.RegisteredClaims{ID: "other", Subject: "3f1c9a52-6a43-4c1e-9d7e-2b8f0c6d5e14"})
+	invalid := testToken(t, jwt.RegisteredClaims{ID: "invalid"})
+
+	tokenizer := fakeTokenizer{
+		access: map[string]*tokens.AccessTokenClaims{
+			access: {
+				Type:             tokens.TokenTypeAccess,
+				Roles:            []string{"admin"},
+				Scope:            "read write",
+				RegisteredClaims: registered,
+			},
+			unacknowledged: {Type: tokens.TokenTypeAccess, Email: "test@latebit.io",
+				RegisteredClaims: jwt.RegisteredClaims{ID: "other"}},
+		},
+		refresh: map[string]*tokens.RefreshTokenClaims{
+			refresh: {Type: tokens.TokenTypeRefresh, Family: "family", RegisteredClaims: refreshClaims},
+		},
+	}
+	session := &authentication.Token{Email: "test@latebit.io", ClientId: "web", AccessToken: access, RefreshToken: refresh}
+	sessions := fakeSessions{access: session, refresh: session}
+	revocations := fakeRevocations{revoked: map[string]bool{}}
+	used := fakeUsedRefreshTokens{}
+	service := NewDefaultIntrospectionService(tokenizer, sessions, revocations, used)
+
+	introspection, err := service.Introspect(context.TODO(), access, "")
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, registered.Subject, introspection.Subject)
+	assert.Equal(t, "test@latebit.io", introspection.Username)
+	assert.Equal(t, "web", introspection.ClientId)
+	assert.Equal(t, "read write", introspection.Scope)
+	assert.Equal(t, []string{"admin"}, introspection.Roles)
+	assert.Equal(t, TokenTypeHintAccessToken, introspection.TokenType)
+	assert.Equal(t, registered.ExpiresAt.Unix(), introspection.Expires)
+
+	introspection, err = service.Introspect(context.TODO(), refresh, TokenTypeHintRefreshToken)
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, TokenTypeHintRefreshToken, introspection.TokenType)
+
+	// a wrong hint still finds the token
+	introspection, err = service.Introspect(context.TODO(), refresh, TokenTypeHintAccessToken)
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+
+	// renewed or unacknowledged tokens have no session, they are still active
+	introspection, err = service.Introspect(context.TODO(), unacknowledged, "")
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "test@latebit.io", introspection.Username)
+	assert.Empty(t, introspection.ClientId)
+
+	introspection, err = service.Introspect(context.TODO(), invalid, "")
+	assert.Nil(t, err)
+	assert.Equal(t, &Introspection{Active: false}, introspection)
+
+	// rotated refresh tokens are inactive
+	used["refresh"] = true
+	introspection, err = service.Introspect(context.TODO(), refresh, TokenTypeHintRefreshToken)
+	assert.Nil(t, err)
+	assert.False(t, introspection.Active)
+	delete(used, "refresh")
+
+	// as are revoked tokens and families
+	revocations.revoked["access"] = true
+	revocations.revoked["family"] = true
+	introspection, err = service.Introspect(context.TODO(), access, "")
+	assert.Nil(t, err)
+	assert.False(t, introspection.Active)
+	introspection, err = service.Introspect(context.TODO(), refresh, TokenTypeHintRefreshToken)
+	assert.Nil(t, err)
+	assert.False(t, introspection.Active)
+}
+
+func TestDefaultIntrospectionService_ClientToken(t *testing.T) {
+	registered := jwt.RegisteredClaims{
+		ID:        "client",
+		Subject:   "reports-job",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	client := testToken(t, registered)
+	tokenizer := fakeTokenizer{
+		access: map[string]*tokens.AccessTokenClaims{
+			client: {Type: tokens.TokenTypeAccess, ClientId: "reports-job", Scope: "reports:read",
+				RegisteredClaims: registered},
+		},
+	}
+	revocations := fakeRevocations{revoked: map[string]bool{}}
+	service := NewDefaultIntrospectionService(tokenizer, fakeSessions{}, revocations, fakeUsedRefreshTokens{})
+
+	introspection, err := service.Introspect(context.TODO(), client, "")
+	assert.Nil(t, err)
+	assert.True(t, introspection.Active)
+	assert.Equal(t, "reports-job", introspection.ClientId)
+	assert.Equal(t, "reports:read", introspection.Scope)
+	assert.Empty(t, introspection.Username)
+
+	revocations.revoked["client"] = true
+	introspection, err = service.Introspect(context.TODO(), client, "")
+	assert.Nil(t, err)
+	assert.False(t, introspection.Active)
+}
@@ -0,0 +1,114 @@
+package oauth
+
+import "fmt"
+
+type InvalidRequestError struct {
+	Value string `json:"value"`
+}
+
+func (e InvalidRequestError) Error() string {
+	return fmt.Sprintf("invalid request: %s", e.Value)
+}
+
+type InvalidGrantError struct {
+	Value string `json:"value"`
+}
+
+func (e InvalidGrantError) Error() string {
+	return fmt.Sprintf("invalid grant: %s", e.Value)
+}
+
+type UnauthorizedClientError struct {
+	Value string `json:"value"`
+}
+
+func (e UnauthorizedClientError) Error() string {
+	return fmt.Sprintf("client is not allowed this grant: %s", e.Value)
+}
+
+type UnsupportedGrantTypeError struct {
+	Value string `json:"value"`
+}
+
+func (e UnsupportedGrantTypeError) Error() string {
+	return fmt.Sprintf("unsupported grant type: %s", e.Value)
+}
+
+type UnsupportedResponseTypeError struct {
+	Value string `json:"value"`
+}
+
+func (e UnsupportedResponseTypeError) Error() string {
+	return fmt.Sprintf("unsupported response type: %s", e.Value)
+}
+
+// InvalidRedirectError the client or redirect uri of an authorization request can not be trusted, so the error is
+// shown to the user instead of being sent to the redirect uri
+type InvalidRedirectError struct {
+	Value string `json:"value"`
+}
+
+func (e InvalidRedirectError) Error() string {
+	return fmt.Sprintf("invalid client or redirect uri: %s", e.Value)
+}
+
+// AuthorizationPendingError the user has not approved or denied the device code yet, see RFC 8628 section 3.5
+type AuthorizationPendingError struct {
+	Value string `json:"value"`
+}
+
+func (e AuthorizationPendingError) Error() string {
+	return fmt.Sprintf("authorization pending: %s", e.Value)
+}
+
+// SlowDownError the device polled before its interval passed, the interval is increased
+type SlowDownError struct {
+	Value string `json:"value"`
+}
+
+func (e SlowDownError) Error() string {
+	return fmt.Sprintf("polling too fast: %s", e.Value)
+}
+
+type AccessDeniedError struct {
+	Value string `json:"value"`
+}
+
+func (e AccessDeniedError) Error() string {
+	return fmt.Sprintf("access denied: %s", e.Value)
+}
+
+type ExpiredTokenError struct {
+	Value string `json:"value"`
+}
+
+func (e ExpiredTokenError) Error() string {
+	return fmt.Sprintf("device code expired: %s", e.Value)
+}
+
+// InvalidTargetError the client may not exchange tokens for the audience, see RFC 8693 section 2.2.2
+type InvalidTargetError struct {
+	Value string `json:"value"`
+}
+
+func (e InvalidTargetError) Error() string {
+	return fmt.Sprintf("invalid target: %s", e.Value)
+}
+
+// UserCodeError the user code is unknown, expired or has already been used
+type UserCodeError struct {
+	Value string `json:"value"`
+}
+
+func (e UserCodeError) Error() string {
+	return fmt.Sprintf("invalid user code: %s", e.Value)
+}
+
+// IssuerUrlError the issuer is not an https url, so it does not locate the endpoints of the service
+type IssuerUrlError struct {
+	Value string `json:"value"`
+}
+
+func (e IssuerUrlError) Error() string {
+	return fmt.Sprintf("issuer is not an https url: %s", e.Value)
+}
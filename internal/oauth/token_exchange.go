@@ -0,0 +1,136 @@
+package oauth
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+)
+
+// TokenTypeAccessToken the token type identifier of an access token, the only type that can be exchanged, see
+// RFC 8693 section 3
+const TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+// ExchangeTokenizer reads the subject token and issues the exchanged token
+type ExchangeTokenizer interface {
+	ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error)
+	CreateExchangedAccessToken(ctx context.Context, subject *tokens.AccessTokenClaims, actor, scope string, options tokens.TokenOptions) (string, error)
+}
+
+// TokenExchangeService the token exchange grant of RFC 8693 for services calling other services on behalf of a user,
+// register Exchange with DefaultAuthorizationService.AddGrant
+type TokenExchangeService interface {
+	Exchange(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error)
+}
+
+type DefaultTokenExchangeService struct {
+	introspection       IntrospectionService
+	tokenizer           ExchangeTokenizer
+	accessTokenExpInSec int
+}
+
+// NewDefaultTokenExchangeService subject tokens are checked with introspection, so only active tokens can be
+// exchanged. The access token lifetime is used for clients without one of their own
+func NewDefaultTokenExchangeService(introspection IntrospectionService, tokenizer ExchangeTokenizer,
+	accessTokenExpInSec int) *DefaultTokenExchangeService {
+	return &DefaultTokenExchangeService{
+		introspection:       introspection,
+		tokenizer:           tokenizer,
+		accessTokenExpInSec: accessTokenExpInSec,
+	}
+}
+
+// Exchange issues a narrower token for the subject of an access token, the client is the actor. The subject token
+// must have been issued to the client or be addressed to it. The client must be allowed to exchange for every
+// requested audience and the subject token must already be addressed to them, the scope can only be reduced and the
+// token never outlives the subject token
+func (s *DefaultTokenExchangeService) Exchange(ctx context.Context, client *clients.Client, request TokenRequest) (*TokenResponse, error) {
+	if request.SubjectToken == "" {
+		return nil, InvalidRequestError{Value: "subject_token is required"}
+	}
+	if request.SubjectTokenType != TokenTypeAccessToken {
+		return nil, InvalidRequestError{Value: "subject_token_type must be " + TokenTypeAccessToken}
+	}
+	if request.RequestedTokenType != "" && request.RequestedTokenType != TokenTypeAccessToken {
+		return nil, InvalidRequestError{Value: "requested_token_type must be " + TokenTypeAccessToken}
+	}
+	if request.ActorToken != "" {
+		return nil, InvalidRequestError{Value: "actor_token is not supported, the client is the actor"}
+	}
+
+	audience := strings.Fields(request.Audience)
+	if len(audience) == 0 {
+		return nil, InvalidRequestError{Value: "audience is required"}
+	}
+	if !client.AllowsExchange(audience) {
+		return nil, InvalidTargetError{Value: request.Audience}
+	}
+
+	introspection, err := s.introspection.Introspect(ctx, request.SubjectToken, TokenTypeHintAccessToken)
+	if err != nil {
+		return nil, err
+	}
+	if !introspection.Active || introspection.TokenType != TokenTypeHintAccessToken {
+		return nil, InvalidGrantError{Value: "subject_token is invalid, expired or revoked"}
+	}
+	subject, err := s.tokenizer.ValidateAccessToken(ctx, request.SubjectToken)
+	if err != nil {
+		return nil, InvalidGrantError{Value: err.Error()}
+	}
+	if introspection.ClientId != client.ClientId && !slices.Contains(subject.Audience, client.ClientId) {
+		return nil, InvalidGrantError{Value: "subject_token was not issued to or for the client"}
+	}
+	for _, exchangeAudience := range audience {
+		if !slices.Contains(subject.Audience, exchangeAudience) {
+			return nil, InvalidTargetError{Value: exchangeAudience}
+		}
+	}
+
+	scope, err := exchangeScope(client, strings.Fields(introspection.Scope), strings.Fields(request.Scope))
+	if err != nil {
+		return nil, err
+	}
+
+	options := client.TokenOptions(audience)
+	options.AccessTokenExpInSec = expiresIn(client.AccessTokenExpireInSeconds, s.accessTokenExpInSec)
+	if remaining := int(time.Until(subject.ExpiresAt.Time).Seconds()); remaining < options.AccessTokenExpInSec {
+		options.AccessTokenExpInSec = remaining
+	}
+	if options.AccessTokenExpInSec <= 0 {
+		return nil, InvalidGrantError{Value: "subject_token is invalid, expired or revoked"}
+	}
+
+	accessToken, err := s.tokenizer.CreateExchangedAccessToken(ctx, subject, client.ClientId, scope, options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenResponse{
+		AccessToken:     accessToken,
+		TokenType:       TokenTypeBearer,
+		ExpiresIn:       options.AccessTokenExpInSec,
+		Scope:           scope,
+		IssuedTokenType: TokenTypeAccessToken,
+	}, nil
+}
+
+// exchangeScope the exchanged scope is the requested scope, or the scope of the subject token when none is requested.
+// Every scope must be in the subject token, so a subject token without a scope is exchanged without one, and the
+// client must be registered for every scope
+func exchangeScope(client *clients.Client, subject, requested []string) (string, error) {
+	if len(requested) == 0 {
+		requested = subject
+	}
+	if len(requested) == 0 {
+		return "", nil
+	}
+	for _, scope := range requested {
+		if !slices.Contains(subject, scope) {
+			return "", clients.ScopeError{Value: scope}
+		}
+	}
+	return client.GrantScope(requested)
+}
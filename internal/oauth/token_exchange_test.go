@@ -0,0 +1,159 @@
+package oauth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/latebit-io/bulwarkauth/internal/clients"
+	"github.com/latebit-io/bulwarkauth/internal/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExchangeTokenizer knows the subject tokens by their string, exchanged tokens name the actor, scope and
+// audience they were issued with
+type fakeExchangeTokenizer map[string]*tokens.AccessTokenClaims
+
+func (f fakeExchangeTokenizer) Introspect(ctx context.Context, token, tokenTypeHint string) (*Introspection, error) {
+	claims, ok := f[token]
+	if !ok || claims.ExpiresAt.Before(time.Now()) {
+		return &Introspection{Active: false}, nil
+	}
+	return &Introspection{Active: true, TokenType: TokenTypeHintAccessToken, Subject: claims.Subject,
+		Scope: claims.Scope, ClientId: claims.ClientId, Audience: claims.Audience}, nil
+}
+
+func (f fakeExchangeTokenizer) ValidateAccessToken(ctx context.Context, tokenString string) (*tokens.AccessTokenClaims, error) {
+	claims, ok := f[tokenString]
+	if !ok {
+		return nil, errors.New("invalid token")
+	}
+	return claims, nil
+}
+
+func (f fakeExchangeTokenizer) CreateExchangedAccessToken(ctx context.Context, subject *tokens.AccessTokenClaims, actor, scope string, options tokens.TokenOptions) (string, error) {
+	return fmt.Sprintf("%s-%s-%s-%v", subject.Subject, actor, scope, options.Audience), nil
+}
+
+func newTestTokenExchangeService() (*DefaultTokenExchangeService, *clients.Client) {
+	expires := jwt.NewNumericDate(time.Now().Add(2 * time.Hour))
+	audience := jwt.ClaimStrings{"api-gateway", "billing"}
+	tokenizer := fakeExchangeTokenizer{
+		// addressed to the gateway
+		"user-token": {Scope: "billing:read billing:write", RegisteredClaims: jwt.RegisteredClaims{Subject: "account",
+			Audience: audience, ExpiresAt: expires}},
+		"unscoped-token": {RegisteredClaims: jwt.RegisteredClaims{Subject: "account", Audience: audience,
+			ExpiresAt: expires}},
+		// issued to the gateway
+		"scoped-token": {Scope: "billing:read", ClientId: "api-gateway", RegisteredClaims: jwt.RegisteredClaims{
+			Subject: "account", Audience: jwt.ClaimStrings{"billing"},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute))}},
+		"web-token": {Scope: "billing:read", ClientId: "web", RegisteredClaims: jwt.RegisteredClaims{
+			Subject: "account", Audience: jwt.ClaimStrings{"billing"}, ExpiresAt: expires}},
+		"expired-token": {RegisteredClaims: jwt.RegisteredClaims{Subject: "account", Audience: audience,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))}},
+	}
+	gateway := &clients.Client{
+		ClientId:          "api-gateway",
+		GrantTypes:        []string{clients.GrantTypeTokenExchange},
+		Scopes:            []string{"billing:read", "billing:write"},
+		ExchangeAudiences: []string{"billing", "ledger"},
+	}
+	return NewDefaultTokenExchangeService(tokenizer, tokenizer, 3600), gateway
+}
+
+func TestDefaultTokenExchangeService_Exchange(t *testing.T) {
+	service, gateway := newTestTokenExchangeService()
+
+	response, err := service.Exchange(context.TODO(), gateway, TokenRequest{
+		SubjectToken:     "user-token",
+		SubjectTokenType: TokenTypeAccessToken,
+		Scope:            "billing:read",
+		Audience:         "billing",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "account-api-gateway-billing:read-[billing]", response.AccessToken)
+	assert.Equal(t, TokenTypeAccessToken, response.IssuedTokenType)
+	assert.Equal(t, 3600, response.ExpiresIn)
+	assert.Empty(t, response.RefreshToken)
+
+	// the scope of the subject token is kept and the token does not outlive it
+	response, err = service.Exchange(context.TODO(), gateway, TokenRequest{
+		SubjectToken:     "scoped-token",
+		SubjectTokenType: TokenTypeAccessToken,
+		Audience:         "billing",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "billing:read", response.Scope)
+	assert.LessOrEqual(t, response.ExpiresIn, 60)
+
+	// a subject token without a scope is exchanged without one
+	response, err = service.Exchange(context.TODO(), gateway, TokenRequest{
+		SubjectToken:     "unscoped-token",
+		SubjectTokenType: TokenTypeAccessToken,
+		Audience:         "billing",
+	})
+	assert.Nil(t, err)
+	assert.Empty(t, response.Scope)
+}
+
+func TestDefaultTokenExchangeService_ExchangeRejected(t *testing.T) {
+	service, gateway := newTestTokenExchangeService()
+	exchange := func(request TokenRequest) error {
+		_, err := service.Exchange(context.TODO(), gateway, request)
+		return err
+	}
+
+	var target InvalidTargetError
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token", SubjectTokenType: TokenTypeAccessToken,
+		Audience: "accounts"}), &target)
+	// the subject token is not addressed to the ledger
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token", SubjectTokenType: TokenTypeAccessToken,
+		Audience: "ledger"}), &target)
+
+	var scopeErr clients.ScopeError
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "scoped-token", SubjectTokenType: TokenTypeAccessToken,
+		Scope: "billing:write", Audience: "billing"}), &scopeErr)
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token", SubjectTokenType: TokenTypeAccessToken,
+		Scope: "accounts:read", Audience: "billing"}), &scopeErr)
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "unscoped-token", SubjectTokenType: TokenTypeAccessToken,
+		Scope: "billing:read", Audience: "billing"}), &scopeErr)
+
+	var invalidGrant InvalidGrantError
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "expired-token", SubjectTokenType: TokenTypeAccessToken,
+		Audience: "billing"}), &invalidGrant)
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "unknown", SubjectTokenType: TokenTypeAccessToken,
+		Audience: "billing"}), &invalidGrant)
+	// tokens issued to another client can not be exchanged by the gateway
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "web-token", SubjectTokenType: TokenTypeAccessToken,
+		Audience: "billing"}), &invalidGrant)
+
+	var invalidRequest InvalidRequestError
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token", SubjectTokenType: TokenTypeAccessToken}),
+		&invalidRequest)
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token",
+		SubjectTokenType: "urn:ietf:params:oauth:token-type:refresh_token", Audience: "billing"}), &invalidRequest)
+	assert.ErrorAs(t, exchange(TokenRequest{SubjectToken: "user-token", SubjectTokenType: TokenTypeAccessToken,
+		ActorToken: "actor", Audience: "billing"}), &invalidRequest)
+}
+
+func TestDefaultAuthorizationService_AddGrant(t *testing.T) {
+	service, _ := newTestAuthorizationService()
+	exchange, _ := newTestTokenExchangeService()
+	service.AddGrant(clients.GrantTypeTokenExchange, exchange.Exchange)
+
+	// the client must still be allowed the grant
+	var unauthorized UnauthorizedClientError
+	_, err := service.Token(context.TODO(), TokenRequest{
+		GrantType:        clients.GrantTypeTokenExchange,
+		ClientId:         "backup-job",
+		ClientSecret:     "secret",
+		SubjectToken:     "user-token",
+		SubjectTokenType: TokenTypeAccessToken,
+		Audience:         "billing",
+	})
+	assert.ErrorAs(t, err, &unauthorized)
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepInterval how often full buckets are dropped from memory
+const sweepInterval = time.Minute
+
+// MemoryLimiter keeps the buckets in the process, each replica limits on its own
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	bucket
+	fullAt time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: map[string]*memoryBucket{}, lastSweep: time.Now()}
+}
+
+func (l *MemoryLimiter) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok || !now.Before(b.fullAt) {
+		b = &memoryBucket{bucket: bucket{tokens: float64(limit.Requests), updated: now}}
+		l.buckets[key] = b
+	}
+	result := b.take(limit, now)
+	b.fullAt = b.full(limit)
+	return result, nil
+}
+
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	for key, b := range l.buckets {
+		if !now.Before(b.fullAt) {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
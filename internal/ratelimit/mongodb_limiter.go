@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	collectionRateLimits = "rateLimits"
+)
+
+type rateLimitBucket struct {
+	Key     string    `bson:"key"`
+	Tokens  float64   `bson:"tokens"`
+	Allowed bool      `bson:"allowed"`
+	Updated time.Time `bson:"updated"`
+	Expires time.Time `bson:"expires"`
+}
+
+// MongodbLimiter keeps the buckets in mongodb so the limits are shared across replicas
+type MongodbLimiter struct {
+	db *mongo.Database
+}
+
+func NewMongodbLimiter(db *mongo.Database) *MongodbLimiter {
+	// mongodb removes a bucket once it has refilled, which is the same as a new one
+	_, err := db.Collection(collectionRateLimits).Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "key", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &MongodbLimiter{db: db}
+}
+
+// Take refills and takes the token in a single update so replicas can not take the same token
+func (l *MongodbLimiter) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	now := time.Now()
+	requests := float64(limit.Requests)
+	// a bucket that expired but was not yet removed by mongodb starts over full
+	current := bson.D{{Key: "$cond", Value: bson.A{
+		bson.D{{Key: "$gt", Value: bson.A{"$expires", now}}}, "$tokens", requests}}}
+	elapsed := bson.D{{Key: "$divide", Value: bson.A{
+		bson.D{{Key: "$subtract", Value: bson.A{now, bson.D{{Key: "$ifNull", Value: bson.A{"$updated", now}}}}}}, 1000}}}
+	refilled := bson.D{{Key: "$min", Value: bson.A{requests,
+		bson.D{{Key: "$add", Value: bson.A{current, bson.D{{Key: "$multiply", Value: bson.A{
+			bson.D{{Key: "$max", Value: bson.A{elapsed, 0}}}, limit.rate()}}}}}}}}}
+	allowed := bson.D{{Key: "$gte", Value: bson.A{"$tokens", 1}}}
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.D{{Key: "tokens", Value: refilled}, {Key: "updated", Value: now}}}},
+		{{Key: "$set", Value: bson.D{
+			{Key: "allowed", Value: allowed},
+			{Key: "tokens", Value: bson.D{{Key: "$cond", Value: bson.A{
+				allowed, bson.D{{Key: "$subtract", Value: bson.A{"$tokens", 1}}}, "$tokens"}}}},
+		}}},
+		{{Key: "$set", Value: bson.D{{Key: "expires", Value: bson.D{{Key: "$add", Value: bson.A{now,
+			bson.D{{Key: "$multiply", Value: bson.A{
+				bson.D{{Key: "$subtract", Value: bson.A{requests, "$tokens"}}}, 1000 / limit.rate()}}}}}}}}}},
+	}
+
+	take := func() (*rateLimitBucket, error) {
+		var b rateLimitBucket
+		err := l.db.Collection(collectionRateLimits).FindOneAndUpdate(ctx, bson.D{{Key: "key", Value: key}}, pipeline,
+			options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&b)
+		return &b, err
+	}
+	b, err := take()
+	// two requests at once can both try to insert the first bucket, the one that lost takes from it instead
+	if mongo.IsDuplicateKeyError(err) {
+		b, err = take()
+	}
+	if err != nil {
+		return Result{}, err
+	}
+
+	if !b.Allowed {
+		return Result{RetryAfter: retryAfter(b.Tokens, limit)}, nil
+	}
+	return Result{Allowed: true, Remaining: int(b.Tokens)}, nil
+}
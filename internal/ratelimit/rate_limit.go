@@ -0,0 +1,128 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Request attributes a route can be limited by, each gets its own bucket
+const (
+	KeyIp     = "ip"
+	KeyEmail  = "email"
+	KeyApiKey = "api_key"
+)
+
+// Keys the request attributes a route can be limited by
+var Keys = []string{KeyIp, KeyEmail, KeyApiKey}
+
+// Stores where the buckets are kept, mongodb shares them across replicas
+const (
+	StoreMemory  = "memory"
+	StoreMongodb = "mongodb"
+)
+
+var Stores = []string{StoreMemory, StoreMongodb}
+
+// Limit a token bucket that holds Requests tokens and refills all of them over Period, so bursts of Requests are
+// allowed and the rate averages to Requests each Period
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// rate tokens refilled each second
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// DefaultLimits the public routes that send emails
+var DefaultLimits = map[string]Limit{
+	"/api/accounts":                   {Requests: 10, Period: time.Hour},
+	"/api/accounts/forgot":            {Requests: 5, Period: time.Hour},
+	"/api/accounts/resend":            {Requests: 5, Period: time.Hour},
+	"/api/authenticate/logon/request": {Requests: 5, Period: time.Hour},
+}
+
+// Result of taking a token, RetryAfter is how long until the next token when it was not allowed
+type Result struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration
+}
+
+// Limiter takes a token from the bucket of the key, the bucket starts full
+type Limiter interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
+
+// bucket refills the tokens for the time since updated and takes one when there is one
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *bucket) take(limit Limit, now time.Time) Result {
+	elapsed := max(now.Sub(b.updated).Seconds(), 0)
+	b.tokens = min(float64(limit.Requests), b.tokens+elapsed*limit.rate())
+	b.updated = now
+	if b.tokens < 1 {
+		return Result{RetryAfter: retryAfter(b.tokens, limit)}
+	}
+	b.tokens--
+	return Result{Allowed: true, Remaining: int(b.tokens)}
+}
+
+// full when the bucket has refilled, from then on it is the same as a new bucket
+func (b *bucket) full(limit Limit) time.Time {
+	return b.updated.Add(time.Duration((float64(limit.Requests) - b.tokens) / limit.rate() * float64(time.Second)))
+}
+
+func retryAfter(tokens float64, limit Limit) time.Duration {
+	return time.Duration(math.Ceil((1 - tokens) / limit.rate() * float64(time.Second)))
+}
+
+// ParseLimit reads a limit written as requests/period, such as 5/1h
+func ParseLimit(value string) (Limit, error) {
+	requests, period, found := strings.Cut(strings.TrimSpace(value), "/")
+	if !found {
+		return Limit{}, fmt.Errorf("rate limit %q is not requests/period", value)
+	}
+	limit := Limit{}
+	var err error
+	if limit.Requests, err = strconv.Atoi(requests); err != nil || limit.Requests < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive number of requests", value)
+	}
+	if limit.Period, err = time.ParseDuration(period); err != nil || limit.Period <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q needs a positive period such as 1h", value)
+	}
+	return limit, nil
+}
+
+// ParseLimits reads route=requests/period entries, such as /api/accounts/forgot=5/1h, a limit of off removes the
+// route from the defaults
+func ParseLimits(entries []string, defaults map[string]Limit) (map[string]Limit, error) {
+	limits := make(map[string]Limit, len(defaults))
+	for route, limit := range defaults {
+		limits[route] = limit
+	}
+	for _, entry := range entries {
+		route, value, found := strings.Cut(strings.TrimSpace(entry), "=")
+		if !found || !strings.HasPrefix(route, "/") {
+			return nil, fmt.Errorf("rate limit %q is not route=requests/period", entry)
+		}
+		if value == "off" {
+			delete(limits, route)
+			continue
+		}
+		limit, err := ParseLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		limits[route] = limit
+	}
+	return limits, nil
+}
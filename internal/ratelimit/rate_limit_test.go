@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryLimiter_Take(t *testing.T) {
+	ctx := context.Background()
+	limiter := NewMemoryLimiter()
+	limit := Limit{Requests: 3, Period: time.Hour}
+
+	for remaining := 2; remaining >= 0; remaining-- {
+		result, err := limiter.Take(ctx, "forgot:email:john@latebit.io", limit)
+		assert.NoError(t, err)
+		assert.True(t, result.Allowed)
+		assert.Equal(t, remaining, result.Remaining)
+	}
+	result, err := limiter.Take(ctx, "forgot:email:john@latebit.io", limit)
+	assert.NoError(t, err)
+	assert.False(t, result.Allowed)
+	assert.InDelta(t, (20 * time.Minute).Seconds(), result.RetryAfter.Seconds(), 1)
+
+	result, err = limiter.Take(ctx, "forgot:email:jane@latebit.io", limit)
+	assert.NoError(t, err)
+	assert.True(t, result.Allowed)
+}
+
+func TestBucket_Refills(t *testing.T) {
+	now := time.Now()
+	limit := Limit{Requests: 2, Period: time.Minute}
+	b := bucket{tokens: 0, updated: now}
+
+	assert.False(t, b.take(limit, now.Add(10*time.Second)).Allowed)
+	assert.True(t, b.take(limit, now.Add(30*time.Second)).Allowed)
+	assert.False(t, b.take(limit, now.Add(31*time.Second)).Allowed)
+
+	// refilling stops when the bucket is full
+	result := b.take(limit, now.Add(time.Hour))
+	assert.True(t, result.Allowed)
+	assert.Equal(t, 1, result.Remaining)
+	assert.Equal(t, now.Add(time.Hour+30*time.Second), b.full(limit))
+}
+
+func TestParseLimits(t *testing.T) {
+	limits, err := ParseLimits([]string{"/api/accounts/forgot=2/15m", " /api/authenticate=20/1m", "/api/accounts=off"},
+		DefaultLimits)
+	assert.NoError(t, err)
+	assert.Equal(t, Limit{Requests: 2, Period: 15 * time.Minute}, limits["/api/accounts/forgot"])
+	assert.Equal(t, Limit{Requests: 20, Period: time.Minute}, limits["/api/authenticate"])
+	assert.NotContains(t, limits, "/api/accounts")
+	assert.Contains(t, DefaultLimits, "/api/accounts")
+	assert.Equal(t, DefaultLimits["/api/accounts/resend"], limits["/api/accounts/resend"])
+
+	for _, entry := range []string{"/api/accounts", "api/accounts=5/1h", "/api/accounts=5", "/api/accounts=0/1h",
+		"/api/accounts=5/hour", "/api/accounts=5/-1h"} {
+		_, err := ParseLimits([]string{entry}, nil)
+		assert.Error(t, err, entry)
+	}
+}
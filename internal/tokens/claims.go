@@ -0,0 +1,94 @@
+package tokens
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+)
+
+// ReservedClaims claims set by the tokenizer itself, claims providers can never overwrite them
+var ReservedClaims = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "typ", "email", "client_id", "roles", "act",
+	"scope", "azp", "nonce", "auth_time", "fam"}
+
+// ClaimsProvider adds custom claims to access tokens, providers run in the order they were added and a later
+// provider overwrites the claims of an earlier one
+type ClaimsProvider interface {
+	Claims(ctx context.Context, subject string) (map[string]interface{}, error)
+}
+
+// MarshalJSON writes the custom claims next to the registered claims, reserved claims are left as they are
+func (c AccessTokenClaims) MarshalJSON() ([]byte, error) {
+	type plain AccessTokenClaims
+	data, err := json.Marshal(plain(c))
+	if err != nil || len(c.Custom) == 0 {
+		return data, err
+	}
+
+	merged := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, err
+	}
+
+	for name, value := range c.Custom {
+		if isReservedClaim(name) {
+			continue
+		}
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		merged[name] = raw
+	}
+
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON reads every claim that is not reserved into Custom
+func (c *AccessTokenClaims) UnmarshalJSON(data []byte) error {
+	type plain AccessTokenClaims
+	if err := json.Unmarshal(data, (*plain)(c)); err != nil {
+		return err
+	}
+
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+
+	for _, name := range ReservedClaims {
+		delete(all, name)
+	}
+
+	c.Custom = nil
+	if len(all) > 0 {
+		c.Custom = all
+	}
+
+	return nil
+}
+
+// customClaims collects the claims of every provider, a provider failing fails the token
+func (d DefaultTokenizer) customClaims(ctx context.Context, subject string) (map[string]interface{}, error) {
+	if len(d.claimsProviders) == 0 {
+		return nil, nil
+	}
+
+	custom := make(map[string]interface{})
+	for _, provider := range d.claimsProviders {
+		claims, err := provider.Claims(ctx, subject)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range claims {
+			if !isReservedClaim(name) {
+				custom[name] = value
+			}
+		}
+	}
+
+	return custom, nil
+}
+
+func isReservedClaim(name string) bool {
+	return slices.Contains(ReservedClaims, name)
+}
@@ -0,0 +1,79 @@
+package tokens
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// Authentication method references set as the amr claim, see RFC 8176. RFC 8176 has no value for a sign in with
+// another identity provider so fed is used
+const (
+	AmrPassword        = "pwd"
+	AmrOneTimePassword = "otp"
+	AmrFederated       = "fed"
+	AmrMultiFactor     = "mfa"
+)
+
+// IdTokenClaims the claims of an OpenID Connect ID token, see OpenID Connect Core section 2. The audience is the
+// client the user signed in to
+type IdTokenClaims struct {
+	Nonce           string           `json:"nonce,omitempty"`
+	AuthTime        *jwt.NumericDate `json:"auth_time,omitempty"`
+	Amr             []string         `json:"amr,omitempty"`
+	AuthorizedParty string           `json:"azp,omitempty"`
+	Email           string           `json:"email,omitempty"`
+	EmailVerified   bool             `json:"email_verified"`
+	jwt.RegisteredClaims
+}
+
+// IdTokenOptions what the ID token says about the sign in. ClientId is the audience, Nonce is echoed back to the
+// client and AuthTime is when the user authenticated. ExpInSec falls back to the access token lifetime
+type IdTokenOptions struct {
+	ClientId      string
+	Nonce         string
+	AuthTime      time.Time
+	Methods       []string
+	Email         string
+	EmailVerified bool
+	ExpInSec      int
+}
+
+// CreateIdToken signs an ID token with the current access key, so it can be verified with the published key set.
+// Its audience is the client rather than the audience allowlist, it is not meant for resource servers
+func (d DefaultTokenizer) CreateIdToken(ctx context.Context, subject string, options IdTokenOptions) (string, error) {
+	if options.ClientId == "" {
+		return "", AudienceError{}
+	}
+
+	key, err := d.signingKeyService.LatestKey(ctx, KeyUseAccess)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	authTime := options.AuthTime
+	if authTime.IsZero() {
+		authTime = now
+	}
+	claims := IdTokenClaims{
+		Nonce:           options.Nonce,
+		AuthTime:        jwt.NewNumericDate(authTime),
+		Amr:             options.Methods,
+		AuthorizedParty: options.ClientId,
+		Email:           options.Email,
+		EmailVerified:   options.EmailVerified,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        uuid.New().String(),
+			Issuer:    d.Issuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{options.ClientId},
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Second * time.Duration(expiresIn(options.ExpInSec, d.accessTokenExpInSec)))),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+
+	return d.signAs(key, claims, KeyUseAccess, TokenTypeId)
+}
@@ -0,0 +1,85 @@
+package tokens
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// JWK a single public signing key in RFC 7517 JSON Web Key format
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+}
+
+// JWKS a JSON Web Key Set containing all public keys that can verify bulwarkauth tokens
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK converts the PEM encoded public key of a SigningKey into a JWK
+func NewJWK(key SigningKey) (*JWK, error) {
+	block, _ := pem.Decode([]byte(key.PublicKey))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode public key PEM block for key: %s", key.KeyId)
+	}
+
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	jwk := &JWK{
+		KeyId:     key.KeyId,
+		Algorithm: key.Algorithm,
+		Use:       "sig",
+	}
+
+	switch k := publicKey.(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(k.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the curve size as required by RFC 7518
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk.KeyType = "EC"
+		jwk.Curve = k.Curve.Params().Name
+		jwk.X = base64.RawURLEncoding.EncodeToString(k.X.FillBytes(make([]byte, size)))
+		jwk.Y = base64.RawURLEncoding.EncodeToString(k.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(k)
+	default:
+		return nil, errors.New("public key type not supported")
+	}
+
+	return jwk, nil
+}
+
+// NewJWKS builds a key set from the stored signing keys
+func NewJWKS(keys []SigningKey) (*JWKS, error) {
+	jwks := &JWKS{Keys: make([]JWK, 0, len(keys))}
+	for _, key := range keys {
+		jwk, err := NewJWK(key)
+		if err != nil {
+			return nil, err
+		}
+		jwks.Keys = append(jwks.Keys, *jwk)
+	}
+	return jwks, nil
+}
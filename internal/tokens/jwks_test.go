@@ -0,0 +1,88 @@
+package tokens
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewJWK(t *testing.T) {
+	key, err := NewSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwk, err := NewJWK(*key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode([]byte(key.PublicKey))
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey := publicKey.(*rsa.PublicKey)
+
+	n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+	assert.Nil(t, err)
+	e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "RSA", jwk.KeyType)
+	assert.Equal(t, key.KeyId, jwk.KeyId)
+	assert.Equal(t, "RS256", jwk.Algorithm)
+	assert.Equal(t, "sig", jwk.Use)
+	assert.Equal(t, 0, rsaKey.N.Cmp(new(big.Int).SetBytes(n)))
+	assert.Equal(t, int64(rsaKey.E), new(big.Int).SetBytes(e).Int64())
+}
+
+func TestNewJWKS(t *testing.T) {
+	first, err := NewSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewSigningKey("RS256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks, err := NewJWKS([]SigningKey{*first, *second})
+	assert.Nil(t, err)
+	assert.Len(t, jwks.Keys, 2)
+
+	_, err = NewJWKS([]SigningKey{{KeyId: "bad", PublicKey: "not a pem"}})
+	assert.Error(t, err)
+}
+
+func TestNewJWK_EllipticCurves(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		keyType   string
+		curve     string
+	}{
+		{"ES256", "EC", "P-256"},
+		{"EdDSA", "OKP", "Ed25519"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			key, err := NewSigningKey(tt.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			jwk, err := NewJWK(*key)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.keyType, jwk.KeyType)
+			assert.Equal(t, tt.curve, jwk.Curve)
+			assert.Equal(t, tt.algorithm, jwk.Algorithm)
+			assert.NotEmpty(t, jwk.X)
+		})
+	}
+}
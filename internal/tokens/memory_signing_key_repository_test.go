@@ -0,0 +1,74 @@
+package tokens
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// memorySigningKeyRepository keeps signing keys in memory so tokenizer tests can run without mongodb
+type memorySigningKeyRepository struct {
+	keys []SigningKey
+}
+
+func newMemorySigningKeyRepository() *memorySigningKeyRepository {
+	return &memorySigningKeyRepository{}
+}
+
+func (m *memorySigningKeyRepository) Add(ctx context.Context, key SigningKey) error {
+	m.keys = append(m.keys, key)
+	return nil
+}
+
+func (m *memorySigningKeyRepository) GetKey(ctx context.Context, keyId string) (SigningKey, error) {
+	for _, k := range m.keys {
+		if k.KeyId == keyId {
+			return k, nil
+		}
+	}
+	return SigningKey{}, mongo.ErrNoDocuments
+}
+
+func (m *memorySigningKeyRepository) GetLatestKey(ctx context.Context, use string) (SigningKey, error) {
+	var latest SigningKey
+	for _, k := range m.keys {
+		if k.Use == use && k.CurrentState() == KeyStateActive && !k.ActivatedAt().Before(latest.ActivatedAt()) {
+			latest = k
+		}
+	}
+	return latest, nil
+}
+
+func (m *memorySigningKeyRepository) GetAllKeys(ctx context.Context) ([]SigningKey, error) {
+	return append([]SigningKey(nil), m.keys...), nil
+}
+
+func (m *memorySigningKeyRepository) UpdateState(ctx context.Context, keyId, state string, changed time.Time) error {
+	for i, k := range m.keys {
+		if k.KeyId != keyId {
+			continue
+		}
+		m.keys[i].State = state
+		switch state {
+		case KeyStateActive:
+			m.keys[i].Activated = changed
+		case KeyStateVerify:
+			m.keys[i].Deactivated = changed
+		case KeyStateRetired:
+			m.keys[i].Retired = changed
+		}
+		return nil
+	}
+	return mongo.ErrNoDocuments
+}
+
+func (m *memorySigningKeyRepository) Delete(ctx context.Context, keyId string) error {
+	for i, k := range m.keys {
+		if k.KeyId == keyId {
+			m.keys = append(m.keys[:i], m.keys[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
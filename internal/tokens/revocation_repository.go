@@ -0,0 +1,90 @@
+package tokens
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Revocation kinds, a token revocation revokes a single token by its jti, a subject revocation revokes every
+// token issued to the subject up to the time of revocation and a family revocation revokes every refresh token
+// of a family
+const (
+	RevocationToken   = "token"
+	RevocationSubject = "subject"
+	RevocationFamily  = "family"
+)
+
+// Revocation a revoked token or subject, it is kept until every token it covers has expired
+type Revocation struct {
+	Kind    string    `bson:"kind"`
+	Value   string    `bson:"value"`
+	Revoked time.Time `bson:"revoked"`
+	Expires time.Time `bson:"expires"`
+}
+
+type RevocationRepository interface {
+	Revoke(ctx context.Context, revocation Revocation) error
+	Read(ctx context.Context, kind, value string) (*Revocation, error)
+}
+
+const (
+	revocationCollection = "revocations"
+)
+
+type DefaultRevocationRepository struct {
+	db *mongo.Database
+}
+
+func NewDefaultRevocationRepository(db *mongo.Database) *DefaultRevocationRepository {
+	collection := db.Collection(revocationCollection)
+	_, err := collection.Indexes().CreateMany(context.Background(), []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "kind", Value: 1}, {Key: "value", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			// mongodb removes revocations once the tokens they cover can no longer be used
+			Keys:    bson.D{{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &DefaultRevocationRepository{db: db}
+}
+
+// Revoke stores the revocation, revoking the same token or subject again moves the revocation time forward
+func (r *DefaultRevocationRepository) Revoke(ctx context.Context, revocation Revocation) error {
+	collection := r.db.Collection(revocationCollection)
+	filter := bson.D{{Key: "kind", Value: revocation.Kind}, {Key: "value", Value: revocation.Value}}
+	update := bson.D{{Key: "$set", Value: bson.D{
+		{Key: "revoked", Value: revocation.Revoked},
+		{Key: "expires", Value: revocation.Expires},
+	}}}
+	_, err := collection.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Read returns nil when nothing has been revoked
+func (r *DefaultRevocationRepository) Read(ctx context.Context, kind, value string) (*Revocation, error) {
+	collection := r.db.Collection(revocationCollection)
+	var revocation Revocation
+	err := collection.FindOne(ctx, bson.D{{Key: "kind", Value: kind}, {Key: "value", Value: value}}).Decode(&revocation)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &revocation, nil
+}
@@ -0,0 +1,161 @@
+package tokens
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RevocationService revokes tokens and checks whether a token has been revoked
+type RevocationService interface {
+	RevokeToken(ctx context.Context, claims jwt.RegisteredClaims) error
+	RevokeSubject(ctx context.Context, subject string) error
+	RevokeFamily(ctx context.Context, family string) error
+	IsRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error)
+	IsFamilyRevoked(ctx context.Context, family string) (bool, error)
+}
+
+type cachedRevocation struct {
+	revocation *Revocation
+	cached     time.Time
+}
+
+// DefaultRevocationService caches revocation lookups in process so validation does not hit the database for
+// every request. Revocations made on this replica apply immediately, revocations made on another replica apply
+// once the cached lookup is older than cacheTtl
+type DefaultRevocationService struct {
+	repository       RevocationRepository
+	maxTokenLifetime time.Duration
+	cacheTtl         time.Duration
+
+	mu          sync.RWMutex
+	cache       map[string]cachedRevocation
+	lastEvicted time.Time
+}
+
+// NewDefaultRevocationService maxTokenLifetime is how long a subject revocation is kept, it should be the
+// longest lifetime of any token
+func NewDefaultRevocationService(repository RevocationRepository, maxTokenLifetime, cacheTtl time.Duration) *DefaultRevocationService {
+	return &DefaultRevocationService{
+		repository:       repository,
+		maxTokenLifetime: maxTokenLifetime,
+		cacheTtl:         cacheTtl,
+		cache:            make(map[string]cachedRevocation),
+	}
+}
+
+// RevokeToken revokes a single token by its jti until it expires
+func (s *DefaultRevocationService) RevokeToken(ctx context.Context, claims jwt.RegisteredClaims) error {
+	expires := time.Now().Add(s.maxTokenLifetime)
+	if claims.ExpiresAt != nil {
+		expires = claims.ExpiresAt.Time
+	}
+	return s.revoke(ctx, Revocation{
+		Kind:    RevocationToken,
+		Value:   claims.ID,
+		Revoked: time.Now(),
+		Expires: expires,
+	})
+}
+
+// RevokeSubject revokes every token issued to the subject so far, used when an account is deleted or its
+// password changes
+func (s *DefaultRevocationService) RevokeSubject(ctx context.Context, subject string) error {
+	// iat only has second precision, every token issued within the current second is revoked as well
+	revoked := time.Now().Truncate(time.Second)
+	return s.revoke(ctx, Revocation{
+		Kind:    RevocationSubject,
+		Value:   subject,
+		Revoked: revoked,
+		Expires: revoked.Add(s.maxTokenLifetime),
+	})
+}
+
+// RevokeFamily revokes every refresh token of a family, used when a refresh token is presented a second time
+func (s *DefaultRevocationService) RevokeFamily(ctx context.Context, family string) error {
+	return s.revoke(ctx, Revocation{
+		Kind:    RevocationFamily,
+		Value:   family,
+		Revoked: time.Now(),
+		Expires: time.Now().Add(s.maxTokenLifetime),
+	})
+}
+
+// IsFamilyRevoked reports whether the refresh token family has been revoked
+func (s *DefaultRevocationService) IsFamilyRevoked(ctx context.Context, family string) (bool, error) {
+	revocation, err := s.lookup(ctx, RevocationFamily, family)
+	if err != nil {
+		return false, err
+	}
+	return revocation != nil, nil
+}
+
+// IsRevoked reports whether the token itself or every token of its subject issued up to its iat was revoked
+func (s *DefaultRevocationService) IsRevoked(ctx context.Context, claims jwt.RegisteredClaims) (bool, error) {
+	token, err := s.lookup(ctx, RevocationToken, claims.ID)
+	if err != nil {
+		return false, err
+	}
+	if token != nil {
+		return true, nil
+	}
+
+	subject, err := s.lookup(ctx, RevocationSubject, claims.Subject)
+	if err != nil {
+		return false, err
+	}
+	if subject == nil {
+		return false, nil
+	}
+
+	return claims.IssuedAt == nil || !claims.IssuedAt.Time.After(subject.Revoked), nil
+}
+
+func (s *DefaultRevocationService) revoke(ctx context.Context, revocation Revocation) error {
+	err := s.repository.Revoke(ctx, revocation)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache[revocation.Kind+":"+revocation.Value] = cachedRevocation{revocation: &revocation, cached: time.Now()}
+	return nil
+}
+
+func (s *DefaultRevocationService) lookup(ctx context.Context, kind, value string) (*Revocation, error) {
+	key := kind + ":" + value
+	s.mu.RLock()
+	cached, ok := s.cache[key]
+	s.mu.RUnlock()
+	if ok && time.Since(cached.cached) < s.cacheTtl {
+		return cached.revocation, nil
+	}
+
+	revocation, err := s.repository.Read(ctx, kind, value)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evictExpired()
+	s.cache[key] = cachedRevocation{revocation: revocation, cached: time.Now()}
+	return revocation, nil
+}
+
+// evictExpired drops stale entries at most once per cacheTtl so the cache does not grow with every token
+// ever validated, callers must hold the write lock
+func (s *DefaultRevocationService) evictExpired() {
+	if time.Since(s.lastEvicted) < s.cacheTtl {
+		return
+	}
+	s.lastEvicted = time.Now()
+	for key, cached := range s.cache {
+		if time.Since(cached.cached) >= s.cacheTtl {
+			delete(s.cache, key)
+		}
+	}
+}
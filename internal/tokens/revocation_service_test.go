@@ -0,0 +1,100 @@
+package tokens
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+type memoryRevocationRepository struct {
+	revocations map[string]Revocation
+	reads       int
+}
+
+func (m *memoryRevocationRepository) Revoke(ctx context.Context, revocation Revocation) error {
+	m.revocations[revocation.Kind+":"+revocation.Value] = revocation
+	return nil
+}
+
+func (m *memoryRevocationRepository) Read(ctx context.Context, kind, value string) (*Revocation, error) {
+	m.reads++
+	revocation, ok := m.revocations[kind+":"+value]
+	if !ok {
+		return nil, nil
+	}
+	return &revocation, nil
+}
+
+func TestDefaultRevocationService_RevokeToken(t *testing.T) {
+	repo := &memoryRevocationRepository{revocations: make(map[string]Revocation)}
+	service := NewDefaultRevocationService(repo, time.Hour, time.Minute)
+	claims := jwt.RegisteredClaims{
+		ID:        "jti",
+		Subject:   "test@latebit.io",
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	revoked, err := service.IsRevoked(context.TODO(), claims)
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	// the lookup is cached
+	reads := repo.reads
+	_, _ = service.IsRevoked(context.TODO(), claims)
+	assert.Equal(t, reads, repo.reads)
+
+	// revoking on this replica applies straight away
+	assert.Nil(t, service.RevokeToken(context.TODO(), claims))
+	revoked, err = service.IsRevoked(context.TODO(), claims)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+	assert.Equal(t, claims.ExpiresAt.Time, repo.revocations[RevocationToken+":jti"].Expires)
+}
+
+func TestDefaultRevocationService_RevokeSubject(t *testing.T) {
+	repo := &memoryRevocationRepository{revocations: make(map[string]Revocation)}
+	service := NewDefaultRevocationService(repo, time.Hour, time.Minute)
+	before := jwt.RegisteredClaims{
+		ID:       "before",
+		Subject:  "test@latebit.io",
+		IssuedAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}
+	after := jwt.RegisteredClaims{
+		ID:       "after",
+		Subject:  "test@latebit.io",
+		IssuedAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	assert.Nil(t, service.RevokeSubject(context.TODO(), "test@latebit.io"))
+
+	revoked, err := service.IsRevoked(context.TODO(), before)
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = service.IsRevoked(context.TODO(), after)
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+}
+
+func TestDefaultRevocationService_RevokeFamily(t *testing.T) {
+	repo := &memoryRevocationRepository{revocations: make(map[string]Revocation)}
+	service := NewDefaultRevocationService(repo, time.Hour, time.Minute)
+
+	revoked, err := service.IsFamilyRevoked(context.TODO(), "family")
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+
+	assert.Nil(t, service.RevokeFamily(context.TODO(), "family"))
+
+	revoked, err = service.IsFamilyRevoked(context.TODO(), "family")
+	assert.Nil(t, err)
+	assert.True(t, revoked)
+
+	revoked, err = service.IsFamilyRevoked(context.TODO(), "other")
+	assert.Nil(t, err)
+	assert.False(t, revoked)
+}
@@ -1,58 +1,211 @@
 package tokens
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// SigningAlgorithms the JWS algorithms tokens can be signed with
+var SigningAlgorithms = []string{"RS256", "RS384", "RS512", "ES256", "EdDSA"}
+
+// Signing key lifecycle states, a key is published while pending, signs while active, only verifies
+// tokens it already signed while in verify and is no longer trusted once retired
+const (
+	KeyStatePending = "pending"
+	KeyStateActive  = "active"
+	KeyStateVerify  = "verify"
+	KeyStateRetired = "retired"
+)
+
+// Signing key uses, when separate keys are enabled access and refresh tokens are signed by their own keys and a key
+// only verifies tokens of its use. Keys without a use sign and verify both
+const (
+	KeyUseAccess  = "access"
+	KeyUseRefresh = "refresh"
+)
+
+// SigningKeyUses the uses signing keys are kept for, a single shared key unless separate keys are enabled
+func SigningKeyUses(separate bool) []string {
+	if separate {
+		return []string{KeyUseAccess, KeyUseRefresh}
+	}
+	return []string{""}
+}
+
 type SigningKey struct {
-	KeyId      string    `bson:"key_id"`
-	Format     string    `bson:"format"`
-	Algorithm  string    `bson:"algorithm"`
-	PrivateKey string    `bson:"private_key"`
-	PublicKey  string    `bson:"public_key"`
-	Created    time.Time `bson:"created"`
+	KeyId       string    `bson:"key_id"`
+	Format      string    `bson:"format"`
+	Algorithm   string    `bson:"algorithm"`
+	Use         string    `bson:"use,omitempty"`
+	PrivateKey  string    `bson:"private_key"`
+	PublicKey   string    `bson:"public_key"`
+	WrappedKey  string    `bson:"wrapped_key,omitempty"`
+	KekId       string    `bson:"kek_id,omitempty"`
+	State       string    `bson:"state"`
+	Created     time.Time `bson:"created"`
+	Activated   time.Time `bson:"activated,omitempty"`
+	Deactivated time.Time `bson:"deactivated,omitempty"`
+	Retired     time.Time `bson:"retired,omitempty"`
 }
 
-func NewSigningKey(byteSize int) (*SigningKey, error) {
-	bits := byteSize * 8
-	privateKey, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return nil, err
+// CurrentState keys stored before the lifecycle was introduced have no state and are treated as active
+func (k SigningKey) CurrentState() string {
+	if k.State == "" {
+		return KeyStateActive
 	}
+	return k.State
+}
+
+// Verifies reports whether the key may verify tokens of the given use
+func (k SigningKey) Verifies(use string) bool {
+	return k.Use == "" || k.Use == use
+}
 
-	privateKeyPEM := &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+// ActivatedAt when the key started signing, falls back to created for keys stored without an activation time
+func (k SigningKey) ActivatedAt() time.Time {
+	if k.Activated.IsZero() {
+		return k.Created
 	}
+	return k.Activated
+}
+
+// NewSigningKey generates a key pair for the given JWS algorithm, RSA private keys are stored as PKCS#1,
+// ECDSA as SEC 1 and Ed25519 as PKCS#8, public keys are always PKIX
+func NewSigningKey(algorithm string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var privateKeyPEM *pem.Block
+	var format string
 
-	publicKey := &privateKey.PublicKey
-	publicKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	switch algorithm {
+	case "RS256", "RS384", "RS512":
+		rsaKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits[algorithm])
+		if err != nil {
+			return nil, err
+		}
+		privateKey = rsaKey
+		format = "PKCS#1"
+		privateKeyPEM = &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}
+	case "ES256":
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		ecBytes, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = ecKey
+		format = "SEC1"
+		privateKeyPEM = &pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: ecBytes,
+		}
+	case "EdDSA":
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		edBytes, err := x509.MarshalPKCS8PrivateKey(edKey)
+		if err != nil {
+			return nil, err
+		}
+		privateKey = edKey
+		format = "PKCS#8"
+		privateKeyPEM = &pem.Block{
+			Type:  "PRIVATE KEY",
+			Bytes: edBytes,
+		}
+	default:
+		return nil, fmt.Errorf("signing algorithm not supported: %s", algorithm)
+	}
+
+	publicKeyBytes, err := x509.MarshalPKIXPublicKey(privateKey.Public())
 	if err != nil {
 		return nil, err
 	}
 
 	publicKeyPEM := &pem.Block{
-		Type:  "RSA PUBLIC KEY",
+		Type:  publicKeyPEMType(algorithm),
 		Bytes: publicKeyBytes,
 	}
 	keyId := uuid.New()
 	return &SigningKey{
 		KeyId:      keyId.String(),
-		Algorithm:  fmt.Sprintf("RS%d", byteSize),
+		Algorithm:  algorithm,
 		PrivateKey: pemBlockToString(privateKeyPEM),
 		PublicKey:  pemBlockToString(publicKeyPEM),
-		Format:     "PKCS#1",
+		Format:     format,
+		State:      KeyStatePending,
 		Created:    time.Now(),
 	}, nil
 }
 
+// rsaKeyBits modulus size used for each RSA algorithm
+var rsaKeyBits = map[string]int{
+	"RS256": 2048,
+	"RS384": 3072,
+	"RS512": 4096,
+}
+
+// publicKeyPEMType RSA keys keep the block type they have always been stored with
+func publicKeyPEMType(algorithm string) string {
+	if strings.HasPrefix(algorithm, "RS") {
+		return "RSA PUBLIC KEY"
+	}
+	return "PUBLIC KEY"
+}
+
+// ParsePrivateKey decodes a PEM private key in any of the formats NewSigningKey stores
+func ParsePrivateKey(key string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key type not supported")
+	}
+	return signer, nil
+}
+
+// ParsePublicKey decodes a PEM PKIX public key
+func ParsePublicKey(key string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
 func pemBlockToString(block *pem.Block) string {
 	return string(pem.EncodeToMemory(block))
 }
@@ -0,0 +1,109 @@
+package tokens
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// reloadCooldown limits how often tokens with an unknown kid can force a reload from the database
+	reloadCooldown = time.Second
+)
+
+// SigningKeyWatcher notifies when the stored signing keys change
+type SigningKeyWatcher interface {
+	Watch(ctx context.Context, onChange func()) error
+}
+
+// SigningKeyCache keeps the verification keys in memory and refreshes them when keys are added or change
+// state on any replica
+type SigningKeyCache struct {
+	mu         sync.RWMutex
+	keys       map[string]SigningKey
+	service    SigningKeyService
+	lastReload time.Time
+}
+
+func NewSigningKeyCache(service SigningKeyService) *SigningKeyCache {
+	return &SigningKeyCache{
+		keys:    make(map[string]SigningKey),
+		service: service,
+	}
+}
+
+// Reload replaces the cached keys with the keys currently stored
+func (c *SigningKeyCache) Reload(ctx context.Context) error {
+	keys, err := c.service.GetAllKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	keyMap := make(map[string]SigningKey, len(keys))
+	for _, k := range keys {
+		keyMap[k.KeyId] = k
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keyMap
+	c.lastReload = time.Now()
+	return nil
+}
+
+// Get returns the key for kid, an unknown kid triggers a single reload in case the key was added on
+// another replica since the last refresh
+func (c *SigningKeyCache) Get(ctx context.Context, kid string) (SigningKey, error) {
+	c.mu.RLock()
+	key, ok := c.keys[kid]
+	lastReload := c.lastReload
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	if time.Since(lastReload) >= reloadCooldown {
+		if err := c.Reload(ctx); err != nil {
+			return SigningKey{}, err
+		}
+		c.mu.RLock()
+		key, ok = c.keys[kid]
+		c.mu.RUnlock()
+		if ok {
+			return key, nil
+		}
+	}
+
+	return SigningKey{}, SigningKeyNotFoundError{Value: kid}
+}
+
+// Start keeps the cache up to date until the context is cancelled. Changes are followed through the watcher,
+// if it is nil or fails, for example when mongodb is not a replica set, the keys are polled every pollEvery instead
+func (c *SigningKeyCache) Start(ctx context.Context, watcher SigningKeyWatcher, pollEvery time.Duration) {
+	reload := func() {
+		if err := c.Reload(ctx); err != nil && ctx.Err() == nil {
+			log.Println("reloading signing keys failed:", err)
+		}
+	}
+
+	if watcher != nil {
+		err := watcher.Watch(ctx, reload)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("watching signing keys failed, polling instead:", err)
+		reload()
+	}
+
+	ticker := time.NewTicker(pollEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reload()
+		}
+	}
+}
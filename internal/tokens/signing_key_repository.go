@@ -3,41 +3,71 @@ package tokens
 import (
 	"context"
 	"errors"
+	"fmt"
+	"log"
 	"time"
 
-	"github.com/google/uuid"
+	"github.com/latebit-io/bulwarkauth/internal/encryption"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SigningKeyRepository interface {
-	Add(ctx context.Context, privateKey string, publicKey string, algorithm string) error
+	Add(ctx context.Context, key SigningKey) error
 	GetKey(ctx context.Context, keyId string) (SigningKey, error)
-	GetLatestKey(ctx context.Context) (SigningKey, error)
+	GetLatestKey(ctx context.Context, use string) (SigningKey, error)
 	GetAllKeys(ctx context.Context) ([]SigningKey, error)
+	UpdateState(ctx context.Context, keyId, state string, changed time.Time) error
+	Delete(ctx context.Context, keyId string) error
 }
 
+// DefaultSigningKeyRepository stores signing keys in mongodb, when a key-encryption key is configured private keys
+// are envelope encrypted before they are written and decrypted when they are read
 type DefaultSigningKeyRepository struct {
-	db             *mongo.Database
-	collectionName string
+	db                    *mongo.Database
+	collectionName        string
+	keyEncryption         *encryption.KeyEncryption
+	previousKeyEncryption *encryption.KeyEncryption
 }
 
-func NewDefaultSigningKeyRepository(db *mongo.Database) *DefaultSigningKeyRepository {
-	return &DefaultSigningKeyRepository{db: db, collectionName: "signingKeys"}
+// NewDefaultSigningKeyRepository keyEncryption can be nil in which case private keys are stored as plain PEM.
+// previousKeyEncryption can be nil, when set keys it sealed are still read until they are re-wrapped
+func NewDefaultSigningKeyRepository(db *mongo.Database, keyEncryption,
+	previousKeyEncryption *encryption.KeyEncryption) *DefaultSigningKeyRepository {
+	collectionName := "signingKeys"
+	// the pending index used to cover state alone, it is replaced by one per key use
+	_, _ = db.Collection(collectionName).Indexes().DropOne(context.Background(), "state_1")
+	// only one key of each use can wait to become active at a time, this stops replicas rotating at the same
+	// moment from each publishing their own new key
+	_, err := db.Collection(collectionName).Indexes().CreateOne(context.Background(), mongo.IndexModel{
+		Keys: bson.D{{Key: "use", Value: 1}, {Key: "state", Value: 1}},
+		Options: options.Index().SetUnique(true).
+			SetPartialFilterExpression(bson.D{{Key: "state", Value: KeyStatePending}}),
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &DefaultSigningKeyRepository{
+		db:                    db,
+		collectionName:        collectionName,
+		keyEncryption:         keyEncryption,
+		previousKeyEncryption: previousKeyEncryption,
+	}
 }
 
-func (d *DefaultSigningKeyRepository) Add(ctx context.Context, privateKey string, publicKey string, algorithm string) error {
+func (d *DefaultSigningKeyRepository) Add(ctx context.Context, key SigningKey) error {
 	collection := d.db.Collection(d.collectionName)
-	keyId := uuid.New()
-	_, err := collection.InsertOne(ctx, SigningKey{
-		KeyId:      keyId.String(),
-		Format:     "PKCS#1",
-		PrivateKey: privateKey,
-		PublicKey:  publicKey,
-		Algorithm:  algorithm,
-		Created:    time.Now(),
-	})
+	if d.keyEncryption != nil {
+		envelope, err := d.keyEncryption.Seal([]byte(key.PrivateKey))
+		if err != nil {
+			return err
+		}
+		key.PrivateKey = envelope.Ciphertext
+		key.WrappedKey = envelope.WrappedKey
+		key.KekId = envelope.KekId
+	}
+	_, err := collection.InsertOne(ctx, key)
 
 	if err != nil {
 		return err
@@ -49,18 +79,31 @@ func (d *DefaultSigningKeyRepository) Add(ctx context.Context, privateKey string
 func (d *DefaultSigningKeyRepository) GetKey(ctx context.Context, keyId string) (SigningKey, error) {
 	collection := d.db.Collection(d.collectionName)
 	var key SigningKey
-	err := collection.FindOne(ctx, bson.D{{Key: "keyId", Value: keyId}}).Decode(&key)
+	err := collection.FindOne(ctx, bson.D{{Key: "key_id", Value: keyId}}).Decode(&key)
 	if err != nil {
 		return SigningKey{}, err
 	}
-	return key, nil
+	return d.decrypt(key)
 }
 
-func (d *DefaultSigningKeyRepository) GetLatestKey(ctx context.Context) (SigningKey, error) {
+// GetLatestKey returns the most recently activated key of the use, keys stored without a state are considered
+// active and an empty use matches keys shared by every use
+func (d *DefaultSigningKeyRepository) GetLatestKey(ctx context.Context, use string) (SigningKey, error) {
 	collection := d.db.Collection(d.collectionName)
 	var key SigningKey
-	opt := options.FindOne().SetSort(bson.D{{"created", -1}})
-	err := collection.FindOne(ctx, bson.D{{}}, opt).Decode(&key)
+	useFilter := bson.D{{Key: "use", Value: use}}
+	if use == "" {
+		useFilter = bson.D{{Key: "use", Value: bson.D{{Key: "$in", Value: bson.A{"", nil}}}}}
+	}
+	filter := bson.D{{Key: "$and", Value: bson.A{
+		useFilter,
+		bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "state", Value: KeyStateActive}},
+			bson.D{{Key: "state", Value: bson.D{{Key: "$exists", Value: false}}}},
+		}}},
+	}}}
+	opt := options.FindOne().SetSort(bson.D{{Key: "activated", Value: -1}, {Key: "created", Value: -1}})
+	err := collection.FindOne(ctx, filter, opt).Decode(&key)
 
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
@@ -69,9 +112,11 @@ func (d *DefaultSigningKeyRepository) GetLatestKey(ctx context.Context) (Signing
 		return SigningKey{}, err
 	}
 
-	return key, nil
+	return d.decrypt(key)
 }
 
+// GetAllKeys a key whose private key can not be decrypted is still returned for its public key, so verifying tokens
+// and publishing the JWKS keep working. It can not sign
 func (d *DefaultSigningKeyRepository) GetAllKeys(ctx context.Context) ([]SigningKey, error) {
 	collection := d.db.Collection(d.collectionName)
 	var keys []SigningKey
@@ -86,10 +131,147 @@ func (d *DefaultSigningKeyRepository) GetAllKeys(ctx context.Context) ([]Signing
 		if err != nil {
 			return keys, err
 		}
-		keys = append(keys, key)
+		decrypted, err := d.decrypt(key)
+		if err != nil {
+			log.Println("signing key can only be used to verify:", err)
+			key.PrivateKey = ""
+			decrypted = key
+		}
+		keys = append(keys, decrypted)
 	}
 	if err := cursor.Err(); err != nil {
 		return keys, err
 	}
 	return keys, nil
 }
+
+// UpdateState moves a key to a new lifecycle state and records when the change happened
+func (d *DefaultSigningKeyRepository) UpdateState(ctx context.Context, keyId, state string, changed time.Time) error {
+	collection := d.db.Collection(d.collectionName)
+	set := bson.D{{Key: "state", Value: state}}
+	switch state {
+	case KeyStateActive:
+		set = append(set, bson.E{Key: "activated", Value: changed})
+	case KeyStateVerify:
+		set = append(set, bson.E{Key: "deactivated", Value: changed})
+	case KeyStateRetired:
+		set = append(set, bson.E{Key: "retired", Value: changed})
+	}
+
+	result, err := collection.UpdateOne(ctx, bson.D{{Key: "key_id", Value: keyId}}, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return mongo.ErrNoDocuments
+	}
+
+	return nil
+}
+
+func (d *DefaultSigningKeyRepository) Delete(ctx context.Context, keyId string) error {
+	collection := d.db.Collection(d.collectionName)
+	_, err := collection.DeleteOne(ctx, bson.D{{Key: "key_id", Value: keyId}})
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Watch calls onChange whenever a signing key is added, changes state or is deleted. It needs mongodb to run as a
+// replica set and blocks until the context is cancelled or the change stream fails
+func (d *DefaultSigningKeyRepository) Watch(ctx context.Context, onChange func()) error {
+	collection := d.db.Collection(d.collectionName)
+	stream, err := collection.Watch(ctx, mongo.Pipeline{})
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		onChange()
+	}
+	return stream.Err()
+}
+
+// Rewrap re-wraps the data key of every private key with the current key-encryption key. Keys sealed with the
+// previous key-encryption key are re-wrapped and keys still stored as plain PEM are encrypted, it returns how many
+// keys changed
+func (d *DefaultSigningKeyRepository) Rewrap(ctx context.Context) (int, error) {
+	if d.keyEncryption == nil {
+		return 0, errors.New("no key-encryption key configured")
+	}
+
+	collection := d.db.Collection(d.collectionName)
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return 0, err
+	}
+	var keys []SigningKey
+	if err = cursor.All(ctx, &keys); err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, key := range keys {
+		var envelope *encryption.Envelope
+		switch {
+		case key.WrappedKey == "":
+			envelope, err = d.keyEncryption.Seal([]byte(key.PrivateKey))
+		case key.KekId == d.keyEncryption.KekId():
+			continue
+		case d.previousKeyEncryption != nil:
+			envelope, err = d.keyEncryption.Rewrap(encryption.Envelope{
+				Ciphertext: key.PrivateKey,
+				WrappedKey: key.WrappedKey,
+				KekId:      key.KekId,
+			}, d.previousKeyEncryption)
+		default:
+			err = fmt.Errorf("signing key %s was sealed with an unknown key-encryption key %s", key.KeyId, key.KekId)
+		}
+		if err != nil {
+			return changed, err
+		}
+
+		_, err = collection.UpdateOne(ctx, bson.D{{Key: "key_id", Value: key.KeyId}}, bson.D{{Key: "$set", Value: bson.D{
+			{Key: "private_key", Value: envelope.Ciphertext},
+			{Key: "wrapped_key", Value: envelope.WrappedKey},
+			{Key: "kek_id", Value: envelope.KekId},
+		}}})
+		if err != nil {
+			return changed, err
+		}
+		changed++
+	}
+
+	return changed, nil
+}
+
+// decrypt opens the private key of an encrypted key with the key-encryption key that sealed it, keys stored as plain
+// PEM are returned as is
+func (d *DefaultSigningKeyRepository) decrypt(key SigningKey) (SigningKey, error) {
+	if key.WrappedKey == "" {
+		return key, nil
+	}
+
+	keyEncryption := d.keyEncryption
+	if d.previousKeyEncryption != nil && key.KekId == d.previousKeyEncryption.KekId() {
+		keyEncryption = d.previousKeyEncryption
+	}
+	if keyEncryption == nil {
+		return SigningKey{}, fmt.Errorf("signing key %s is encrypted but no key-encryption key is configured", key.KeyId)
+	}
+
+	privateKey, err := keyEncryption.Open(encryption.Envelope{
+		Ciphertext: key.PrivateKey,
+		WrappedKey: key.WrappedKey,
+		KekId:      key.KekId,
+	})
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	key.PrivateKey = string(privateKey)
+	return key, nil
+}
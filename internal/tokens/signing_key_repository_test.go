@@ -0,0 +1,27 @@
+package tokens
+
+import (
+	"testing"
+
+	"github.com/latebit-io/bulwarkauth/internal/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultSigningKeyRepository_DecryptPreviousKek(t *testing.T) {
+	previous, err := encryption.NewKeyEncryption([]byte("01234567890123456789012345678901"))
+	assert.NoError(t, err)
+	current, err := encryption.NewKeyEncryption([]byte("abcdefghijabcdefghijabcdefghijab"))
+	assert.NoError(t, err)
+	envelope, err := previous.Seal([]byte("private key"))
+	assert.NoError(t, err)
+	key := SigningKey{KeyId: "kid", PrivateKey: envelope.Ciphertext, WrappedKey: envelope.WrappedKey,
+		KekId: envelope.KekId}
+
+	_, err = (&DefaultSigningKeyRepository{keyEncryption: current}).decrypt(key)
+	assert.Error(t, err)
+
+	repository := &DefaultSigningKeyRepository{keyEncryption: current, previousKeyEncryption: previous}
+	decrypted, err := repository.decrypt(key)
+	assert.NoError(t, err)
+	assert.Equal(t, "private key", decrypted.PrivateKey)
+}
@@ -0,0 +1,150 @@
+package tokens
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RotationPolicy controls how long a signing key spends in each lifecycle state
+type RotationPolicy struct {
+	// Interval how long a key signs tokens before it is replaced
+	Interval time.Duration
+	// PendingPeriod how long a new key is published before it starts signing, this should be longer than
+	// consumers cache the key set
+	PendingPeriod time.Duration
+	// MaxTokenLifetime the longest lifetime of any token, a key stays in verify until every token it signed
+	// has expired and a retired key is purged once the same time has passed again
+	MaxTokenLifetime time.Duration
+	// Algorithm the JWS algorithm new keys are generated for
+	Algorithm string
+	// SeparateKeys rotates a key for access tokens and a key for refresh tokens instead of a single shared key
+	SeparateKeys bool
+}
+
+// SigningKeyRotator moves signing keys through pending, active, verify and retired on a schedule.
+// Every step is worked out from the stored timestamps so replicas can run the rotator side by side
+type SigningKeyRotator struct {
+	repository SigningKeyRepository
+	policy     RotationPolicy
+}
+
+func NewSigningKeyRotator(repository SigningKeyRepository, policy RotationPolicy) *SigningKeyRotator {
+	return &SigningKeyRotator{
+		repository: repository,
+		policy:     policy,
+	}
+}
+
+// Start runs Rotate every checkEvery until the context is cancelled
+func (r *SigningKeyRotator) Start(ctx context.Context, checkEvery time.Duration) {
+	ticker := time.NewTicker(checkEvery)
+	defer ticker.Stop()
+	for {
+		if err := r.Rotate(ctx, time.Now()); err != nil {
+			log.Println("signing key rotation failed:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Rotate applies every lifecycle transition that is due at now
+func (r *SigningKeyRotator) Rotate(ctx context.Context, now time.Time) error {
+	keys, err := r.repository.GetAllKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	uses := SigningKeyUses(r.policy.SeparateKeys)
+	pending := make(map[string][]SigningKey)
+	active := make(map[string][]SigningKey)
+	for _, key := range keys {
+		switch key.CurrentState() {
+		case KeyStateRetired:
+			if now.Sub(key.Retired) >= r.policy.MaxTokenLifetime {
+				if err := r.repository.Delete(ctx, key.KeyId); err != nil {
+					return err
+				}
+			}
+		case KeyStateVerify:
+			if now.Sub(key.Deactivated) >= r.policy.MaxTokenLifetime {
+				if err := r.repository.UpdateState(ctx, key.KeyId, KeyStateRetired, now); err != nil {
+					return err
+				}
+			}
+		case KeyStatePending, KeyStateActive:
+			if !slices.Contains(uses, key.Use) {
+				// keys of a use that is no longer configured stop signing but still verify what they signed
+				if err := r.repository.UpdateState(ctx, key.KeyId, KeyStateVerify, now); err != nil {
+					return err
+				}
+			} else if key.CurrentState() == KeyStatePending {
+				pending[key.Use] = append(pending[key.Use], key)
+			} else {
+				active[key.Use] = append(active[key.Use], key)
+			}
+		}
+	}
+
+	for _, use := range uses {
+		if err := r.rotateUse(ctx, now, use, pending[use], active[use]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rotateUse activates, demotes and publishes the keys of a single use
+func (r *SigningKeyRotator) rotateUse(ctx context.Context, now time.Time, use string, pending, active []SigningKey) error {
+	for _, key := range pending {
+		if now.Sub(key.Created) < r.policy.PendingPeriod {
+			continue
+		}
+		if err := r.repository.UpdateState(ctx, key.KeyId, KeyStateActive, now); err != nil {
+			return err
+		}
+		key.State = KeyStateActive
+		key.Activated = now
+		active = append(active, key)
+		pending = nil
+	}
+
+	// the newest key keeps signing, it is promoted before older keys are demoted so there is always an active key
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].ActivatedAt().After(active[j].ActivatedAt())
+	})
+	for _, key := range active[min(1, len(active)):] {
+		if err := r.repository.UpdateState(ctx, key.KeyId, KeyStateVerify, now); err != nil {
+			return err
+		}
+	}
+
+	if len(pending) > 0 || len(active) == 0 {
+		return nil
+	}
+
+	if now.Sub(active[0].ActivatedAt()) < r.policy.Interval-r.policy.PendingPeriod {
+		return nil
+	}
+
+	key, err := NewSigningKey(r.policy.Algorithm)
+	if err != nil {
+		return err
+	}
+	key.Use = use
+
+	err = r.repository.Add(ctx, *key)
+	if mongo.IsDuplicateKeyError(err) {
+		// another replica published the next key first
+		return nil
+	}
+	return err
+}
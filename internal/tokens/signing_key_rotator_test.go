@@ -0,0 +1,112 @@
+package tokens
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSigningKeyRotator_Rotate(t *testing.T) {
+	repo := newMemorySigningKeyRepository()
+	signingService := NewDefaultSigningKeyService(repo, "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	policy := RotationPolicy{
+		Interval:         24 * time.Hour,
+		PendingPeriod:    time.Hour,
+		MaxTokenLifetime: 2 * time.Hour,
+		Algorithm:        "RS256",
+	}
+	rotator := NewSigningKeyRotator(repo, policy)
+	first, _ := signingService.LatestKey(context.TODO(), "")
+	start := first.ActivatedAt()
+
+	states := func() map[string]string {
+		keys, _ := repo.GetAllKeys(context.TODO())
+		result := make(map[string]string)
+		for _, k := range keys {
+			result[k.KeyId] = k.CurrentState()
+		}
+		return result
+	}
+
+	// nothing is due yet
+	assert.Nil(t, rotator.Rotate(context.TODO(), start.Add(time.Hour)))
+	assert.Len(t, states(), 1)
+
+	// the next key is published ahead of the interval
+	assert.Nil(t, rotator.Rotate(context.TODO(), start.Add(23*time.Hour)))
+	assert.Len(t, states(), 2)
+	assert.Equal(t, first.KeyId, mustLatest(t, signingService).KeyId)
+
+	// once the pending period is over the new key signs and the old one only verifies
+	keys, _ := repo.GetAllKeys(context.TODO())
+	second := keys[1]
+	assert.Nil(t, rotator.Rotate(context.TODO(), second.Created.Add(time.Hour)))
+	assert.Equal(t, second.KeyId, mustLatest(t, signingService).KeyId)
+	assert.Equal(t, KeyStateVerify, states()[first.KeyId])
+
+	// after the longest token lifetime the old key is retired and no longer published
+	retireAt := second.Created.Add(3 * time.Hour)
+	assert.Nil(t, rotator.Rotate(context.TODO(), retireAt))
+	assert.Equal(t, KeyStateRetired, states()[first.KeyId])
+	published, _ := signingService.GetAllKeys(context.TODO())
+	assert.Len(t, published, 1)
+
+	// and purged once the same time has passed again
+	assert.Nil(t, rotator.Rotate(context.TODO(), retireAt.Add(2*time.Hour)))
+	_, found := states()[first.KeyId]
+	assert.False(t, found)
+}
+
+func TestSigningKeyRotator_SeparateKeys(t *testing.T) {
+	repo := newMemorySigningKeyRepository()
+	shared := NewDefaultSigningKeyService(repo, "RS256", false)
+	err := shared.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedKey := mustLatest(t, shared)
+
+	// switching to separate keys adds a key per use and the shared key stops signing
+	separate := NewDefaultSigningKeyService(repo, "RS256", true)
+	err = separate.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotator := NewSigningKeyRotator(repo, RotationPolicy{
+		Interval:         24 * time.Hour,
+		PendingPeriod:    time.Hour,
+		MaxTokenLifetime: 2 * time.Hour,
+		Algorithm:        "RS256",
+		SeparateKeys:     true,
+	})
+	now := time.Now()
+	assert.Nil(t, rotator.Rotate(context.TODO(), now))
+	key, _ := repo.GetKey(context.TODO(), sharedKey.KeyId)
+	assert.Equal(t, KeyStateVerify, key.CurrentState())
+
+	// each use publishes its own next key
+	assert.Nil(t, rotator.Rotate(context.TODO(), now.Add(23*time.Hour)))
+	uses := make(map[string]int)
+	keys, _ := repo.GetAllKeys(context.TODO())
+	for _, k := range keys {
+		if k.CurrentState() == KeyStatePending {
+			uses[k.Use]++
+		}
+	}
+	assert.Equal(t, map[string]int{KeyUseAccess: 1, KeyUseRefresh: 1}, uses)
+}
+
+func mustLatest(t *testing.T, service SigningKeyService) *SigningKey {
+	key, err := service.LatestKey(context.TODO(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -1,62 +1,104 @@
 package tokens
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type SigningKeyService interface {
 	GenerateKey(ctx context.Context) error
 	GetAllKeys(ctx context.Context) ([]SigningKey, error)
-	LatestKey(ctx context.Context) (*SigningKey, error)
+	LatestKey(ctx context.Context, use string) (*SigningKey, error)
 	Initialize(ctx context.Context) error
 }
 
 type DefaultSigningKeyService struct {
-	repository SigningKeyRepository
+	repository   SigningKeyRepository
+	algorithm    string
+	separateKeys bool
 }
 
-func NewDefaultSigningKeyService(repository SigningKeyRepository) *DefaultSigningKeyService {
+// NewDefaultSigningKeyService algorithm is the JWS algorithm new keys are generated for, existing keys keep
+// signing with the algorithm they were created with. With separateKeys access and refresh tokens are signed
+// by keys of their own use
+func NewDefaultSigningKeyService(repository SigningKeyRepository, algorithm string, separateKeys bool) *DefaultSigningKeyService {
 	return &DefaultSigningKeyService{
-		repository: repository,
+		repository:   repository,
+		algorithm:    algorithm,
+		separateKeys: separateKeys,
 	}
 }
 
+// GenerateKey adds a new pending key for each use, it is published straight away but will only sign once it is
+// activated
 func (s *DefaultSigningKeyService) GenerateKey(ctx context.Context) error {
-	key, err := NewSigningKey(256)
-	if err != nil {
-		return err
-	}
+	for _, use := range SigningKeyUses(s.separateKeys) {
+		key, err := NewSigningKey(s.algorithm)
+		if err != nil {
+			return err
+		}
+		key.Use = use
 
-	err = s.repository.Add(ctx, key.PrivateKey, key.PublicKey, key.Algorithm)
-	if err != nil {
-		return err
+		err = s.repository.Add(ctx, *key)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// GetAllKeys returns every key that can still verify tokens, retired keys are left out
 func (s *DefaultSigningKeyService) GetAllKeys(ctx context.Context) ([]SigningKey, error) {
-	return s.repository.GetAllKeys(ctx)
-}
-
-func (s *DefaultSigningKeyService) Initialize(ctx context.Context) error {
-	latest, err := s.repository.GetLatestKey(ctx)
+	keys, err := s.repository.GetAllKeys(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if latest.Algorithm != "" {
-		return nil
+	trusted := make([]SigningKey, 0, len(keys))
+	for _, k := range keys {
+		if k.CurrentState() != KeyStateRetired {
+			trusted = append(trusted, k)
+		}
 	}
+	return trusted, nil
+}
 
-	key, err := NewSigningKey(256)
-	if err != nil {
-		return err
+// Initialize makes sure every use has an active key, keys created here sign straight away
+func (s *DefaultSigningKeyService) Initialize(ctx context.Context) error {
+	for _, use := range SigningKeyUses(s.separateKeys) {
+		latest, err := s.repository.GetLatestKey(ctx, use)
+		if err != nil {
+			return err
+		}
+
+		if latest.Algorithm != "" {
+			continue
+		}
+
+		key, err := NewSigningKey(s.algorithm)
+		if err != nil {
+			return err
+		}
+		key.Use = use
+		key.State = KeyStateActive
+		key.Activated = time.Now()
+
+		err = s.repository.Add(ctx, *key)
+		if err != nil {
+			return err
+		}
 	}
 
-	return s.repository.Add(ctx, key.PrivateKey, key.PublicKey, key.Algorithm)
+	return nil
 }
 
-func (s *DefaultSigningKeyService) LatestKey(ctx context.Context) (*SigningKey, error) {
-	latest, err := s.repository.GetLatestKey(ctx)
+// LatestKey returns the key that signs tokens of the use, the shared key when separate keys are not enabled
+func (s *DefaultSigningKeyService) LatestKey(ctx context.Context, use string) (*SigningKey, error) {
+	if !s.separateKeys {
+		use = ""
+	}
+	latest, err := s.repository.GetLatestKey(ctx, use)
 	if err != nil {
 		return nil, err
 	}
@@ -40,8 +40,8 @@ func TestDefaultSigningKeyService_GenerateKey(t *testing.T) {
 	}()
 
 	db := client.Database("bulwark")
-	signingRepo := NewDefaultSigningKeyRepository(db)
-	signingService := NewDefaultSigningKeyService(signingRepo)
+	signingRepo := NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := NewDefaultSigningKeyService(signingRepo, "RS256", false)
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -8,7 +8,7 @@ import (
 )
 
 func TestNewSigningKey(t *testing.T) {
-	newSigningKey, err := NewSigningKey(256)
+	newSigningKey, err := NewSigningKey("RS256")
 	assert.Equal(t, nil, err)
 	fmt.Println(newSigningKey.PrivateKey)
 	fmt.Println(newSigningKey.PublicKey)
@@ -0,0 +1,43 @@
+package tokens
+
+import "fmt"
+
+type SigningKeyNotFoundError struct {
+	Value string `json:"value"`
+}
+
+func (e SigningKeyNotFoundError) Error() string {
+	return fmt.Sprintf("signing key not found: %s", e.Value)
+}
+
+type TokenRevokedError struct {
+	Value string `json:"value"`
+}
+
+func (e TokenRevokedError) Error() string {
+	return fmt.Sprintf("token revoked: %s", e.Value)
+}
+
+type TokenTypeError struct {
+	Value string `json:"value"`
+}
+
+func (e TokenTypeError) Error() string {
+	return fmt.Sprintf("unexpected token type: %s", e.Value)
+}
+
+type AudienceError struct {
+	Value string `json:"value"`
+}
+
+func (e AudienceError) Error() string {
+	return fmt.Sprintf("audience not allowed: %s", e.Value)
+}
+
+type IssuerError struct {
+	Value string `json:"value"`
+}
+
+func (e IssuerError) Error() string {
+	return fmt.Sprintf("unexpected token issuer: %s", e.Value)
+}
@@ -2,104 +2,216 @@ package tokens
 
 import (
 	"context"
-	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
-	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
 )
 
+// Token types set as the typ header and claim, access tokens follow RFC 9068. A token only validates as the type
+// it was issued as so a refresh token can never be presented as an access token or the other way around. ID tokens
+// keep the plain JWT type OpenID Connect libraries expect and are never accepted as access tokens
+const (
+	TokenTypeAccess  = "at+jwt"
+	TokenTypeRefresh = "rt+jwt"
+	TokenTypeId      = "JWT"
+)
+
+// tokenTypes the token type issued for each key use
+var tokenTypes = map[string]string{
+	KeyUseAccess:  TokenTypeAccess,
+	KeyUseRefresh: TokenTypeRefresh,
+}
+
+// Tokenizer issues and validates tokens, the subject of every token is the account id so a token stays valid when
+// the email of the account changes. Tokens a client requests for itself have the client id as subject
 type Tokenizer interface {
-	CreateAccessToken(ctx context.Context, email string, rbac []string) (string, error)
-	CreateRefreshToken(ctx context.Context, email string) (string, error)
-	ValidateRefreshToken(ctx context.Context, email, token string) (*RefreshTokenClaims, error)
-	ValidateAccessToken(ctx context.Context, email, tokenString string) (*AccessTokenClaims, error)
+	CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options TokenOptions) (string, error)
+	CreateClientAccessToken(ctx context.Context, clientId string, rbac []string, scope string, options TokenOptions) (string, error)
+	CreateExchangedAccessToken(ctx context.Context, subject *AccessTokenClaims, actor, scope string, options TokenOptions) (string, error)
+	CreateRefreshToken(ctx context.Context, subject string, options TokenOptions) (string, error)
+	CreateRefreshTokenInFamily(ctx context.Context, subject, family string, options TokenOptions) (string, error)
+	CreateIdToken(ctx context.Context, subject string, options IdTokenOptions) (string, error)
+	ValidateRefreshToken(ctx context.Context, tokenString string) (*RefreshTokenClaims, error)
+	ValidateAccessToken(ctx context.Context, tokenString string) (*AccessTokenClaims, error)
 }
 
+// DefaultTokenizer Audiences is the allowlist of audiences tokens can be issued to, the first is used when no
+// audience is requested
 type DefaultTokenizer struct {
-	Name     string
-	Issuer   string
-	Audience string
+	Name      string
+	Issuer    string
+	Audiences []string
 
-	keys                 map[string]SigningKey
+	keys                 *SigningKeyCache
 	signingKeyService    SigningKeyService
+	claimsProviders      []ClaimsProvider
 	refreshTokenExpInSec int
 	accessTokenExpInSec  int
+	untypedUntil         time.Time
 }
 
+// TokenOptions how a token is issued, zero values fall back to the default audience and lifetimes of the tokenizer.
+// ClientId is the client a refresh token is issued to, access tokens of an account do not carry it. Scope is the
+// scope granted to an access token of an account
+type TokenOptions struct {
+	Audience             []string
+	AccessTokenExpInSec  int
+	RefreshTokenExpInSec int
+	ClientId             string
+	Scope                string
+}
+
+// AccessTokenClaims Custom holds the claims added by claims providers. ClientId is only set on tokens a client
+// requested for itself, see RFC 9068 section 2.2. Act is only set on tokens issued by token exchange
 type AccessTokenClaims struct {
-	Roles []string `json:"roles"`
+	Type     string                 `json:"typ"`
+	Email    string                 `json:"email,omitempty"`
+	ClientId string                 `json:"client_id,omitempty"`
+	Scope    string                 `json:"scope,omitempty"`
+	Roles    []string               `json:"roles"`
+	Act      *Actor                 `json:"act,omitempty"`
+	Custom   map[string]interface{} `json:"-"`
 	jwt.RegisteredClaims
 }
 
+// Actor the party acting on behalf of the subject, Act is the actor before it when a token was exchanged more than
+// once, see RFC 8693 section 4.1
+type Actor struct {
+	Subject string `json:"sub"`
+	Act     *Actor `json:"act,omitempty"`
+}
+
+// RefreshTokenClaims Family is shared by every refresh token renewed from the same sign in, so reuse of any one of
+// them can revoke the whole chain. ClientId is the client the family was issued to, empty for sign ins without one.
+// Scope is the scope granted to the client, the tokens renewed from the refresh token keep it
 type RefreshTokenClaims struct {
+	Type     string `json:"typ"`
+	Family   string `json:"fam,omitempty"`
+	ClientId string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
-func NewDefaultTokenizer(name, issuer, audience string, refreshTokenExpInSec int, accessTokenExpInSec int, service SigningKeyService) *DefaultTokenizer {
-	keys, err := service.GetAllKeys(context.Background())
-	keyMap := make(map[string]SigningKey)
-	for _, k := range keys {
-		keyMap[k.KeyId] = k
+// TokenFamily refresh tokens issued before families were introduced are their own family
+func (c RefreshTokenClaims) TokenFamily() string {
+	if c.Family == "" {
+		return c.ID
 	}
+	return c.Family
+}
+
+func NewDefaultTokenizer(name, issuer string, audiences []string, refreshTokenExpInSec int, accessTokenExpInSec int, service SigningKeyService) *DefaultTokenizer {
+	keys := NewSigningKeyCache(service)
+	err := keys.Reload(context.Background())
 	if err != nil {
 		panic(err)
 	}
 	return &DefaultTokenizer{
-		Name:     name,
-		Issuer:   issuer,
-		Audience: audience,
+		Name:      name,
+		Issuer:    issuer,
+		Audiences: audiences,
 
-		keys:                 keyMap,
+		keys:                 keys,
 		signingKeyService:    service,
 		accessTokenExpInSec:  accessTokenExpInSec,
 		refreshTokenExpInSec: refreshTokenExpInSec,
 	}
 }
 
-func (d DefaultTokenizer) CreateAccessToken(ctx context.Context, email string, rbac []string) (string, error) {
-	key, err := d.signingKeyService.LatestKey(ctx)
+// AddClaimsProvider registers a provider whose claims are added to every access token
+func (d *DefaultTokenizer) AddClaimsProvider(provider ClaimsProvider) {
+	d.claimsProviders = append(d.claimsProviders, provider)
+}
+
+// AcceptUntypedUntil accepts tokens issued before the token types were introduced until the time, set it to the
+// longest token lifetime after the upgrade. Until then an untyped refresh token also validates as an access token
+func (d *DefaultTokenizer) AcceptUntypedUntil(until time.Time) {
+	d.untypedUntil = until
+}
+
+// CreateAccessToken subject is the account id, the email is added as a separate claim. Every requested audience must
+// be on the allowlist, without one the token is issued to the default audience
+func (d DefaultTokenizer) CreateAccessToken(ctx context.Context, subject, email string, rbac []string, options TokenOptions) (string, error) {
+	custom, err := d.customClaims(ctx, subject)
 	if err != nil {
 		return "", err
 	}
 
-	id := uuid.New()
+	return d.createAccessToken(ctx, AccessTokenClaims{
+		Email:            email,
+		Scope:            options.Scope,
+		Roles:            rbac,
+		Custom:           custom,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: subject},
+	}, options)
+}
 
-	claims := AccessTokenClaims{
-		Roles: rbac,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ID:        id.String(),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second * time.Duration(d.accessTokenExpInSec))),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
-			Issuer:    d.Issuer,
-			Subject:   email,
-			Audience:  []string{d.Audience},
-		},
-	}
+// CreateClientAccessToken issues a token to a client acting on its own behalf, the client id is the subject and
+// the client_id claim. Claims providers are not run as there is no account
+func (d DefaultTokenizer) CreateClientAccessToken(ctx context.Context, clientId string, rbac []string, scope string, options TokenOptions) (string, error) {
+	return d.createAccessToken(ctx, AccessTokenClaims{
+		ClientId:         clientId,
+		Scope:            scope,
+		Roles:            rbac,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: clientId},
+	}, options)
+}
 
-	j := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	j.Header["use"] = "access"
-	j.Header["kid"] = key.KeyId
-	privateKey, err := d.loadPrivateKey(key.PrivateKey)
+// CreateExchangedAccessToken issues a token for the subject of another access token to the actor, see RFC 8693. The
+// email, roles and custom claims are carried over and the actor is added to the front of the act chain
+func (d DefaultTokenizer) CreateExchangedAccessToken(ctx context.Context, subject *AccessTokenClaims, actor, scope string, options TokenOptions) (string, error) {
+	return d.createAccessToken(ctx, AccessTokenClaims{
+		Email:            subject.Email,
+		ClientId:         subject.ClientId,
+		Scope:            scope,
+		Roles:            subject.Roles,
+		Act:              &Actor{Subject: actor, Act: subject.Act},
+		Custom:           subject.Custom,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: subject.Subject},
+	}, options)
+}
+
+// createAccessToken sets the registered claims and signs the token with the latest access key
+func (d DefaultTokenizer) createAccessToken(ctx context.Context, claims AccessTokenClaims, options TokenOptions) (string, error) {
+	audience, err := d.audience(options.Audience)
 	if err != nil {
 		return "", err
 	}
 
-	token, err := j.SignedString(privateKey)
+	key, err := d.signingKeyService.LatestKey(ctx, KeyUseAccess)
 	if err != nil {
 		return "", err
 	}
 
-	return token, nil
+	now := time.Now()
+	claims.Type = TokenTypeAccess
+	claims.ID = uuid.New().String()
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(time.Second * time.Duration(expiresIn(options.AccessTokenExpInSec, d.accessTokenExpInSec))))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.Issuer = d.Issuer
+	claims.Audience = audience
+
+	return d.sign(key, claims, KeyUseAccess)
 }
 
-func (d DefaultTokenizer) CreateRefreshToken(ctx context.Context, email string) (string, error) {
-	key, err := d.signingKeyService.LatestKey(ctx)
+// CreateRefreshToken creates a refresh token that starts a new family, access tokens renewed with it are issued to
+// the same audience
+func (d DefaultTokenizer) CreateRefreshToken(ctx context.Context, subject string, options TokenOptions) (string, error) {
+	return d.CreateRefreshTokenInFamily(ctx, subject, uuid.New().String(), options)
+}
+
+// CreateRefreshTokenInFamily creates a refresh token that replaces an earlier token of the family
+func (d DefaultTokenizer) CreateRefreshTokenInFamily(ctx context.Context, subject, family string, options TokenOptions) (string, error) {
+	audience, err := d.audience(options.Audience)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := d.signingKeyService.LatestKey(ctx, KeyUseRefresh)
 	if err != nil {
 		return "", err
 	}
@@ -107,122 +219,176 @@ func (d DefaultTokenizer) CreateRefreshToken(ctx context.Context, email string)
 	id := uuid.New()
 
 	claims := RefreshTokenClaims{
+		Type:     TokenTypeRefresh,
+		Family:   family,
+		ClientId: options.ClientId,
+		Scope:    options.Scope,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ID:        id.String(),
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second * time.Duration(d.refreshTokenExpInSec))),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Second * time.Duration(expiresIn(options.RefreshTokenExpInSec, d.refreshTokenExpInSec)))),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
 			Issuer:    d.Issuer,
-			Subject:   email,
-			Audience:  []string{d.Audience},
+			Subject:   subject,
+			Audience:  audience,
 		},
 	}
 
-	j := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	j.Header["use"] = "refresh"
-	j.Header["kid"] = key.KeyId
-	privateKey, err := d.loadPrivateKey(key.PrivateKey)
-	if err != nil {
-		return "", err
-	}
+	return d.sign(key, claims, KeyUseRefresh)
+}
+
+func (d DefaultTokenizer) ValidateRefreshToken(ctx context.Context, tokenString string) (*RefreshTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &RefreshTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return d.verificationKey(ctx, token, KeyUseRefresh)
+	})
 
-	token, err := j.SignedString(privateKey)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return token, nil
-}
-
-func (d DefaultTokenizer) ValidateRefreshToken(ctx context.Context, email, tokenString string) (*RefreshTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &RefreshTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("signing method not supported")
+	if claims, ok := token.Claims.(*RefreshTokenClaims); ok && token.Valid {
+		if claims.Type != TokenTypeRefresh && (claims.Type != "" || !d.acceptsUntyped(token)) {
+			return nil, TokenTypeError{Value: claims.Type}
 		}
-		tokenEmail, err := token.Claims.GetSubject()
-
-		if err != nil {
+		if err = d.verifyIssuerAndAudience(claims.RegisteredClaims); err != nil {
 			return nil, err
 		}
+		return claims, nil
+	} else {
+		return nil, err
+	}
+}
 
-		if tokenEmail != email {
-			return nil, fmt.Errorf("invalid token")
-		}
-
-		kid := fmt.Sprintf("%v", token.Header["kid"])
-		key := d.keys[kid]
-		return d.loadPublicKey(key.PublicKey)
+// ValidateAccessToken validates an access token presented on its own, the account is identified by the subject
+func (d DefaultTokenizer) ValidateAccessToken(ctx context.Context, tokenString string) (*AccessTokenClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return d.verificationKey(ctx, token, KeyUseAccess)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*RefreshTokenClaims); ok && token.Valid {
+	if claims, ok := token.Claims.(*AccessTokenClaims); ok && token.Valid {
+		if claims.Type != TokenTypeAccess && (claims.Type != "" || !d.acceptsUntyped(token)) {
+			return nil, TokenTypeError{Value: claims.Type}
+		}
+		if err = d.verifyIssuerAndAudience(claims.RegisteredClaims); err != nil {
+			return nil, err
+		}
 		return claims, nil
 	} else {
 		return nil, err
 	}
 }
 
-func (d DefaultTokenizer) ValidateAccessToken(ctx context.Context, email, tokenString string) (*AccessTokenClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &AccessTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("signing method not supported")
-		}
+// WatchKeys keeps the verification keys in sync with the database until the context is cancelled,
+// see SigningKeyCache.Start
+func (d DefaultTokenizer) WatchKeys(ctx context.Context, watcher SigningKeyWatcher, pollEvery time.Duration) {
+	d.keys.Start(ctx, watcher, pollEvery)
+}
 
-		tokenEmail, err := token.Claims.GetSubject()
+// expiresIn a lifetime the token options do not set falls back to the tokenizer default
+func expiresIn(seconds, defaultSeconds int) int {
+	if seconds <= 0 {
+		return defaultSeconds
+	}
+	return seconds
+}
 
-		if err != nil {
-			return nil, err
+// audience falls back to the default audience and rejects audiences that are not on the allowlist
+func (d DefaultTokenizer) audience(requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		if len(d.Audiences) == 0 {
+			return nil, AudienceError{}
 		}
+		return []string{d.Audiences[0]}, nil
+	}
 
-		if tokenEmail != email {
-			return nil, fmt.Errorf("invalid token")
+	for _, audience := range requested {
+		if !slices.Contains(d.Audiences, audience) {
+			return nil, AudienceError{Value: audience}
 		}
+	}
+	return requested, nil
+}
 
-		kid := fmt.Sprintf("%v", token.Header["kid"])
-		key := d.keys[kid]
-		return d.loadPublicKey(key.PublicKey)
-	})
-
-	if err != nil {
-		return nil, err
+// verifyIssuerAndAudience tokens must have been issued by this issuer to audiences that are still on the allowlist,
+// removing an audience from the allowlist rejects the tokens already issued to it
+func (d DefaultTokenizer) verifyIssuerAndAudience(claims jwt.RegisteredClaims) error {
+	if claims.Issuer != d.Issuer {
+		return IssuerError{Value: claims.Issuer}
 	}
 
-	if claims, ok := token.Claims.(*AccessTokenClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, err
+	if len(claims.Audience) == 0 {
+		return AudienceError{}
 	}
+	for _, audience := range claims.Audience {
+		if !slices.Contains(d.Audiences, audience) {
+			return AudienceError{Value: audience}
+		}
+	}
+	return nil
+}
+
+// sign signs the claims with the algorithm the key was created for and sets the typ header for the use
+func (d DefaultTokenizer) sign(key *SigningKey, claims jwt.Claims, use string) (string, error) {
+	return d.signAs(key, claims, use, tokenTypes[use])
 }
 
-func (d DefaultTokenizer) loadPrivateKey(key string) (*rsa.PrivateKey, error) {
-	keyBytes := []byte(key)
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		return nil, errors.New("failed to decode PEM block")
+// signAs signs a token whose type is not one of the key uses, such as an ID token signed with the access key
+func (d DefaultTokenizer) signAs(key *SigningKey, claims jwt.Claims, use, typ string) (string, error) {
+	method := jwt.GetSigningMethod(key.Algorithm)
+	if method == nil {
+		return "", fmt.Errorf("signing method not supported: %s", key.Algorithm)
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	j := jwt.NewWithClaims(method, claims)
+	j.Header["typ"] = typ
+	j.Header["use"] = use
+	j.Header["kid"] = key.KeyId
+	privateKey, err := ParsePrivateKey(key.PrivateKey)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return privateKey, nil
+	token, err := j.SignedString(privateKey)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
 }
 
-func (d DefaultTokenizer) loadPublicKey(key string) (*rsa.PublicKey, error) {
-	keyBytes := []byte(key)
-	block, _ := pem.Decode(keyBytes)
-	if block == nil {
-		return nil, errors.New("")
+// verificationKey looks up the public key for the token's kid, the token must be signed with the
+// algorithm recorded on that key so one key can never be used with a different algorithm. The typ header must
+// match the use and a key kept for another use is rejected
+func (d DefaultTokenizer) verificationKey(ctx context.Context, token *jwt.Token, use string) (interface{}, error) {
+	typ := fmt.Sprintf("%v", token.Header["typ"])
+	if typ != tokenTypes[use] && !d.acceptsUntyped(token) {
+		return nil, TokenTypeError{Value: typ}
 	}
 
-	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	kid := fmt.Sprintf("%v", token.Header["kid"])
+	key, err := d.keys.Get(ctx, kid)
 	if err != nil {
 		return nil, err
 	}
 
-	return publicKey.(*rsa.PublicKey), nil
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("signing method not supported")
+	}
+
+	if !key.Verifies(use) {
+		return nil, fmt.Errorf("signing key %s does not verify %s tokens", key.KeyId, use)
+	}
+
+	return ParsePublicKey(key.PublicKey)
+}
+
+// acceptsUntyped tokens issued before the token types were introduced have the plain JWT typ header and no use
+// header, which every token issued since has
+func (d DefaultTokenizer) acceptsUntyped(token *jwt.Token) bool {
+	_, hasUse := token.Header["use"]
+	return !hasUse && token.Header["typ"] == TokenTypeId && time.Now().Before(d.untypedUntil)
 }
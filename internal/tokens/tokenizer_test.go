@@ -2,15 +2,20 @@ package tokens
 
 import (
 	"context"
+	"errors"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/latebit-io/bulwarkauth/internal/utils"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+const testSubject = "6f1c2a9e-3b7d-4c41-9a57-2f0e8d4b1c73"
+
 func TestDefaultTokenizer_CreateAccessToken(t *testing.T) {
 	mongodb := utils.NewMongoTestUtil()
 	mongoServer, err := mongodb.CreateServer()
@@ -34,21 +39,21 @@ func TestDefaultTokenizer_CreateAccessToken(t *testing.T) {
 	}()
 
 	db := client.Database("bulwark")
-	signingRepo := NewDefaultSigningKeyRepository(db)
-	signingService := NewDefaultSigningKeyService(signingRepo)
+	signingRepo := NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := NewDefaultSigningKeyService(signingRepo, "RS256", false)
 
 	err = signingService.Initialize(context.TODO())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tokenizer := NewDefaultTokenizer("test", "test", "test", 3600, 9600, signingService)
-	a, err := tokenizer.CreateAccessToken(context.TODO(), "test@latebit.io", []string{"test:read-write"})
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", []string{"test:read-write"}, TokenOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.Equal(t, 3, len(strings.Split(a, ".")))
-	valid, err := tokenizer.ValidateAccessToken(context.TODO(), "test@latebit.io", a)
+	valid, err := tokenizer.ValidateAccessToken(context.TODO(), a)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -78,23 +83,23 @@ func TestDefaultTokenizer_RefreshAccessToken(t *testing.T) {
 	}()
 
 	db := client.Database("bulwark")
-	signingRepo := NewDefaultSigningKeyRepository(db)
-	signingService := NewDefaultSigningKeyService(signingRepo)
+	signingRepo := NewDefaultSigningKeyRepository(db, nil, nil)
+	signingService := NewDefaultSigningKeyService(signingRepo, "RS256", false)
 
 	err = signingService.Initialize(context.TODO())
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	tokenizer := NewDefaultTokenizer("test", "test", "test", 3600, 9600, signingService)
-	r, err := tokenizer.CreateRefreshToken(context.TODO(), "test@latebit.io")
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+	r, err := tokenizer.CreateRefreshToken(context.TODO(), testSubject, TokenOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	assert.Equal(t, 3, len(strings.Split(r, ".")))
 
-	valid, err := tokenizer.ValidateRefreshToken(context.TODO(), "test@latebit.io", r)
+	valid, err := tokenizer.ValidateRefreshToken(context.TODO(), r)
 
 	if err != nil {
 		t.Fatal(err)
@@ -102,3 +107,436 @@ func TestDefaultTokenizer_RefreshAccessToken(t *testing.T) {
 
 	assert.NotEmpty(t, valid)
 }
+
+func TestDefaultTokenizer_ValidateAccessToken(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", []string{"test:read-write"}, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+	assert.Equal(t, testSubject, claims.Subject)
+	assert.Equal(t, "test@latebit.io", claims.Email)
+	assert.Equal(t, []string{"test:read-write"}, claims.Roles)
+
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), a+"x")
+	assert.Error(t, err)
+}
+
+func TestDefaultTokenizer_SigningAlgorithms(t *testing.T) {
+	for _, algorithm := range SigningAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), algorithm, false)
+			err := signingService.Initialize(context.TODO())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+			a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, _, err := jwt.NewParser().ParseUnverified(a, &AccessTokenClaims{})
+			assert.Nil(t, err)
+			assert.Equal(t, algorithm, token.Method.Alg())
+
+			_, err = tokenizer.ValidateAccessToken(context.TODO(), a)
+			assert.Nil(t, err)
+
+			r, err := tokenizer.CreateRefreshToken(context.TODO(), testSubject, TokenOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = tokenizer.ValidateRefreshToken(context.TODO(), r)
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestDefaultTokenizer_UnknownKeyReload(t *testing.T) {
+	repo := newMemorySigningKeyRepository()
+	signingService := NewDefaultSigningKeyService(repo, "ES256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+
+	// another replica rotates in a new key after this tokenizer loaded its keys
+	err = signingService.GenerateKey(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, _ := repo.GetAllKeys(context.TODO())
+	err = repo.UpdateState(context.TODO(), keys[1].KeyId, KeyStateActive, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(reloadCooldown)
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+
+	forged := jwt.NewWithClaims(jwt.SigningMethodES256, AccessTokenClaims{})
+	forged.Header["typ"] = TokenTypeAccess
+	forged.Header["kid"] = "unknown"
+	privateKey, _ := ParsePrivateKey(keys[1].PrivateKey)
+	f, err := forged.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), f)
+	var notFound SigningKeyNotFoundError
+	assert.ErrorAs(t, err, &notFound)
+}
+
+func TestDefaultTokenizer_TokenType(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := tokenizer.CreateRefreshToken(context.TODO(), testSubject, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, _, err := jwt.NewParser().ParseUnverified(a, &AccessTokenClaims{})
+	assert.Nil(t, err)
+	assert.Equal(t, TokenTypeAccess, token.Header["typ"])
+	assert.Equal(t, TokenTypeAccess, token.Claims.(*AccessTokenClaims).Type)
+
+	var typeErr TokenTypeError
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), r)
+	assert.ErrorAs(t, err, &typeErr)
+	_, err = tokenizer.ValidateRefreshToken(context.TODO(), a)
+	assert.ErrorAs(t, err, &typeErr)
+
+	// the typ claim is checked as well as the header
+	key, _ := signingService.LatestKey(context.TODO(), KeyUseAccess)
+	forged, err := tokenizer.sign(key, RefreshTokenClaims{
+		Type:             TokenTypeRefresh,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: testSubject},
+	}, KeyUseAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), forged)
+	assert.ErrorAs(t, err, &typeErr)
+}
+
+func TestDefaultTokenizer_SeparateKeys(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "ES256", true)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+
+	accessKey, _ := signingService.LatestKey(context.TODO(), KeyUseAccess)
+	refreshKey, _ := signingService.LatestKey(context.TODO(), KeyUseRefresh)
+	assert.NotEqual(t, accessKey.KeyId, refreshKey.KeyId)
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := jwt.NewParser().ParseUnverified(a, &AccessTokenClaims{})
+	assert.Nil(t, err)
+	assert.Equal(t, accessKey.KeyId, token.Header["kid"])
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+
+	// an access token signed by the refresh key is rejected
+	forged, err := tokenizer.sign(refreshKey, AccessTokenClaims{
+		Type:             TokenTypeAccess,
+		RegisteredClaims: jwt.RegisteredClaims{Subject: testSubject},
+	}, KeyUseAccess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), forged)
+	assert.Error(t, err)
+}
+
+type staticClaimsProvider map[string]interface{}
+
+func (p staticClaimsProvider) Claims(ctx context.Context, subject string) (map[string]interface{}, error) {
+	return p, nil
+}
+
+func TestDefaultTokenizer_ClaimsProviders(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+	tokenizer.AddClaimsProvider(staticClaimsProvider{"tenant": "first", "plan": "pro"})
+	tokenizer.AddClaimsProvider(staticClaimsProvider{"tenant": "acme", "sub": "someone", "email": "x@latebit.io", "typ": "rt+jwt"})
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", []string{"admin"}, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+	assert.Equal(t, testSubject, claims.Subject)
+	assert.Equal(t, TokenTypeAccess, claims.Type)
+	assert.Equal(t, []string{"admin"}, claims.Roles)
+	assert.Equal(t, map[string]interface{}{"tenant": "acme", "plan": "pro"}, claims.Custom)
+}
+
+func TestDefaultTokenizer_Audience(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "https://auth.latebit.io", []string{"web", "api"}, 3600, 9600, signingService)
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+	assert.Equal(t, jwt.ClaimStrings{"web"}, claims.Audience)
+	assert.Equal(t, "https://auth.latebit.io", claims.Issuer)
+
+	r, err := tokenizer.CreateRefreshToken(context.TODO(), testSubject, TokenOptions{Audience: []string{"api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshClaims, err := tokenizer.ValidateRefreshToken(context.TODO(), r)
+	assert.Nil(t, err)
+	assert.Equal(t, jwt.ClaimStrings{"api"}, refreshClaims.Audience)
+
+	var audienceErr AudienceError
+	_, err = tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil, TokenOptions{Audience: []string{"api", "other"}})
+	assert.ErrorAs(t, err, &audienceErr)
+	assert.Equal(t, "other", audienceErr.Value)
+
+	// tokens to an audience removed from the allowlist are rejected, as are tokens of another issuer
+	tokenizer.Audiences = []string{"api"}
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.ErrorAs(t, err, &audienceErr)
+	_, err = tokenizer.ValidateRefreshToken(context.TODO(), r)
+	assert.Nil(t, err)
+
+	tokenizer.Issuer = "bulwark-auth"
+	var issuerErr IssuerError
+	_, err = tokenizer.ValidateRefreshToken(context.TODO(), r)
+	assert.ErrorAs(t, err, &issuerErr)
+}
+
+func TestDefaultTokenizer_TokenOptionsLifetimes(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", nil,
+		TokenOptions{AccessTokenExpInSec: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), claims.ExpiresAt.Time, 2*time.Second)
+
+	r, err := tokenizer.CreateRefreshToken(context.TODO(), testSubject, TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshClaims, err := tokenizer.ValidateRefreshToken(context.TODO(), r)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(3600*time.Second), refreshClaims.ExpiresAt.Time, 2*time.Second)
+}
+
+type failingClaimsProvider struct{}
+
+func (failingClaimsProvider) Claims(ctx context.Context, subject string) (map[string]interface{}, error) {
+	return nil, errors.New("account not found")
+}
+
+func TestDefaultTokenizer_CreateClientAccessToken(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+	tokenizer.AddClaimsProvider(failingClaimsProvider{})
+
+	a, err := tokenizer.CreateClientAccessToken(context.TODO(), "reports-job", []string{"reports"}, "reports:read",
+		TokenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	assert.Nil(t, err)
+	assert.Equal(t, "reports-job", claims.Subject)
+	assert.Equal(t, "reports-job", claims.ClientId)
+	assert.Equal(t, "reports:read", claims.Scope)
+	assert.Equal(t, []string{"reports"}, claims.Roles)
+	assert.Empty(t, claims.Email)
+}
+
+func TestDefaultTokenizer_CreateIdToken(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "https://auth.latebit.io", []string{"api"}, 3600, 9600, signingService)
+
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	i, err := tokenizer.CreateIdToken(context.TODO(), testSubject, IdTokenOptions{
+		ClientId:      "spa",
+		Nonce:         "n-0S6_WzA2Mj",
+		AuthTime:      authTime,
+		Methods:       []string{AmrPassword},
+		Email:         "test@latebit.io",
+		EmailVerified: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := signingService.LatestKey(context.TODO(), KeyUseAccess)
+	token, err := jwt.ParseWithClaims(i, &IdTokenClaims{}, func(token *jwt.Token) (interface{}, error) {
+		return ParsePublicKey(key.PublicKey)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, TokenTypeId, token.Header["typ"])
+	assert.Equal(t, key.KeyId, token.Header["kid"])
+	claims := token.Claims.(*IdTokenClaims)
+	assert.Equal(t, testSubject, claims.Subject)
+	assert.Equal(t, "https://auth.latebit.io", claims.Issuer)
+	assert.Equal(t, jwt.ClaimStrings{"spa"}, claims.Audience)
+	assert.Equal(t, "n-0S6_WzA2Mj", claims.Nonce)
+	assert.Equal(t, authTime, claims.AuthTime.Time)
+	assert.Equal(t, []string{AmrPassword}, claims.Amr)
+	assert.True(t, claims.EmailVerified)
+
+	// an ID token is never accepted as an access token
+	var typeErr TokenTypeError
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), i)
+	assert.ErrorAs(t, err, &typeErr)
+
+	var audienceErr AudienceError
+	_, err = tokenizer.CreateIdToken(context.TODO(), testSubject, IdTokenOptions{})
+	assert.ErrorAs(t, err, &audienceErr)
+}
+
+func TestDefaultTokenizer_CreateExchangedAccessToken(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"api", "billing", "ledger"}, 3600, 9600, signingService)
+	tokenizer.AddClaimsProvider(staticClaimsProvider{"tenant": "acme", "scope": "billing:read billing:write"})
+
+	a, err := tokenizer.CreateAccessToken(context.TODO(), testSubject, "test@latebit.io", []string{"admin"},
+		TokenOptions{Audience: []string{"api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := tokenizer.ValidateAccessToken(context.TODO(), a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// scope is reserved, a provider can not grant one
+	assert.Empty(t, subject.Scope)
+
+	e, err := tokenizer.CreateExchangedAccessToken(context.TODO(), subject, "api-gateway", "billing:read",
+		TokenOptions{Audience: []string{"billing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanged, err := tokenizer.ValidateAccessToken(context.TODO(), e)
+	assert.Nil(t, err)
+	assert.Equal(t, testSubject, exchanged.Subject)
+	assert.Equal(t, "test@latebit.io", exchanged.Email)
+	assert.Equal(t, []string{"admin"}, exchanged.Roles)
+	assert.Equal(t, jwt.ClaimStrings{"billing"}, exchanged.Audience)
+	assert.Equal(t, "billing:read", exchanged.Scope)
+	assert.Equal(t, "acme", exchanged.Custom["tenant"])
+	assert.Equal(t, &Actor{Subject: "api-gateway"}, exchanged.Act)
+
+	// exchanging again keeps the earlier actor in the chain
+	e, err = tokenizer.CreateExchangedAccessToken(context.TODO(), exchanged, "billing", "billing:read",
+		TokenOptions{Audience: []string{"ledger"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchanged, err = tokenizer.ValidateAccessToken(context.TODO(), e)
+	assert.Nil(t, err)
+	assert.Equal(t, &Actor{Subject: "billing", Act: &Actor{Subject: "api-gateway"}}, exchanged.Act)
+}
+
+func TestDefaultTokenizer_AcceptUntypedUntil(t *testing.T) {
+	signingService := NewDefaultSigningKeyService(newMemorySigningKeyRepository(), "RS256", false)
+	err := signingService.Initialize(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenizer := NewDefaultTokenizer("test", "test", []string{"test"}, 3600, 9600, signingService)
+
+	// a token issued before the token types were introduced
+	key, _ := signingService.LatestKey(context.TODO(), KeyUseAccess)
+	legacy := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), jwt.RegisteredClaims{
+		Subject:   testSubject,
+		Issuer:    "test",
+		Audience:  []string{"test"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	legacy.Header["kid"] = key.KeyId
+	privateKey, err := ParsePrivateKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	untyped, err := legacy.SignedString(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var typeErr TokenTypeError
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), untyped)
+	assert.ErrorAs(t, err, &typeErr)
+
+	tokenizer.AcceptUntypedUntil(time.Now().Add(time.Hour))
+	claims, err := tokenizer.ValidateAccessToken(context.TODO(), untyped)
+	assert.NoError(t, err)
+	assert.Equal(t, testSubject, claims.Subject)
+	_, err = tokenizer.ValidateRefreshToken(context.TODO(), untyped)
+	assert.NoError(t, err)
+
+	tokenizer.AcceptUntypedUntil(time.Now().Add(-time.Second))
+	_, err = tokenizer.ValidateAccessToken(context.TODO(), untyped)
+	assert.ErrorAs(t, err, &typeErr)
+}